@@ -0,0 +1,421 @@
+package dhcp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	. "github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/mesh"
+	"github.com/weaveworks/weave/net/address"
+)
+
+// A DHCPv4 server for workloads, such as VMs, which are bridged onto
+// weave but not started through Docker.  Addresses are leased from
+// IPAM, with an owner named after the client's MAC address, so a
+// client gets the same address back for as long as its lease is
+// renewed.
+
+const (
+	serverPort = 67
+	clientPort = 68
+
+	DefaultLeaseTime = time.Hour
+	// How long an address offered but not yet requested is held for
+	offerTime = time.Minute
+	// How long to wait for IPAM to find an address to offer; by then
+	// the client has retransmitted, or given up
+	allocateTimeout = 10 * time.Second
+)
+
+// LeaseIdent is the owner of a client's addresses in IPAM.  Like
+// other owners which aren't containers it starts with "weave:", so
+// IPAM doesn't ask Docker whether it is still running.
+func LeaseIdent(mac net.HardwareAddr) string {
+	return "weave:dhcp:" + mac.String()
+}
+
+// Allocator leases addresses; *ipam.Allocator is one.
+type Allocator interface {
+	Allocate(ident string, r address.Range, hasBeenCancelled func() bool) (address.Address, error)
+	Lookup(ident string, r address.Range) (address.Address, error)
+	Claim(ident string, addr address.Address, noErrorOnUnknown bool) error
+	Free(ident string, addr address.Address) error
+}
+
+// Registrar records the names of clients; *nameserver.Nameserver is one.
+type Registrar interface {
+	AddEntry(hostname, containerid string, origin mesh.PeerName, addr address.Address) error
+	Delete(hostname, containerid, ipStr string, ip address.Address) error
+}
+
+type lease struct {
+	addr     address.Address
+	hostname string // registered in DNS, if not empty
+	expires  time.Time
+}
+
+type Server struct {
+	sync.Mutex
+	iface     *net.Interface
+	subnet    address.CIDR
+	leaseTime time.Duration
+	alloc     Allocator
+	dns       Registrar // nil to not register names
+	domain    string
+	ourName   mesh.PeerName
+	leases    map[string]*lease // by LeaseIdent
+	offering  map[string]bool   // clients we are finding an address for
+	conn      net.PacketConn
+	quit      chan struct{}
+	now       func() time.Time
+}
+
+// NewServer creates a server answering clients on iface with
+// addresses in subnet.  If dns is not nil, clients which give a host
+// name are registered under it in domain.
+func NewServer(iface *net.Interface, subnet address.CIDR, leaseTime time.Duration, alloc Allocator, dns Registrar, domain string, ourName mesh.PeerName) *Server {
+	return &Server{
+		iface:     iface,
+		subnet:    subnet,
+		leaseTime: leaseTime,
+		alloc:     alloc,
+		dns:       dns,
+		domain:    strings.TrimSuffix(domain, ".") + ".",
+		ourName:   ourName,
+		leases:    make(map[string]*lease),
+		offering:  make(map[string]bool),
+		quit:      make(chan struct{}),
+		now:       time.Now,
+	}
+}
+
+func (s *Server) Start() error {
+	conn, err := listen(s.iface)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	s.infof("listening on %s, leasing addresses in %s", s.iface.Name, s.subnet)
+	go s.serve()
+	go func() {
+		ticker := time.NewTicker(offerTime)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.quit:
+				return
+			case <-ticker.C:
+				s.expireLeases()
+			}
+		}
+	}()
+	return nil
+}
+
+func (s *Server) Stop() {
+	close(s.quit)
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+func (s *Server) serve() {
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.quit:
+			default:
+				s.errorf("unable to read request: %s", err)
+			}
+			return
+		}
+		req := &layers.DHCPv4{}
+		if err := req.DecodeFromBytes(buf[:n], gopacket.NilDecodeFeedback); err != nil {
+			s.debugf("ignoring malformed request: %s", err)
+			continue
+		}
+		// Allocation may wait for IPAM, so don't hold up other clients
+		go s.respond(req)
+	}
+}
+
+func (s *Server) respond(req *layers.DHCPv4) {
+	serverIP, err := s.serverIP()
+	if err != nil {
+		s.errorf("unable to answer %s: %s", req.ClientHWAddr, err)
+		return
+	}
+	reply := s.handle(req, serverIP)
+	if reply == nil {
+		return
+	}
+	dest := &net.UDPAddr{IP: net.IPv4bcast, Port: clientPort}
+	if !req.ClientIP.Equal(net.IPv4zero) && messageType(reply) != layers.DHCPMsgTypeNak {
+		dest.IP = req.ClientIP
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := reply.SerializeTo(buf, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+		s.errorf("unable to encode reply to %s: %s", req.ClientHWAddr, err)
+		return
+	}
+	if _, err := s.conn.WriteTo(buf.Bytes(), dest); err != nil {
+		s.errorf("unable to send reply to %s: %s", req.ClientHWAddr, err)
+	}
+}
+
+// Clients need an address to identify us by, and to renew leases
+// with; we use the interface's address in the subnet.
+func (s *Server) serverIP() (net.IP, error) {
+	addrs, err := s.iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil && s.subnet.Range().Contains(address.FromIP4(ipnet.IP)) {
+			return ipnet.IP.To4(), nil
+		}
+	}
+	return nil, fmt.Errorf("%s has no address in %s; run 'weave expose'", s.iface.Name, s.subnet)
+}
+
+func (s *Server) handle(req *layers.DHCPv4, serverIP net.IP) *layers.DHCPv4 {
+	if req.Operation != layers.DHCPOpRequest || !req.RelayAgentIP.Equal(net.IPv4zero) {
+		return nil
+	}
+	ident := LeaseIdent(req.ClientHWAddr)
+	switch messageType(req) {
+	case layers.DHCPMsgTypeDiscover:
+		if !s.startOffer(ident) {
+			// Still working on an earlier discovery, which will
+			// answer this one too
+			return nil
+		}
+		defer s.endOffer(ident)
+		addr, err := s.alloc.Allocate(ident, s.subnet.HostRange(), s.cancelAfter(allocateTimeout))
+		if err != nil {
+			s.errorf("unable to allocate an address for %s: %s", ident, err)
+			return nil
+		}
+		s.hold(ident, addr, offerTime, "")
+		s.debugf("offering %s to %s", addr, ident)
+		return s.reply(req, layers.DHCPMsgTypeOffer, addr.IP4(), serverIP)
+
+	case layers.DHCPMsgTypeRequest:
+		if id := option(req, layers.DHCPOptServerID); id != nil && !net.IP(id).Equal(serverIP) {
+			// The client took up another server's offer
+			return nil
+		}
+		requested := req.ClientIP
+		if ip := option(req, layers.DHCPOptRequestIP); ip != nil {
+			requested = net.IP(ip)
+		}
+		if requested.To4() == nil || requested.Equal(net.IPv4zero) {
+			return s.reply(req, layers.DHCPMsgTypeNak, nil, serverIP)
+		}
+		addr := address.FromIP4(requested)
+		// If IPAM doesn't know of the lease, e.g. after weave was
+		// restarted, the client can have the address back if it's free
+		if owned, err := s.alloc.Lookup(ident, s.subnet.HostRange()); err == nil {
+			if owned != addr {
+				s.debugf("%s requested %s, but has %s", ident, addr, owned)
+				return s.reply(req, layers.DHCPMsgTypeNak, nil, serverIP)
+			}
+		} else if !s.subnet.HostRange().Contains(addr) {
+			return s.reply(req, layers.DHCPMsgTypeNak, nil, serverIP)
+		} else if err := s.alloc.Claim(ident, addr, false); err != nil {
+			s.debugf("unable to give %s to %s: %s", addr, ident, err)
+			return s.reply(req, layers.DHCPMsgTypeNak, nil, serverIP)
+		}
+		s.hold(ident, addr, s.leaseTime, string(option(req, layers.DHCPOptHostname)))
+		s.debugf("leased %s to %s", addr, ident)
+		return s.reply(req, layers.DHCPMsgTypeAck, requested, serverIP)
+
+	case layers.DHCPMsgTypeDecline:
+		// Someone else is using the address; let the client try again
+		if ip := option(req, layers.DHCPOptRequestIP); ip != nil {
+			s.release(ident, address.FromIP4(net.IP(ip)))
+		}
+
+	case layers.DHCPMsgTypeRelease:
+		s.release(ident, address.FromIP4(req.ClientIP))
+
+	case layers.DHCPMsgTypeInform:
+		return s.reply(req, layers.DHCPMsgTypeAck, nil, serverIP)
+	}
+	return nil
+}
+
+func (s *Server) reply(req *layers.DHCPv4, msgType layers.DHCPMsgType, yourIP, serverIP net.IP) *layers.DHCPv4 {
+	if yourIP == nil {
+		yourIP = net.IPv4zero
+	}
+	reply := &layers.DHCPv4{
+		Operation:    layers.DHCPOpReply,
+		HardwareType: req.HardwareType,
+		Xid:          req.Xid,
+		Flags:        req.Flags,
+		ClientIP:     req.ClientIP,
+		YourClientIP: yourIP,
+		NextServerIP: net.IPv4zero,
+		RelayAgentIP: req.RelayAgentIP,
+		ClientHWAddr: req.ClientHWAddr,
+	}
+	reply.Options = append(reply.Options,
+		layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(msgType)}),
+		layers.NewDHCPOption(layers.DHCPOptServerID, serverIP.To4()))
+	if msgType == layers.DHCPMsgTypeNak {
+		return reply
+	}
+	if !yourIP.Equal(net.IPv4zero) {
+		reply.Options = append(reply.Options, layers.NewDHCPOption(layers.DHCPOptLeaseTime, seconds(s.leaseTime)))
+	}
+	reply.Options = append(reply.Options, layers.NewDHCPOption(layers.DHCPOptSubnetMask, net.CIDRMask(s.subnet.PrefixLen, 32)))
+	if s.dns != nil {
+		reply.Options = append(reply.Options, layers.NewDHCPOption(layers.DHCPOptDomainName, []byte(strings.TrimSuffix(s.domain, "."))))
+	}
+	return reply
+}
+
+func (s *Server) startOffer(ident string) bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.offering[ident] {
+		return false
+	}
+	s.offering[ident] = true
+	return true
+}
+
+func (s *Server) endOffer(ident string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.offering, ident)
+}
+
+// For giving up on IPAM after a while, or when we are stopped
+func (s *Server) cancelAfter(timeout time.Duration) func() bool {
+	deadline := s.now().Add(timeout)
+	return func() bool {
+		select {
+		case <-s.quit:
+			return true
+		default:
+			return s.now().After(deadline)
+		}
+	}
+}
+
+// Record a lease, or extend one; the name, if given, is registered
+// in DNS.
+func (s *Server) hold(ident string, addr address.Address, duration time.Duration, hostname string) {
+	s.Lock()
+	defer s.Unlock()
+	l, found := s.leases[ident]
+	if !found || l.addr != addr {
+		l = &lease{addr: addr}
+		s.leases[ident] = l
+	}
+	if expires := s.now().Add(duration); expires.After(l.expires) {
+		l.expires = expires
+	}
+	if s.dns == nil || hostname == "" {
+		return
+	}
+	hostname = hostname + "." + s.domain
+	if hostname == l.hostname {
+		return
+	}
+	s.unregister(ident, l)
+	if err := s.dns.AddEntry(hostname, ident, s.ourName, addr); err != nil {
+		s.errorf("unable to register %s for %s: %s", hostname, ident, err)
+		return
+	}
+	l.hostname = hostname
+}
+
+func (s *Server) release(ident string, addr address.Address) {
+	s.Lock()
+	defer s.Unlock()
+	if l, found := s.leases[ident]; found && l.addr == addr {
+		s.free(ident, l)
+	}
+}
+
+func (s *Server) expireLeases() {
+	s.Lock()
+	defer s.Unlock()
+	now := s.now()
+	for ident, l := range s.leases {
+		if now.After(l.expires) {
+			s.debugf("lease of %s to %s expired", l.addr, ident)
+			s.free(ident, l)
+		}
+	}
+}
+
+// NB: must hold the lock
+func (s *Server) free(ident string, l *lease) {
+	delete(s.leases, ident)
+	s.unregister(ident, l)
+	if err := s.alloc.Free(ident, l.addr); err != nil {
+		s.errorf("unable to free %s of %s: %s", l.addr, ident, err)
+	}
+}
+
+// NB: must hold the lock
+func (s *Server) unregister(ident string, l *lease) {
+	if l.hostname == "" {
+		return
+	}
+	if err := s.dns.Delete(l.hostname, ident, l.addr.String(), l.addr); err != nil {
+		s.errorf("unable to unregister %s for %s: %s", l.hostname, ident, err)
+	}
+	l.hostname = ""
+}
+
+func (s *Server) numLeases() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.leases)
+}
+
+func messageType(msg *layers.DHCPv4) layers.DHCPMsgType {
+	if t := option(msg, layers.DHCPOptMessageType); len(t) == 1 {
+		return layers.DHCPMsgType(t[0])
+	}
+	return layers.DHCPMsgTypeUnspecified
+}
+
+func option(msg *layers.DHCPv4, opt layers.DHCPOpt) []byte {
+	for _, o := range msg.Options {
+		if o.Type == opt {
+			return o.Data
+		}
+	}
+	return nil
+}
+
+func seconds(d time.Duration) []byte {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, uint32(d/time.Second))
+	return buf
+}
+
+func (s *Server) infof(fmt string, args ...interface{}) {
+	Log.Infof("[dhcp] "+fmt, args...)
+}
+func (s *Server) debugf(fmt string, args ...interface{}) {
+	Log.Debugf("[dhcp] "+fmt, args...)
+}
+func (s *Server) errorf(fmt string, args ...interface{}) {
+	Log.Errorf("[dhcp] "+fmt, args...)
+}
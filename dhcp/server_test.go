@@ -0,0 +1,222 @@
+package dhcp
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/weave/mesh"
+	"github.com/weaveworks/weave/net/address"
+)
+
+type mockAllocator struct {
+	next  address.Address
+	owned map[string]address.Address
+}
+
+func (m *mockAllocator) Allocate(ident string, r address.Range, hasBeenCancelled func() bool) (address.Address, error) {
+	if addr, found := m.owned[ident]; found {
+		return addr, nil
+	}
+	m.owned[ident] = m.next
+	m.next++
+	return m.owned[ident], nil
+}
+
+func (m *mockAllocator) Lookup(ident string, r address.Range) (address.Address, error) {
+	if addr, found := m.owned[ident]; found {
+		return addr, nil
+	}
+	return 0, fmt.Errorf("no address for %s", ident)
+}
+
+func (m *mockAllocator) Claim(ident string, addr address.Address, noErrorOnUnknown bool) error {
+	for owner, owned := range m.owned {
+		if owned == addr && owner != ident {
+			return fmt.Errorf("%s is owned by %s", addr, owner)
+		}
+	}
+	m.owned[ident] = addr
+	return nil
+}
+
+func (m *mockAllocator) Free(ident string, addr address.Address) error {
+	if m.owned[ident] != addr {
+		return fmt.Errorf("%s does not own %s", ident, addr)
+	}
+	delete(m.owned, ident)
+	return nil
+}
+
+type mockRegistrar map[string]address.Address
+
+func (m mockRegistrar) AddEntry(hostname, containerid string, origin mesh.PeerName, addr address.Address) error {
+	m[hostname] = addr
+	return nil
+}
+
+func (m mockRegistrar) Delete(hostname, containerid, ipStr string, ip address.Address) error {
+	delete(m, hostname)
+	return nil
+}
+
+var (
+	serverIP  = net.ParseIP("10.32.0.1").To4()
+	clientMAC = net.HardwareAddr{0x02, 0x42, 0xac, 0x11, 0x00, 0x02}
+	otherMAC  = net.HardwareAddr{0x02, 0x42, 0xac, 0x11, 0x00, 0x03}
+)
+
+func makeServer(alloc Allocator, dns Registrar) (*Server, *time.Time) {
+	_, subnet, _ := address.ParseCIDR("10.32.0.0/24")
+	s := NewServer(&net.Interface{Name: "weave"}, subnet, time.Hour, alloc, dns, "weave.local", mesh.UnknownPeerName)
+	now := time.Now()
+	s.now = func() time.Time { return now }
+	return s, &now
+}
+
+func request(mac net.HardwareAddr, msgType layers.DHCPMsgType, clientIP net.IP, options ...layers.DHCPOption) *layers.DHCPv4 {
+	if clientIP == nil {
+		clientIP = net.IPv4zero
+	}
+	req := &layers.DHCPv4{
+		Operation:    layers.DHCPOpRequest,
+		HardwareType: layers.LinkTypeEthernet,
+		Xid:          0x1234,
+		ClientIP:     clientIP,
+		YourClientIP: net.IPv4zero,
+		NextServerIP: net.IPv4zero,
+		RelayAgentIP: net.IPv4zero,
+		ClientHWAddr: mac,
+		Options:      []layers.DHCPOption{layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(msgType)})},
+	}
+	req.Options = append(req.Options, options...)
+	// Go through the wire format, as the server does
+	buf := gopacket.NewSerializeBuffer()
+	if err := req.SerializeTo(buf, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+		panic(err)
+	}
+	decoded := &layers.DHCPv4{}
+	if err := decoded.DecodeFromBytes(buf.Bytes(), gopacket.NilDecodeFeedback); err != nil {
+		panic(err)
+	}
+	return decoded
+}
+
+func TestLease(t *testing.T) {
+	alloc := &mockAllocator{next: 0x0a200005, owned: make(map[string]address.Address)}
+	dns := mockRegistrar{}
+	s, now := makeServer(alloc, dns)
+	leased := net.ParseIP("10.32.0.5").To4()
+
+	offer := s.handle(request(clientMAC, layers.DHCPMsgTypeDiscover, nil), serverIP)
+	require.Equal(t, layers.DHCPMsgTypeOffer, messageType(offer))
+	require.Equal(t, leased, offer.YourClientIP.To4())
+	require.Equal(t, []byte(serverIP), option(offer, layers.DHCPOptServerID))
+	require.Equal(t, []byte{0xff, 0xff, 0xff, 0}, option(offer, layers.DHCPOptSubnetMask))
+
+	ack := s.handle(request(clientMAC, layers.DHCPMsgTypeRequest, nil,
+		layers.NewDHCPOption(layers.DHCPOptRequestIP, leased),
+		layers.NewDHCPOption(layers.DHCPOptServerID, serverIP),
+		layers.NewDHCPOption(layers.DHCPOptHostname, []byte("vm1"))), serverIP)
+	require.Equal(t, layers.DHCPMsgTypeAck, messageType(ack))
+	require.Equal(t, leased, ack.YourClientIP.To4())
+	require.Equal(t, []byte{0, 0, 0x0e, 0x10}, option(ack, layers.DHCPOptLeaseTime))
+	require.Equal(t, mockRegistrar{"vm1.weave.local.": 0x0a200005}, dns)
+
+	// Someone else can't have the same address
+	nak := s.handle(request(otherMAC, layers.DHCPMsgTypeRequest, nil,
+		layers.NewDHCPOption(layers.DHCPOptRequestIP, leased)), serverIP)
+	require.Equal(t, layers.DHCPMsgTypeNak, messageType(nak))
+
+	// Requests accepting another server's offer are ignored
+	require.Nil(t, s.handle(request(otherMAC, layers.DHCPMsgTypeRequest, nil,
+		layers.NewDHCPOption(layers.DHCPOptRequestIP, net.ParseIP("10.32.0.9").To4()),
+		layers.NewDHCPOption(layers.DHCPOptServerID, net.ParseIP("10.32.0.2").To4())), serverIP))
+
+	// Renewal keeps the lease going past its original expiry
+	*now = now.Add(50 * time.Minute)
+	ack = s.handle(request(clientMAC, layers.DHCPMsgTypeRequest, leased), serverIP)
+	require.Equal(t, layers.DHCPMsgTypeAck, messageType(ack))
+	*now = now.Add(50 * time.Minute)
+	s.expireLeases()
+	require.Equal(t, 1, s.numLeases())
+
+	s.handle(request(clientMAC, layers.DHCPMsgTypeRelease, leased), serverIP)
+	require.Equal(t, 0, s.numLeases())
+	require.Len(t, alloc.owned, 0)
+	require.Len(t, dns, 0)
+}
+
+func TestLeaseExpiry(t *testing.T) {
+	alloc := &mockAllocator{next: 0x0a200005, owned: make(map[string]address.Address)}
+	s, now := makeServer(alloc, nil)
+
+	// An offer which is never taken up is only held briefly
+	s.handle(request(clientMAC, layers.DHCPMsgTypeDiscover, nil), serverIP)
+	*now = now.Add(2 * offerTime)
+	s.expireLeases()
+	require.Len(t, alloc.owned, 0)
+
+	// After a restart, a client can keep its address if it's free
+	leased := net.ParseIP("10.32.0.7").To4()
+	ack := s.handle(request(clientMAC, layers.DHCPMsgTypeRequest, leased), serverIP)
+	require.Equal(t, layers.DHCPMsgTypeAck, messageType(ack))
+	require.Nil(t, option(ack, layers.DHCPOptDomainName))
+	require.Equal(t, address.Address(0x0a200007), alloc.owned[LeaseIdent(clientMAC)])
+
+	*now = now.Add(2 * time.Hour)
+	s.expireLeases()
+	require.Len(t, alloc.owned, 0)
+}
+
+// Holds allocations until told to finish them
+type blockingAllocator struct {
+	mockAllocator
+	allocating chan func() bool
+	finish     chan struct{}
+}
+
+func (b *blockingAllocator) Allocate(ident string, r address.Range, hasBeenCancelled func() bool) (address.Address, error) {
+	b.allocating <- hasBeenCancelled
+	<-b.finish
+	if hasBeenCancelled() {
+		return 0, fmt.Errorf("allocation for %s cancelled", ident)
+	}
+	return b.mockAllocator.Allocate(ident, r, hasBeenCancelled)
+}
+
+func TestSlowAllocation(t *testing.T) {
+	alloc := &blockingAllocator{
+		mockAllocator: mockAllocator{next: 0x0a200005, owned: make(map[string]address.Address)},
+		allocating:    make(chan func() bool),
+		finish:        make(chan struct{}),
+	}
+	s, now := makeServer(alloc, nil)
+
+	offers := make(chan *layers.DHCPv4)
+	discover := func() { offers <- s.handle(request(clientMAC, layers.DHCPMsgTypeDiscover, nil), serverIP) }
+	go discover()
+	hasBeenCancelled := <-alloc.allocating
+
+	// Retransmissions while IPAM is busy don't pile up
+	require.Nil(t, s.handle(request(clientMAC, layers.DHCPMsgTypeDiscover, nil), serverIP))
+
+	// and IPAM is told to give up eventually
+	require.False(t, hasBeenCancelled())
+	*now = now.Add(2 * allocateTimeout)
+	require.True(t, hasBeenCancelled())
+	alloc.finish <- struct{}{}
+	require.Nil(t, <-offers)
+	require.Len(t, alloc.owned, 0)
+
+	// after which the client can try again
+	go discover()
+	<-alloc.allocating
+	alloc.finish <- struct{}{}
+	require.Equal(t, layers.DHCPMsgTypeOffer, messageType(<-offers))
+}
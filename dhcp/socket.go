@@ -0,0 +1,38 @@
+package dhcp
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// Listen on the DHCP server port of just the given interface, so we
+// neither answer clients on other networks nor need an address on
+// the interface to receive their broadcasts.
+func listen(iface *net.Interface) (net.PacketConn, error) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, syscall.IPPROTO_UDP)
+	if err != nil {
+		return nil, err
+	}
+	if err := setupSocket(fd, iface.Name); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("unable to listen for DHCP on %s: %s", iface.Name, err)
+	}
+	file := os.NewFile(uintptr(fd), "dhcp")
+	defer file.Close()
+	return net.FilePacketConn(file)
+}
+
+func setupSocket(fd int, ifName string) error {
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		return err
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1); err != nil {
+		return err
+	}
+	if err := syscall.BindToDevice(fd, ifName); err != nil {
+		return err
+	}
+	return syscall.Bind(fd, &syscall.SockaddrInet4{Port: serverPort})
+}
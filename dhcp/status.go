@@ -0,0 +1,23 @@
+package dhcp
+
+import (
+	"time"
+)
+
+type Status struct {
+	Interface string
+	Subnet    string
+	LeaseTime time.Duration
+	Leases    int
+}
+
+func NewStatus(s *Server) *Status {
+	if s == nil {
+		return nil
+	}
+	return &Status{
+		Interface: s.iface.Name,
+		Subnet:    s.subnet.String(),
+		LeaseTime: s.leaseTime,
+		Leases:    s.numLeases()}
+}
@@ -30,28 +30,45 @@ func (g *allocate) Try(alloc *Allocator) bool {
 		return true
 	}
 
-	if !alloc.universe.Overlaps(g.r) {
-		g.resultChan <- allocateResult{0, fmt.Errorf("range %s out of bounds: %s", g.r, alloc.universe)}
+	if alloc.takenOver {
+		g.resultChan <- allocateResult{0, errTakenOver}
 		return true
 	}
 
-	alloc.establishRing()
+	if !alloc.ring.Overlaps(g.r) {
+		g.resultChan <- allocateResult{0, fmt.Errorf("range %s out of bounds: %s", g.r, rangesString(alloc.ring.Universe()))}
+		return true
+	}
 
-	if ok, addr := alloc.space.Allocate(g.r); ok {
-		alloc.debugln("Allocated", addr, "for", g.ident, "in", g.r)
-		alloc.addOwned(g.ident, addr)
-		g.resultChan <- allocateResult{addr, nil}
+	// Pool quotas apply however the range was asked for
+	ranges, err := alloc.rangesWithinQuota(g.r)
+	if err != nil {
+		g.resultChan <- allocateResult{0, err}
 		return true
 	}
 
+	alloc.establishRing()
+
+	for _, r := range ranges {
+		if ok, addr := alloc.space.Allocate(r); ok {
+			alloc.debugln("Allocated", addr, "for", g.ident, "in", g.r)
+			alloc.addOwned(g.ident, addr)
+			alloc.auditAddress(auditAllocate, g.ident, addr)
+			alloc.rebalancer.allocations++
+			g.resultChan <- allocateResult{addr, nil}
+			return true
+		}
+	}
+
 	// out of space
-	donors := alloc.ring.ChoosePeersToAskForSpace(g.r.Start, g.r.End)
-	for _, donor := range donors {
-		if err := alloc.sendSpaceRequest(donor, g.r); err != nil {
-			alloc.debugln("Problem asking peer", donor, "for space:", err)
-		} else {
-			alloc.debugln("Decided to ask peer", donor, "for space in range", g.r)
-			break
+	for _, r := range ranges {
+		for _, donor := range alloc.ring.ChoosePeersToAskForSpace(r.Start, r.End) {
+			if err := alloc.sendSpaceRequest(donor, r); err != nil {
+				alloc.debugln("Problem asking peer", donor, "for space:", err)
+			} else {
+				alloc.debugln("Decided to ask peer", donor, "for space in range", r)
+				return false
+			}
 		}
 	}
 
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/gob"
 	"fmt"
+	"hash/fnv"
 	"sort"
 	"time"
 
@@ -11,8 +12,8 @@ import (
 	"github.com/weaveworks/weave/ipam/paxos"
 	"github.com/weaveworks/weave/ipam/ring"
 	"github.com/weaveworks/weave/ipam/space"
+	"github.com/weaveworks/weave/mesh"
 	"github.com/weaveworks/weave/net/address"
-	"github.com/weaveworks/weave/router"
 )
 
 // Kinds of message we can unicast to other peers
@@ -20,6 +21,8 @@ const (
 	msgSpaceRequest = iota
 	msgRingUpdate
 	msgSpaceRequestDenied
+	msgHeldAddresses
+	msgHeldAddressesAck
 
 	paxosInterval = time.Second * 5
 	MinSubnetSize = 4 // first and last addresses are excluded, so 2 would be too small
@@ -43,37 +46,64 @@ type operation interface {
 // are used around data structures.
 type Allocator struct {
 	actionChan       chan<- func()
-	ourName          router.PeerName
-	universe         address.Range                // superset of all ranges
+	ourName          mesh.PeerName
+	ourUID           mesh.PeerUID
+	quorum           uint
 	ring             *ring.Ring                   // information on ranges owned by all peers
 	space            space.Space                  // more detail on ranges owned by us
 	owned            map[string][]address.Address // who owns what addresses, indexed by container-ID
-	nicknames        map[router.PeerName]string   // so we can map nicknames for rmpeer
+	nicknames        map[mesh.PeerName]string     // so we can map nicknames for rmpeer
 	pendingAllocates []operation                  // held until we get some free space
 	pendingClaims    []operation                  // held until we know who owns the space
-	gossip           router.Gossip                // our link to the outside world for sending messages
+	gossip           mesh.Gossip                  // our link to the outside world for sending messages
 	paxos            *paxos.Node
 	paxosTicker      *time.Ticker
-	shuttingDown     bool // to avoid doing any requests while trying to shut down
+	growing          *grow           // range being added to the universe
+	growQueue        []address.Range // ranges waiting to be added
+	growTicker       *time.Ticker
+	pools            []*Pool                         // named subnets; fixed once started
+	poolUsage        map[mesh.PeerName]peerPoolUsage // addresses handed out in each pool, by peer
+	leakSuspects     map[string]time.Time            // owners found to have gone away, and since when
+	reclaimed        int                             // addresses freed after their owner went away
+	leaseGCTicker    *time.Ticker
+	leaseGrace       time.Duration
+	livenessCheckers []LivenessChecker
+	checkingLeases   bool // liveness sources are being asked in the background
+	rebalancer       rebalancer
+	takeoverAfter    time.Duration               // how long peers must be gone before we take over their ranges; zero to never
+	absentSince      map[mesh.PeerName]time.Time // peers owning ranges which have gone away, and since when
+	takingOver       *takeover                   // peer whose ranges we are agreeing to take over
+	takeoverTicker   *time.Ticker
+	deadPeerTicker   *time.Ticker // to check for peers gone long enough to take over
+	peerLister       PeerLister
+	takenOver        bool                            // our ranges were taken over while we were away
+	handingOver      map[mesh.PeerName]heldAddresses // addresses still in use here, by the peers now owning them, until they acknowledge
+	seed             []mesh.PeerName                 // if set, the peers the ring is created for, without Paxos
+	observer         bool                            // we wait to learn of the ring, rather than help create it
+	waitTicker       *time.Ticker                    // to ask again for the ring, when not using Paxos
+	shuttingDown     bool                            // to avoid doing any requests while trying to shut down
+	audit            auditLog
 	now              func() time.Time
 }
 
-// NewAllocator creates and initialises a new Allocator
-func NewAllocator(ourName router.PeerName, ourUID router.PeerUID, ourNickname string, universe address.Range, quorum uint) *Allocator {
+// NewAllocator creates and initialises a new Allocator, allocating
+// from the (disjoint) ranges of the universe
+func NewAllocator(ourName mesh.PeerName, ourUID mesh.PeerUID, ourNickname string, universe []address.Range, quorum uint) *Allocator {
 	return &Allocator{
 		ourName:   ourName,
-		universe:  universe,
-		ring:      ring.New(universe.Start, universe.End, ourName),
+		ourUID:    ourUID,
+		quorum:    quorum,
+		ring:      ring.NewFromRanges(universe, ourName),
 		owned:     make(map[string][]address.Address),
 		paxos:     paxos.NewNode(ourName, ourUID, quorum),
-		nicknames: map[router.PeerName]string{ourName: ourNickname},
+		nicknames: map[mesh.PeerName]string{ourName: ourNickname},
 		now:       time.Now,
 	}
 }
 
 // Start runs the allocator goroutine
 func (alloc *Allocator) Start() {
-	actionChan := make(chan func(), router.ChannelSize)
+	actionChan := make(chan func(), mesh.ChannelSize)
 	alloc.actionChan = actionChan
 	go alloc.actorLoop(actionChan)
 }
@@ -163,7 +193,7 @@ func (alloc *Allocator) tryPendingOps() {
 	}
 }
 
-func (alloc *Allocator) spaceRequestDenied(sender router.PeerName, r address.Range) {
+func (alloc *Allocator) spaceRequestDenied(sender mesh.PeerName, r address.Range) {
 	for i := 0; i < len(alloc.pendingClaims); {
 		claim := alloc.pendingClaims[i].(*claim)
 		if r.Contains(claim.addr) {
@@ -234,6 +264,7 @@ func (alloc *Allocator) Delete(ident string) error {
 		addrs, found := alloc.owned[ident]
 		for _, addr := range addrs {
 			alloc.space.Free(addr)
+			alloc.auditAddress(auditFree, ident, addr)
 		}
 		delete(alloc.owned, ident)
 
@@ -254,19 +285,12 @@ func (alloc *Allocator) Delete(ident string) error {
 func (alloc *Allocator) Free(ident string, addrToFree address.Address) error {
 	errChan := make(chan error)
 	alloc.actionChan <- func() {
-		addrs := alloc.owned[ident]
-		for i, ownedAddr := range addrs {
-			if ownedAddr == addrToFree {
-				alloc.debugln("Freed", addrToFree, "for", ident)
-				if len(addrs) == 1 {
-					delete(alloc.owned, ident)
-				} else {
-					alloc.owned[ident] = append(addrs[:i], addrs[i+1:]...)
-				}
-				alloc.space.Free(addrToFree)
-				errChan <- nil
-				return
-			}
+		if alloc.removeOwned(ident, addrToFree) {
+			alloc.debugln("Freed", addrToFree, "for", ident)
+			alloc.space.Free(addrToFree)
+			alloc.auditAddress(auditFree, ident, addrToFree)
+			errChan <- nil
+			return
 		}
 
 		errChan <- fmt.Errorf("Free: address %s not found for %s", addrToFree, ident)
@@ -282,8 +306,11 @@ func (alloc *Allocator) Shutdown() {
 		alloc.shuttingDown = true
 		alloc.cancelOps(&alloc.pendingClaims)
 		alloc.cancelOps(&alloc.pendingAllocates)
-		if heir := alloc.ring.PickPeerForTransfer(); heir != router.UnknownPeerName {
-			alloc.ring.Transfer(alloc.ourName, heir)
+		if heir := alloc.ring.PickPeerForTransfer(); heir != mesh.UnknownPeerName && !alloc.takenOver {
+			given, _ := alloc.ring.Transfer(alloc.ourName, heir)
+			for _, r := range given {
+				alloc.auditRange(auditDonate, r, heir)
+			}
 			alloc.space.Clear()
 			alloc.gossip.GossipBroadcast(alloc.Gossip())
 			time.Sleep(100 * time.Millisecond)
@@ -313,23 +340,76 @@ func (alloc *Allocator) AdminTakeoverRanges(peerNameOrNickname string) error {
 		delete(alloc.nicknames, peername)
 		newRanges, err := alloc.ring.Transfer(peername, alloc.ourName)
 		alloc.space.AddRanges(newRanges)
+		for _, r := range newRanges {
+			alloc.auditRange(auditTakeover, r, peername)
+		}
 		resultChan <- err
 	}
 	return <-resultChan
 }
 
+// Reserve (Sync) - exclude a range of addresses, under the given
+// name, from allocation across the whole network
+func (alloc *Allocator) Reserve(name string, r address.Range) error {
+	resultChan := make(chan error)
+	alloc.actionChan <- func() {
+		if err := alloc.ring.Reserve(name, r); err != nil {
+			resultChan <- err
+			return
+		}
+		alloc.infof("Reserved %s as %s", r, name)
+		alloc.reservationsUpdated()
+		resultChan <- nil
+	}
+	return <-resultChan
+}
+
+// Unreserve (Sync) - remove the reservation with the given name
+func (alloc *Allocator) Unreserve(name string) error {
+	resultChan := make(chan error)
+	alloc.actionChan <- func() {
+		if err := alloc.ring.Unreserve(name); err != nil {
+			resultChan <- fmt.Errorf("No reservation named %s", name)
+			return
+		}
+		alloc.infof("Removed reservation %s", name)
+		alloc.reservationsUpdated()
+		resultChan <- nil
+	}
+	return <-resultChan
+}
+
+// Reservations (Sync) - the current reservations, indexed by name
+func (alloc *Allocator) Reservations() map[string]address.Range {
+	resultChan := make(chan map[string]address.Range)
+	alloc.actionChan <- func() {
+		resultChan <- alloc.ring.Reserved()
+	}
+	return <-resultChan
+}
+
+func (alloc *Allocator) reservationsUpdated() {
+	alloc.space.SetReserved(alloc.ring.ReservedRanges())
+	// Reservations travel with the ring, so there is nobody to
+	// tell until we have one
+	if !alloc.ring.Empty() {
+		alloc.gossip.GossipBroadcast(alloc.Gossip())
+	}
+	alloc.tryPendingOps()
+}
+
 // Lookup a PeerName by nickname or stringified PeerName.  We can't
 // call into the router for this because we are interested in peers
 // that have gone away but are still in the ring, which is why we
 // maintain our own nicknames map.
-func (alloc *Allocator) lookupPeername(name string) (router.PeerName, error) {
+func (alloc *Allocator) lookupPeername(name string) (mesh.PeerName, error) {
 	for peername, nickname := range alloc.nicknames {
 		if nickname == name {
 			return peername, nil
 		}
 	}
 
-	return router.PeerNameFromString(name)
+	return mesh.PeerNameFromString(name)
 }
 
 // Restrict the peers in "nicknames" to those in the ring and our own
@@ -342,7 +422,7 @@ func (alloc *Allocator) pruneNicknames() {
 	}
 }
 
-func (alloc *Allocator) annotatePeernames(names []router.PeerName) []string {
+func (alloc *Allocator) annotatePeernames(names []mesh.PeerName) []string {
 	var res []string
 	for _, name := range names {
 		if nickname, found := alloc.nicknames[name]; found {
@@ -360,7 +440,7 @@ func decodeRange(msg []byte) (r address.Range, err error) {
 }
 
 // OnGossipUnicast (Sync)
-func (alloc *Allocator) OnGossipUnicast(sender router.PeerName, msg []byte) error {
+func (alloc *Allocator) OnGossipUnicast(sender mesh.PeerName, msg []byte) error {
 	alloc.debugln("OnGossipUnicast from", sender, ": ", len(msg), "bytes")
 	resultChan := make(chan error)
 	alloc.actionChan <- func() {
@@ -380,13 +460,25 @@ func (alloc *Allocator) OnGossipUnicast(sender router.PeerName, msg []byte) erro
 			resultChan <- err
 		case msgRingUpdate:
 			resultChan <- alloc.update(sender, msg[1:])
+		case msgHeldAddresses:
+			held, err := decodeHeldAddresses(msg[1:])
+			if err == nil {
+				alloc.adoptAddresses(sender, held)
+			}
+			resultChan <- err
+		case msgHeldAddressesAck:
+			conflicts, err := decodeHeldAddresses(msg[1:])
+			if err == nil {
+				alloc.handedOver(sender, conflicts)
+			}
+			resultChan <- err
 		}
 	}
 	return <-resultChan
 }
 
 // OnGossipBroadcast (Sync)
-func (alloc *Allocator) OnGossipBroadcast(sender router.PeerName, msg []byte) (router.GossipData, error) {
+func (alloc *Allocator) OnGossipBroadcast(sender mesh.PeerName, msg []byte) (mesh.GossipData, error) {
 	alloc.debugln("OnGossipBroadcast from", sender, ":", len(msg), "bytes")
 	resultChan := make(chan error)
 	alloc.actionChan <- func() {
@@ -399,23 +491,46 @@ type gossipState struct {
 	// We send a timstamp along with the information to be
 	// gossipped in order to detect skewed clocks
 	Now       int64
-	Nicknames map[router.PeerName]string
+	Nicknames map[mesh.PeerName]string
 
-	Paxos paxos.GossipState
-	Ring  *ring.Ring
+	Paxos    paxos.GossipState
+	Ring     *ring.Ring
+	Grow     *growState
+	Takeover *takeoverState
+	WantRing bool // asking peers which have a ring to send it
+
+	PoolUsage map[mesh.PeerName]peerPoolUsage
+
+	// In place of Ring when made up of several ranges, so that
+	// peers which predate them don't see it
+	MultiRangeRing *ring.Ring
 }
 
 func (alloc *Allocator) encode() []byte {
 	data := gossipState{
 		Now:       alloc.now().Unix(),
 		Nicknames: alloc.nicknames,
+		PoolUsage: alloc.poolUsage,
 	}
 
 	// We're only interested in Paxos until we have a Ring.
 	if alloc.ring.Empty() {
-		data.Paxos = alloc.paxos.GossipState()
+		if alloc.paxos != nil {
+			data.Paxos = alloc.paxos.GossipState()
+		}
+		data.WantRing = alloc.waitTicker != nil
 	} else {
-		data.Ring = alloc.ring
+		if len(alloc.ring.Universe()) > 1 {
+			data.MultiRangeRing = alloc.ring
+		} else {
+			data.Ring = alloc.ring
+		}
+		if alloc.growing != nil {
+			data.Grow = &growState{alloc.growing.r, alloc.growing.paxos.GossipState()}
+		}
+		if alloc.takingOver != nil {
+			data.Takeover = &takeoverState{alloc.takingOver.peer, alloc.takingOver.paxos.GossipState()}
+		}
 	}
 	buf := new(bytes.Buffer)
 	enc := gob.NewEncoder(buf)
@@ -435,11 +550,11 @@ func (alloc *Allocator) Encode() []byte {
 }
 
 // OnGossip (Sync)
-func (alloc *Allocator) OnGossip(msg []byte) (router.GossipData, error) {
+func (alloc *Allocator) OnGossip(msg []byte) (mesh.GossipData, error) {
 	alloc.debugln("Allocator.OnGossip:", len(msg), "bytes")
 	resultChan := make(chan error)
 	alloc.actionChan <- func() {
-		resultChan <- alloc.update(router.UnknownPeerName, msg)
+		resultChan <- alloc.update(mesh.UnknownPeerName, msg)
 	}
 	return nil, <-resultChan // for now, we never propagate updates. TBD
 }
@@ -450,7 +565,7 @@ type ipamGossipData struct {
 	alloc *Allocator
 }
 
-func (d *ipamGossipData) Merge(other router.GossipData) {
+func (d *ipamGossipData) Merge(other mesh.GossipData) {
 	// no-op
 }
 
@@ -460,12 +575,50 @@ func (d *ipamGossipData) Encode() [][]byte {
 
 // Gossip returns a GossipData implementation, which in this case always
 // returns the latest ring state (and does nothing on merge)
-func (alloc *Allocator) Gossip() router.GossipData {
+func (alloc *Allocator) Gossip() mesh.GossipData {
 	return &ipamGossipData{alloc}
 }
 
+// GossipSince (Sync) returns our state unless it's the same as the
+// version given.  The version is a digest of the ring, and is only
+// given once we have one and aren't in the middle of agreeing on
+// anything, which must be gossiped regardless.
+func (alloc *Allocator) GossipSince(version uint64) (mesh.GossipData, uint64) {
+	resultChan := make(chan uint64)
+	alloc.actionChan <- func() {
+		if alloc.ring.Empty() || alloc.growing != nil || alloc.takingOver != nil {
+			resultChan <- 0
+			return
+		}
+		h := fnv.New64a()
+		fmt.Fprint(h, alloc.ring.Digest())
+		var peers peerNames
+		for peer := range alloc.nicknames {
+			peers = append(peers, peer)
+		}
+		sort.Sort(peers)
+		for _, peer := range peers {
+			fmt.Fprint(h, peer, alloc.nicknames[peer])
+		}
+		peers = nil
+		for peer := range alloc.poolUsage {
+			peers = append(peers, peer)
+		}
+		sort.Sort(peers)
+		for _, peer := range peers {
+			fmt.Fprint(h, peer, alloc.poolUsage[peer].Version)
+		}
+		resultChan <- h.Sum64()
+	}
+	current := <-resultChan
+	if current != 0 && current == version {
+		return nil, current
+	}
+	return alloc.Gossip(), current
+}
+
 // SetInterfaces gives the allocator two interfaces for talking to the outside world
-func (alloc *Allocator) SetInterfaces(gossip router.Gossip) {
+func (alloc *Allocator) SetInterfaces(gossip mesh.Gossip) {
 	alloc.gossip = gossip
 }
 
@@ -473,23 +626,64 @@ func (alloc *Allocator) SetInterfaces(gossip router.Gossip) {
 
 func (alloc *Allocator) actorLoop(actionChan <-chan func()) {
 	for {
-		var tickChan <-chan time.Time
+		var tickChan, waitTickChan, growTickChan, takeoverTickChan, leaseGCTickChan, deadPeerTickChan, rebalanceTickChan <-chan time.Time
 		if alloc.paxosTicker != nil {
 			tickChan = alloc.paxosTicker.C
 		}
+		if alloc.waitTicker != nil {
+			waitTickChan = alloc.waitTicker.C
+		}
+		if alloc.growTicker != nil {
+			growTickChan = alloc.growTicker.C
+		}
+		if alloc.takeoverTicker != nil {
+			takeoverTickChan = alloc.takeoverTicker.C
+		}
+		if alloc.leaseGCTicker != nil {
+			leaseGCTickChan = alloc.leaseGCTicker.C
+		}
+		if alloc.deadPeerTicker != nil {
+			deadPeerTickChan = alloc.deadPeerTicker.C
+		}
+		if alloc.rebalancer.ticker != nil {
+			rebalanceTickChan = alloc.rebalancer.ticker.C
+		}
 
 		select {
 		case action := <-actionChan:
 			if action == nil {
+				if alloc.rebalancer.ticker != nil {
+					alloc.rebalancer.ticker.Stop()
+				}
+				if alloc.leaseGCTicker != nil {
+					alloc.leaseGCTicker.Stop()
+				}
+				if alloc.deadPeerTicker != nil {
+					alloc.deadPeerTicker.Stop()
+				}
+				alloc.stopTakeover()
 				return
 			}
 			action()
 		case <-tickChan:
 			alloc.propose()
+		case <-waitTickChan:
+			alloc.waitedForRing()
+		case <-growTickChan:
+			alloc.proposeGrow()
+		case <-takeoverTickChan:
+			alloc.proposeTakeover()
+		case <-rebalanceTickChan:
+			alloc.rebalance()
+		case <-leaseGCTickChan:
+			alloc.checkLeases()
+		case <-deadPeerTickChan:
+			alloc.listPeers()
 		}
 
 		alloc.assertInvariants()
 		alloc.reportFreeSpace()
+		alloc.updatePoolUsage()
 	}
 }
 
@@ -497,7 +691,12 @@ func (alloc *Allocator) actorLoop(actionChan <-chan func()) {
 
 // Ensure we are making progress towards an established ring
 func (alloc *Allocator) establishRing() {
-	if !alloc.ring.Empty() || alloc.paxosTicker != nil {
+	if !alloc.ring.Empty() || alloc.paxosTicker != nil || alloc.waitTicker != nil {
+		return
+	}
+
+	if alloc.paxos == nil {
+		alloc.waitForRing()
 		return
 	}
 
@@ -512,9 +711,10 @@ func (alloc *Allocator) establishRing() {
 	}
 }
 
-func (alloc *Allocator) createRing(peers []router.PeerName) {
+func (alloc *Allocator) createRing(peers []mesh.PeerName) {
 	alloc.debugln("Paxos consensus:", peers)
 	alloc.ring.ClaimForPeers(normalizeConsensus(peers))
+	alloc.auditReceived(nil, mesh.UnknownPeerName)
 	alloc.gossip.GossipBroadcast(alloc.Gossip())
 	alloc.ringUpdated()
 }
@@ -529,13 +729,20 @@ func (alloc *Allocator) ringUpdated() {
 			alloc.paxosTicker = nil
 		}
 	}
+	alloc.stopWaitingForRing()
 
 	alloc.space.UpdateRanges(alloc.ring.OwnedRanges())
+	alloc.space.SetReserved(alloc.ring.ReservedRanges())
+	if alloc.growing != nil && alloc.ring.HasRange(alloc.growing.r) {
+		alloc.stopGrow()
+		alloc.startGrow()
+	}
+	alloc.pruneAbsentPeers()
 	alloc.tryPendingOps()
 }
 
 // For compatibility with sort.Interface
-type peerNames []router.PeerName
+type peerNames []mesh.PeerName
 
 func (a peerNames) Len() int           { return len(a) }
 func (a peerNames) Less(i, j int) bool { return a[i] < a[j] }
@@ -544,7 +751,7 @@ func (a peerNames) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 // When we get a consensus from Paxos, the peer names are not in a
 // defined order and may contain duplicates.  This function sorts them
 // and de-dupes.
-func normalizeConsensus(consensus []router.PeerName) []router.PeerName {
+func normalizeConsensus(consensus []mesh.PeerName) []mesh.PeerName {
 	if len(consensus) == 0 {
 		return nil
 	}
@@ -579,22 +786,22 @@ func encodeRange(r address.Range) []byte {
 	return buf.Bytes()
 }
 
-func (alloc *Allocator) sendSpaceRequest(dest router.PeerName, r address.Range) error {
-	msg := router.Concat([]byte{msgSpaceRequest}, encodeRange(r))
+func (alloc *Allocator) sendSpaceRequest(dest mesh.PeerName, r address.Range) error {
+	msg := mesh.Concat([]byte{msgSpaceRequest}, encodeRange(r))
 	return alloc.gossip.GossipUnicast(dest, msg)
 }
 
-func (alloc *Allocator) sendSpaceRequestDenied(dest router.PeerName, r address.Range) error {
-	msg := router.Concat([]byte{msgSpaceRequestDenied}, encodeRange(r))
+func (alloc *Allocator) sendSpaceRequestDenied(dest mesh.PeerName, r address.Range) error {
+	msg := mesh.Concat([]byte{msgSpaceRequestDenied}, encodeRange(r))
 	return alloc.gossip.GossipUnicast(dest, msg)
 }
 
-func (alloc *Allocator) sendRingUpdate(dest router.PeerName) {
-	msg := router.Concat([]byte{msgRingUpdate}, alloc.encode())
+func (alloc *Allocator) sendRingUpdate(dest mesh.PeerName) {
+	msg := mesh.Concat([]byte{msgRingUpdate}, alloc.encode())
 	alloc.gossip.GossipUnicast(dest, msg)
 }
 
-func (alloc *Allocator) update(sender router.PeerName, msg []byte) error {
+func (alloc *Allocator) update(sender mesh.PeerName, msg []byte) error {
 	reader := bytes.NewReader(msg)
 	decoder := gob.NewDecoder(reader)
 	var data gossipState
@@ -614,29 +821,72 @@ func (alloc *Allocator) update(sender router.PeerName, msg []byte) error {
 		alloc.nicknames[peer] = nickname
 	}
 
+	alloc.mergePoolUsage(data.PoolUsage)
+
+	if data.Ring == nil {
+		data.Ring = data.MultiRangeRing
+	}
+
 	// only one of Ring and Paxos should be present.  And we
 	// shouldn't get updates for a empty Ring. But tolerate
 	// them just in case.
 	if data.Ring != nil {
+		if err := alloc.checkSeeds(data.Ring.Seeds); err != nil {
+			return err
+		}
+		owned := alloc.ring.OwnedRanges()
 		switch err = alloc.ring.Merge(*data.Ring); err {
 		case ring.ErrDifferentSeeds:
-			return fmt.Errorf("IP allocation was seeded by different peers (received: %v, ours: %v)",
+			return fmt.Errorf("IP allocation was seeded by different peers (received: %v, ours: %v); to join the two groups, reset the peers of one with 'weave reset' and launch them again connected to the other",
 				alloc.annotatePeernames(data.Ring.Seeds), alloc.annotatePeernames(alloc.ring.Seeds))
 		case ring.ErrDifferentRange:
 			return fmt.Errorf("Incompatible IP allocation ranges (received: %s, ours: %s)",
-				data.Ring.Range().AsCIDRString(), alloc.ring.Range().AsCIDRString())
-		default:
-			if err == nil && !alloc.ring.Empty() {
+				rangesString(data.Ring.Universe()), rangesString(alloc.ring.Universe()))
+		case ring.ErrOldVersion:
+			return fmt.Errorf("IP allocation ring received from a peer running an older version of weave, which does not support multiple ranges (ours: %s); upgrade it",
+				rangesString(alloc.ring.Universe()))
+		case ring.ErrTakenOver:
+			alloc.rangesTakenOver(data.Ring)
+			return nil
+		case ring.ErrNewerVersion:
+			if alloc.takeoverAfter == 0 {
+				return err
+			}
+			// Someone else has changed our entries, which, with
+			// takeover enabled, happens when they took over our
+			// ranges before they had heard of it
+			alloc.rangesTakenOver(data.Ring)
+			return nil
+		case nil:
+			if !alloc.ring.Empty() {
+				alloc.auditReceived(owned, sender)
 				alloc.pruneNicknames()
 				alloc.ringUpdated()
 			}
+		default:
 			return err
 		}
 	}
 
+	if data.Grow != nil {
+		alloc.updateGrow(sender, data.Grow)
+	}
+
+	if data.Takeover != nil {
+		alloc.updateTakeover(sender, data.Takeover)
+	}
+
+	if data.WantRing && !alloc.ring.Empty() && sender != mesh.UnknownPeerName {
+		alloc.sendRingUpdate(sender)
+	} else if data.WantRing && alloc.isSeed() {
+		// Someone needs the ring, so we'd better make sure it exists
+		alloc.establishRing()
+	}
+
 	if data.Paxos != nil {
 		if alloc.ring.Empty() {
-			if alloc.paxos.Update(data.Paxos) {
+			// Seeds and observers don't take part
+			if alloc.paxos != nil && alloc.paxos.Update(data.Paxos) {
 				if alloc.paxos.Think() {
 					// If something important changed, broadcast
 					alloc.gossip.GossipBroadcast(alloc.Gossip())
@@ -646,7 +896,7 @@ func (alloc *Allocator) update(sender router.PeerName, msg []byte) error {
 					alloc.createRing(cons.Value)
 				}
 			}
-		} else if sender != router.UnknownPeerName {
+		} else if sender != mesh.UnknownPeerName {
 			// Sender is trying to initialize a ring, but we have one
 			// already - send it straight back
 			alloc.sendRingUpdate(sender)
@@ -656,7 +906,7 @@ func (alloc *Allocator) update(sender router.PeerName, msg []byte) error {
 	return nil
 }
 
-func (alloc *Allocator) donateSpace(r address.Range, to router.PeerName) {
+func (alloc *Allocator) donateSpace(r address.Range, to mesh.PeerName) {
 	// No matter what we do, we'll send a unicast gossip
 	// of our ring back to tha chap who asked for space.
 	// This serves to both tell him of any space we might
@@ -665,6 +915,16 @@ func (alloc *Allocator) donateSpace(r address.Range, to router.PeerName) {
 	defer alloc.sendRingUpdate(to)
 
 	alloc.debugln("Peer", to, "asked me for space")
+	if alloc.takenOver {
+		// It isn't ours to give any more
+		alloc.sendSpaceRequestDenied(to, r)
+		return
+	}
+	if r.Size() == 1 {
+		// A claim for an address we may be holding for a peer
+		// whose ranges we took over
+		alloc.releaseHeldAddress(r.Start)
+	}
 	chunk, ok := alloc.space.Donate(r)
 	if !ok {
 		free := alloc.space.NumFreeAddressesInRange(r)
@@ -677,6 +937,7 @@ func (alloc *Allocator) donateSpace(r address.Range, to router.PeerName) {
 	}
 	alloc.debugln("Giving range", chunk, "to", to)
 	alloc.ring.GrantRangeToHost(chunk.Start, chunk.End, to)
+	alloc.auditRange(auditDonate, chunk, to)
 	alloc.sendRingUpdate(to)
 }
 
@@ -717,6 +978,21 @@ func (alloc *Allocator) addOwned(ident string, addr address.Address) {
 	alloc.owned[ident] = append(alloc.owned[ident], addr)
 }
 
+func (alloc *Allocator) removeOwned(ident string, addr address.Address) bool {
+	addrs := alloc.owned[ident]
+	for i, ownedAddr := range addrs {
+		if ownedAddr == addr {
+			if len(addrs) == 1 {
+				delete(alloc.owned, ident)
+			} else {
+				alloc.owned[ident] = append(addrs[:i], addrs[i+1:]...)
+			}
+			return true
+		}
+	}
+	return false
+}
+
 func (alloc *Allocator) lookupOwned(ident string, r address.Range) (address.Address, bool) {
 	for _, addr := range alloc.owned[ident] {
 		if r.Contains(addr) {
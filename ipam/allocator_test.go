@@ -1,8 +1,11 @@
 package ipam
 
 import (
+	"bytes"
+	"encoding/gob"
 	"fmt"
 	"math/rand"
+	"net"
 	"sync"
 	"testing"
 	"time"
@@ -10,6 +13,9 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/dhcp"
+	"github.com/weaveworks/weave/ipam/ring"
+	"github.com/weaveworks/weave/mesh"
 	"github.com/weaveworks/weave/net/address"
 	"github.com/weaveworks/weave/testing/gossip"
 )
@@ -574,3 +580,414 @@ func TestGossipSkew(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestReservations(t *testing.T) {
+	const (
+		container1 = "abcdef"
+		container2 = "baddf00d"
+		universe   = "10.0.3.0/29"
+	)
+
+	allocs, router, subnet := makeNetworkOfAllocators(2, universe)
+	defer stopNetworkOfAllocators(allocs)
+
+	// Do one allocate to ensure paxos is all done
+	allocs[1].Allocate("unused", subnet, returnFalse)
+
+	// Reserve all but one of the usable addresses, and check
+	// everyone avoids them
+	reserved := address.Range{Start: subnet.Start, End: subnet.End - 1}
+	require.NoError(t, allocs[1].Reserve("static", reserved))
+	router.Flush()
+	require.Equal(t, map[string]address.Range{"static": reserved}, allocs[0].Reservations())
+
+	addr, err := allocs[0].Allocate(container1, subnet, returnFalse)
+	require.NoError(t, err)
+	require.Equal(t, subnet.End-1, addr)
+
+	// Reserved addresses can still be claimed explicitly
+	require.NoError(t, allocs[0].Claim(container2, subnet.Start, false))
+
+	require.NoError(t, allocs[0].Unreserve("static"))
+	require.Error(t, allocs[0].Unreserve("static"))
+}
+
+func TestAddRange(t *testing.T) {
+	const (
+		container1 = "abcdef"
+		universe   = "10.0.3.0/30"
+	)
+
+	allocs, router, subnet := makeNetworkOfAllocators(3, universe)
+	defer stopNetworkOfAllocators(allocs)
+
+	newStart, _ := address.ParseIP("10.0.9.0")
+	newRange := address.NewRange(newStart, 4)
+	require.Error(t, allocs[0].AddRange(newRange), "cannot add before ring established")
+
+	allocs[1].Allocate("unused", subnet, returnFalse)
+	router.Flush()
+
+	require.Error(t, allocs[0].AddRange(address.NewRange(subnet.Start, 8)), "overlapping range")
+	require.NoError(t, allocs[0].AddRange(newRange))
+	// agreement takes a few rounds of gossip
+	agreed := func() bool {
+		for _, alloc := range allocs {
+			if len(alloc.Universe()) < 2 {
+				return false
+			}
+		}
+		return true
+	}
+	for i := 0; i < 10 && !agreed(); i++ {
+		router.Flush()
+	}
+
+	for _, alloc := range allocs {
+		require.Equal(t, []address.Range{{Start: subnet.Start - 1, End: subnet.End + 1}, newRange}, alloc.Universe())
+	}
+	addr, err := allocs[2].Allocate(container1, newRange, returnFalse)
+	require.NoError(t, err)
+	require.True(t, newRange.Contains(addr))
+
+	// Peers which predate multiple ranges don't get to see the ring
+	var old struct {
+		Now  int64
+		Ring *ring.Ring
+	}
+	require.NoError(t, gob.NewDecoder(bytes.NewReader(allocs[0].Encode())).Decode(&old))
+	require.Nil(t, old.Ring)
+}
+
+type mockLiveness map[string]bool // idents which have gone away
+
+func (m mockLiveness) IsContainerNotRunning(ident string) bool { return m[ident] }
+
+// As checkLeases, but waiting for the result (Sync)
+func (alloc *Allocator) collectLeaks(grace time.Duration, checkers []LivenessChecker) {
+	identsChan := make(chan []string)
+	alloc.actionChan <- func() {
+		identsChan <- alloc.containerIdents()
+	}
+
+	// Talk to the liveness sources outside the actor loop
+	gone := goneIdents(<-identsChan, checkers)
+
+	doneChan := make(chan struct{})
+	alloc.actionChan <- func() {
+		alloc.reapLeases(gone, grace)
+		close(doneChan)
+	}
+	<-doneChan
+}
+
+func TestLeaseGC(t *testing.T) {
+	const (
+		container1 = "abcdef"
+		container2 = "baddf00d"
+		expose     = "weave:expose"
+		grace      = time.Minute
+	)
+	// Docker doesn't know about DHCP clients, so says they are gone
+	dhcpLease := dhcp.LeaseIdent(net.HardwareAddr{0x02, 0x42, 0xac, 0x11, 0x00, 0x02})
+
+	alloc, subnet := makeAllocatorWithMockGossip(t, "01:00:00:01:00:00", "10.0.3.0/29", 1)
+	defer alloc.Stop()
+	now := time.Now()
+	alloc.now = func() time.Time { return now }
+	alloc.claimRingForTesting()
+
+	for _, ident := range []string{container1, container2, expose, dhcpLease} {
+		_, err := alloc.Allocate(ident, subnet, returnFalse)
+		require.NoError(t, err)
+	}
+	checkers := []LivenessChecker{mockLiveness{container2: true, expose: true, dhcpLease: true}}
+
+	// Nothing is freed until the grace period has passed
+	alloc.collectLeaks(grace, checkers)
+	status := NewStatus(alloc, address.CIDR{})
+	require.Equal(t, 1, status.Leaked)
+	require.Equal(t, 0, status.Reclaimed)
+
+	now = now.Add(grace)
+	alloc.collectLeaks(grace, checkers)
+	status = NewStatus(alloc, address.CIDR{})
+	require.Equal(t, 0, status.Leaked)
+	require.Equal(t, 1, status.Reclaimed)
+	_, err := alloc.Lookup(container2, subnet)
+	require.Error(t, err)
+	for _, ident := range []string{container1, expose, dhcpLease} {
+		_, err := alloc.Lookup(ident, subnet)
+		require.NoError(t, err)
+	}
+
+	// An owner which comes back within the grace period keeps its address
+	alloc.collectLeaks(grace, []LivenessChecker{mockLiveness{container1: true}})
+	now = now.Add(grace)
+	alloc.collectLeaks(grace, []LivenessChecker{mockLiveness{}})
+	alloc.collectLeaks(grace, []LivenessChecker{mockLiveness{container1: true}})
+	_, err = alloc.Lookup(container1, subnet)
+	require.NoError(t, err)
+
+	// Left running, the collector frees leaks by itself
+	alloc.StartLeaseGC(time.Millisecond, 0, mockLiveness{container1: true})
+	for i := 0; err == nil && i < 1000; i++ {
+		time.Sleep(time.Millisecond)
+		_, err = alloc.Lookup(container1, subnet)
+	}
+	require.Error(t, err)
+}
+
+func TestRebalance(t *testing.T) {
+	allocs, router, subnet := makeNetworkOfAllocators(2, "10.0.3.0/26")
+	defer stopNetworkOfAllocators(allocs)
+
+	for i := 0; i < 20; i++ {
+		_, err := allocs[0].Allocate(fmt.Sprintf("container%d", i), subnet, returnFalse)
+		require.NoError(t, err)
+	}
+	router.Flush()
+	before := allocs[0].NumFreeAddresses(subnet)
+
+	done := make(chan struct{})
+	allocs[0].actionChan <- func() {
+		allocs[0].rebalancer.horizon = 10
+		allocs[0].rebalance()
+		close(done)
+	}
+	<-done
+	// one flush for the request, and one for the reply
+	router.Flush()
+	router.Flush()
+
+	require.True(t, allocs[0].NumFreeAddresses(subnet) > before, "should have been given space")
+	require.Equal(t, 1, NewStatus(allocs[0], address.CIDR{}).Rebalance.Requests)
+	require.Equal(t, address.Offset(62-20), allocs[0].NumFreeAddresses(subnet)+allocs[1].NumFreeAddresses(subnet))
+}
+
+func TestDeadPeerTakeover(t *testing.T) {
+	allocs, gossipRouter, subnet := makeNetworkOfAllocators(3, "10.0.4.0/24")
+	defer stopNetworkOfAllocators(allocs)
+	survivors, dead := allocs[:2], allocs[2]
+
+	addr, err := dead.Allocate("foo", subnet, returnFalse)
+	require.NoError(t, err)
+	given, err := dead.Allocate("bar", subnet, returnFalse)
+	require.NoError(t, err)
+	// Only peers owning ranges take part
+	for i, alloc := range survivors {
+		_, err := alloc.Allocate(fmt.Sprintf("survivor%d", i), subnet, returnFalse)
+		require.NoError(t, err)
+	}
+	gossipRouter.Flush()
+	gossipRouter.RemovePeer(dead.ourName)
+
+	live := make(mesh.PeerNameSet)
+	for _, alloc := range survivors {
+		live[alloc.ourName] = struct{}{}
+	}
+	checkAfter := func(alloc *Allocator, delay time.Duration) {
+		done := make(chan struct{})
+		alloc.actionChan <- func() {
+			now := time.Now().Add(delay)
+			alloc.now = func() time.Time { return now }
+			alloc.takeoverAfter = time.Minute
+			alloc.checkDeadPeers(live)
+			close(done)
+		}
+		<-done
+	}
+	for _, alloc := range survivors {
+		checkAfter(alloc, 0)
+	}
+	require.Equal(t, []string{dead.ourName.String() + "(nick-" + dead.ourName.String() + ")"},
+		NewStatus(allocs[0], address.CIDR{}).Takeover.Absent)
+
+	// Not gone for long enough yet
+	checkAfter(allocs[1], 30*time.Second)
+	gossipRouter.Flush()
+	require.Equal(t, dead.ourName, allocs[1].Owner(addr))
+
+	// A peer on its own is not a majority of the peers owning
+	// ranges, whatever quorum it was launched with
+	allocs[1].quorum = 1
+	checkAfter(allocs[1], 2*time.Minute)
+	require.Equal(t, dead.ourName, allocs[1].Owner(addr))
+
+	for _, alloc := range survivors {
+		checkAfter(alloc, 2*time.Minute)
+	}
+	// agreement takes a few rounds of gossip
+	for i := 0; i < 10 && allocs[1].Owner(addr) != allocs[0].ourName; i++ {
+		gossipRouter.Flush()
+	}
+	for _, alloc := range survivors {
+		require.Equal(t, allocs[0].ourName, alloc.Owner(addr), "lowest-named peer should have taken over")
+		require.Empty(t, NewStatus(alloc, address.CIDR{}).Takeover.Absent)
+	}
+	require.NoError(t, allocs[0].Claim("baz", given, false))
+
+	// If the dead peer comes back, it must not allocate any more,
+	// and hands over the address it still has in use
+	gossipRouter.Connect(dead.ourName, dead)
+	_, err = dead.OnGossipBroadcast(allocs[0].ourName, allocs[0].Encode())
+	require.NoError(t, err)
+	_, err = dead.Allocate("qux", subnet, returnFalse)
+	require.Equal(t, errTakenOver, err)
+	require.True(t, NewStatus(dead, address.CIDR{}).Takeover.TakenOver)
+	// one flush for the addresses, and one for the acknowledgement
+	gossipRouter.Flush()
+	gossipRouter.Flush()
+	held, err := allocs[0].Lookup(heldIdentPrefix+"foo", subnet)
+	require.NoError(t, err)
+	require.Equal(t, addr, held)
+
+	// ... giving up the one the heir had given out already
+	_, err = dead.Lookup("bar", subnet)
+	require.Error(t, err)
+	_, err = dead.Lookup("foo", subnet)
+	require.NoError(t, err)
+
+	// The heir doesn't give it out, but lets the container claim it
+	// once it has rejoined
+	for i := 0; i < 10; i++ {
+		other, err := allocs[0].Allocate(fmt.Sprintf("other%d", i), subnet, returnFalse)
+		require.NoError(t, err)
+		require.NotEqual(t, addr, other)
+	}
+	claimed := make(chan error)
+	go func() { claimed <- allocs[1].Claim("foo", addr, false) }()
+	done := false
+	for i := 0; i < 10 && !done; i++ {
+		gossipRouter.Flush()
+		select {
+		case err = <-claimed:
+			require.NoError(t, err)
+			done = true
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	require.True(t, done, "claim should have succeeded")
+	require.Equal(t, allocs[1].ourName, allocs[1].Owner(addr))
+	_, err = allocs[0].Lookup(heldIdentPrefix+"foo", subnet)
+	require.Error(t, err)
+}
+
+func TestRmpeerIsNotTakeover(t *testing.T) {
+	allocs, gossipRouter, subnet := makeNetworkOfAllocators(2, "10.0.4.0/24")
+	defer stopNetworkOfAllocators(allocs)
+
+	_, err := allocs[0].Allocate("foo", subnet, returnFalse)
+	require.NoError(t, err)
+	gossipRouter.Flush()
+	gossipRouter.RemovePeer(allocs[0].ourName)
+	require.NoError(t, allocs[1].AdminTakeoverRanges(allocs[0].ourName.String()))
+
+	// Without takeover enabled, hearing that someone else changed
+	// our entries is an error, as it always was, and doesn't stop us
+	_, err = allocs[0].OnGossipBroadcast(allocs[1].ourName, allocs[1].Encode())
+	require.Error(t, err)
+	require.False(t, NewStatus(allocs[0], address.CIDR{}).Takeover.TakenOver)
+}
+
+func TestAuditLogWraps(t *testing.T) {
+	alloc, _ := makeAllocatorWithMockGossip(t, "01:00:00:01:00:00", "10.0.3.0/29", 1)
+	defer alloc.Stop()
+
+	done := make(chan struct{})
+	alloc.actionChan <- func() {
+		for i := 0; i < auditLogSize+10; i++ {
+			alloc.auditAddress(auditAllocate, fmt.Sprint(i), 0)
+		}
+		close(done)
+	}
+	<-done
+	events := alloc.Audit(AuditQuery{})
+	require.Len(t, events, auditLogSize)
+	require.Equal(t, "10", events[0].Ident)
+	require.Equal(t, fmt.Sprint(auditLogSize+9), events[auditLogSize-1].Ident)
+}
+
+func TestSeed(t *testing.T) {
+	const cidr = "10.0.5.0/24"
+	gossipRouter := gossip.NewTestRouter(0.0)
+	var allocs []*Allocator
+	for i := 0; i < 3; i++ {
+		alloc, _ := makeAllocator(fmt.Sprintf("%02d:00:00:02:00:00", i+1), cidr, 1)
+		alloc.SetInterfaces(gossipRouter.Connect(alloc.ourName, alloc))
+		allocs = append(allocs, alloc)
+	}
+	allocs[0].SeedWith([]mesh.PeerName{allocs[0].ourName})
+	allocs[1].SeedWith([]mesh.PeerName{allocs[0].ourName})
+	allocs[2].Observe()
+	for _, alloc := range allocs {
+		alloc.Start()
+	}
+	defer stopNetworkOfAllocators(allocs)
+	_, subnet, _ := address.ParseCIDR(cidr)
+
+	// Observers wait to be told about the ring...
+	done := make(chan bool)
+	go func() {
+		_, err := allocs[2].Allocate("foo", subnet.HostRange(), returnFalse)
+		done <- err == nil
+	}()
+	gossipRouter.Flush()
+	AssertNothingSent(t, done)
+	require.True(t, NewStatus(allocs[1], address.CIDR{}).Observer)
+
+	// ...which the seed creates when nobody else answers
+	allocs[0].actionChan <- func() { allocs[0].waitedForRing() }
+	gossipRouter.Flush()
+	AssertSent(t, done)
+	require.Equal(t, allocs[0].ourName, allocs[2].Owner(subnet.Start))
+	_, err := allocs[1].Allocate("bar", subnet.HostRange(), returnFalse)
+	require.NoError(t, err)
+
+	// A peer launched with a different seed is told what's wrong
+	other, _ := makeAllocator("04:00:00:02:00:00", cidr, 1)
+	other.SetInterfaces(&mockGossipComms{T: t, name: "other"})
+	other.SeedWith([]mesh.PeerName{other.ourName})
+	other.Start()
+	defer other.Stop()
+	_, err = other.OnGossipBroadcast(allocs[0].ourName, allocs[0].Encode())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "launched with seed")
+}
+
+func TestPoolQuotaAcrossPeers(t *testing.T) {
+	allocs, router, _ := makeNetworkOfAllocators(2, "10.0.4.0/24")
+	defer stopNetworkOfAllocators(allocs)
+	pool, err := ParsePool("acme=10.0.4.0/28,quota=3")
+	require.NoError(t, err)
+	for _, alloc := range allocs {
+		done := make(chan struct{})
+		alloc.actionChan <- func() {
+			alloc.pools = append(alloc.pools, pool)
+			close(done)
+		}
+		<-done
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err := allocs[0].AllocateInPool(fmt.Sprintf("container%d", i), pool, returnFalse)
+		require.NoError(t, err)
+	}
+	router.Flush()
+	_, err = allocs[1].AllocateInPool("container2", pool, returnFalse)
+	require.NoError(t, err)
+	router.Flush()
+
+	// The quota applies to all the peers' addresses together
+	for _, alloc := range allocs {
+		_, err = alloc.AllocateInPool("container3", pool, returnFalse)
+		require.Error(t, err, "quota exhausted")
+		require.Equal(t, []PoolStatus{{"acme", "10.0.4.0/28", "", 3, 3}}, NewStatus(alloc, address.CIDR{}).Pools)
+	}
+
+	// Freeing an address on one peer makes room on the other
+	require.NoError(t, allocs[0].Delete("container0"))
+	router.Flush()
+	_, err = allocs[1].AllocateInPool("container3", pool, returnFalse)
+	require.NoError(t, err)
+}
@@ -0,0 +1,160 @@
+package ipam
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/mesh"
+	"github.com/weaveworks/weave/net/address"
+)
+
+// Every change to who holds an address, or which peer owns a range,
+// is recorded as an AuditEvent.  The most recent events are kept in
+// memory to be queried; all of them can also be appended to a file,
+// one JSON object per line.
+
+const (
+	auditAllocate = "allocate"
+	auditClaim    = "claim"
+	auditFree     = "free"
+	auditDonate   = "donate"
+	auditReceive  = "receive"
+	auditTakeover = "takeover"
+
+	auditLogSize = 10000 // events kept in memory
+)
+
+type AuditEvent struct {
+	Time    time.Time
+	Event   string // one of allocate, claim, free, donate, receive, takeover
+	Ident   string `json:",omitempty"` // the container, for address events
+	Address string `json:",omitempty"`
+	Range   string `json:",omitempty"` // for range events
+	Peer    string `json:",omitempty"` // the other peer, for range events
+
+	r *address.Range // for matching queries against Range
+}
+
+// AuditQuery selects events; zero fields match everything
+type AuditQuery struct {
+	Ident        string
+	Address      address.Address
+	HasAddress   bool
+	Since, Until time.Time
+}
+
+type auditLog struct {
+	events []AuditEvent // a ring, once full
+	next   int          // where the next event goes, once full
+	writer io.Writer
+}
+
+// The events, oldest first
+func (log *auditLog) each(f func(AuditEvent)) {
+	for i := range log.events {
+		f(log.events[(log.next+i)%len(log.events)])
+	}
+}
+
+// SetAuditWriter makes the allocator append every audit event to w,
+// as well as keeping recent ones.  Must be called before Start.
+func (alloc *Allocator) SetAuditWriter(w io.Writer) {
+	alloc.audit.writer = w
+}
+
+func (alloc *Allocator) auditAddress(event, ident string, addr address.Address) {
+	alloc.record(AuditEvent{Event: event, Ident: ident, Address: addr.String()})
+}
+
+func (alloc *Allocator) auditRange(event string, r address.Range, peer mesh.PeerName) {
+	e := AuditEvent{Event: event, Range: r.String(), r: &r}
+	if peer != mesh.UnknownPeerName {
+		e.Peer = alloc.annotatePeernames([]mesh.PeerName{peer})[0]
+	}
+	alloc.record(e)
+}
+
+// Record ranges we own now which we didn't before
+func (alloc *Allocator) auditReceived(before []address.Range, from mesh.PeerName) {
+	had := make(map[address.Range]bool)
+	for _, r := range before {
+		had[r] = true
+	}
+	for _, r := range alloc.ring.OwnedRanges() {
+		if !had[r] {
+			alloc.auditRange(auditReceive, r, from)
+		}
+	}
+}
+
+func (alloc *Allocator) record(e AuditEvent) {
+	e.Time = alloc.now()
+	log := &alloc.audit
+	if len(log.events) < auditLogSize {
+		log.events = append(log.events, e)
+	} else {
+		log.events[log.next] = e
+		log.next = (log.next + 1) % auditLogSize
+	}
+	if log.writer != nil {
+		buf, _ := json.Marshal(e)
+		if _, err := log.writer.Write(append(buf, '\n')); err != nil {
+			common.Log.Errorln("[allocator] Unable to write audit log:", err)
+		}
+	}
+}
+
+func (q AuditQuery) matches(e AuditEvent) bool {
+	if q.Ident != "" && e.Ident != q.Ident {
+		return false
+	}
+	if q.HasAddress {
+		if e.Address != "" && e.Address != q.Address.String() {
+			return false
+		}
+		if e.r != nil && !e.r.Contains(q.Address) {
+			return false
+		}
+	}
+	return (q.Since.IsZero() || !e.Time.Before(q.Since)) && (q.Until.IsZero() || e.Time.Before(q.Until))
+}
+
+// Audit returns the recorded events matching q, oldest first (Sync)
+func (alloc *Allocator) Audit(q AuditQuery) []AuditEvent {
+	resultChan := make(chan []AuditEvent)
+	alloc.actionChan <- func() {
+		result := []AuditEvent{}
+		alloc.audit.each(func(e AuditEvent) {
+			if q.matches(e) {
+				result = append(result, e)
+			}
+		})
+		resultChan <- result
+	}
+	return <-resultChan
+}
+
+func parseAuditQuery(r *http.Request) (AuditQuery, error) {
+	var query AuditQuery
+	var err error
+	values := r.URL.Query()
+	query.Ident = values.Get("ident")
+	if addr := values.Get("addr"); addr != "" {
+		if query.Address, err = address.ParseIP(addr); err != nil {
+			return query, err
+		}
+		query.HasAddress = true
+	}
+	for param, t := range map[string]*time.Time{"since": &query.Since, "until": &query.Until} {
+		if value := values.Get(param); value != "" {
+			if *t, err = time.Parse(time.RFC3339, value); err != nil {
+				return query, fmt.Errorf("Invalid %s time %q; expected RFC3339, e.g. 2006-01-02T15:04:05Z", param, value)
+			}
+		}
+	}
+	return query, nil
+}
@@ -4,8 +4,8 @@ import (
 	"fmt"
 
 	"github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/mesh"
 	"github.com/weaveworks/weave/net/address"
-	"github.com/weaveworks/weave/router"
 )
 
 type claim struct {
@@ -38,18 +38,23 @@ func (c *claim) Try(alloc *Allocator) bool {
 		return true
 	}
 
+	if alloc.takenOver {
+		c.sendResult(errTakenOver)
+		return true
+	}
+
 	alloc.establishRing()
 
 	switch owner := alloc.ring.Owner(c.addr); owner {
 	case alloc.ourName:
 		// success
-	case router.UnknownPeerName:
+	case mesh.UnknownPeerName:
 		// If our ring doesn't know, it must be empty.
 		if c.noErrorOnUnknown {
 			alloc.infof("Claim %s for %s: address allocator still initializing; will try later.", c.addr, c.ident)
 			c.sendResult(nil)
 		} else {
-			c.sendResult(fmt.Errorf("%s is in the range %s, but the allocator is not initialized yet", c.addr, alloc.universe.AsCIDRString()))
+			c.sendResult(fmt.Errorf("%s is in the range %s, but the allocator is not initialized yet", c.addr, rangesString(alloc.ring.Universe())))
 		}
 		return false
 	default:
@@ -69,9 +74,12 @@ func (c *claim) Try(alloc *Allocator) bool {
 	// We are the owner, check we haven't given it to another container
 	switch existingIdent := alloc.findOwner(c.addr); existingIdent {
 	case "":
-		if err := alloc.space.Claim(c.addr); err == nil {
+		if pool := alloc.fullPoolContaining(c.addr); pool != nil {
+			c.sendResult(pool.quotaError())
+		} else if err := alloc.space.Claim(c.addr); err == nil {
 			alloc.debugln("Claimed", c.addr, "for", c.ident)
 			alloc.addOwned(c.ident, c.addr)
+			alloc.auditAddress(auditClaim, c.ident, c.addr)
 			c.sendResult(nil)
 		} else {
 			c.sendResult(err)
@@ -86,7 +94,7 @@ func (c *claim) Try(alloc *Allocator) bool {
 	return true
 }
 
-func (c *claim) deniedBy(alloc *Allocator, owner router.PeerName) {
+func (c *claim) deniedBy(alloc *Allocator, owner mesh.PeerName) {
 	name, found := alloc.nicknames[owner]
 	if found {
 		name = " (" + name + ")"
@@ -0,0 +1,151 @@
+package ipam
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/weaveworks/weave/common"
+)
+
+// If weaver is not running when a container dies, we never hear
+// about it and its addresses stay allocated.  To catch these leaks,
+// we periodically ask each liveness source whether the owners of our
+// addresses still exist, and free the addresses of any owner that has
+// been gone from all of them for longer than a grace period.
+
+// LivenessChecker is a source of truth about which address owners
+// exist.  The Docker client is one.
+type LivenessChecker interface {
+	// Returns true only if ident is known not to be running
+	IsContainerNotRunning(ident string) bool
+}
+
+// How long to wait for a web service to say whether an owner exists
+const livenessTimeout = 10 * time.Second
+
+var livenessClient = &http.Client{Timeout: livenessTimeout}
+
+// HTTPLivenessChecker asks a web service about owners, for users who
+// don't run their containers with Docker.  A GET of URL/<ident>
+// answering 404 or 410 means the owner no longer exists.
+type HTTPLivenessChecker struct {
+	URL string
+}
+
+func (c HTTPLivenessChecker) IsContainerNotRunning(ident string) bool {
+	resp, err := livenessClient.Get(strings.TrimSuffix(c.URL, "/") + "/" + url.QueryEscape(ident))
+	if err != nil {
+		common.Log.Errorf("[allocator] Could not check status of %s: %s", ident, err)
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone
+}
+
+// StartLeaseGC checks the owners of our addresses against checkers
+// every interval, and frees the addresses of owners gone for longer
+// than grace.
+func (alloc *Allocator) StartLeaseGC(interval, grace time.Duration, checkers ...LivenessChecker) {
+	alloc.actionChan <- func() {
+		alloc.leaseGrace = grace
+		alloc.livenessCheckers = checkers
+		alloc.leaseGCTicker = time.NewTicker(interval)
+	}
+}
+
+// Called on the leaseGCTicker.  The liveness sources may be slow, so
+// are asked in the background, and the results handed back to the
+// actor loop.
+func (alloc *Allocator) checkLeases() {
+	if alloc.checkingLeases {
+		alloc.infof("Still waiting for the last check for leaked addresses to finish; skipping this one")
+		return
+	}
+	alloc.checkingLeases = true
+	idents := alloc.containerIdents()
+	checkers := alloc.livenessCheckers
+	go func() {
+		var gone []string
+		// However the check ends, let the next one go ahead
+		defer func() {
+			alloc.actionChan <- func() {
+				alloc.checkingLeases = false
+				alloc.reapLeases(gone, alloc.leaseGrace)
+			}
+		}()
+		gone = goneIdents(idents, checkers)
+	}()
+}
+
+// Identifiers which don't belong to a container, e.g. weave:expose
+func isContainerIdent(ident string) bool {
+	return !strings.HasPrefix(ident, "weave:")
+}
+
+func (alloc *Allocator) containerIdents() []string {
+	var idents []string
+	for ident := range alloc.owned {
+		if isContainerIdent(ident) {
+			idents = append(idents, ident)
+		}
+	}
+	return idents
+}
+
+func goneIdents(idents []string, checkers []LivenessChecker) []string {
+	var gone []string
+	for _, ident := range idents {
+		if isGone(ident, checkers) {
+			gone = append(gone, ident)
+		}
+	}
+	return gone
+}
+
+func isGone(ident string, checkers []LivenessChecker) bool {
+	for _, checker := range checkers {
+		if !checker.IsContainerNotRunning(ident) {
+			return false
+		}
+	}
+	return len(checkers) > 0
+}
+
+func (alloc *Allocator) reapLeases(gone []string, grace time.Duration) {
+	now := alloc.now()
+	suspects := make(map[string]time.Time)
+	for _, ident := range gone {
+		if _, found := alloc.owned[ident]; !found {
+			continue // freed in the meantime
+		}
+		since, found := alloc.leakSuspects[ident]
+		if !found {
+			since = now
+		}
+		if now.Sub(since) < grace {
+			suspects[ident] = since
+			continue
+		}
+		addrs := alloc.owned[ident]
+		alloc.infof("Freeing %d addresses leaked by %s, which has gone away", len(addrs), ident)
+		for _, addr := range addrs {
+			alloc.space.Free(addr)
+			alloc.auditAddress(auditFree, ident, addr)
+		}
+		delete(alloc.owned, ident)
+		alloc.reclaimed += len(addrs)
+	}
+	// Owners which have come back, or were freed, drop out
+	alloc.leakSuspects = suspects
+}
+
+// Number of addresses held by owners we believe have gone away
+func (alloc *Allocator) numLeaked() int {
+	leaked := 0
+	for ident := range alloc.leakSuspects {
+		leaked += len(alloc.owned[ident])
+	}
+	return leaked
+}
@@ -0,0 +1,169 @@
+package ipam
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/weaveworks/weave/ipam/paxos"
+	"github.com/weaveworks/weave/mesh"
+	"github.com/weaveworks/weave/net/address"
+)
+
+// Adding a range to the universe of a running cluster is agreed in
+// the same way the ring is first seeded: the peers run a round of
+// Paxos to choose the set of peers which will share the new range,
+// and then each of them extends its ring identically.  Only one
+// range is agreed at a time; others wait in a queue.
+
+type grow struct {
+	r     address.Range
+	paxos *paxos.Node
+}
+
+// Gossiped while a range is being added
+type growState struct {
+	Range address.Range
+	Paxos paxos.GossipState
+}
+
+// AddRange adds r to the universe of addresses available for
+// allocation.  It returns once the change has been proposed; it
+// takes effect when a quorum of peers has agreed to it. (Sync)
+func (alloc *Allocator) AddRange(r address.Range) error {
+	resultChan := make(chan error)
+	alloc.actionChan <- func() {
+		resultChan <- alloc.addRange(r)
+	}
+	return <-resultChan
+}
+
+func (alloc *Allocator) addRange(r address.Range) error {
+	if alloc.ring.Empty() {
+		return fmt.Errorf("Cannot add range %s before the allocator is initialized", r.AsCIDRString())
+	}
+	if alloc.ring.Overlaps(r) {
+		return fmt.Errorf("Range %s overlaps existing ranges %s", r.AsCIDRString(), rangesString(alloc.ring.Universe()))
+	}
+	pending := alloc.growQueue
+	if alloc.growing != nil {
+		pending = append([]address.Range{alloc.growing.r}, pending...)
+	}
+	for _, p := range pending {
+		if p.Overlaps(r) {
+			return fmt.Errorf("Range %s overlaps range %s which is being added", r.AsCIDRString(), p.AsCIDRString())
+		}
+	}
+	alloc.growQueue = append(alloc.growQueue, r)
+	alloc.startGrow()
+	return nil
+}
+
+// Start agreeing the next range in the queue, if we aren't busy
+func (alloc *Allocator) startGrow() {
+	for alloc.growing == nil && len(alloc.growQueue) > 0 {
+		r := alloc.growQueue[0]
+		alloc.growQueue = alloc.growQueue[1:]
+		if alloc.ring.Overlaps(r) {
+			// someone else added an overlapping range in the meantime
+			alloc.infof("Not adding range %s: overlaps %s", r.AsCIDRString(), rangesString(alloc.ring.Universe()))
+			continue
+		}
+		alloc.infof("Proposing to add range %s", r.AsCIDRString())
+		alloc.joinGrow(r)
+		alloc.proposeGrow()
+	}
+}
+
+func (alloc *Allocator) joinGrow(r address.Range) {
+	alloc.growing = &grow{r, paxos.NewNode(alloc.ourName, alloc.ourUID, alloc.quorum)}
+	// re-propose until we get consensus
+	alloc.growTicker = time.NewTicker(paxosInterval)
+}
+
+func (alloc *Allocator) stopGrow() {
+	alloc.growing = nil
+	if alloc.growTicker != nil {
+		alloc.growTicker.Stop()
+		alloc.growTicker = nil
+	}
+}
+
+func (alloc *Allocator) proposeGrow() {
+	alloc.debugf("Paxos proposing to add range %s", alloc.growing.r)
+	alloc.growing.paxos.Propose()
+	alloc.gossip.GossipBroadcast(alloc.Gossip())
+	alloc.checkGrowConsensus()
+}
+
+func (alloc *Allocator) checkGrowConsensus() {
+	ok, cons := alloc.growing.paxos.Consensus()
+	if !ok {
+		return
+	}
+	r := alloc.growing.r
+	alloc.debugln("Paxos consensus to add range", r, ":", cons.Value)
+	if err := alloc.ring.AddRange(r, normalizeConsensus(cons.Value)); err != nil {
+		alloc.infof("Unable to add range %s: %s", r.AsCIDRString(), err)
+		alloc.stopGrow()
+		alloc.startGrow()
+		return
+	}
+	alloc.infof("Added range %s", r.AsCIDRString())
+	alloc.gossip.GossipBroadcast(alloc.Gossip())
+	alloc.ringUpdated()
+}
+
+func rangeBefore(a, b address.Range) bool {
+	return a.Start < b.Start || (a.Start == b.Start && a.End < b.End)
+}
+
+func (alloc *Allocator) updateGrow(sender mesh.PeerName, theirs *growState) {
+	// Until we have a ring, we'll learn the outcome along with it
+	if alloc.ring.Empty() {
+		return
+	}
+	if alloc.ring.HasRange(theirs.Range) {
+		// Sender is still trying to add a range we already have;
+		// send our ring straight back
+		if sender != mesh.UnknownPeerName {
+			alloc.sendRingUpdate(sender)
+		}
+		return
+	}
+
+	if alloc.growing != nil && alloc.growing.r != theirs.Range {
+		if rangeBefore(alloc.growing.r, theirs.Range) {
+			// They will come round to ours
+			return
+		}
+		// Theirs goes first; ours goes back in the queue
+		alloc.growQueue = append([]address.Range{alloc.growing.r}, alloc.growQueue...)
+		alloc.stopGrow()
+	}
+	if alloc.growing == nil {
+		for i, r := range alloc.growQueue {
+			if r == theirs.Range {
+				alloc.growQueue = append(alloc.growQueue[:i], alloc.growQueue[i+1:]...)
+				break
+			}
+		}
+		alloc.joinGrow(theirs.Range)
+	}
+
+	if alloc.growing.paxos.Update(theirs.Paxos) {
+		if alloc.growing.paxos.Think() {
+			// If something important changed, broadcast
+			alloc.gossip.GossipBroadcast(alloc.Gossip())
+		}
+		alloc.checkGrowConsensus()
+	}
+}
+
+func rangesString(ranges []address.Range) string {
+	strs := make([]string, len(ranges))
+	for i, r := range ranges {
+		strs[i] = r.AsCIDRString()
+	}
+	return strings.Join(strs, ", ")
+}
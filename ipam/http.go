@@ -1,6 +1,7 @@
 package ipam
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 
@@ -29,19 +30,28 @@ func parseCIDR(w http.ResponseWriter, cidrStr string) (address.CIDR, bool) {
 	return cidr, true
 }
 
-func (alloc *Allocator) handleHTTPAllocate(dockerCli *docker.Client, w http.ResponseWriter, ident string, checkAlive bool, subnet address.CIDR) {
+// Allocate in subnet, or in pool if given
+func (alloc *Allocator) handleHTTPAllocate(dockerCli *docker.Client, w http.ResponseWriter, ident string, checkAlive bool, subnet address.CIDR, pool *Pool) {
 	closedChan := w.(http.CloseNotifier).CloseNotify()
-	addr, err := alloc.Allocate(ident, subnet.HostRange(),
-		func() bool {
-			select {
-			case <-closedChan:
-				return true
-			default:
-				res := checkAlive && dockerCli != nil && dockerCli.IsContainerNotRunning(ident)
-				checkAlive = false // we check only once; if the container dies later we learn about that through events
-				return res
-			}
-		})
+	hasBeenCancelled := func() bool {
+		select {
+		case <-closedChan:
+			return true
+		default:
+			res := checkAlive && dockerCli != nil && dockerCli.IsContainerNotRunning(ident)
+			checkAlive = false // we check only once; if the container dies later we learn about that through events
+			return res
+		}
+	}
+	var (
+		addr address.Address
+		err  error
+	)
+	if pool != nil {
+		addr, err = alloc.AllocateInPool(ident, pool, hasBeenCancelled)
+	} else {
+		addr, err = alloc.Allocate(ident, subnet.HostRange(), hasBeenCancelled)
+	}
 	if err != nil {
 		if _, ok := err.(*errorCancelled); ok { // cancellation is not really an error
 			common.Log.Infoln("[allocator]:", err.Error())
@@ -55,8 +65,101 @@ func (alloc *Allocator) handleHTTPAllocate(dockerCli *docker.Client, w http.Resp
 	fmt.Fprintf(w, "%s/%d", addr, subnet.PrefixLen)
 }
 
+func (alloc *Allocator) handleHTTPReserve(w http.ResponseWriter, name string, r address.Range) {
+	if err := alloc.Reserve(name, r); err != nil {
+		badRequest(w, fmt.Errorf("Unable to reserve: %s", err))
+		return
+	}
+	w.WriteHeader(204)
+}
+
 // HandleHTTP wires up ipams HTTP endpoints to the provided mux.
 func (alloc *Allocator) HandleHTTP(router *mux.Router, defaultSubnet address.CIDR, dockerCli *docker.Client) {
+	// Reservations come first, so they aren't taken for container ids
+	router.Methods("GET").Path("/ip/reserve").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reservations := make(map[string]string)
+		for name, r := range alloc.Reservations() {
+			reservations[name] = r.AsCIDRString()
+		}
+		if err := json.NewEncoder(w).Encode(reservations); err != nil {
+			badRequest(w, fmt.Errorf("Error marshalling response: %v", err))
+		}
+	})
+
+	router.Methods("PUT").Path("/ip/reserve/{name}/{ip}/{prefixlen}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		if cidr, ok := parseCIDR(w, vars["ip"]+"/"+vars["prefixlen"]); ok {
+			alloc.handleHTTPReserve(w, vars["name"], cidr.Range())
+		}
+	})
+
+	router.Methods("PUT").Path("/ip/reserve/{name}/{ip}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		if ip, err := address.ParseIP(vars["ip"]); err != nil {
+			badRequest(w, err)
+		} else {
+			alloc.handleHTTPReserve(w, vars["name"], address.NewRange(ip, 1))
+		}
+	})
+
+	router.Methods("DELETE").Path("/ip/reserve/{name}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := alloc.Unreserve(mux.Vars(r)["name"]); err != nil {
+			badRequest(w, err)
+			return
+		}
+		w.WriteHeader(204)
+	})
+
+	router.Methods("PUT").Path("/ip/range/{ip}/{prefixlen}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		if cidr, ok := parseCIDR(w, vars["ip"]+"/"+vars["prefixlen"]); ok {
+			if err := alloc.AddRange(cidr.Range()); err != nil {
+				badRequest(w, fmt.Errorf("Unable to add range: %s", err))
+				return
+			}
+			w.WriteHeader(204)
+		}
+	})
+
+	// Also before container ids; filtered by ident, addr, since and until
+	router.Methods("GET").Path("/ip/audit").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, err := parseAuditQuery(r)
+		if err != nil {
+			badRequest(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(alloc.Audit(query)); err != nil {
+			badRequest(w, fmt.Errorf("Error marshalling response: %v", err))
+		}
+	})
+
+	// Pools come before the general routes, so "pool" isn't taken for an address
+	router.Methods("GET").Path("/ip/{id}/pool/{pool}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		pool, err := alloc.Pool(vars["pool"])
+		if err != nil {
+			badRequest(w, err)
+			return
+		}
+		addr, err := alloc.Lookup(vars["id"], pool.Subnet.HostRange())
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, "%s/%d", addr, pool.Subnet.PrefixLen)
+	})
+
+	router.Methods("POST").Path("/ip/{id}/pool/{pool}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		pool, err := alloc.Pool(vars["pool"])
+		if err != nil {
+			badRequest(w, err)
+			return
+		}
+		alloc.handleHTTPAllocate(dockerCli, w, vars["id"], r.FormValue("check-alive") == "true", pool.Subnet, pool)
+	})
+
 	router.Methods("PUT").Path("/ip/{id}/{ip}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		ident := vars["id"]
@@ -97,13 +200,13 @@ func (alloc *Allocator) HandleHTTP(router *mux.Router, defaultSubnet address.CID
 	router.Methods("POST").Path("/ip/{id}/{ip}/{prefixlen}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		if subnet, ok := parseCIDR(w, vars["ip"]+"/"+vars["prefixlen"]); ok {
-			alloc.handleHTTPAllocate(dockerCli, w, vars["id"], r.FormValue("check-alive") == "true", subnet)
+			alloc.handleHTTPAllocate(dockerCli, w, vars["id"], r.FormValue("check-alive") == "true", subnet, nil)
 		}
 	})
 
 	router.Methods("POST").Path("/ip/{id}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
-		alloc.handleHTTPAllocate(dockerCli, w, vars["id"], r.FormValue("check-alive") == "true", defaultSubnet)
+		alloc.handleHTTPAllocate(dockerCli, w, vars["id"], r.FormValue("check-alive") == "true", defaultSubnet, nil)
 	})
 
 	router.Methods("DELETE").Path("/ip/{id}/{ip}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -1,6 +1,8 @@
 package ipam
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -182,3 +184,118 @@ func impTestHTTPCancel(t *testing.T) {
 		require.FailNow(t, "Error: Allocate returned non-nil")
 	}
 }
+
+func TestHTTPPools(t *testing.T) {
+	var (
+		container1 = "deadbeef"
+		container2 = "baddf00d"
+		container3 = "b01df00d"
+		universe   = "10.0.0.0/16"
+	)
+
+	alloc, _ := makeAllocator("08:00:27:01:c3:9a", universe, 1)
+	pool, err := ParsePool("acme=10.0.4.0/29,tenant=acme-corp,quota=2")
+	require.NoError(t, err)
+	require.NoError(t, alloc.AddPool(pool))
+	require.Error(t, alloc.AddPool(&Pool{Name: "acme", Subnet: pool.Subnet}), "duplicate pool")
+	_, err = ParsePool("bad=10.0.5.0/24,colour=blue")
+	require.Error(t, err)
+	alloc.SetInterfaces(&mockGossipComms{T: t, name: "08:00:27:01:c3:9a"})
+	alloc.Start()
+	defer alloc.Stop()
+	_, cidr, _ := address.ParseCIDR(universe)
+	port := listenHTTP(alloc, cidr)
+	alloc.claimRingForTesting()
+
+	poolURL := func(containerID, pool string) string {
+		return fmt.Sprintf("http://localhost:%d/ip/%s/pool/%s", port, containerID, pool)
+	}
+
+	// Pools can be named by tenant as well as by name; each change
+	// in usage is gossiped
+	ExpectBroadcastMessage(alloc, nil)
+	require.Equal(t, "10.0.4.1/29", HTTPPost(t, poolURL(container1, "acme")))
+	require.Equal(t, "10.0.4.1/29", HTTPGet(t, poolURL(container1, "acme-corp")))
+	ExpectBroadcastMessage(alloc, nil)
+	require.Equal(t, "10.0.4.2/29", HTTPPost(t, poolURL(container2, "acme-corp")))
+
+	resp, err := doHTTP("POST", poolURL(container3, "acme"))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode, "quota exhausted")
+	resp, err = doHTTP("POST", poolURL(container3, "nosuchpool"))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode, "unknown pool")
+
+	// The quota also applies to addresses in the pool's subnet asked
+	// for directly, and other allocations steer around it
+	resp, err = doHTTP("POST", allocURL(port, "10.0.4.0/29", container3))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode, "quota exhausted by subnet")
+	resp, err = doHTTP("PUT", fmt.Sprintf("http://localhost:%d/ip/%s/10.0.4.3", port, container3))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode, "quota exhausted by claim")
+	require.Equal(t, "10.0.4.8/28", HTTPPost(t, allocURL(port, "10.0.4.0/28", container3)))
+	doHTTP("DELETE", identURL(port, container3))
+
+	status := NewStatus(alloc, cidr)
+	require.Equal(t, []PoolStatus{{"acme", "10.0.4.0/29", "acme-corp", 2, 2}}, status.Pools)
+
+	// Freeing an address makes room again
+	ExpectBroadcastMessage(alloc, nil)
+	doHTTP("DELETE", identURL(port, container1))
+	ExpectBroadcastMessage(alloc, nil)
+	require.Equal(t, "10.0.4.1/29", HTTPPost(t, poolURL(container3, "acme")))
+	NewStatus(alloc, cidr)
+	CheckAllExpectedMessagesSent(alloc)
+}
+
+func TestHTTPAudit(t *testing.T) {
+	var (
+		container1 = "deadbeef"
+		container2 = "baddf00d"
+		universe   = "10.0.0.0/16"
+		testCIDR1  = "10.0.3.8/29"
+	)
+
+	alloc, _ := makeAllocator("08:00:27:01:c3:9a", universe, 1)
+	var logFile bytes.Buffer
+	alloc.SetAuditWriter(&logFile)
+	alloc.SetInterfaces(&mockGossipComms{T: t, name: "08:00:27:01:c3:9a"})
+	alloc.Start()
+	defer alloc.Stop()
+	_, cidr, _ := address.ParseCIDR(universe)
+	port := listenHTTP(alloc, cidr)
+	alloc.claimRingForTesting()
+
+	start := time.Now().Add(-time.Second).UTC()
+	require.Equal(t, "10.0.3.9/29", HTTPPost(t, allocURL(port, testCIDR1, container1)))
+	resp, err := doHTTP("PUT", fmt.Sprintf("http://localhost:%d/ip/%s/10.0.3.12", port, container2))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode, "claim")
+	doHTTP("DELETE", identURL(port, container1))
+
+	audit := func(query string) []AuditEvent {
+		var events []AuditEvent
+		require.NoError(t, json.Unmarshal([]byte(HTTPGet(t, fmt.Sprintf("http://localhost:%d/ip/audit?%s", port, query))), &events))
+		return events
+	}
+	events := audit("ident=" + container1)
+	require.Len(t, events, 2)
+	require.Equal(t, "allocate", events[0].Event)
+	require.Equal(t, "10.0.3.9", events[0].Address)
+	require.Equal(t, "free", events[1].Event)
+
+	events = audit("addr=10.0.3.12&since=" + start.Format(time.RFC3339))
+	require.Len(t, events, 1)
+	require.Equal(t, "claim", events[0].Event)
+	require.Equal(t, container2, events[0].Ident)
+
+	require.Len(t, audit("until="+start.Format(time.RFC3339)), 0)
+
+	resp, err = doHTTP("GET", fmt.Sprintf("http://localhost:%d/ip/audit?since=yesterday", port))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode, "bad time")
+
+	// Everything also went to the log file, one event per line
+	require.Equal(t, 3, strings.Count(logFile.String(), "\n"))
+}
@@ -0,0 +1,264 @@
+package ipam
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/weaveworks/weave/mesh"
+	"github.com/weaveworks/weave/net/address"
+)
+
+// Pool is a named subnet to allocate from, optionally belonging to a
+// tenant and limited to a number of addresses across all peers.  Each
+// peer gossips how many addresses it has handed out in each pool,
+// however they were asked for, and refuses any more once the total
+// reaches the quota.
+type Pool struct {
+	Name   string
+	Subnet address.CIDR
+	Tenant string
+	Quota  int // zero means unlimited
+}
+
+// Addresses a peer has handed out in each pool, by pool name.  Only
+// the peer itself changes its entry, bumping the version each time.
+type peerPoolUsage struct {
+	Version uint64
+	Used    map[string]int
+}
+
+// ParsePool parses a pool definition of the form
+// name=cidr[,tenant=label][,quota=n]
+func ParsePool(s string) (*Pool, error) {
+	parts := strings.Split(s, ",")
+	nameAndSubnet := strings.SplitN(parts[0], "=", 2)
+	if len(nameAndSubnet) != 2 || nameAndSubnet[0] == "" {
+		return nil, fmt.Errorf("invalid pool '%s': expected name=cidr", s)
+	}
+	subnetAddr, subnet, err := address.ParseCIDR(nameAndSubnet[1])
+	if err != nil {
+		return nil, err
+	}
+	if subnet.Start != subnetAddr {
+		return nil, fmt.Errorf("invalid pool subnet %s - bits after network prefix are not all zero", nameAndSubnet[1])
+	}
+	pool := &Pool{Name: nameAndSubnet[0], Subnet: subnet}
+	for _, option := range parts[1:] {
+		keyValue := strings.SplitN(option, "=", 2)
+		if len(keyValue) != 2 {
+			return nil, fmt.Errorf("invalid pool option '%s'", option)
+		}
+		switch keyValue[0] {
+		case "tenant":
+			pool.Tenant = keyValue[1]
+		case "quota":
+			if pool.Quota, err = strconv.Atoi(keyValue[1]); err != nil || pool.Quota < 0 {
+				return nil, fmt.Errorf("invalid pool quota '%s'", keyValue[1])
+			}
+		default:
+			return nil, fmt.Errorf("unknown pool option '%s'", keyValue[0])
+		}
+	}
+	return pool, nil
+}
+
+// AddPool makes a pool available for allocation.  Must be called
+// before Start.
+func (alloc *Allocator) AddPool(pool *Pool) error {
+	if !alloc.ring.Overlaps(pool.Subnet.Range()) {
+		return fmt.Errorf("pool %s subnet %s does not overlap with allocation range %s", pool.Name, pool.Subnet, rangesString(alloc.ring.Universe()))
+	}
+	for _, existing := range alloc.pools {
+		if existing.Name == pool.Name || (pool.Tenant != "" && existing.Tenant == pool.Tenant) {
+			return fmt.Errorf("pool %s clashes with pool %s", pool.Name, existing.Name)
+		}
+	}
+	alloc.pools = append(alloc.pools, pool)
+	return nil
+}
+
+// Pool finds a pool by name, or by tenant label
+func (alloc *Allocator) Pool(nameOrTenant string) (*Pool, error) {
+	for _, pool := range alloc.pools {
+		if pool.Name == nameOrTenant {
+			return pool, nil
+		}
+	}
+	for _, pool := range alloc.pools {
+		if pool.Tenant != "" && pool.Tenant == nameOrTenant {
+			return pool, nil
+		}
+	}
+	return nil, fmt.Errorf("no pool named %s", nameOrTenant)
+}
+
+// AllocateInPool allocates an address for ident from a pool, within
+// the pool's quota (Sync)
+func (alloc *Allocator) AllocateInPool(ident string, pool *Pool, hasBeenCancelled func() bool) (address.Address, error) {
+	return alloc.Allocate(ident, pool.Subnet.HostRange(), hasBeenCancelled)
+}
+
+func (pool *Pool) quotaError() error {
+	return fmt.Errorf("quota of %d addresses in pool %s exhausted", pool.Quota, pool.Name)
+}
+
+// Whether the peers have handed out as many addresses in pool as they
+// may, as far as we know
+func (alloc *Allocator) poolFull(pool *Pool) bool {
+	return pool.Quota > 0 && alloc.totalPoolUsage(pool) >= pool.Quota
+}
+
+// The full pool containing addr, if any
+func (alloc *Allocator) fullPoolContaining(addr address.Address) *Pool {
+	for _, pool := range alloc.pools {
+		if pool.Subnet.Range().Contains(addr) && alloc.poolFull(pool) {
+			return pool
+		}
+	}
+	return nil
+}
+
+// The parts of r we may allocate from, leaving out the subnets of full
+// pools.  If that leaves nothing, the error says which pool is full.
+func (alloc *Allocator) rangesWithinQuota(r address.Range) ([]address.Range, error) {
+	ranges := []address.Range{r}
+	var full *Pool
+	for _, pool := range alloc.pools {
+		if subnet := pool.Subnet.Range(); subnet.Overlaps(r) && alloc.poolFull(pool) {
+			ranges = subtractRange(ranges, subnet)
+			full = pool
+		}
+	}
+	if len(ranges) == 0 {
+		return nil, full.quotaError()
+	}
+	return ranges, nil
+}
+
+func subtractRange(ranges []address.Range, cut address.Range) []address.Range {
+	var result []address.Range
+	for _, r := range ranges {
+		if !r.Overlaps(cut) {
+			result = append(result, r)
+			continue
+		}
+		if r.Start < cut.Start {
+			result = append(result, address.Range{Start: r.Start, End: cut.Start})
+		}
+		if cut.End < r.End {
+			result = append(result, address.Range{Start: cut.End, End: r.End})
+		}
+	}
+	return result
+}
+
+// Number of addresses we have allocated in pool
+func (alloc *Allocator) localPoolUsage(pool *Pool) int {
+	r := pool.Subnet.HostRange()
+	used := 0
+	for _, addrs := range alloc.owned {
+		for _, addr := range addrs {
+			if r.Contains(addr) {
+				used++
+			}
+		}
+	}
+	return used
+}
+
+// Number of addresses allocated in pool by all peers in the ring, as
+// far as we have heard
+func (alloc *Allocator) totalPoolUsage(pool *Pool) int {
+	used := alloc.localPoolUsage(pool)
+	ringPeers := alloc.ring.PeerNames()
+	for peer, usage := range alloc.poolUsage {
+		if _, ok := ringPeers[peer]; ok && peer != alloc.ourName {
+			used += usage.Used[pool.Name]
+		}
+	}
+	return used
+}
+
+// Bring our entry in the pool usage up to date, telling the other
+// peers if it has changed.  Peers which allocate at the same time,
+// before hearing of each other's usage, may between them go over a
+// quota; we gossip straight away to keep that window small.
+func (alloc *Allocator) updatePoolUsage() {
+	if len(alloc.pools) == 0 {
+		return
+	}
+	ours := alloc.poolUsage[alloc.ourName]
+	changed := false
+	used := make(map[string]int)
+	for _, pool := range alloc.pools {
+		if n := alloc.localPoolUsage(pool); n > 0 {
+			used[pool.Name] = n
+		}
+		changed = changed || used[pool.Name] != ours.Used[pool.Name]
+	}
+	if !changed {
+		return
+	}
+	if alloc.poolUsage == nil {
+		alloc.poolUsage = make(map[mesh.PeerName]peerPoolUsage)
+	}
+	alloc.poolUsage[alloc.ourName] = peerPoolUsage{ours.Version + 1, used}
+	if !alloc.ring.Empty() {
+		alloc.gossip.GossipBroadcast(alloc.Gossip())
+	}
+}
+
+// Merge the pool usage gossiped by another peer, keeping the latest
+// version of each peer's entry
+func (alloc *Allocator) mergePoolUsage(usage map[mesh.PeerName]peerPoolUsage) {
+	if len(usage) == 0 {
+		return
+	}
+	if alloc.poolUsage == nil {
+		alloc.poolUsage = make(map[mesh.PeerName]peerPoolUsage)
+	}
+	for peer, theirs := range usage {
+		ours, found := alloc.poolUsage[peer]
+		switch {
+		case peer == alloc.ourName:
+			// Left over from before we restarted: carry on after it,
+			// so the others take our current usage
+			if theirs.Version > ours.Version || (theirs.Version == ours.Version && !sameUsage(theirs.Used, ours.Used)) {
+				alloc.poolUsage[peer] = peerPoolUsage{theirs.Version + 1, ours.Used}
+				alloc.gossip.GossipBroadcast(alloc.Gossip())
+			}
+		case !found || theirs.Version > ours.Version:
+			alloc.poolUsage[peer] = theirs
+		}
+	}
+}
+
+func sameUsage(a, b map[string]int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, n := range a {
+		if b[name] != n {
+			return false
+		}
+	}
+	return true
+}
+
+// For compatibility with sort.Interface
+type poolsByName []PoolStatus
+
+func (ps poolsByName) Len() int           { return len(ps) }
+func (ps poolsByName) Less(i, j int) bool { return ps[i].Name < ps[j].Name }
+func (ps poolsByName) Swap(i, j int)      { ps[i], ps[j] = ps[j], ps[i] }
+
+func newPoolStatusSlice(allocator *Allocator) []PoolStatus {
+	var slice []PoolStatus
+	for _, pool := range allocator.pools {
+		slice = append(slice, PoolStatus{pool.Name, pool.Subnet.String(), pool.Tenant, allocator.totalPoolUsage(pool), pool.Quota})
+	}
+	sort.Sort(poolsByName(slice))
+	return slice
+}
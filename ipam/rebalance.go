@@ -0,0 +1,97 @@
+package ipam
+
+import (
+	"math"
+	"time"
+
+	"github.com/weaveworks/weave/mesh"
+	"github.com/weaveworks/weave/net/address"
+)
+
+// Space normally only moves when a peer runs out.  To spread it
+// ahead of need, if asked to, every interval each peer compares its
+// free space, as reported in the ring, with its recent rate of
+// allocation; if it has less than the horizon's worth of intervals,
+// it asks the peer with the most free space for some, in the same
+// way as when it runs out.  At most one request is made per interval.
+
+// RebalanceConfig says how often to rebalance, and how far ahead
+type RebalanceConfig struct {
+	Interval time.Duration
+	Horizon  int // intervals' worth of allocations to keep free
+}
+
+type rebalancer struct {
+	ticker      *time.Ticker
+	horizon     int
+	allocations int     // since the last interval
+	rate        float64 // smoothed allocations per interval
+	requests    int     // requests for space made by the rebalancer
+	lastDonor   mesh.PeerName
+}
+
+type RebalanceStatus struct {
+	Rate      float64
+	Requests  int
+	LastDonor string
+}
+
+// StartRebalancing makes the allocator ask for space ahead of need,
+// as set out in config
+func (alloc *Allocator) StartRebalancing(config RebalanceConfig) {
+	alloc.actionChan <- func() {
+		alloc.rebalancer.horizon = config.Horizon
+		alloc.rebalancer.ticker = time.NewTicker(config.Interval)
+	}
+}
+
+func (alloc *Allocator) rebalance() {
+	rb := &alloc.rebalancer
+	rb.rate = (rb.rate + float64(rb.allocations)) / 2
+	rb.allocations = 0
+	if alloc.ring.Empty() || alloc.shuttingDown || alloc.takenOver {
+		return
+	}
+
+	want := address.Offset(math.Ceil(rb.rate * float64(rb.horizon)))
+	free := alloc.ring.FreeByPeer()
+	ourFree := free[alloc.ourName]
+	if ourFree >= want {
+		return
+	}
+
+	donor, donorFree := mesh.UnknownPeerName, address.Offset(0)
+	for peer, peerFree := range free {
+		if peer != alloc.ourName && peerFree > donorFree {
+			donor, donorFree = peer, peerFree
+		}
+	}
+	// Don't bother peers which are hardly better off than us; they
+	// would only ask for it back
+	if donorFree <= 2*ourFree {
+		return
+	}
+
+	// Ask for space where the donor has it, rather than across the
+	// gaps between ranges
+	r, _ := alloc.ring.MostFreeRange(donor)
+	alloc.debugf("Rebalancing: %d free, want %d; asking %s which has %d, for space in %s", ourFree, want, donor, donorFree, r)
+	if err := alloc.sendSpaceRequest(donor, r); err != nil {
+		alloc.debugln("Rebalancing: unable to ask", donor, "for space:", err)
+		return
+	}
+	rb.requests++
+	rb.lastDonor = donor
+}
+
+func newRebalanceStatus(allocator *Allocator) RebalanceStatus {
+	rb := allocator.rebalancer
+	status := RebalanceStatus{Rate: rb.rate, Requests: rb.requests}
+	if rb.lastDonor != mesh.UnknownPeerName {
+		status.LastDonor = rb.lastDonor.String()
+		if nickname, found := allocator.nicknames[rb.lastDonor]; found {
+			status.LastDonor += "(" + nickname + ")"
+		}
+	}
+	return status
+}
@@ -26,6 +26,10 @@ func (i _uint32) String() string {
 
 func (r *Ring) updateExportedVariables() {
 	ringName := r.Start.String()
-	expRingSize.Set(ringName, _uint32(r.End-r.Start))
+	var size uint32
+	for _, rng := range r.Universe() {
+		size += uint32(rng.Size())
+	}
+	expRingSize.Set(ringName, _uint32(size))
 	expRingEntries.Set(ringName, _int(len(r.Entries)))
 }
@@ -0,0 +1,99 @@
+package ring
+
+import (
+	"sort"
+
+	"github.com/weaveworks/weave/mesh"
+	"github.com/weaveworks/weave/net/address"
+)
+
+// Reservation is a named range of addresses which the allocator will
+// never hand out, though they may still be claimed explicitly.
+type Reservation struct {
+	Range     address.Range
+	Peer      mesh.PeerName // peer which made the latest change
+	Version   uint32
+	Tombstone bool
+}
+
+// reservations form a simple last-writer-wins map, gossiped along
+// with the ring.  Deleted reservations are kept as tombstones so that
+// they are not resurrected by peers which haven't heard yet.
+type reservations map[string]*Reservation
+
+// newer returns true if r2 should replace r1
+func (r1 *Reservation) newer(r2 *Reservation) bool {
+	if r1.Version != r2.Version {
+		return r2.Version > r1.Version
+	}
+	// Concurrent changes by different peers; pick one deterministically
+	return r2.Peer > r1.Peer
+}
+
+// Reserve records a reservation of range res under name, replacing
+// any previous reservation with that name.
+func (r *Ring) Reserve(name string, res address.Range) error {
+	if res.Start >= res.End || !r.Contains(res.Start) || !r.Contains(res.End-1) {
+		return ErrReservationOutOfRange
+	}
+	if r.Reservations == nil {
+		r.Reservations = make(reservations)
+	}
+	var version uint32
+	if existing, found := r.Reservations[name]; found {
+		version = existing.Version + 1
+	}
+	r.Reservations[name] = &Reservation{Range: res, Peer: r.Peer, Version: version}
+	return nil
+}
+
+// Unreserve removes the reservation with the given name.
+func (r *Ring) Unreserve(name string) error {
+	existing, found := r.Reservations[name]
+	if !found || existing.Tombstone {
+		return ErrNotFound
+	}
+	r.Reservations[name] = &Reservation{Range: existing.Range, Peer: r.Peer, Version: existing.Version + 1, Tombstone: true}
+	return nil
+}
+
+// Reserved returns the current reservations, indexed by name.
+func (r *Ring) Reserved() map[string]address.Range {
+	res := make(map[string]address.Range)
+	for name, reservation := range r.Reservations {
+		if !reservation.Tombstone {
+			res[name] = reservation.Range
+		}
+	}
+	return res
+}
+
+// ReservedRanges returns the ranges of all current reservations,
+// ordered by address; they may overlap.
+func (r *Ring) ReservedRanges() []address.Range {
+	var result []address.Range
+	for _, res := range r.Reserved() {
+		result = append(result, res)
+	}
+	sort.Sort(ranges(result))
+	return result
+}
+
+func (r *Ring) mergeReservations(gossip reservations) {
+	for name, theirs := range gossip {
+		if mine, found := r.Reservations[name]; !found || mine.newer(theirs) {
+			if r.Reservations == nil {
+				r.Reservations = make(reservations)
+			}
+			reservation := *theirs
+			r.Reservations[name] = &reservation
+		}
+	}
+}
+
+// For compatibility with sort.Interface
+type ranges []address.Range
+
+func (rs ranges) Len() int           { return len(rs) }
+func (rs ranges) Less(i, j int) bool { return rs[i].Start < rs[j].Start }
+func (rs ranges) Swap(i, j int)      { rs[i], rs[j] = rs[j], rs[i] }
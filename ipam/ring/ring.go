@@ -7,24 +7,38 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"math/rand"
 	"sort"
 	"time"
 
 	"github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/mesh"
 	"github.com/weaveworks/weave/net/address"
-	"github.com/weaveworks/weave/router"
 )
 
 // Ring represents the ring itself
 type Ring struct {
-	Start, End address.Address   // [min, max) tokens in this ring.  Due to wrapping, min == max (effectively)
-	Peer       router.PeerName   // name of peer owning this ring instance
-	Entries    entries           // list of entries sorted by token
-	Seeds      []router.PeerName // peers with which the ring was seeded
+	Start, End address.Address // [min, max) tokens in this ring.  Due to wrapping, min == max (effectively)
+	Peer       mesh.PeerName   // name of peer owning this ring instance
+	Entries    entries         // list of entries sorted by token
+	Seeds      []mesh.PeerName // peers with which the ring was seeded
+	Ranges     []address.Range // disjoint ranges making up [Start, End), in order; addresses between them belong to nobody
+
+	Reservations reservations    // named ranges excluded from allocation
+	Dead         []mesh.PeerName // peers whose ranges were taken over after they went away, in order
+
+	Version int // format of the ring; zero from peers which predate multiple ranges
 }
 
+// Rings from peers which predate multiple ranges know nothing of the
+// gaps between ranges, so those peers would take the gaps for space
+// belonging to whoever owns the token before.  We refuse to merge
+// their rings with ours once we have several ranges, and they never
+// get to see ours (see ipam.gossipState).
+const MultiRangeVersion = 1
+
 func (r *Ring) assertInvariants() {
 	err := r.checkInvariants()
 	if err != nil {
@@ -43,6 +57,11 @@ var (
 	ErrInvalidEntry    = errors.New("Received invalid state update!")
 	ErrEntryInMyRange  = errors.New("Received new entry in my range!")
 	ErrNotFound        = errors.New("No entries for peer found")
+	ErrTakenOver       = errors.New("Received ring in which my ranges were taken over!")
+
+	ErrReservationOutOfRange = errors.New("Reservation is not within the ring's range")
+	ErrRangeOverlaps         = errors.New("Range overlaps the ring's ranges")
+	ErrOldVersion            = errors.New("Received ring from a peer which does not support multiple ranges")
 )
 
 func (r *Ring) checkInvariants() error {
@@ -84,18 +103,121 @@ func (r *Ring) checkInvariants() error {
 }
 
 // New creates an empty ring belonging to peer.
-func New(start, end address.Address, peer router.PeerName) *Ring {
+func New(start, end address.Address, peer mesh.PeerName) *Ring {
 	common.Assert(start < end)
 
-	ring := &Ring{Start: start, End: end, Peer: peer, Entries: make([]*entry, 0)}
+	ring := &Ring{Start: start, End: end, Peer: peer, Entries: make([]*entry, 0),
+		Ranges: []address.Range{{Start: start, End: end}}, Version: MultiRangeVersion}
 	ring.updateExportedVariables()
 	return ring
 }
 
+// NewFromRanges creates an empty ring belonging to peer, made up of
+// several disjoint ranges.
+func NewFromRanges(ranges []address.Range, peer mesh.PeerName) *Ring {
+	common.Assert(len(ranges) > 0)
+	ring := New(ranges[0].Start, ranges[0].End, peer)
+	for _, r := range ranges[1:] {
+		common.Assert(ring.AddRange(r, nil) == nil)
+	}
+	return ring
+}
+
+// Range returns the smallest range covering the whole ring
 func (r *Ring) Range() address.Range {
 	return address.Range{Start: r.Start, End: r.End}
 }
 
+// Universe returns the ranges making up the ring, in order.
+func (r *Ring) Universe() []address.Range {
+	// Rings gossiped by older peers have just the one range
+	if len(r.Ranges) == 0 {
+		return []address.Range{r.Range()}
+	}
+	return r.Ranges
+}
+
+// HasRange returns true if rng is one of the ranges making up the ring
+func (r *Ring) HasRange(rng address.Range) bool {
+	for _, existing := range r.Universe() {
+		if existing == rng {
+			return true
+		}
+	}
+	return false
+}
+
+// Overlaps returns true if any of rng is in this ring
+func (r *Ring) Overlaps(rng address.Range) bool {
+	for _, existing := range r.Universe() {
+		if existing.Overlaps(rng) {
+			return true
+		}
+	}
+	return false
+}
+
+// AddRange extends the ring with rng, which must not overlap any of
+// its existing ranges.  If the ring has entries, rng is shared out
+// between peers in the same way ClaimForPeers does, so that every
+// peer doing the same for the same peers ends up with the same ring.
+func (r *Ring) AddRange(rng address.Range, peers []mesh.PeerName) error {
+	common.Assert(rng.Start < rng.End)
+	if r.Overlaps(rng) {
+		return ErrRangeOverlaps
+	}
+
+	r.assertInvariants()
+	defer r.assertInvariants()
+	defer r.updateExportedVariables()
+
+	r.setRanges(append(append([]address.Range{}, r.Universe()...), rng))
+	if !r.Empty() {
+		common.Assert(len(peers) > 0)
+		r.claimRange(rng, peers)
+		r.markGaps()
+	}
+	return nil
+}
+
+func (r *Ring) setRanges(rs []address.Range) {
+	sort.Sort(ranges(rs))
+	r.Ranges = rs
+	r.Start, r.End = rs[0].Start, rs[len(rs)-1].End
+}
+
+// Every gap between ranges starts with a token owned by nobody, so
+// that no peer's entry extends into it.
+func (r *Ring) markGaps() {
+	for i := 1; i < len(r.Ranges); i++ {
+		gap := r.Ranges[i-1].End
+		if gap == r.Ranges[i].Start {
+			continue
+		}
+		if _, found := r.Entries.get(gap); !found {
+			r.Entries.insert(entry{Token: gap, Peer: mesh.UnknownPeerName})
+		}
+	}
+}
+
+// Combine the ranges of two rings.  Each range must either appear in
+// both or overlap nothing in the other.
+func unionRanges(ours, theirs []address.Range) ([]address.Range, bool) {
+	result := append([]address.Range{}, ours...)
+outer:
+	for _, t := range theirs {
+		for _, o := range ours {
+			if o == t {
+				continue outer
+			} else if o.Overlaps(t) {
+				return nil, false
+			}
+		}
+		result = append(result, t)
+	}
+	return result, true
+}
+
 // Returns the distance between two tokens on this ring, dealing
 // with ranges which cross the origin
 func (r *Ring) distance(start, end address.Address) address.Offset {
@@ -111,7 +233,7 @@ func (r *Ring) distance(start, end address.Address) address.Offset {
 // Preconditions:
 // - start < end
 // - [start, end) must be owned by the calling peer
-func (r *Ring) GrantRangeToHost(start, end address.Address, peer router.PeerName) {
+func (r *Ring) GrantRangeToHost(start, end address.Address, peer mesh.PeerName) {
 	//fmt.Printf("%s GrantRangeToHost [%v,%v) -> %s\n", r.Peer, start, end, peer)
 
 	r.assertInvariants()
@@ -190,6 +312,11 @@ func (r *Ring) Merge(gossip Ring) error {
 		return err
 	}
 
+	dead := mergePeerNames(r.Dead, gossip.Dead)
+	if hasPeerName(dead, r.Peer) {
+		return ErrTakenOver
+	}
+
 	if len(gossip.Seeds) > 0 && len(r.Seeds) > 0 {
 		if len(gossip.Seeds) != len(r.Seeds) {
 			return ErrDifferentSeeds
@@ -201,7 +328,13 @@ func (r *Ring) Merge(gossip Ring) error {
 		}
 	}
 
-	if r.Start != gossip.Start || r.End != gossip.End {
+	universe, ok := unionRanges(r.Universe(), gossip.Universe())
+	if len(universe) > 1 && gossip.Version < MultiRangeVersion {
+		return ErrOldVersion
+	}
+	if !ok || (r.Empty() && len(universe) > len(gossip.Universe())) {
+		// Ranges with no entries in a non-empty ring would be
+		// taken to belong to whoever owns the preceding token
 		return ErrDifferentRange
 	}
 
@@ -210,7 +343,7 @@ func (r *Ring) Merge(gossip Ring) error {
 	addToResult := func(e entry) { result = append(result, &e) }
 
 	var mine, theirs *entry
-	var previousOwner *router.PeerName
+	var previousOwner *mesh.PeerName
 	// i is index into r.Entries; j is index into gossip.Entries
 	var i, j int
 	for i < len(r.Entries) && j < len(gossip.Entries) {
@@ -222,7 +355,7 @@ func (r *Ring) Merge(gossip Ring) error {
 			i++
 		case mine.Token > theirs.Token:
 			// insert, checking that a range owned by us hasn't been split
-			if previousOwner != nil && *previousOwner == r.Peer && theirs.Peer != r.Peer {
+			if previousOwner != nil && *previousOwner == r.Peer && theirs.Peer != r.Peer && r.Contains(theirs.Token) {
 				return ErrEntryInMyRange
 			}
 			addToResult(*theirs)
@@ -231,6 +364,14 @@ func (r *Ring) Merge(gossip Ring) error {
 		case mine.Token == theirs.Token:
 			// merge
 			switch {
+			case hasPeerName(dead, theirs.Peer) && !hasPeerName(dead, mine.Peer):
+				// whatever a dead peer did after its ranges were
+				// taken over doesn't count
+				addToResult(*mine)
+				previousOwner = &mine.Peer
+			case hasPeerName(dead, mine.Peer) && !hasPeerName(dead, theirs.Peer):
+				addToResult(*theirs)
+				previousOwner = nil
 			case mine.Version >= theirs.Version:
 				if mine.Version == theirs.Version && !mine.Equal(theirs) {
 					common.Log.Debugf("Error merging entries at %s - %v != %v", mine.Token, mine, theirs)
@@ -260,7 +401,7 @@ func (r *Ring) Merge(gossip Ring) error {
 
 	for ; j < len(gossip.Entries); j++ {
 		theirs = gossip.Entries[j]
-		if previousOwner != nil && *previousOwner == r.Peer && theirs.Peer != r.Peer {
+		if previousOwner != nil && *previousOwner == r.Peer && theirs.Peer != r.Peer && r.Contains(theirs.Token) {
 			return ErrEntryInMyRange
 		}
 		addToResult(*theirs)
@@ -270,7 +411,10 @@ func (r *Ring) Merge(gossip Ring) error {
 	if len(r.Seeds) == 0 {
 		r.Seeds = gossip.Seeds
 	}
+	r.setRanges(universe)
 	r.Entries = result
+	r.Dead = dead
+	r.mergeReservations(gossip.Reservations)
 	return nil
 }
 
@@ -316,17 +460,46 @@ func (r *Ring) OwnedRanges() (result []address.Range) {
 	return r.splitRangesOverZero(result)
 }
 
+// Digest returns a hash of everything in the ring, which changes
+// whenever the ring does.
+func (r *Ring) Digest() uint64 {
+	h := fnv.New64a()
+	fmt.Fprint(h, r.Start, r.End, r.Seeds, r.Ranges, r.Dead)
+	for _, entry := range r.Entries {
+		fmt.Fprint(h, *entry)
+	}
+	names := make([]string, 0, len(r.Reservations))
+	for name := range r.Reservations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprint(h, name, *r.Reservations[name])
+	}
+	return h.Sum64()
+}
+
 // ClaimForPeers claims the entire ring for the array of peers passed
 // in.  Only works for empty rings.
-func (r *Ring) ClaimForPeers(peers []router.PeerName) {
+func (r *Ring) ClaimForPeers(peers []mesh.PeerName) {
 	common.Assert(r.Empty())
 	defer r.assertInvariants()
 	defer r.updateExportedVariables()
 
-	totalSize := r.distance(r.Start, r.End)
+	for _, rng := range r.Universe() {
+		r.claimRange(rng, peers)
+	}
+	r.markGaps()
+
+	r.Seeds = peers
+}
+
+// Divide rng evenly between peers
+func (r *Ring) claimRange(rng address.Range, peers []mesh.PeerName) {
+	totalSize := rng.Size()
 	share := totalSize/address.Offset(len(peers)) + 1
 	remainder := totalSize % address.Offset(len(peers))
-	pos := r.Start
+	pos := rng.Start
 
 	for i, peer := range peers {
 		if address.Offset(i) == remainder {
@@ -345,12 +518,10 @@ func (r *Ring) ClaimForPeers(peers []router.PeerName) {
 		pos += address.Address(share)
 	}
 
-	common.Assert(pos == r.End)
-
-	r.Seeds = peers
+	common.Assert(pos == rng.End)
 }
 
-func (r *Ring) FprintWithNicknames(w io.Writer, m map[router.PeerName]string) {
+func (r *Ring) FprintWithNicknames(w io.Writer, m map[mesh.PeerName]string) {
 	for _, entry := range r.Entries {
 		nickname, found := m[entry.Peer]
 		if found {
@@ -365,7 +536,7 @@ func (r *Ring) FprintWithNicknames(w io.Writer, m map[router.PeerName]string) {
 func (r *Ring) String() string {
 	var buffer bytes.Buffer
 	fmt.Fprintf(&buffer, "Ring [%s, %s)", r.Start, r.End)
-	r.FprintWithNicknames(&buffer, make(map[router.PeerName]string))
+	r.FprintWithNicknames(&buffer, make(map[mesh.PeerName]string))
 	return buffer.String()
 }
 
@@ -415,7 +586,7 @@ func (r *Ring) ReportFree(freespace map[address.Address]address.Offset) {
 
 type weightedPeer struct {
 	weight   float64
-	peername router.PeerName
+	peername mesh.PeerName
 }
 type weightedPeers []weightedPeer
 
@@ -426,10 +597,10 @@ func (ws weightedPeers) Swap(i, j int)      { ws[i], ws[j] = ws[j], ws[i] }
 
 // ChoosePeersToAskForSpace returns all peers we can ask for space in
 // the range [start, end), in weighted-random order.  Assumes start<end.
-func (r *Ring) ChoosePeersToAskForSpace(start, end address.Address) []router.PeerName {
+func (r *Ring) ChoosePeersToAskForSpace(start, end address.Address) []mesh.PeerName {
 	var (
 		sum               address.Offset
-		totalSpacePerPeer = make(map[router.PeerName]address.Offset) // Compute total free space per peer
+		totalSpacePerPeer = make(map[mesh.PeerName]address.Offset) // Compute total free space per peer
 	)
 
 	// iterate through tokens
@@ -463,25 +634,62 @@ func (r *Ring) ChoosePeersToAskForSpace(start, end address.Address) []router.Pee
 		ws = append(ws, weightedPeer{weight: float64(space) * rand.Float64(), peername: peername})
 	}
 	sort.Sort(ws)
-	result := make([]router.PeerName, len(ws))
+	result := make([]mesh.PeerName, len(ws))
 	for i, wp := range ws {
 		result[i] = wp.peername
 	}
 	return result
 }
 
-func (r *Ring) PickPeerForTransfer() router.PeerName {
+// FreeByPeer returns the free space reported by each peer, including
+// ourselves
+func (r *Ring) FreeByPeer() map[mesh.PeerName]address.Offset {
+	res := make(map[mesh.PeerName]address.Offset)
 	for _, entry := range r.Entries {
-		if entry.Peer != r.Peer {
+		if entry.Peer != mesh.UnknownPeerName {
+			res[entry.Peer] += entry.Free
+		}
+	}
+	return res
+}
+
+// MostFreeRange returns the range of the ring in which peer reports
+// the most free space, and how much that is
+func (r *Ring) MostFreeRange(peer mesh.PeerName) (address.Range, address.Offset) {
+	universe := r.Universe()
+	free := make([]address.Offset, len(universe))
+	for _, entry := range r.Entries {
+		if entry.Peer != peer {
+			continue
+		}
+		i := sort.Search(len(universe), func(i int) bool {
+			return universe[i].End > entry.Token
+		})
+		if i < len(universe) {
+			free[i] += entry.Free
+		}
+	}
+	best := 0
+	for i := range free {
+		if free[i] > free[best] {
+			best = i
+		}
+	}
+	return universe[best], free[best]
+}
+
+func (r *Ring) PickPeerForTransfer() mesh.PeerName {
+	for _, entry := range r.Entries {
+		if entry.Peer != r.Peer && entry.Peer != mesh.UnknownPeerName {
 			return entry.Peer
 		}
 	}
-	return router.UnknownPeerName
+	return mesh.UnknownPeerName
 }
 
 // Transfer will mark all entries associated with 'from' peer as owned by 'to' peer
 // and return ranges indicating the new space we picked up
-func (r *Ring) Transfer(from, to router.PeerName) ([]address.Range, error) {
+func (r *Ring) Transfer(from, to mesh.PeerName) ([]address.Range, error) {
 	r.assertInvariants()
 	defer r.assertInvariants()
 	defer r.updateExportedVariables()
@@ -505,19 +713,55 @@ func (r *Ring) Transfer(from, to router.PeerName) ([]address.Range, error) {
 	return r.splitRangesOverZero(newRanges), nil
 }
 
+// TakeOver transfers the entries of a peer which has gone away, like
+// Transfer, and marks it dead so that anything it says about them if
+// it comes back is ignored.
+func (r *Ring) TakeOver(dead, to mesh.PeerName) ([]address.Range, error) {
+	newRanges, err := r.Transfer(dead, to)
+	if err == nil {
+		r.Dead = mergePeerNames(r.Dead, []mesh.PeerName{dead})
+	}
+	return newRanges, err
+}
+
+func hasPeerName(names []mesh.PeerName, name mesh.PeerName) bool {
+	i := sort.Search(len(names), func(i int) bool { return names[i] >= name })
+	return i < len(names) && names[i] == name
+}
+
+// Union of two ordered lists of peer names
+func mergePeerNames(a, b []mesh.PeerName) []mesh.PeerName {
+	var result []mesh.PeerName
+	for len(a) > 0 || len(b) > 0 {
+		switch {
+		case len(b) == 0 || (len(a) > 0 && a[0] < b[0]):
+			result, a = append(result, a[0]), a[1:]
+		case len(a) == 0 || b[0] < a[0]:
+			result, b = append(result, b[0]), b[1:]
+		default:
+			result, a, b = append(result, a[0]), a[1:], b[1:]
+		}
+	}
+	return result
+}
+
 // Contains returns true if addr is in this ring
 func (r *Ring) Contains(addr address.Address) bool {
-	return addr >= r.Start && addr < r.End
+	universe := r.Universe()
+	i := sort.Search(len(universe), func(i int) bool {
+		return universe[i].End > addr
+	})
+	return i < len(universe) && universe[i].Contains(addr)
 }
 
 // Owner returns the peername which owns the range containing addr
-func (r *Ring) Owner(token address.Address) router.PeerName {
+func (r *Ring) Owner(token address.Address) mesh.PeerName {
 	common.Assert(r.Start <= token && token < r.End)
 
 	r.assertInvariants()
 	// There can be no owners on an empty ring
 	if r.Empty() {
-		return router.UnknownPeerName
+		return mesh.UnknownPeerName
 	}
 
 	// Look for the right-most entry, less than or equal to token
@@ -530,11 +774,13 @@ func (r *Ring) Owner(token address.Address) router.PeerName {
 }
 
 // Get the set of PeerNames mentioned in the ring
-func (r *Ring) PeerNames() map[router.PeerName]struct{} {
-	res := make(map[router.PeerName]struct{})
+func (r *Ring) PeerNames() map[mesh.PeerName]struct{} {
+	res := make(map[mesh.PeerName]struct{})
 
 	for _, entry := range r.Entries {
-		res[entry.Peer] = struct{}{}
+		if entry.Peer != mesh.UnknownPeerName {
+			res[entry.Peer] = struct{}{}
+		}
 	}
 
 	return res
@@ -9,14 +9,14 @@ import (
 
 	"github.com/stretchr/testify/require"
 	"github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/mesh"
 	"github.com/weaveworks/weave/net/address"
-	"github.com/weaveworks/weave/router"
 )
 
 var (
-	peer1name, _ = router.PeerNameFromString("01:00:00:00:02:00")
-	peer2name, _ = router.PeerNameFromString("02:00:00:00:02:00")
-	peer3name, _ = router.PeerNameFromString("03:00:00:00:02:00")
+	peer1name, _ = mesh.PeerNameFromString("01:00:00:00:02:00")
+	peer2name, _ = mesh.PeerNameFromString("02:00:00:00:02:00")
+	peer3name, _ = mesh.PeerNameFromString("03:00:00:00:02:00")
 
 	start, end    = ParseIP("10.0.0.0"), ParseIP("10.0.0.255")
 	dot10, dot245 = ParseIP("10.0.0.10"), ParseIP("10.0.0.245")
@@ -351,7 +351,7 @@ func TestGossip(t *testing.T) {
 	assertRing(ring2, []*entry{{Token: start, Peer: peer1name, Free: 255}})
 }
 
-func assertPeersWithSpace(t *testing.T, ring *Ring, start, end address.Address, expected int) []router.PeerName {
+func assertPeersWithSpace(t *testing.T, ring *Ring, start, end address.Address, expected int) []mesh.PeerName {
 	peers := ring.ChoosePeersToAskForSpace(start, end)
 	require.Equal(t, expected, len(peers))
 	return peers
@@ -375,7 +375,7 @@ func TestFindFree(t *testing.T) {
 	ring1.assertInvariants()
 
 	// We should return others
-	var peers []router.PeerName
+	var peers []mesh.PeerName
 
 	ring1.Entries = []*entry{{Token: start, Peer: peer2name, Free: 1}}
 	peers = assertPeersWithSpace(t, ring1, start, end, 1)
@@ -488,12 +488,42 @@ func TestTransfer(t *testing.T) {
 	require.Equal(t, []address.Range{{start, dot10}, {middle, end}}, ring1.OwnedRanges())
 }
 
+func TestTakeOver(t *testing.T) {
+	ring1 := New(start, end, peer1name)
+	ring2 := New(start, end, peer2name)
+	ring3 := New(start, end, peer3name)
+	ring1.ClaimItAll()
+	ring1.GrantRangeToHost(middle, end, peer2name)
+	require.NoError(t, ring2.Merge(*ring1))
+	require.NoError(t, ring3.Merge(*ring1))
+
+	// peer2 carries on without the others hearing, then is taken over
+	ring2.ReportFree(map[address.Address]address.Offset{middle: 10})
+	ring2.ReportFree(map[address.Address]address.Offset{middle: 5})
+	_, err := ring1.TakeOver(peer2name, peer1name)
+	require.NoError(t, err)
+	require.Equal(t, []mesh.PeerName{peer2name}, ring1.Dead)
+
+	// peer2's later versions don't win against the takeover
+	require.NoError(t, ring3.Merge(*ring2))
+	require.Equal(t, peer2name, ring3.Owner(middle))
+	require.NoError(t, ring3.Merge(*ring1))
+	require.Equal(t, peer1name, ring3.Owner(middle))
+	require.NoError(t, ring3.Merge(*ring2))
+	require.Equal(t, peer1name, ring3.Owner(middle))
+	require.NoError(t, ring1.Merge(*ring2))
+	require.Equal(t, peer1name, ring1.Owner(middle))
+
+	// and peer2 finds out
+	require.Equal(t, ErrTakenOver, ring2.Merge(*ring3))
+}
+
 func TestOwner(t *testing.T) {
 	ring1 := New(start, end, peer1name)
 	require.True(t, ring1.Contains(start), "start should be in ring")
 	require.False(t, ring1.Contains(end), "end should not be in ring")
 
-	require.Equal(t, router.UnknownPeerName, ring1.Owner(start))
+	require.Equal(t, mesh.UnknownPeerName, ring1.Owner(start))
 
 	ring1.ClaimItAll()
 	ring1.GrantRangeToHost(middle, end, peer2name)
@@ -517,9 +547,9 @@ func TestFuzzRing(t *testing.T) {
 		iterations = 1000
 	)
 
-	peers := make([]router.PeerName, numPeers)
+	peers := make([]mesh.PeerName, numPeers)
 	for i := 0; i < numPeers; i++ {
-		peer, _ := router.PeerNameFromString(fmt.Sprintf("%02d:00:00:00:02:00", i))
+		peer, _ := mesh.PeerNameFromString(fmt.Sprintf("%02d:00:00:00:02:00", i))
 		peers[i] = peer
 	}
 
@@ -601,13 +631,13 @@ func TestFuzzRingHard(t *testing.T) {
 	var (
 		numPeers   = 100
 		iterations = 3000
-		peers      []router.PeerName
+		peers      []mesh.PeerName
 		rings      []*Ring
 		nextPeerID = 0
 	)
 
 	addPeer := func() {
-		peer, _ := router.PeerNameFromString(fmt.Sprintf("%02d:%02d:00:00:00:00", nextPeerID/10, nextPeerID%10))
+		peer, _ := mesh.PeerNameFromString(fmt.Sprintf("%02d:%02d:00:00:00:00", nextPeerID/10, nextPeerID%10))
 		common.Log.Debugf("%s: Adding peer", peer)
 		nextPeerID++
 		peers = append(peers, peer)
@@ -620,7 +650,7 @@ func TestFuzzRingHard(t *testing.T) {
 
 	rings[0].ClaimItAll()
 
-	randomPeer := func(exclude int) (int, router.PeerName, *Ring) {
+	randomPeer := func(exclude int) (int, mesh.PeerName, *Ring) {
 		var peerIndex int
 		if exclude >= 0 {
 			peerIndex = rand.Intn(len(peers) - 1)
@@ -729,7 +759,7 @@ func TestFuzzRingHard(t *testing.T) {
 }
 
 func (r *Ring) ClaimItAll() {
-	r.ClaimForPeers([]router.PeerName{r.Peer})
+	r.ClaimForPeers([]mesh.PeerName{r.Peer})
 }
 
 func (es entries) String() string {
@@ -744,3 +774,124 @@ func (es entries) String() string {
 	fmt.Fprintf(&buffer, "]")
 	return buffer.String()
 }
+
+func TestReservations(t *testing.T) {
+	ring1 := New(start, end, peer1name)
+	ring2 := New(start, end, peer2name)
+	ring1.ClaimItAll()
+
+	require.Equal(t, ErrReservationOutOfRange, ring1.Reserve("bad", address.NewRange(dot250, 10)))
+	require.NoError(t, ring1.Reserve("gateway", address.NewRange(dot10, 1)))
+	require.NoError(t, ring1.Reserve("static", address.Range{Start: middle, End: dot245}))
+	require.NoError(t, ring2.Merge(*ring1))
+	require.Equal(t, []address.Range{{Start: dot10, End: dot10 + 1}, {Start: middle, End: dot245}}, ring2.ReservedRanges())
+
+	// Concurrent changes converge on the same answer
+	require.NoError(t, ring1.Reserve("gateway", address.NewRange(dot10+1, 1)))
+	require.NoError(t, ring2.Unreserve("gateway"))
+	require.NoError(t, ring2.Merge(*ring1))
+	require.NoError(t, ring1.Merge(*ring2))
+	require.Equal(t, ring1.Reserved(), ring2.Reserved())
+	require.Equal(t, map[string]address.Range{"static": {Start: middle, End: dot245}}, ring1.Reserved())
+
+	// Deletion sticks when merging older state
+	ring3 := New(start, end, peer3name)
+	ring3.Reservations = reservations{"static": {Range: address.Range{Start: middle, End: dot245}, Peer: peer1name}}
+	require.NoError(t, ring1.Unreserve("static"))
+	require.Equal(t, ErrNotFound, ring1.Unreserve("static"))
+	require.NoError(t, ring1.Merge(*ring3))
+	require.Len(t, ring1.Reserved(), 0)
+}
+
+func TestMultipleRanges(t *testing.T) {
+	var (
+		range1 = address.Range{Start: ParseIP("10.0.0.0"), End: ParseIP("10.0.1.0")}
+		range2 = address.Range{Start: ParseIP("10.0.4.0"), End: ParseIP("10.0.5.0")}
+		range3 = address.Range{Start: ParseIP("10.0.2.0"), End: ParseIP("10.0.3.0")}
+		range4 = address.Range{Start: ParseIP("10.0.8.0"), End: ParseIP("10.0.9.0")}
+	)
+	ring1 := NewFromRanges([]address.Range{range1, range2}, peer1name)
+	ring2 := NewFromRanges([]address.Range{range1, range2}, peer2name)
+	ring1.ClaimForPeers([]mesh.PeerName{peer1name, peer2name})
+	ring2.ClaimForPeers([]mesh.PeerName{peer1name, peer2name})
+	require.Equal(t, ring1.Entries, ring2.Entries)
+
+	// Addresses between the ranges belong to nobody
+	require.False(t, ring1.Contains(ParseIP("10.0.2.0")))
+	require.Equal(t, mesh.UnknownPeerName, ring1.Owner(ParseIP("10.0.2.0")))
+	require.Equal(t, []address.Range{{Start: range1.Start, End: range1.Start + 128}, {Start: range2.Start, End: range2.Start + 128}}, ring1.OwnedRanges())
+	require.Equal(t, []mesh.PeerName{peer2name}, ring1.ChoosePeersToAskForSpace(range1.Start, range2.End))
+	require.Equal(t, peer2name, ring1.PickPeerForTransfer())
+
+	// Grow into the gap, and beyond the end, on one peer
+	require.Equal(t, ErrRangeOverlaps, ring1.AddRange(address.NewRange(range1.End-1, 2), []mesh.PeerName{peer1name}))
+	require.NoError(t, ring1.AddRange(range3, []mesh.PeerName{peer1name, peer2name}))
+	require.NoError(t, ring1.AddRange(range4, []mesh.PeerName{peer1name}))
+	require.Equal(t, peer1name, ring1.Owner(range4.Start))
+	require.Equal(t, []address.Range{range1, range3, range2, range4}, ring1.Universe())
+
+	// ... and the other peer picks it all up by gossip
+	require.NoError(t, ring2.Merge(*ring1))
+	require.Equal(t, ring1.Universe(), ring2.Universe())
+	require.Equal(t, ring1.Entries, ring2.Entries)
+	require.Equal(t, []address.Range{{Start: range1.Start + 128, End: range1.End}, {Start: range3.Start + 128, End: range3.End}, {Start: range2.Start + 128, End: range2.End}}, ring2.OwnedRanges())
+
+	// Free space is found within a range, not across the gaps
+	rng, free := ring2.MostFreeRange(peer1name)
+	require.Equal(t, range4, rng)
+	require.Equal(t, address.Offset(256), free)
+	ring2.ReportFree(map[address.Address]address.Offset{range1.Start + 128: 10, range3.Start + 128: 100, range2.Start + 128: 20})
+	rng, free = ring2.MostFreeRange(peer2name)
+	require.Equal(t, range3, rng)
+	require.Equal(t, address.Offset(100), free)
+
+	// Ranges which partially overlap cannot be merged
+	ring3 := New(range1.Start, range1.End+1, peer3name)
+	require.Equal(t, ErrDifferentRange, ring1.Merge(*ring3))
+
+	// Nor can an empty ring with a range the other doesn't have
+	ring4 := NewFromRanges([]address.Range{range1, range4}, peer3name)
+	ring5 := New(range1.Start, range1.End, peer1name)
+	ring5.ClaimItAll()
+	require.Equal(t, ErrDifferentRange, ring4.Merge(*ring5))
+
+	// Contains holds for every range, and nothing between them
+	for _, rng := range ring1.Universe() {
+		require.True(t, ring1.Contains(rng.Start))
+		require.True(t, ring1.Contains(rng.End-1))
+	}
+	require.False(t, ring1.Contains(range1.Start-1))
+	require.False(t, ring1.Contains(ParseIP("10.0.6.0")))
+	require.False(t, ring1.Contains(range4.End))
+}
+
+func TestMergeOlderVersion(t *testing.T) {
+	var (
+		range1 = address.Range{Start: ParseIP("10.0.0.0"), End: ParseIP("10.0.1.0")}
+		range2 = address.Range{Start: ParseIP("10.0.4.0"), End: ParseIP("10.0.5.0")}
+	)
+
+	// A ring from a peer which predates multiple ranges, holding
+	// half of range1
+	old := New(range1.Start, range1.End, peer2name)
+	old.ClaimForPeers([]mesh.PeerName{peer1name, peer2name})
+	old.Ranges, old.Version = nil, 0
+
+	// merges as before with a ring of the same range
+	ring1 := New(range1.Start, range1.End, peer1name)
+	require.NoError(t, ring1.Merge(*old))
+	require.Equal(t, old.Entries, ring1.Entries)
+
+	// but not with one of several ranges, from the start or once
+	// grown
+	ring2 := NewFromRanges([]address.Range{range1, range2}, peer3name)
+	require.Equal(t, ErrOldVersion, ring2.Merge(*old))
+	require.True(t, ring2.Empty())
+	require.NoError(t, ring1.AddRange(range2, []mesh.PeerName{peer1name}))
+	require.Equal(t, ErrOldVersion, ring1.Merge(*old))
+
+	// Peers of this version merge either way
+	ring3 := New(range1.Start, range1.End, peer3name)
+	require.NoError(t, ring3.Merge(*ring1))
+	require.Equal(t, ring1.Universe(), ring3.Universe())
+}
@@ -0,0 +1,87 @@
+package ipam
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/weaveworks/weave/mesh"
+)
+
+// Agreeing on the ring with Paxos needs every peer to know roughly
+// how many peers there will be.  Instead, the ring can be seeded by
+// a list of peers given to everyone at launch, in which case nobody
+// needs a count: the seeds create the ring between them, and
+// everyone else waits to be told about it.  A peer can also be an
+// observer, which waits to be told about the ring however it is
+// created.
+
+// SeedWith makes the ring be created for seed, without consulting
+// other peers.  Must be called before Start.
+func (alloc *Allocator) SeedWith(seed []mesh.PeerName) {
+	alloc.seed = normalizeConsensus(seed)
+	alloc.paxos = nil
+	alloc.observer = !alloc.isSeed()
+}
+
+// Observe makes this peer wait to learn of the ring from others,
+// instead of taking part in its creation.  Must be called before
+// Start.
+func (alloc *Allocator) Observe() {
+	alloc.paxos = nil
+	alloc.observer = true
+}
+
+func (alloc *Allocator) isSeed() bool {
+	for _, peer := range alloc.seed {
+		if peer == alloc.ourName {
+			return true
+		}
+	}
+	return false
+}
+
+// Ask peers which have a ring to send it to us, and keep asking
+// until one does; or, if we are a seed and nobody answers, create it
+func (alloc *Allocator) waitForRing() {
+	alloc.gossip.GossipBroadcast(alloc.Gossip())
+	alloc.waitTicker = time.NewTicker(paxosInterval)
+}
+
+func (alloc *Allocator) waitedForRing() {
+	if !alloc.ring.Empty() {
+		return
+	}
+	if alloc.isSeed() {
+		alloc.infof("Nobody else has a ring; creating it for seed peers %v", alloc.annotatePeernames(alloc.seed))
+		alloc.createRing(alloc.seed)
+		return
+	}
+	alloc.debugln("Still waiting to hear of the ring from other peers")
+	alloc.gossip.GossipBroadcast(alloc.Gossip())
+}
+
+func (alloc *Allocator) stopWaitingForRing() {
+	if alloc.waitTicker != nil {
+		alloc.waitTicker.Stop()
+		alloc.waitTicker = nil
+	}
+}
+
+// Check a ring we've been told about was seeded the way we were told
+func (alloc *Allocator) checkSeeds(seeds []mesh.PeerName) error {
+	if len(alloc.seed) == 0 || len(seeds) == 0 || !alloc.ring.Empty() {
+		// A non-empty ring checks its own seeds on merge
+		return nil
+	}
+	if len(seeds) == len(alloc.seed) {
+		same := true
+		for i, seed := range seeds {
+			same = same && seed == alloc.seed[i]
+		}
+		if same {
+			return nil
+		}
+	}
+	return fmt.Errorf("IP allocation was seeded by %v, but this peer was launched with seed %v; relaunch it with the same seed as the other peers",
+		alloc.annotatePeernames(seeds), alloc.annotatePeernames(alloc.seed))
+}
@@ -19,6 +19,10 @@ type Space struct {
 	// repetition.
 	ours []address.Address
 	free []address.Address
+
+	// reserved addresses are never allocated or donated, although
+	// they may be claimed; same representation as above.
+	reserved []address.Address
 }
 
 func New() *Space {
@@ -35,14 +39,34 @@ func (s *Space) Clear() {
 	s.ours = s.ours[:0]
 }
 
-// Walk down the free list calling f() on the in-range portions, until
-// f() returns true or we run out of free space.  Return true iff f() returned true
+// SetReserved replaces the set of reserved addresses with those in
+// the supplied Ranges, which may overlap.
+func (s *Space) SetReserved(ranges []address.Range) {
+	s.reserved = s.reserved[:0]
+	for _, r := range ranges {
+		s.reserved = add(s.reserved, r.Start, r.End)
+	}
+}
+
+// Return the free addresses which are not reserved
+func (s *Space) available() []address.Address {
+	available := s.free
+	for i := 0; i < len(s.reserved); i += 2 {
+		available = subtract(available, s.reserved[i], s.reserved[i+1])
+	}
+	return available
+}
+
+// Walk down the free, unreserved, list calling f() on the in-range
+// portions, until f() returns true or we run out of free space.
+// Return true iff f() returned true
 func (s *Space) walkFree(r address.Range, f func(address.Range) bool) bool {
 	if r.Start >= r.End { // degenerate case
 		return false
 	}
-	for i := 0; i < len(s.free); i += 2 {
-		chunk := address.Range{Start: s.free[i], End: s.free[i+1]}
+	free := s.available()
+	for i := 0; i < len(free); i += 2 {
+		chunk := address.Range{Start: free[i], End: free[i+1]}
 		if chunk.End <= r.Start { // this chunk comes before the range
 			continue
 		}
@@ -261,3 +261,29 @@ func TestDonateHard(t *testing.T) {
 	expected.ours = add(nil, ip("10.0.1.47"), ip("10.0.1.48"))
 	require.Equal(t, expected, spaceset)
 }
+
+func TestSpaceReserved(t *testing.T) {
+	var (
+		start = ip("10.0.3.0")
+		r     = address.NewRange(start, 8)
+	)
+
+	space := makeSpace(start, 8)
+	space.SetReserved([]address.Range{address.NewRange(start, 2), address.NewRange(start+1, 2), address.NewRange(start+5, 3)})
+	require.Equal(t, address.Offset(2), space.NumFreeAddressesInRange(r))
+
+	ok, addr := space.Allocate(r)
+	require.True(t, ok)
+	require.Equal(t, start+3, addr)
+	ok, addr = space.Allocate(r)
+	require.True(t, ok)
+	require.Equal(t, start+4, addr)
+	ok, _ = space.Allocate(r)
+	require.False(t, ok, "reserved addresses should not be allocated")
+	_, ok = space.Donate(r)
+	require.False(t, ok, "reserved addresses should not be donated")
+
+	// Reserved addresses can still be claimed
+	require.NoError(t, space.Claim(start+6))
+	space.assertInvariants()
+}
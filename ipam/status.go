@@ -1,17 +1,28 @@
 package ipam
 
 import (
+	"sort"
+
 	"github.com/weaveworks/weave/ipam/paxos"
 	"github.com/weaveworks/weave/net/address"
 )
 
 type Status struct {
 	Paxos            *paxos.Status
+	Seed             []string
+	Observer         bool
 	Range            string
+	PendingRanges    []string
 	DefaultSubnet    string
 	Entries          []EntryStatus
 	PendingClaims    []ClaimStatus
 	PendingAllocates []string
+	Reservations     []ReservationStatus
+	Pools            []PoolStatus
+	Leaked           int
+	Reclaimed        int
+	Rebalance        RebalanceStatus
+	Takeover         TakeoverStatus
 }
 
 type EntryStatus struct {
@@ -20,6 +31,19 @@ type EntryStatus struct {
 	Version uint32
 }
 
+type ReservationStatus struct {
+	Name  string
+	Range string
+}
+
+type PoolStatus struct {
+	Name   string
+	Subnet string
+	Tenant string
+	Used   int // by all peers
+	Quota  int
+}
+
 type ClaimStatus struct {
 	Ident   string
 	Address address.Address
@@ -39,11 +63,20 @@ func NewStatus(allocator *Allocator, defaultSubnet address.CIDR) *Status {
 	allocator.actionChan <- func() {
 		resultChan <- &Status{
 			paxosStatus,
-			allocator.universe.String(),
+			allocator.annotatePeernames(allocator.seed),
+			allocator.observer,
+			rangesString(allocator.ring.Universe()),
+			newPendingRangeSlice(allocator),
 			defaultSubnet.String(),
 			newEntryStatusSlice(allocator),
 			newClaimStatusSlice(allocator),
-			newAllocateIdentSlice(allocator)}
+			newAllocateIdentSlice(allocator),
+			newReservationStatusSlice(allocator),
+			newPoolStatusSlice(allocator),
+			allocator.numLeaked(),
+			allocator.reclaimed,
+			newRebalanceStatus(allocator),
+			newTakeoverStatus(allocator)}
 	}
 
 	return <-resultChan
@@ -80,3 +113,31 @@ func newAllocateIdentSlice(allocator *Allocator) []string {
 	}
 	return slice
 }
+
+func newReservationStatusSlice(allocator *Allocator) []ReservationStatus {
+	var slice []ReservationStatus
+	for name, r := range allocator.ring.Reserved() {
+		slice = append(slice, ReservationStatus{name, r.AsCIDRString()})
+	}
+	sort.Sort(reservationsByName(slice))
+	return slice
+}
+
+type reservationsByName []ReservationStatus
+
+func (rs reservationsByName) Len() int           { return len(rs) }
+func (rs reservationsByName) Less(i, j int) bool { return rs[i].Name < rs[j].Name }
+func (rs reservationsByName) Swap(i, j int)      { rs[i], rs[j] = rs[j], rs[i] }
+
+func newPendingRangeSlice(allocator *Allocator) []string {
+	var slice []string
+
+	if allocator.growing != nil {
+		slice = append(slice, allocator.growing.r.AsCIDRString())
+	}
+	for _, r := range allocator.growQueue {
+		slice = append(slice, r.AsCIDRString())
+	}
+
+	return slice
+}
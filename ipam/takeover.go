@@ -0,0 +1,379 @@
+package ipam
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/ipam/paxos"
+	"github.com/weaveworks/weave/ipam/ring"
+	"github.com/weaveworks/weave/mesh"
+	"github.com/weaveworks/weave/net/address"
+)
+
+// The ranges of a peer which has died stay unusable until an
+// administrator runs rmpeer.  When enabled, each peer instead notes
+// when peers in the ring disappear from the router's list of peers,
+// and once one has been absent for long enough, the peers owning
+// ranges which agree that it has gone run a round of Paxos.  The
+// quorum is a strict majority of the peers owning ranges, counting
+// the dead one, so that peers cut off from the rest cannot take over
+// the ranges of peers which are still alive.  The lowest-named peer
+// in the consensus takes over the dead peer's ranges.
+//
+// The ring remembers which peers are dead.  If one comes back, it
+// will learn from the ring that its ranges have been taken over, and
+// stop allocating rather than hand out addresses which now belong to
+// someone else.  It tells the peers now owning the addresses its
+// containers still use about them, and they hold on to them until
+// the containers claim them again, once the peer has been reset and
+// has rejoined.  Any which they have given out in the meantime, they
+// send back, and the peer gives them up.
+
+// PeerLister is the source of truth about which peers are around;
+// *mesh.Peers is one.
+type PeerLister interface {
+	Names() mesh.PeerNameSet
+}
+
+type takeover struct {
+	peer  mesh.PeerName // the peer whose ranges are to be taken over
+	paxos *paxos.Node
+}
+
+// Gossiped while agreeing a takeover
+type takeoverState struct {
+	Peer  mesh.PeerName
+	Paxos paxos.GossipState
+}
+
+type TakeoverStatus struct {
+	After      time.Duration
+	Absent     []string
+	TakingOver string
+	TakenOver  bool
+}
+
+// StartDeadPeerTakeover takes over the ranges of peers which have
+// been missing from peers for longer than after.
+func (alloc *Allocator) StartDeadPeerTakeover(after time.Duration, peers PeerLister) {
+	alloc.actionChan <- func() {
+		alloc.takeoverAfter = after
+		alloc.peerLister = peers
+		alloc.deadPeerTicker = time.NewTicker(after / 4)
+	}
+}
+
+// Called on the deadPeerTicker.  The list of peers is fetched outside
+// the actor loop, so we don't hold up the router.
+func (alloc *Allocator) listPeers() {
+	go func() {
+		live := alloc.peerLister.Names()
+		alloc.actionChan <- func() {
+			alloc.checkDeadPeers(live)
+		}
+	}()
+}
+
+func (alloc *Allocator) checkDeadPeers(live mesh.PeerNameSet) {
+	if alloc.ring.Empty() || alloc.shuttingDown || alloc.takenOver || !alloc.ownsRanges() {
+		return
+	}
+	now := alloc.now()
+	absent := make(map[mesh.PeerName]time.Time)
+	for peer := range alloc.ring.PeerNames() {
+		if _, found := live[peer]; found || peer == alloc.ourName {
+			continue
+		}
+		since, found := alloc.absentSince[peer]
+		if !found {
+			alloc.debugln("Peer", peer, "owning ranges has gone away")
+			since = now
+		}
+		absent[peer] = since
+	}
+	// Peers which have come back, or no longer own anything, drop out
+	alloc.absentSince = absent
+
+	if alloc.takingOver != nil {
+		return
+	}
+	for _, peer := range alloc.absentPeers() {
+		if alloc.isDead(peer) {
+			alloc.infof("Proposing to take over ranges of %s, gone since %s", alloc.annotatePeernames([]mesh.PeerName{peer})[0], absent[peer].Format(time.RFC3339))
+			alloc.joinTakeover(peer)
+			alloc.proposeTakeover()
+			return
+		}
+	}
+}
+
+// Forget about peers which no longer own anything
+func (alloc *Allocator) pruneAbsentPeers() {
+	ringPeers := alloc.ring.PeerNames()
+	for peer := range alloc.absentSince {
+		if _, found := ringPeers[peer]; !found {
+			delete(alloc.absentSince, peer)
+		}
+	}
+	if alloc.takingOver != nil {
+		if _, found := ringPeers[alloc.takingOver.peer]; !found {
+			alloc.stopTakeover()
+		}
+	}
+}
+
+// Absent peers, in order, so that everyone tends to pick the same one
+func (alloc *Allocator) absentPeers() []mesh.PeerName {
+	var peers peerNames
+	for peer := range alloc.absentSince {
+		peers = append(peers, peer)
+	}
+	sort.Sort(peers)
+	return peers
+}
+
+// Only peers owning ranges take part in agreeing a takeover
+func (alloc *Allocator) ownsRanges() bool {
+	_, found := alloc.ring.PeerNames()[alloc.ourName]
+	return found
+}
+
+// A strict majority of the peers owning ranges
+func (alloc *Allocator) takeoverQuorum() uint {
+	return uint(len(alloc.ring.PeerNames())/2 + 1)
+}
+
+func (alloc *Allocator) isDead(peer mesh.PeerName) bool {
+	since, found := alloc.absentSince[peer]
+	return alloc.takeoverAfter > 0 && found && alloc.now().Sub(since) >= alloc.takeoverAfter
+}
+
+func (alloc *Allocator) joinTakeover(peer mesh.PeerName) {
+	alloc.takingOver = &takeover{peer, paxos.NewNode(alloc.ourName, alloc.ourUID, alloc.takeoverQuorum())}
+	// re-propose until we get consensus
+	alloc.takeoverTicker = time.NewTicker(paxosInterval)
+}
+
+func (alloc *Allocator) stopTakeover() {
+	alloc.takingOver = nil
+	if alloc.takeoverTicker != nil {
+		alloc.takeoverTicker.Stop()
+		alloc.takeoverTicker = nil
+	}
+}
+
+func (alloc *Allocator) proposeTakeover() {
+	alloc.debugln("Paxos proposing to take over ranges of", alloc.takingOver.peer)
+	alloc.takingOver.paxos.Propose()
+	alloc.gossip.GossipBroadcast(alloc.Gossip())
+	alloc.checkTakeoverConsensus()
+}
+
+func (alloc *Allocator) checkTakeoverConsensus() {
+	ok, cons := alloc.takingOver.paxos.Consensus()
+	if !ok {
+		return
+	}
+	dead := alloc.takingOver.peer
+	alloc.stopTakeover()
+	// The peers owning ranges may have changed since we started
+	ringPeers := alloc.ring.PeerNames()
+	var agreed []mesh.PeerName
+	for _, peer := range cons.Value {
+		if _, found := ringPeers[peer]; found && peer != dead {
+			agreed = append(agreed, peer)
+		}
+	}
+	if uint(len(agreed)) < alloc.takeoverQuorum() {
+		alloc.infof("Not taking over ranges of %s: only %d of the %d peers owning ranges agree it has gone",
+			alloc.annotatePeernames([]mesh.PeerName{dead})[0], len(agreed), len(ringPeers))
+		return
+	}
+	heir := normalizeConsensus(agreed)[0]
+	delete(alloc.absentSince, dead)
+	alloc.debugln("Paxos consensus for", heir, "to take over ranges of", dead, ":", cons.Value)
+	if heir != alloc.ourName {
+		// We'll hear about it when the heir gossips the ring
+		return
+	}
+
+	newRanges, err := alloc.ring.TakeOver(dead, alloc.ourName)
+	if err != nil {
+		// Already done, by an earlier round of agreement
+		alloc.debugln("Unable to take over ranges of", dead, ":", err)
+		return
+	}
+	alloc.infof("Took over ranges %s of %s, which had been gone for more than %v",
+		rangesString(newRanges), alloc.annotatePeernames([]mesh.PeerName{dead})[0], alloc.takeoverAfter)
+	for _, r := range newRanges {
+		alloc.auditRange(auditTakeover, r, dead)
+	}
+	delete(alloc.nicknames, dead)
+	alloc.gossip.GossipBroadcast(alloc.Gossip())
+	alloc.ringUpdated()
+}
+
+func (alloc *Allocator) updateTakeover(sender mesh.PeerName, theirs *takeoverState) {
+	if alloc.ring.Empty() || alloc.takenOver || theirs.Peer == alloc.ourName || !alloc.ownsRanges() {
+		return
+	}
+	if _, found := alloc.ring.PeerNames()[theirs.Peer]; !found {
+		// Sender is still trying to take over ranges which have
+		// gone already; send our ring straight back
+		if sender != mesh.UnknownPeerName {
+			alloc.sendRingUpdate(sender)
+		}
+		return
+	}
+	// Only agree if we haven't seen the peer for long enough either
+	if !alloc.isDead(theirs.Peer) {
+		return
+	}
+
+	if alloc.takingOver != nil && alloc.takingOver.peer != theirs.Peer {
+		if alloc.takingOver.peer < theirs.Peer {
+			// They will come round to ours
+			return
+		}
+		alloc.stopTakeover()
+	}
+	if alloc.takingOver == nil {
+		alloc.joinTakeover(theirs.Peer)
+	}
+
+	if alloc.takingOver.paxos.Update(theirs.Paxos) {
+		if alloc.takingOver.paxos.Think() {
+			// If something important changed, broadcast
+			alloc.gossip.GossipBroadcast(alloc.Gossip())
+		}
+		alloc.checkTakeoverConsensus()
+	}
+}
+
+// Our ranges have been given to another peer while we were away, as
+// we learned from theirs.  Stop allocating, and hand over the
+// addresses we still have in use to the peers which now own them.
+func (alloc *Allocator) rangesTakenOver(theirs *ring.Ring) {
+	if !alloc.takenOver {
+		alloc.infof("Our ranges have been taken over by other peers; handing over the addresses in use here")
+		alloc.takenOver = true
+		alloc.cancelOps(&alloc.pendingAllocates)
+		alloc.cancelOps(&alloc.pendingClaims)
+		alloc.handingOver = make(map[mesh.PeerName]heldAddresses)
+		for ident, addrs := range alloc.owned {
+			for _, addr := range addrs {
+				if !theirs.Contains(addr) {
+					continue
+				}
+				if heir := theirs.Owner(addr); heir != mesh.UnknownPeerName && heir != alloc.ourName {
+					if alloc.handingOver[heir] == nil {
+						alloc.handingOver[heir] = make(heldAddresses)
+					}
+					alloc.handingOver[heir][ident] = append(alloc.handingOver[heir][ident], addr)
+				}
+			}
+		}
+	}
+	// Until they acknowledge, tell them each time we hear of it
+	for heir, held := range alloc.handingOver {
+		alloc.sendHeldAddresses(heir, held)
+	}
+}
+
+// Addresses in use by a peer whose ranges were taken over, by ident
+type heldAddresses map[string][]address.Address
+
+// Idents under which we hold the addresses handed over to us, so they
+// aren't given to anything else
+const heldIdentPrefix = "weave:held:"
+
+func (alloc *Allocator) sendHeldAddresses(dest mesh.PeerName, held heldAddresses) {
+	alloc.gossip.GossipUnicast(dest, mesh.Concat([]byte{msgHeldAddresses}, encodeHeldAddresses(held)))
+}
+
+func encodeHeldAddresses(held heldAddresses) []byte {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(held); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+func decodeHeldAddresses(msg []byte) (held heldAddresses, err error) {
+	return held, gob.NewDecoder(bytes.NewReader(msg)).Decode(&held)
+}
+
+// On the peer which took over the ranges of a peer that has come
+// back: keep hold of the addresses it still has in use, unless they
+// have been given out already, in which case we send them back in
+// our acknowledgement.
+func (alloc *Allocator) adoptAddresses(from mesh.PeerName, held heldAddresses) {
+	conflicts := make(heldAddresses)
+	for ident, addrs := range held {
+		for _, addr := range addrs {
+			if alloc.ring.Empty() || !alloc.ring.Contains(addr) || alloc.ring.Owner(addr) != alloc.ourName {
+				alloc.infof("Address %s handed over by %s for %s is not ours", addr, from, ident)
+				continue
+			}
+			heldIdent := heldIdentPrefix + ident
+			switch existing := alloc.findOwner(addr); existing {
+			case "":
+				if err := alloc.space.Claim(addr); err != nil {
+					alloc.infof("Unable to hold address %s handed over by %s for %s: %s", addr, from, ident, err)
+					continue
+				}
+				alloc.addOwned(heldIdent, addr)
+				alloc.auditAddress(auditClaim, heldIdent, addr)
+			case heldIdent:
+				// heard about it already
+			default:
+				alloc.infof("Address %s handed over by %s for %s was given to %s after we took it over; telling %s to give it up", addr, from, ident, existing, from)
+				conflicts[ident] = append(conflicts[ident], addr)
+			}
+		}
+	}
+	alloc.gossip.GossipUnicast(from, mesh.Concat([]byte{msgHeldAddressesAck}, encodeHeldAddresses(conflicts)))
+}
+
+// On the peer which has come back: the heir has taken the addresses
+// we handed over, except for the conflicts, which it had given out
+// already.  Give those up, so that they are never in use twice once
+// we rejoin.
+func (alloc *Allocator) handedOver(heir mesh.PeerName, conflicts heldAddresses) {
+	delete(alloc.handingOver, heir)
+	for ident, addrs := range conflicts {
+		for _, addr := range addrs {
+			if !alloc.removeOwned(ident, addr) {
+				continue
+			}
+			alloc.space.Free(addr)
+			alloc.auditAddress(auditFree, ident, addr)
+			common.Log.Errorf("[allocator] Address %s of %s was given to another container after our ranges were taken over; giving it up, so %s must be restarted", addr, ident, ident)
+		}
+	}
+}
+
+// Let go of an address we have been holding, so that it can be claimed
+func (alloc *Allocator) releaseHeldAddress(addr address.Address) {
+	if ident := alloc.findOwner(addr); strings.HasPrefix(ident, heldIdentPrefix) {
+		alloc.removeOwned(ident, addr)
+		alloc.space.Free(addr)
+		alloc.auditAddress(auditFree, ident, addr)
+	}
+}
+
+var errTakenOver = errors.New("the address ranges of this peer have been taken over by another peer; run 'weave reset' to rejoin")
+
+func newTakeoverStatus(allocator *Allocator) TakeoverStatus {
+	status := TakeoverStatus{After: allocator.takeoverAfter, TakenOver: allocator.takenOver}
+	status.Absent = allocator.annotatePeernames(allocator.absentPeers())
+	if allocator.takingOver != nil {
+		status.TakingOver = allocator.annotatePeernames([]mesh.PeerName{allocator.takingOver.peer})[0]
+	}
+	return status
+}
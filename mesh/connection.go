@@ -1,4 +1,4 @@
-package router
+package mesh
 
 import (
 	"fmt"
@@ -50,7 +50,9 @@ type LocalConnection struct {
 	uid           uint64
 	actionChan    chan<- ConnectionAction
 	finished      <-chan struct{} // closed to signal that actorLoop has finished
-	forwarder     OverlayForwarder
+	OverlayConn   OverlayConnection
+	gossipDelta   bool // the remote peer understands gossip deltas and acknowledgements
+	compress      bool // gossip is compressed in both directions
 }
 
 type ConnectionAction func() error
@@ -118,6 +120,10 @@ func (conn *LocalConnection) Established() bool {
 	return conn.established
 }
 
+func (conn *LocalConnection) GossipDelta() bool {
+	return conn.gossipDelta
+}
+
 // Send directly, not via the Actor.  If it goes via the Actor we can
 // get a deadlock where LocalConnection is blocked talking to
 // LocalPeer and LocalPeer is blocked trying send a ProtocolMsg via
@@ -192,28 +198,29 @@ func (conn *LocalConnection) run(actionChan <-chan ConnectionAction, finished ch
 
 	conn.Log("connection ready; using protocol version", conn.version)
 
-	params := ForwarderParams{
+	params := OverlayConnectionParams{
 		RemotePeer:         conn.remote,
 		LocalIP:            conn.TCPConn.LocalAddr().(*net.TCPAddr).IP,
 		RemoteAddr:         conn.remoteUDPAddr,
+		Outbound:           conn.outbound,
 		ConnUID:            conn.uid,
-		Crypto:             conn.forwarderCrypto(),
+		SessionKey:         conn.SessionKey,
 		SendControlMessage: conn.sendOverlayControlMessage,
 		Features:           intro.Features,
 	}
-	if conn.forwarder, err = conn.Router.Overlay.MakeForwarder(params); err != nil {
+	if conn.OverlayConn, err = conn.Router.Overlay.PrepareConnection(params); err != nil {
 		return
 	}
 
 	// As soon as we do AddConnection, the new connection becomes
 	// visible to the packet routing logic.  So AddConnection must
-	// come after MakeForwarder
+	// come after PrepareConnection
 	if err = conn.Router.Ourself.AddConnection(conn); err != nil {
 		return
 	}
 	conn.Router.ConnectionMaker.ConnectionCreated(conn)
 
-	// Forwarder confirmation comes after AddConnection, because
+	// Overlay confirmation comes after AddConnection, because
 	// only after that completes do we know the connection is
 	// valid: in particular that it is not a duplicate connection
 	// to the same peer. Sending heartbeats on a duplicate
@@ -222,7 +229,7 @@ func (conn *LocalConnection) run(actionChan <-chan ConnectionAction, finished ch
 	// connection. It is also generally wasteful to engage in any
 	// interaction with the remote on a connection that turns out
 	// to be invalid.
-	conn.forwarder.Confirm()
+	conn.OverlayConn.Confirm()
 
 	// receiveTCP must follow also AddConnection. In the absence
 	// of any indirect connectivity to the remote peer, the first
@@ -253,9 +260,16 @@ func (conn *LocalConnection) makeFeatures() map[string]string {
 		"PeerNameFlavour": PeerNameFlavour,
 		"Name":            conn.local.Name.String(),
 		"NickName":        conn.local.NickName,
-		"ShortID":         fmt.Sprint(conn.local.ShortID),
 		"UID":             fmt.Sprint(conn.local.UID),
 		"ConnID":          fmt.Sprint(conn.uid),
+		"GossipDelta":     "1",
+		"ZoneSummaries":   "1",
+	}
+	if conn.local.HasShortID {
+		features["ShortID"] = fmt.Sprint(conn.local.ShortID)
+	}
+	if conn.Router.GossipCompression {
+		features["GossipCompression"] = gossipCompression
 	}
 	conn.Router.Overlay.AddFeaturesTo(features)
 	return features
@@ -315,8 +329,11 @@ func (conn *LocalConnection) parseFeatures(features features) (*Peer, error) {
 	}
 
 	conn.uid ^= remoteConnID
+	conn.gossipDelta = features.Get("GossipDelta") == "1"
+	conn.compress = conn.Router.GossipCompression && features.Get("GossipCompression") == gossipCompression
 	peer := NewPeer(name, nickName, uid, 0, PeerShortID(shortID))
 	peer.HasShortID = hasShortID
+	peer.ZoneSummaries = features.Get("ZoneSummaries") == "1"
 	return peer, nil
 }
 
@@ -342,8 +359,8 @@ func (conn *LocalConnection) registerRemote(remote *Peer, acceptNewPeer bool) er
 }
 
 func (conn *LocalConnection) actorLoop(actionChan <-chan ConnectionAction) (err error) {
-	fwdErrorChan := conn.forwarder.ErrorChannel()
-	fwdEstablishedChan := conn.forwarder.EstablishedChannel()
+	fwdErrorChan := conn.OverlayConn.ErrorChannel()
+	fwdEstablishedChan := conn.OverlayConn.EstablishedChannel()
 
 	for err == nil {
 		select {
@@ -382,26 +399,13 @@ func (conn *LocalConnection) shutdown(err error) {
 
 	stopTicker(conn.heartbeatTCP)
 
-	if conn.forwarder != nil {
-		conn.forwarder.Stop()
+	if conn.OverlayConn != nil {
+		conn.OverlayConn.Stop()
 	}
 
 	conn.Router.ConnectionMaker.ConnectionTerminated(conn, err)
 }
 
-func (conn *LocalConnection) forwarderCrypto() *OverlayCrypto {
-	if !conn.Router.UsingPassword() {
-		return nil
-	}
-
-	name := conn.local.NameByte
-	return &OverlayCrypto{
-		Dec:   NewNaClDecryptor(conn.SessionKey, conn.outbound),
-		Enc:   NewNaClEncryptor(name, conn.SessionKey, conn.outbound, false),
-		EncDF: NewNaClEncryptor(name, conn.SessionKey, conn.outbound, true),
-	}
-}
-
 func (conn *LocalConnection) sendOverlayControlMessage(tag byte, msg []byte) error {
 	return conn.sendProtocolMsg(ProtocolMsg{ProtocolTag(tag), msg})
 }
@@ -413,6 +417,9 @@ func (conn *LocalConnection) sendSimpleProtocolMsg(tag ProtocolTag) error {
 }
 
 func (conn *LocalConnection) sendProtocolMsg(m ProtocolMsg) error {
+	if conn.compress && isGossip(m.tag) {
+		m.msg = compress(m.msg)
+	}
 	return conn.tcpSender.Send(Concat([]byte{byte(m.tag)}, m.msg))
 }
 
@@ -440,8 +447,14 @@ func (conn *LocalConnection) handleProtocolMsg(tag ProtocolTag, payload []byte)
 	switch tag {
 	case ProtocolHeartbeat:
 	case ProtocolConnectionEstablished, ProtocolFragmentationReceived, ProtocolPMTUVerified, ProtocolOverlayControlMsg:
-		conn.forwarder.ControlMessage(byte(tag), payload)
-	case ProtocolGossipUnicast, ProtocolGossipBroadcast, ProtocolGossip:
+		conn.OverlayConn.ControlMessage(byte(tag), payload)
+	case ProtocolGossipUnicast, ProtocolGossipBroadcast, ProtocolGossip, ProtocolGossipDelta, ProtocolGossipAck:
+		if conn.compress && isGossip(tag) {
+			var err error
+			if payload, err = decompress(payload); err != nil {
+				return err
+			}
+		}
 		return conn.Router.handleGossip(tag, payload)
 	default:
 		conn.Log("ignoring unknown protocol tag:", tag)
@@ -453,17 +466,6 @@ func (conn *LocalConnection) extendReadDeadline() {
 	conn.TCPConn.SetReadDeadline(time.Now().Add(TCPHeartbeat * 2))
 }
 
-func (conn *LocalConnection) Forward(key ForwardPacketKey) FlowOp {
-	return conn.forwarder.Forward(key)
-}
-
-func tickerChan(ticker *time.Ticker) <-chan time.Time {
-	if ticker != nil {
-		return ticker.C
-	}
-	return nil
-}
-
 func stopTicker(ticker *time.Ticker) {
 	if ticker != nil {
 		ticker.Stop()
@@ -1,4 +1,4 @@
-package router
+package mesh
 
 import (
 	"fmt"
@@ -243,6 +243,9 @@ func (cm *ConnectionMaker) addPeerTargets(ourConnectedPeers PeerNameSet, addTarg
 			if _, connected := ourConnectedPeers[otherPeer]; connected {
 				continue
 			}
+			if !cm.ourself.zoneAllows(conn.Remote()) {
+				continue
+			}
 			address := conn.RemoteTCPAddr()
 			if conn.Outbound() {
 				addTarget(address)
@@ -0,0 +1,15 @@
+package mesh
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	Port           = 6783
+	ChannelSize    = 16
+	TCPHeartbeat   = 30 * time.Second
+	GossipInterval = 30 * time.Second
+	MaxDuration    = time.Duration(math.MaxInt64)
+	MaxTCPMsgSize  = 10 * 1024 * 1024
+)
@@ -1,4 +1,4 @@
-package router
+package mesh
 
 import (
 	"fmt"
@@ -29,6 +29,16 @@ type Gossiper interface {
 	OnGossip(update []byte) (GossipData, error)
 }
 
+// A Gossiper which can send a neighbour just what has changed since
+// the version of its state the neighbour last acknowledged.
+type DeltaGossiper interface {
+	Gossiper
+	// return what has changed since version, or everything if that
+	// version is unknown, or nil if nothing has, along with the
+	// current version, e.g. a serial number or a digest of the state
+	GossipSince(version uint64) (GossipData, uint64)
+}
+
 // Accumulates GossipData that needs to be sent to one destination,
 // and sends it when possible.
 type GossipSender struct {
@@ -103,6 +113,23 @@ func (router *Router) NewGossip(channelName string, g Gossiper) Gossip {
 	return channel
 }
 
+// Like NewGossip, but if the channel is one we have only been
+// relaying, it takes over from the surrogate, and if it already has a
+// gossiper that is an error rather than fatal.
+func (router *Router) adoptGossip(channelName string, g Gossiper) (*GossipChannel, error) {
+	channel := NewGossipChannel(channelName, router.Ourself, router.Routes, g)
+	router.gossipLock.Lock()
+	defer router.gossipLock.Unlock()
+	if existing, found := router.gossipChannels[channelName]; found {
+		if _, relaying := existing.gossiper.(*SurrogateGossiper); !relaying {
+			return nil, fmt.Errorf("gossip channel %s is already in use", channelName)
+		}
+		existing.stop()
+	}
+	router.gossipChannels[channelName] = channel
+	return channel, nil
+}
+
 func (router *Router) gossipChannel(channelName string) *GossipChannel {
 	router.gossipLock.RLock()
 	channel, found := router.gossipChannels[channelName]
@@ -133,9 +160,7 @@ func (router *Router) gossipChannelSet() map[*GossipChannel]struct{} {
 
 func (router *Router) SendAllGossip() {
 	for channel := range router.gossipChannelSet() {
-		if gossip := channel.gossiper.Gossip(); gossip != nil {
-			channel.Send(router.Ourself.Name, gossip)
-		}
+		channel.SendGossip()
 	}
 }
 
@@ -152,14 +177,23 @@ func (router *Router) SendAllGossipDown(conn Connection) {
 func (router *Router) sendPendingGossip() bool {
 	sentSomething := false
 	for channel := range router.gossipChannelSet() {
+		// Flush outside the lock, since delivering deltas leads to
+		// acknowledgements coming back into the channel
+		var senders []*GossipSender
 		channel.Lock()
 		for _, sender := range channel.senders {
-			sentSomething = sender.flush() || sentSomething
+			senders = append(senders, sender)
+		}
+		for _, sender := range channel.deltaSenders {
+			senders = append(senders, sender)
 		}
 		for _, sender := range channel.broadcasters {
-			sentSomething = sender.flush() || sentSomething
+			senders = append(senders, sender)
 		}
 		channel.Unlock()
+		for _, sender := range senders {
+			sentSomething = sender.flush() || sentSomething
+		}
 	}
 	return sentSomething
 }
@@ -0,0 +1,343 @@
+package mesh
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The gossip API lets processes outside weaver use the mesh for
+// membership and gossip, in the same way IPAM and DNS do.  A process
+// registers a channel along with the path of a unix socket on which
+// it serves HTTP; we then call it there for each Gossiper method:
+//
+//   POST /unicast?sender=<peer>    a unicast message for us
+//   POST /broadcast?sender=<peer>  a broadcast update
+//   POST /gossip                   gossip from a neighbour
+//   GET  /gossip                   our complete state, to gossip
+//
+// The body of each request is the message.  Broadcasts are relayed
+// as they are; responses to the last two carry what should be gossiped
+// on, or nothing (204) if there is nothing new.  Until a process
+// registers, and after it goes away, a channel relays broadcasts and
+// gossip like any other channel it doesn't understand.
+//
+// The process is called from a queue per channel, in order, rather
+// than from the connection the message arrived on, so a slow process
+// only holds up its own channel.  If it falls too far behind, messages
+// for it are dropped.
+
+const gossipCallbackTimeout = 5 * time.Second
+
+type GossipAPI struct {
+	sync.Mutex
+	router    *Router
+	gossipers map[string]*externalGossiper
+}
+
+func NewGossipAPI(router *Router) *GossipAPI {
+	return &GossipAPI{router: router, gossipers: make(map[string]*externalGossiper)}
+}
+
+type externalGossiper struct {
+	sync.RWMutex
+	channel  string
+	gossip   *GossipChannel
+	socket   string // where the process serves HTTP, or empty if none
+	client   *http.Client
+	calls    chan func()   // queued calls to the process, while registered
+	done     chan struct{} // closed once run has finished with calls
+	relaying SurrogateGossiper
+}
+
+func (api *GossipAPI) register(channel, socket string) error {
+	if !filepath.IsAbs(socket) {
+		return fmt.Errorf("callback %q is not an absolute path to a unix socket", socket)
+	}
+	api.Lock()
+	defer api.Unlock()
+	g, found := api.gossipers[channel]
+	if !found {
+		g = &externalGossiper{channel: channel}
+		gossip, err := api.router.adoptGossip(channel, g)
+		if err != nil {
+			return err
+		}
+		g.gossip = gossip
+		api.gossipers[channel] = g
+	}
+	g.setSocket(socket)
+	return nil
+}
+
+func (api *GossipAPI) unregister(channel string) bool {
+	api.Lock()
+	g, found := api.gossipers[channel]
+	api.Unlock()
+	if found {
+		g.setSocket("")
+	}
+	return found
+}
+
+func (api *GossipAPI) gossiper(channel string) (*externalGossiper, bool) {
+	api.Lock()
+	defer api.Unlock()
+	g, found := api.gossipers[channel]
+	return g, found
+}
+
+// Registered channels, and the sockets of the processes behind them
+func (api *GossipAPI) Channels() map[string]string {
+	api.Lock()
+	defer api.Unlock()
+	channels := make(map[string]string)
+	for name, g := range api.gossipers {
+		channels[name] = g.callback()
+	}
+	return channels
+}
+
+type gossipPeer struct {
+	Name     string
+	NickName string
+}
+
+func (api *GossipAPI) HandleHTTP(muxRouter *mux.Router) {
+	muxRouter.Methods("GET").Path("/peers").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peers := []gossipPeer{}
+		api.router.Peers.ForEach(func(peer *Peer) {
+			peers = append(peers, gossipPeer{peer.Name.String(), peer.NickName})
+		})
+		writeJSON(w, peers)
+	})
+
+	muxRouter.Methods("GET").Path("/gossip").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, api.Channels())
+	})
+
+	muxRouter.Methods("PUT").Path("/gossip/{channel}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := api.register(mux.Vars(r)["channel"], r.FormValue("callback")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(204)
+	})
+
+	muxRouter.Methods("DELETE").Path("/gossip/{channel}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !api.unregister(mux.Vars(r)["channel"]) {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(204)
+	})
+
+	muxRouter.Methods("POST").Path("/gossip/{channel}/broadcast").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		api.handleSend(w, r, func(g *externalGossiper, msg []byte) error {
+			return g.gossip.GossipBroadcast(NewSurrogateGossipData(msg))
+		})
+	})
+
+	muxRouter.Methods("POST").Path("/gossip/{channel}/unicast/{peer}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peerName, err := PeerNameFromString(mux.Vars(r)["peer"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		api.handleSend(w, r, func(g *externalGossiper, msg []byte) error {
+			return g.gossip.GossipUnicast(peerName, msg)
+		})
+	})
+}
+
+func (api *GossipAPI) handleSend(w http.ResponseWriter, r *http.Request, send func(*externalGossiper, []byte) error) {
+	g, found := api.gossiper(mux.Vars(r)["channel"])
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	msg, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := send(g, msg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(204)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, fmt.Sprint("unable to marshal response: ", err), http.StatusInternalServerError)
+	}
+}
+
+// Start calling the process at socket, or, if it is empty, stop
+// calling any, waiting for the call in progress to finish.
+func (g *externalGossiper) setSocket(socket string) {
+	g.Lock()
+	g.socket = socket
+	g.client = nil
+	calls, done := g.calls, g.done
+	if socket == "" {
+		g.calls, g.done = nil, nil
+	} else {
+		g.client = &http.Client{
+			Timeout: gossipCallbackTimeout,
+			Transport: &http.Transport{Dial: func(_, _ string) (net.Conn, error) {
+				return net.Dial("unix", socket)
+			}}}
+		if g.calls == nil {
+			g.calls, g.done = make(chan func(), ChannelSize), make(chan struct{})
+			go g.run(g.calls, g.done)
+		}
+		calls = nil
+	}
+	g.Unlock()
+
+	if calls != nil {
+		close(calls)
+		<-done
+	}
+}
+
+func (g *externalGossiper) callback() string {
+	g.RLock()
+	defer g.RUnlock()
+	return g.socket
+}
+
+func (g *externalGossiper) registered() bool {
+	g.RLock()
+	defer g.RUnlock()
+	return g.client != nil
+}
+
+// Calls queued after the process has gone away find no client, and
+// return straight away
+func (g *externalGossiper) run(calls <-chan func(), done chan<- struct{}) {
+	for call := range calls {
+		call()
+	}
+	close(done)
+}
+
+func (g *externalGossiper) enqueue(call func()) {
+	g.RLock()
+	defer g.RUnlock()
+	if g.calls == nil {
+		return
+	}
+	select {
+	case g.calls <- call:
+	default:
+		g.log("process at", g.socket, "is not keeping up; dropping message")
+	}
+}
+
+// Pass on what the process says is new
+func (g *externalGossiper) gossipReply(reply []byte) {
+	if data := replyData(reply); data != nil {
+		g.gossip.Send(g.gossip.ourself.Name, data)
+	}
+}
+
+// Call the process behind the channel; found is false if there is no
+// such process, or it didn't answer, in which case we just relay.
+func (g *externalGossiper) call(method, path string, sender PeerName, msg []byte) (reply []byte, found bool) {
+	g.RLock()
+	client := g.client
+	g.RUnlock()
+	if client == nil {
+		return nil, false
+	}
+	u := url.URL{Scheme: "http", Host: "gossip", Path: path}
+	if sender != UnknownPeerName {
+		u.RawQuery = url.Values{"sender": {sender.String()}}.Encode()
+	}
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(msg))
+	if err != nil {
+		g.log(err)
+		return nil, false
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		g.log("unable to call", g.callback(), path, ":", err)
+		return nil, false
+	}
+	defer resp.Body.Close()
+	if reply, err = ioutil.ReadAll(resp.Body); err != nil {
+		g.log("unable to read reply to", path, ":", err)
+		return nil, false
+	}
+	if resp.StatusCode/100 != 2 {
+		g.log("call to", path, "failed:", resp.Status, string(reply))
+		return nil, false
+	}
+	return reply, true
+}
+
+func (g *externalGossiper) log(args ...interface{}) {
+	log.Println(append(append([]interface{}{}, "[gossip "+g.channel+"]:"), args...)...)
+}
+
+// Errors from the process are not ours to act on, e.g. by dropping
+// the connection the message arrived on, so we only ever log them.
+
+func (g *externalGossiper) OnGossipUnicast(sender PeerName, msg []byte) error {
+	if g.registered() {
+		g.enqueue(func() { g.call("POST", "/unicast", sender, msg) })
+	}
+	return nil
+}
+
+func (g *externalGossiper) OnGossipBroadcast(sender PeerName, update []byte) (GossipData, error) {
+	if g.registered() {
+		g.enqueue(func() { g.call("POST", "/broadcast", sender, update) })
+	}
+	return g.relaying.OnGossipBroadcast(sender, update)
+}
+
+// The state to gossip is sent once the process has told us it
+func (g *externalGossiper) Gossip() GossipData {
+	if !g.registered() {
+		return g.relaying.Gossip()
+	}
+	g.enqueue(func() {
+		if reply, found := g.call("GET", "/gossip", UnknownPeerName, nil); found {
+			g.gossipReply(reply)
+		}
+	})
+	return nil
+}
+
+func (g *externalGossiper) OnGossip(update []byte) (GossipData, error) {
+	if !g.registered() {
+		return g.relaying.OnGossip(update)
+	}
+	g.enqueue(func() {
+		if reply, found := g.call("POST", "/gossip", UnknownPeerName, update); found {
+			g.gossipReply(reply)
+		}
+	})
+	return nil, nil
+}
+
+func replyData(reply []byte) GossipData {
+	if len(reply) == 0 {
+		return nil
+	}
+	return NewSurrogateGossipData(reply)
+}
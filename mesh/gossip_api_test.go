@@ -0,0 +1,159 @@
+package mesh
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+// A process using the gossip API, recording what it is called with
+type testGossipApp struct {
+	sync.Mutex
+	socket     string
+	listener   net.Listener
+	unicasts   []string
+	broadcasts []string
+	hold       chan struct{} // if not nil, calls wait for it
+}
+
+func newTestGossipApp(t *testing.T, dir, name string) *testGossipApp {
+	app := &testGossipApp{socket: filepath.Join(dir, name)}
+	l, err := net.Listen("unix", app.socket)
+	require.NoError(t, err)
+	app.listener = l
+	muxRouter := mux.NewRouter()
+	record := func(msgs *[]string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			msg, _ := ioutil.ReadAll(r.Body)
+			if app.hold != nil {
+				<-app.hold
+			}
+			app.Lock()
+			*msgs = append(*msgs, r.FormValue("sender")+":"+string(msg))
+			app.Unlock()
+			w.WriteHeader(204)
+		}
+	}
+	muxRouter.Methods("POST").Path("/unicast").HandlerFunc(record(&app.unicasts))
+	muxRouter.Methods("POST").Path("/broadcast").HandlerFunc(record(&app.broadcasts))
+	go http.Serve(l, muxRouter)
+	return app
+}
+
+func (app *testGossipApp) received() ([]string, []string) {
+	app.Lock()
+	defer app.Unlock()
+	return app.unicasts, app.broadcasts
+}
+
+// The process is called in the background, so give it a moment
+func (app *testGossipApp) waitFor(count int) ([]string, []string) {
+	for i := 0; i < 100; i++ {
+		if unicasts, broadcasts := app.received(); len(unicasts)+len(broadcasts) >= count {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return app.received()
+}
+
+func callGossipAPI(api *GossipAPI, method, path string, body []byte) *httptest.ResponseRecorder {
+	muxRouter := mux.NewRouter()
+	api.HandleHTTP(muxRouter)
+	req, _ := http.NewRequest(method, path, bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	muxRouter.ServeHTTP(w, req)
+	return w
+}
+
+func TestGossipAPI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gossip-api")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	r1 := NewTestRouter("01:00:00:01:00:00")
+	r2 := NewTestRouter("02:00:00:02:00:00")
+	r1.AddTestChannelConnection(r2)
+	r2.AddTestChannelConnection(r1)
+	sendPendingGossip(r1, r2)
+	api1, api2 := NewGossipAPI(r1), NewGossipAPI(r2)
+	app1, app2 := newTestGossipApp(t, dir, "app1.sock"), newTestGossipApp(t, dir, "app2.sock")
+	defer app1.listener.Close()
+	defer app2.listener.Close()
+
+	require.Equal(t, 400, callGossipAPI(api1, "PUT", "/gossip/Test?callback=app1.sock", nil).Code)
+	require.Equal(t, 404, callGossipAPI(api1, "POST", "/gossip/Test/broadcast", []byte("hello")).Code)
+	require.Equal(t, 204, callGossipAPI(api1, "PUT", "/gossip/Test?callback="+app1.socket, nil).Code)
+	require.Equal(t, 204, callGossipAPI(api2, "PUT", "/gossip/Test?callback="+app2.socket, nil).Code)
+
+	require.Equal(t, 204, callGossipAPI(api1, "POST", "/gossip/Test/broadcast", []byte("hello")).Code)
+	sendPendingGossip(r1, r2)
+	_, broadcasts := app2.waitFor(1)
+	require.Equal(t, []string{r1.Ourself.Name.String() + ":hello"}, broadcasts)
+
+	require.Equal(t, 204, callGossipAPI(api2, "POST", "/gossip/Test/unicast/"+r1.Ourself.Name.String(), []byte("hi")).Code)
+	unicasts, _ := app1.waitFor(1)
+	require.Equal(t, []string{r2.Ourself.Name.String() + ":hi"}, unicasts)
+
+	// Channels weaver uses itself can't be taken over
+	r1.NewGossip("Internal", newTestGossiper())
+	require.Equal(t, 400, callGossipAPI(api1, "PUT", "/gossip/Internal?callback="+app1.socket, nil).Code)
+
+	// Unregistering stops the queue of calls to the process, and
+	// registering again starts another
+	g, _ := api2.gossiper("Test")
+	done := g.done
+	require.Equal(t, 204, callGossipAPI(api2, "DELETE", "/gossip/Test", nil).Code)
+	require.Equal(t, 404, callGossipAPI(api2, "DELETE", "/gossip/Other", nil).Code)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		require.FailNow(t, "queue of calls still running after unregistering")
+	}
+	require.Nil(t, g.calls)
+	require.Equal(t, 204, callGossipAPI(api2, "PUT", "/gossip/Test?callback="+app2.socket, nil).Code)
+	require.NotNil(t, g.calls)
+}
+
+func TestGossipAPISlowProcess(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gossip-api")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	r1 := NewTestRouter("01:00:00:01:00:00")
+	api := NewGossipAPI(r1)
+	app := newTestGossipApp(t, dir, "app.sock")
+	defer app.listener.Close()
+	app.hold = make(chan struct{})
+	require.Equal(t, 204, callGossipAPI(api, "PUT", "/gossip/Test?callback="+app.socket, nil).Code)
+	g, _ := api.gossiper("Test")
+
+	// Messages for a process which isn't answering don't hold up the
+	// connection they arrived on, and are passed on in order once it does
+	sender := PeerName(2)
+	for _, msg := range []string{"one", "two", "three"} {
+		done := make(chan struct{})
+		go func() {
+			g.OnGossipUnicast(sender, []byte(msg))
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			require.FailNow(t, "blocked delivering to a slow process")
+		}
+	}
+	close(app.hold)
+	unicasts, _ := app.waitFor(3)
+	require.Equal(t, []string{sender.String() + ":one", sender.String() + ":two", sender.String() + ":three"}, unicasts)
+}
@@ -1,4 +1,4 @@
-package router
+package mesh
 
 import (
 	"bytes"
@@ -7,6 +7,11 @@ import (
 	"sync"
 )
 
+// Every so often we send neighbours everything, rather than just
+// what changed since the version they acknowledged, in case they
+// dropped some of it.
+const fullGossipEvery = 10
+
 type GossipChannel struct {
 	sync.Mutex
 	name         string
@@ -14,6 +19,9 @@ type GossipChannel struct {
 	routes       *Routes
 	gossiper     Gossiper
 	senders      connectionSenders
+	deltaSenders connectionSenders
+	acked        map[Connection]uint64 // version of our state each neighbour has acknowledged
+	rounds       int                   // of periodic gossip
 	broadcasters peerSenders
 }
 
@@ -27,6 +35,8 @@ func NewGossipChannel(channelName string, ourself *LocalPeer, routes *Routes, g
 		routes:       routes,
 		gossiper:     g,
 		senders:      make(connectionSenders),
+		deltaSenders: make(connectionSenders),
+		acked:        make(map[Connection]uint64),
 		broadcasters: make(peerSenders)}
 }
 
@@ -48,6 +58,10 @@ func (router *Router) handleGossip(tag ProtocolTag, payload []byte) error {
 		return channel.deliverBroadcast(srcName, payload, decoder)
 	case ProtocolGossip:
 		return channel.deliver(srcName, payload, decoder)
+	case ProtocolGossipDelta:
+		return channel.deliverDelta(srcName, payload, decoder)
+	case ProtocolGossipAck:
+		return channel.deliverAck(srcName, decoder)
 	}
 	return nil
 }
@@ -97,8 +111,101 @@ func (c *GossipChannel) deliver(srcName PeerName, _ []byte, dec *gob.Decoder) er
 	return nil
 }
 
-func (c *GossipChannel) Send(srcName PeerName, data GossipData) {
-	// do this outside the lock below so we avoid lock nesting
+func (c *GossipChannel) deliverDelta(srcName PeerName, payload []byte, dec *gob.Decoder) error {
+	var version uint64
+	if err := dec.Decode(&version); err != nil {
+		return err
+	}
+	if err := c.deliver(srcName, payload, dec); err != nil {
+		return err
+	}
+	// Only a gossiper which sends deltas itself can be relied upon to
+	// have kept everything it was sent; surrogates don't acknowledge.
+	if _, ok := c.gossiper.(DeltaGossiper); !ok {
+		return nil
+	}
+	if conn, found := c.ourself.ConnectionTo(srcName); found {
+		conn.(ProtocolSender).SendProtocolMsg(ProtocolMsg{ProtocolGossipAck, GobEncode(c.name, c.ourself.Name, version)})
+	}
+	return nil
+}
+
+func (c *GossipChannel) deliverAck(srcName PeerName, dec *gob.Decoder) error {
+	var version uint64
+	if err := dec.Decode(&version); err != nil {
+		return err
+	}
+	if conn, found := c.ourself.ConnectionTo(srcName); found {
+		c.Lock()
+		c.acked[conn] = version
+		c.Unlock()
+	}
+	return nil
+}
+
+// SendGossip sends our state to some neighbours.  If the gossiper can,
+// neighbours which can take them are sent just the changes since the
+// version they last acknowledged.
+func (c *GossipChannel) SendGossip() {
+	deltaGossiper, ok := c.gossiper.(DeltaGossiper)
+	if !ok {
+		if gossip := c.gossiper.Gossip(); gossip != nil {
+			c.Send(c.ourself.Name, gossip)
+		}
+		return
+	}
+	selectedConnections := c.neighbourConnections(c.ourself.Name)
+	if len(selectedConnections) == 0 {
+		return
+	}
+	// Work out what to send outside the lock, so we avoid lock
+	// nesting with the gossiper
+	c.Lock()
+	c.rounds++
+	full := c.rounds%fullGossipEvery == 0
+	acked := make(map[Connection]uint64)
+	for conn := range selectedConnections {
+		if canTakeGossipDelta(conn) {
+			acked[conn] = c.acked[conn]
+			if full {
+				acked[conn] = 0
+			}
+		}
+	}
+	c.Unlock()
+	type delta struct {
+		data    GossipData
+		version uint64
+	}
+	deltas := make(map[Connection]delta)
+	var gossip GossipData
+	for conn := range selectedConnections {
+		if since, found := acked[conn]; found {
+			data, version := deltaGossiper.GossipSince(since)
+			deltas[conn] = delta{data, version}
+		} else if gossip == nil {
+			gossip = c.gossiper.Gossip()
+		}
+	}
+
+	connections := c.ourself.Connections()
+	c.Lock()
+	defer c.Unlock()
+	c.gcSenders(connections)
+	for conn := range selectedConnections {
+		if d, found := deltas[conn]; !found {
+			if gossip != nil {
+				c.sendDown(conn, gossip)
+			}
+		} else if d.data != nil {
+			c.sendDownDelta(conn, d.data, d.version)
+		}
+	}
+}
+
+// Connections to random neighbours, for gossip from srcName
+func (c *GossipChannel) neighbourConnections(srcName PeerName) ConnectionSet {
+	// do this outside any lock so we avoid lock nesting
 	c.routes.EnsureRecalculated()
 	selectedConnections := make(ConnectionSet)
 	for name := range c.routes.RandomNeighbours(srcName) {
@@ -106,6 +213,11 @@ func (c *GossipChannel) Send(srcName PeerName, data GossipData) {
 			selectedConnections[conn] = void
 		}
 	}
+	return selectedConnections
+}
+
+func (c *GossipChannel) Send(srcName PeerName, data GossipData) {
+	selectedConnections := c.neighbourConnections(srcName)
 	if len(selectedConnections) == 0 {
 		return
 	}
@@ -138,10 +250,19 @@ func (c *GossipChannel) SendDown(conn Connection, data GossipData) {
 // the result of LocalPeer.Connections(). That is O(n_our_connections)
 // at best.
 func (c *GossipChannel) gcSenders(connections ConnectionSet) {
-	for conn, sender := range c.senders {
+	for _, senders := range []connectionSenders{c.senders, c.deltaSenders} {
+		for conn, sender := range senders {
+			if _, found := connections[conn]; !found {
+				delete(senders, conn)
+				sender.Stop()
+			} else {
+				break
+			}
+		}
+	}
+	for conn := range c.acked {
 		if _, found := connections[conn]; !found {
-			delete(c.senders, conn)
-			sender.Stop()
+			delete(c.acked, conn)
 		} else {
 			break
 		}
@@ -152,6 +273,17 @@ func (c *GossipChannel) gcSenders(connections ConnectionSet) {
 // 100MB should be enough for anyone.
 const maxFeasibleMessageLen = 100 * 1024 * 1024
 
+// Stop all senders, when the channel is being replaced
+func (c *GossipChannel) stop() {
+	c.Lock()
+	defer c.Unlock()
+	c.gcSenders(make(ConnectionSet))
+	for name, broadcaster := range c.broadcasters {
+		delete(c.broadcasters, name)
+		broadcaster.Stop()
+	}
+}
+
 func (c *GossipChannel) sendDown(conn Connection, data GossipData) {
 	sender, found := c.senders[conn]
 	if !found {
@@ -169,6 +301,51 @@ func (c *GossipChannel) sendDown(conn Connection, data GossipData) {
 	sender.Send(data)
 }
 
+// Changes to our state since some version, which the recipient
+// acknowledges having once it has taken them in
+type deltaGossipData struct {
+	data    GossipData
+	version uint64
+}
+
+func (d *deltaGossipData) Encode() [][]byte {
+	return d.data.Encode()
+}
+
+func (d *deltaGossipData) Merge(other GossipData) {
+	o := other.(*deltaGossipData)
+	d.data.Merge(o.data)
+	d.version = o.version
+}
+
+// Connections which can carry gossip deltas; see LocalConnection
+type gossipDeltaConnection interface {
+	GossipDelta() bool
+}
+
+func canTakeGossipDelta(conn Connection) bool {
+	dc, ok := conn.(gossipDeltaConnection)
+	return ok && dc.GossipDelta()
+}
+
+func (c *GossipChannel) sendDownDelta(conn Connection, data GossipData, version uint64) {
+	sender, found := c.deltaSenders[conn]
+	if !found {
+		sender = NewGossipSender(func(pending GossipData) {
+			delta := pending.(*deltaGossipData)
+			for _, msg := range delta.Encode() {
+				if len(msg) > maxFeasibleMessageLen {
+					panic(fmt.Sprintf("Gossip message too large: len=%d bytes; on channel '%s' from %+v", len(msg), c.name, pending))
+				}
+				protocolMsg := ProtocolMsg{ProtocolGossipDelta, GobEncode(c.name, c.ourself.Name, delta.version, msg)}
+				conn.(ProtocolSender).SendProtocolMsg(protocolMsg)
+			}
+		})
+		c.deltaSenders[conn] = sender
+	}
+	sender.Send(&deltaGossipData{data, version})
+}
+
 func (c *GossipChannel) GossipUnicast(dstPeerName PeerName, msg []byte) error {
 	return c.relayUnicast(dstPeerName, GobEncode(c.name, c.ourself.Name, dstPeerName, msg))
 }
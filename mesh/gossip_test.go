@@ -1,6 +1,8 @@
-package router
+package mesh
 
 import (
+	"bytes"
+	"compress/flate"
 	"fmt"
 	"sync"
 	"testing"
@@ -20,7 +22,7 @@ type mockChannelConnection struct {
 
 func NewTestRouter(name string) *Router {
 	peerName, _ := PeerNameFromString(name)
-	router := NewRouter(Config{}, peerName, "nick")
+	router := NewRouter(Config{}, peerName, "nick", nil)
 	router.Start()
 	return router
 }
@@ -31,6 +33,10 @@ func (conn *mockChannelConnection) SendProtocolMsg(protocolMsg ProtocolMsg) {
 	}
 }
 
+func (conn *mockChannelConnection) GossipDelta() bool {
+	return true
+}
+
 func sendPendingGossip(routers ...*Router) {
 	// Loop until all routers report they didn't send anything
 	for sentSomething := true; sentSomething; {
@@ -257,3 +263,112 @@ func (g *testGossiper) checkHas(t *testing.T, vs ...byte) {
 func broadcast(s Gossip, v byte) {
 	s.GossipBroadcast(NewSurrogateGossipData([]byte{v}))
 }
+
+// A gossiper which can send deltas, numbering each value it learns
+type testDeltaGossiper struct {
+	*testGossiper
+	serial   uint64
+	learnt   map[byte]uint64
+	received int    // number of gossips received
+	last     []byte // the most recent of them
+}
+
+func newTestDeltaGossiper() *testDeltaGossiper {
+	return &testDeltaGossiper{testGossiper: newTestGossiper(), learnt: make(map[byte]uint64)}
+}
+
+func (g *testDeltaGossiper) add(v byte) {
+	g.Lock()
+	defer g.Unlock()
+	if _, found := g.state[v]; found {
+		return
+	}
+	g.serial++
+	g.state[v] = void
+	g.learnt[v] = g.serial
+}
+
+func (g *testDeltaGossiper) OnGossip(update []byte) (GossipData, error) {
+	g.Lock()
+	g.received++
+	g.last = update
+	g.Unlock()
+	for _, v := range update {
+		g.add(v)
+	}
+	return nil, nil
+}
+
+func (g *testDeltaGossiper) GossipSince(since uint64) (GossipData, uint64) {
+	g.RLock()
+	defer g.RUnlock()
+	var delta []byte
+	for v, serial := range g.learnt {
+		if serial > since {
+			delta = append(delta, v)
+		}
+	}
+	if len(delta) == 0 {
+		return nil, g.serial
+	}
+	return NewSurrogateGossipData(delta), g.serial
+}
+
+func TestGossipDelta(t *testing.T) {
+	r1 := NewTestRouter("01:00:00:01:00:00")
+	r2 := NewTestRouter("02:00:00:02:00:00")
+	r1.AddTestChannelConnection(r2)
+	r2.AddTestChannelConnection(r1)
+	sendPendingGossip(r1, r2)
+
+	g1 := newTestDeltaGossiper()
+	g2 := newTestDeltaGossiper()
+	r1.NewGossip("Test", g1)
+	r2.NewGossip("Test", g2)
+	g1.add(1)
+	g1.add(2)
+
+	r1.SendAllGossip()
+	sendPendingGossip(r1, r2)
+	g2.checkHas(t, 1, 2)
+	channel := r1.gossipChannel("Test")
+	conn, _ := r1.Ourself.ConnectionTo(r2.Ourself.Name)
+	channel.Lock()
+	require.Equal(t, uint64(2), channel.acked[conn], "acknowledged")
+	channel.Unlock()
+
+	// Nothing changed, so nothing is sent
+	r1.SendAllGossip()
+	sendPendingGossip(r1, r2)
+	require.Equal(t, 1, g2.received)
+
+	// Just the change is sent
+	g1.add(3)
+	r1.SendAllGossip()
+	sendPendingGossip(r1, r2)
+	require.Equal(t, 2, g2.received)
+	g2.checkHas(t, 3)
+	require.Equal(t, []byte{3}, g2.last, "nothing sent again")
+}
+
+func TestGossipCompression(t *testing.T) {
+	msg := GobEncode("Test", make([]byte, 1000))
+	compressed := compress(msg)
+	require.True(t, len(compressed) < len(msg), "compressed")
+	decompressed, err := decompress(compressed)
+	require.NoError(t, err)
+	require.Equal(t, msg, decompressed)
+
+	// Messages expanding beyond what could have been sent are refused
+	buf := new(bytes.Buffer)
+	w, err := flate.NewWriter(buf, flate.BestSpeed)
+	require.NoError(t, err)
+	chunk := make([]byte, 1024*1024)
+	for written := 0; written <= maxFeasibleMessageLen; written += len(chunk) {
+		_, err = w.Write(chunk)
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+	_, err = decompress(buf.Bytes())
+	require.Error(t, err)
+}
@@ -1,4 +1,4 @@
-package router
+package mesh
 
 import (
 	"fmt"
@@ -24,6 +24,8 @@ func NewLocalPeer(name PeerName, nickName string, router *Router) *LocalPeer {
 		router:     router,
 		actionChan: actionChan,
 	}
+	peer.ShortIDOptional = true
+	peer.ZoneSummaries = true
 	go peer.actorLoop(actionChan)
 	return peer
 }
@@ -253,5 +255,13 @@ func (peer *LocalPeer) setShortID(shortID PeerShortID) {
 	peer.Lock()
 	defer peer.Unlock()
 	peer.ShortID = shortID
+	peer.HasShortID = true
+	peer.Version++
+}
+
+func (peer *LocalPeer) clearShortID() {
+	peer.Lock()
+	defer peer.Unlock()
+	peer.HasShortID = false
 	peer.Version++
 }
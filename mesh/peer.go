@@ -1,4 +1,4 @@
-package router
+package mesh
 
 import (
 	"fmt"
@@ -17,10 +17,13 @@ func ParsePeerUID(s string) (PeerUID, error) {
 	return PeerUID(uid), err
 }
 
-// Short IDs exist for the sake of fast datapath.  They are 12 bits,
-// randomly assigned, but we detect and recover from collisions.  This
-// does limit us to 4096 peers, but that should be sufficient for a
-// while.
+// Short IDs exist for the sake of fast datapath with vxlan.  They are
+// 12 bits, randomly assigned, but we detect and recover from
+// collisions.  That keeps peers from being mistaken for each other,
+// but does not make room for more than 4096 of them: once every peer
+// understands it (see ShortIDOptional), a peer which cannot find a
+// short ID of its own goes without, and so only uses fast datapath
+// with peers which give out IDs of their own (see router/fastdp.go).
 type PeerShortID uint16
 
 const PeerShortIDBits = 12
@@ -30,12 +33,25 @@ func randomPeerShortID() PeerShortID {
 }
 
 type PeerSummary struct {
-	NameByte   []byte
-	NickName   string
-	UID        PeerUID
-	Version    uint64
-	ShortID    PeerShortID
-	HasShortID bool
+	NameByte    []byte
+	NickName    string
+	UID         PeerUID
+	Version     uint64
+	ShortID     PeerShortID
+	HasShortID  bool
+	Zone        string
+	ZoneGateway bool
+	// Set by peers which understand others going without short
+	// IDs.  Older peers keep a peer at the short ID it first had.
+	ShortIDOptional bool
+	// Set when the connections have been summarised for another
+	// zone (see zones.go), so that the full list at the same
+	// version replaces them.
+	Summarised bool
+	// Set by peers which understand that.  Older peers would keep
+	// a summary in place of the full connections at the same
+	// version.
+	ZoneSummaries bool
 }
 
 type Peer struct {
@@ -1,4 +1,4 @@
-package router
+package mesh
 
 import (
 	"bytes"
@@ -15,6 +15,10 @@ type Peers struct {
 	byShortID map[PeerShortID]ShortIDPeers
 	onGC      []func(*Peer)
 
+	// An older peer we last logged as keeping us at a short id we
+	// share with another peer
+	shortIDKeptBy PeerName
+
 	// Called when the mapping from short ids to peers changes
 	onInvalidateShortIDs []func()
 }
@@ -89,7 +93,8 @@ func (peers *Peers) OnInvalidateShortIDs(callback func()) {
 }
 
 func (peers *Peers) unlockAndNotify(pending *PeersPendingNotifications) {
-	broadcastLocalPeer := pending.reassignLocalShortID && peers.reassignLocalShortID(pending)
+	broadcastLocalPeer := pending.reassignLocalShortID &&
+		(peers.reassignLocalShortID(pending) || peers.dropLocalShortID(pending))
 	onGC := peers.onGC
 	onInvalidateShortIDs := peers.onInvalidateShortIDs
 	peers.Unlock()
@@ -211,6 +216,44 @@ func (peers *Peers) reassignLocalShortID(pending *PeersPendingNotifications) boo
 	return false
 }
 
+// When we cannot find a short id of our own, we give up the one we
+// share with another peer, so that traffic for that peer is not
+// mistaken for ours.  Older peers would keep us at the short id, and
+// could take us for its owner once that goes, so we only do this
+// when every peer understands it, and say which peer doesn't
+// otherwise.  Returns true if the local peer changed.
+func (peers *Peers) dropLocalShortID(pending *PeersPendingNotifications) bool {
+	ourself := peers.ourself
+	if !ourself.HasShortID || peers.byShortID[ourself.ShortID].peer == ourself.Peer {
+		return false
+	}
+	if older := peers.olderPeer(); older != nil {
+		if older.Name != peers.shortIDKeptBy {
+			log.Printf("Keeping short id %d, which another peer owns, as peer %s does not understand peers going without; our traffic with peers not giving out ids of their own goes over sleeve", ourself.ShortID, older)
+			peers.shortIDKeptBy = older.Name
+		}
+		return false
+	}
+
+	peers.deleteByShortID(ourself.Peer, pending)
+	ourself.clearShortID()
+	return true
+}
+
+// A peer which does not understand others going without short ids,
+// preferring the one we last logged
+func (peers *Peers) olderPeer() *Peer {
+	if peer, found := peers.byName[peers.shortIDKeptBy]; found && !peer.ShortIDOptional {
+		return peer
+	}
+	for _, peer := range peers.byName {
+		if !peer.ShortIDOptional {
+			return peer
+		}
+	}
+	return nil
+}
+
 func (peers *Peers) setLocalShortID(newShortID PeerShortID, pending *PeersPendingNotifications) {
 	peers.deleteByShortID(peers.ourself.Peer, pending)
 	peers.ourself.setShortID(newShortID)
@@ -366,10 +409,18 @@ func (peers *Peers) EncodePeers(names PeerNameSet) []byte {
 	enc := gob.NewEncoder(buf)
 	peers.RLock()
 	defer peers.RUnlock()
+	understood, checked := true, false
 	for name := range names {
 		if peer, found := peers.byName[name]; found {
 			if peer == peers.ourself.Peer {
 				peers.ourself.Encode(enc)
+				continue
+			}
+			if peer.Summarised && !checked {
+				understood, checked = peers.summariesUnderstood(), true
+			}
+			if peer.Summarised && !understood {
+				peer.encodeSummaryForOlder(enc)
 			} else {
 				peer.Encode(enc)
 			}
@@ -454,13 +505,20 @@ func (peers *Peers) decodeUpdate(update []byte) (newPeers map[PeerName]*Peer, de
 
 func (peers *Peers) applyUpdate(decodedUpdate []*Peer, decodedConns [][]ConnectionSummary, pending *PeersPendingNotifications) PeerNameSet {
 	newUpdate := make(PeerNameSet)
+	summarising := peers.summariesUnderstood()
 	for idx, newPeer := range decodedUpdate {
 		connSummaries := decodedConns[idx]
 		name := newPeer.Name
 		// guaranteed to find peer in the peers.byName
 		peer := peers.byName[name]
+		// The full connections of a peer replace a summary of
+		// them at the same version, unless we would summarise
+		// them too.
+		summarise := summarising && peers.summarises(newPeer)
+		fuller := peer.Version == newPeer.Version && peer.Summarised &&
+			!newPeer.Summarised && !summarise
 		if peer != newPeer &&
-			(peer == peers.ourself.Peer || peer.Version >= newPeer.Version) {
+			(peer == peers.ourself.Peer || (peer.Version >= newPeer.Version && !fuller)) {
 			// Nobody but us updates us. And if we know more about a
 			// peer than what's in the the update, we ignore the
 			// latter.
@@ -477,11 +535,19 @@ func (peers *Peers) applyUpdate(decodedUpdate []*Peer, decodedConns [][]Connecti
 		// router.Peers.ApplyUpdate. But ApplyUpdate takes the Lock on
 		// the router.Peers, so there can be no race here.
 		peer.Version = newPeer.Version
+		peer.Zone, peer.ZoneGateway = newPeer.Zone, newPeer.ZoneGateway
+		peer.ShortIDOptional = newPeer.ShortIDOptional
+		peer.ZoneSummaries = newPeer.ZoneSummaries
+		peer.Summarised = newPeer.Summarised || summarise
+		if summarise {
+			connSummaries = peers.summariseConnections(peer, connSummaries)
+		}
 		peer.connections = makeConnsMap(peer, connSummaries, peers.byName)
 
-		if newPeer.ShortID != peer.ShortID {
+		if newPeer.ShortID != peer.ShortID || newPeer.HasShortID != peer.HasShortID {
 			peers.deleteByShortID(peer, pending)
 			peer.ShortID = newPeer.ShortID
+			peer.HasShortID = newPeer.HasShortID
 			peers.addByShortID(peer, pending)
 		}
 
@@ -1,4 +1,4 @@
-package router
+package mesh
 
 import (
 	"fmt"
@@ -362,9 +362,10 @@ func TestDeferredShortIDReassignment(t *testing.T) {
 	}
 
 	// Check that, as expected, the local peer does not own its
-	// short id
+	// short id, and so has given it up
 	require.NotEqual(t, us.ourself.Peer,
 		us.byShortID[us.ourself.ShortID].peer)
+	require.False(t, us.ourself.HasShortID)
 
 	// Disconnect one peer, and we should now be able to claim its
 	// short id
@@ -373,4 +374,54 @@ func TestDeferredShortIDReassignment(t *testing.T) {
 	us.GarbageCollect()
 
 	require.Equal(t, us.ourself.Peer, us.byShortID[us.ourself.ShortID].peer)
+	require.True(t, us.ourself.HasShortID)
+}
+
+func TestDroppedShortIDPropagation(t *testing.T) {
+	_, peers1 := newNode(PeerName(1))
+	_, peers2 := newNode(PeerName(2))
+
+	peers1.AddTestConnection(peers2.ourself.Peer)
+	peers1.ApplyUpdate(peers2.EncodePeers(peers2.Names()))
+	peers12 := peers1.Fetch(PeerName(2))
+	require.True(t, peers12.HasShortID)
+
+	// Peer 2 gives up its short id when it collides with a peer
+	// with a lower name, and it cannot find another
+	var pending PeersPendingNotifications
+	peers2.addByShortID(NewPeer(PeerName(0), "", PeerUID(0), 0,
+		peers2.ourself.ShortID), &pending)
+	require.True(t, peers2.dropLocalShortID(&pending))
+	require.False(t, peers2.dropLocalShortID(&pending))
+	peers1.ApplyUpdate(peers2.EncodePeers(PeerNameSet{PeerName(2): void}))
+	require.False(t, peers12.HasShortID)
+	require.NotEqual(t, peers12, peers1.FetchByShortID(peers12.ShortID))
+
+	// ... and takes one again when it can
+	require.True(t, peers2.reassignLocalShortID(&pending))
+	peers1.ApplyUpdate(peers2.EncodePeers(PeerNameSet{PeerName(2): void}))
+	require.True(t, peers12.HasShortID)
+	require.Equal(t, peers12, peers1.FetchByShortID(peers2.ourself.ShortID))
+}
+
+// Older peers would keep a peer at the short id it gives up
+func TestShortIDKeptWithOlderPeers(t *testing.T) {
+	_, peers1 := newNode(PeerName(2))
+	var pending PeersPendingNotifications
+	peers1.addByShortID(NewPeer(PeerName(0), "", PeerUID(0), 0,
+		peers1.ourself.ShortID), &pending)
+
+	older := peers1.FetchWithDefault(NewPeer(PeerName(3), "", PeerUID(0), 0,
+		(peers1.ourself.ShortID+1)%(1<<PeerShortIDBits)))
+	require.False(t, peers1.dropLocalShortID(&pending))
+	require.True(t, peers1.ourself.HasShortID)
+	require.Equal(t, older.Name, peers1.shortIDKeptBy)
+
+	// ... until they upgrade
+	update := NewPeerFrom(older)
+	update.Version++
+	update.ShortIDOptional = true
+	peers1.applyUpdate([]*Peer{update}, [][]ConnectionSummary{nil}, &pending)
+	require.True(t, peers1.dropLocalShortID(&pending))
+	require.False(t, peers1.ourself.HasShortID)
 }
@@ -1,4 +1,4 @@
-package router
+package mesh
 
 import (
 	"bytes"
@@ -336,6 +336,8 @@ const (
 	ProtocolGossipUnicast
 	ProtocolGossipBroadcast
 	ProtocolOverlayControlMsg
+	ProtocolGossipDelta
+	ProtocolGossipAck
 )
 
 type ProtocolMsg struct {
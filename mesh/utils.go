@@ -0,0 +1,134 @@
+package mesh
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+
+	"github.com/weaveworks/weave/common"
+)
+
+var log = common.Log
+
+var void = struct{}{}
+
+func checkFatal(e error) {
+	if e != nil {
+		log.Fatal(e)
+	}
+}
+
+func checkWarn(e error) {
+	if e != nil {
+		log.Warnln(e)
+	}
+}
+
+func (upe UnknownPeerError) Error() string {
+	return fmt.Sprint("Reference to unknown peer ", upe.Name)
+}
+
+func (nce NameCollisionError) Error() string {
+	return fmt.Sprint("Multiple peers found with same name: ", nce.Name)
+}
+
+func Concat(elems ...[]byte) []byte {
+	res := []byte{}
+	for _, e := range elems {
+		res = append(res, e...)
+	}
+	return res
+}
+
+func randBytes(n int) []byte {
+	buf := make([]byte, n)
+	_, err := rand.Read(buf)
+	checkFatal(err)
+	return buf
+}
+
+func randUint64() (r uint64) {
+	return binary.LittleEndian.Uint64(randBytes(8))
+}
+
+func randUint16() (r uint16) {
+	return binary.LittleEndian.Uint16(randBytes(2))
+}
+
+func GobEncode(items ...interface{}) []byte {
+	buf := new(bytes.Buffer)
+	enc := gob.NewEncoder(buf)
+	for _, i := range items {
+		checkFatal(enc.Encode(i))
+	}
+	return buf.Bytes()
+}
+
+// Gossip payloads are compressed on connections where both ends
+// have asked for it; acknowledgements are too small to bother.
+const gossipCompression = "flate"
+
+func isGossip(tag ProtocolTag) bool {
+	switch tag {
+	case ProtocolGossip, ProtocolGossipUnicast, ProtocolGossipBroadcast, ProtocolGossipDelta:
+		return true
+	}
+	return false
+}
+
+func compress(msg []byte) []byte {
+	buf := new(bytes.Buffer)
+	w, err := flate.NewWriter(buf, flate.BestSpeed)
+	checkFatal(err)
+	_, err = w.Write(msg)
+	checkFatal(err)
+	checkFatal(w.Close())
+	return buf.Bytes()
+}
+
+// Messages are limited in size before compression, so one which
+// decompresses to more than that is bogus
+func decompress(msg []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(msg))
+	defer r.Close()
+	buf, err := ioutil.ReadAll(io.LimitReader(r, maxFeasibleMessageLen+1))
+	if err == nil && len(buf) > maxFeasibleMessageLen {
+		return nil, fmt.Errorf("compressed message expands beyond the maximum message length of %d bytes", maxFeasibleMessageLen)
+	}
+	return buf, err
+}
+
+func macint(mac net.HardwareAddr) (r uint64) {
+	for _, b := range mac {
+		r <<= 8
+		r |= uint64(b)
+	}
+	return
+}
+
+func intmac(key uint64) (r net.HardwareAddr) {
+	r = make([]byte, 6)
+	for i := 5; i >= 0; i-- {
+		r[i] = byte(key)
+		key >>= 8
+	}
+	return
+}
+
+type ListOfPeers []*Peer
+
+func (lop ListOfPeers) Len() int {
+	return len(lop)
+}
+func (lop ListOfPeers) Swap(i, j int) {
+	lop[i], lop[j] = lop[j], lop[i]
+}
+func (lop ListOfPeers) Less(i, j int) bool {
+	return lop[i].Name < lop[j].Name
+}
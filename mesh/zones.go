@@ -0,0 +1,73 @@
+package mesh
+
+import (
+	"encoding/gob"
+)
+
+// Peers can be grouped into zones, to let the network scale to
+// thousands of peers.  With peer discovery, peers only connect to
+// the other peers in their zone, and to the gateways of other zones
+// if they are gateways themselves.  And we only keep a summary of
+// the topology of other zones: for each peer outside our zone, just
+// its connections to the gateways of its zone, or to other zones.
+// That is all we need to route to it via the gateways, and keeps
+// topology gossip from growing with the square of the number of
+// peers.
+//
+// Peers with no zone, including peers which predate zones, are
+// treated as before: connected to by all, and never summarised.
+// Peers which predate zones would also take a summary for the full
+// connections, so while there are any, we make no summaries, and
+// gossip those we have under an earlier version than the peer's (see
+// ZoneSummaries).
+
+// Should we discover and connect to the other peer?
+func (peer *Peer) zoneAllows(other *Peer) bool {
+	return peer.Zone == "" || other.Zone == "" || other.Zone == peer.Zone ||
+		(peer.ZoneGateway && other.ZoneGateway)
+}
+
+// Do we only keep a summary of the peer's connections?
+func (peers *Peers) summarises(peer *Peer) bool {
+	ourZone := peers.ourself.Zone
+	return ourZone != "" && peer.Zone != "" && peer.Zone != ourZone && !peer.ZoneGateway
+}
+
+// Do all peers understand summaries?  Call with the Peers lock held.
+func (peers *Peers) summariesUnderstood() bool {
+	for _, peer := range peers.byName {
+		if !peer.ZoneSummaries {
+			return false
+		}
+	}
+	return true
+}
+
+// Summarise the connections of a peer in another zone.  Call with
+// the Peers lock held.
+//
+// Summaries get gossiped on under the peer's version, including to
+// peers in its zone, which keep them until they hear of a later
+// version, or of the full connections (see Peers.applyUpdate).
+func (peers *Peers) summariseConnections(peer *Peer, connSummaries []ConnectionSummary) []ConnectionSummary {
+	summary := []ConnectionSummary{}
+	for _, connSummary := range connSummaries {
+		remote, found := peers.byName[PeerNameFromBin(connSummary.NameByte)]
+		if !found || remote.Zone != peer.Zone || remote.ZoneGateway {
+			summary = append(summary, connSummary)
+		}
+	}
+	return summary
+}
+
+// Encode a summary we hold for peers which may not understand it,
+// under the version before the peer's, so that they take the full
+// connections when they hear them.  A peer at version 0 has none to
+// leave out.
+func (peer *Peer) encodeSummaryForOlder(enc *gob.Encoder) {
+	older := *peer
+	if older.Version > 0 {
+		older.Version--
+	}
+	older.Encode(enc)
+}
@@ -0,0 +1,160 @@
+package mesh
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newZonePeer(name PeerName, zone string, gateway bool) *Peer {
+	peer := NewPeer(name, "", PeerUID(name), 0, PeerShortID(name))
+	peer.Zone, peer.ZoneGateway = zone, gateway
+	peer.ZoneSummaries = true
+	return peer
+}
+
+func TestZoneAllows(t *testing.T) {
+	a1 := newZonePeer(PeerName(1), "a", false)
+	a2 := newZonePeer(PeerName(2), "a", false)
+	aGw := newZonePeer(PeerName(3), "a", true)
+	b1 := newZonePeer(PeerName(4), "b", false)
+	bGw := newZonePeer(PeerName(5), "b", true)
+	none := newZonePeer(PeerName(6), "", false)
+
+	require.True(t, a1.zoneAllows(a2))
+	require.True(t, a1.zoneAllows(aGw))
+	require.False(t, a1.zoneAllows(b1))
+	require.False(t, a1.zoneAllows(bGw))
+	require.True(t, aGw.zoneAllows(bGw))
+	require.False(t, aGw.zoneAllows(b1))
+	require.True(t, a1.zoneAllows(none))
+	require.True(t, none.zoneAllows(b1))
+}
+
+// Check which connections of a peer in zone "b" we keep, depending on
+// our zone
+func checkZoneSummary(t *testing.T, ourZone string, expected ...PeerName) {
+	// Peer 1 is in zone "b", connected to another peer in that
+	// zone, its gateway, and a peer in zone "c"
+	_, source := newNode(PeerName(1))
+	source.ourself.Zone = "b"
+	source.AddTestConnection(newZonePeer(PeerName(2), "b", false))
+	source.AddTestConnection(newZonePeer(PeerName(3), "b", true))
+	source.AddTestConnection(newZonePeer(PeerName(4), "c", false))
+
+	_, us := newNode(PeerName(10))
+	us.ourself.Zone = ourZone
+	us.AddTestConnection(source.ourself.Peer)
+	_, _, err := us.ApplyUpdate(source.EncodePeers(source.Names()))
+	require.NoError(t, err)
+
+	var kept []PeerName
+	for name := range us.Fetch(PeerName(1)).connections {
+		kept = append(kept, name)
+	}
+	require.Equal(t, len(expected), len(kept))
+	for _, name := range expected {
+		require.Contains(t, kept, name)
+	}
+}
+
+func TestZoneSummary(t *testing.T) {
+	// Outside zone "b", we only keep the connections to its
+	// gateway and to other zones
+	checkZoneSummary(t, "a", PeerName(3), PeerName(4))
+
+	// Inside it, or without zones, we keep them all
+	checkZoneSummary(t, "b", PeerName(2), PeerName(3), PeerName(4))
+	checkZoneSummary(t, "", PeerName(2), PeerName(3), PeerName(4))
+}
+
+// With two gateways in a zone, the summary one of them gets from
+// another zone must not keep out the full connections
+func TestZoneSummaryRelayed(t *testing.T) {
+	// Peer 1 is in zone "b", connected to another peer in that
+	// zone, and to gateway 3 of the two in zone "b"
+	_, source := newNode(PeerName(1))
+	source.ourself.Zone = "b"
+	source.AddTestConnection(newZonePeer(PeerName(2), "b", false))
+	source.AddTestConnection(newZonePeer(PeerName(3), "b", true))
+	full := source.EncodePeers(source.Names())
+
+	// The gateway of zone "a" summarises it
+	_, aGw := newNode(PeerName(10))
+	aGw.ourself.Zone, aGw.ourself.ZoneGateway = "a", true
+	aGw.AddTestConnection(source.ourself.Peer)
+	_, _, err := aGw.ApplyUpdate(full)
+	require.NoError(t, err)
+	require.Len(t, aGw.Fetch(PeerName(1)).connections, 1)
+
+	// and hearing the full connections again changes nothing
+	_, newUpdate, err := aGw.ApplyUpdate(full)
+	require.NoError(t, err)
+	require.Empty(t, newUpdate)
+
+	// The other gateway of zone "b" hears the summary first
+	_, bGw := newNode(PeerName(4))
+	bGw.ourself.Zone, bGw.ourself.ZoneGateway = "b", true
+	bGw.AddTestConnection(aGw.ourself.Peer)
+	_, _, err = bGw.ApplyUpdate(aGw.EncodePeers(aGw.Names()))
+	require.NoError(t, err)
+	require.Len(t, bGw.Fetch(PeerName(1)).connections, 1)
+
+	// and then the full connections, at the same version
+	_, newUpdate, err = bGw.ApplyUpdate(full)
+	require.NoError(t, err)
+	require.Contains(t, newUpdate, PeerName(1))
+	require.Len(t, bGw.Fetch(PeerName(1)).connections, 2)
+	require.False(t, bGw.Fetch(PeerName(1)).Summarised)
+
+	// after which the summary does not replace them again
+	_, newUpdate, err = bGw.ApplyUpdate(aGw.EncodePeers(aGw.Names()))
+	require.NoError(t, err)
+	require.NotContains(t, newUpdate, PeerName(1))
+	require.Len(t, bGw.Fetch(PeerName(1)).connections, 2)
+}
+
+// Peers which predate zones ignore Summarised, so must never hear a
+// summary under the peer's version
+func TestZoneSummaryOlderPeers(t *testing.T) {
+	// Peer 1 is in zone "b", connected to another peer in that
+	// zone, and to its gateway
+	_, source := newNode(PeerName(1))
+	source.ourself.Zone = "b"
+	source.AddTestConnection(newZonePeer(PeerName(2), "b", false))
+	source.AddTestConnection(newZonePeer(PeerName(3), "b", true))
+	full := source.EncodePeers(source.Names())
+	version := source.ourself.Version
+
+	// The gateway of zone "a" summarises it
+	_, aGw := newNode(PeerName(10))
+	aGw.ourself.Zone, aGw.ourself.ZoneGateway = "a", true
+	aGw.AddTestConnection(source.ourself.Peer)
+	_, _, err := aGw.ApplyUpdate(full)
+	require.NoError(t, err)
+	require.Len(t, aGw.Fetch(PeerName(1)).connections, 1)
+
+	summaryVersion := func() uint64 {
+		update := aGw.EncodePeers(PeerNameSet{PeerName(1): void})
+		summary, _, err := decodePeer(gob.NewDecoder(bytes.NewReader(update)))
+		require.NoError(t, err)
+		return summary.Version
+	}
+	require.Equal(t, version, summaryVersion())
+
+	// Once an older peer turns up, the summary goes out under an
+	// earlier version, so the older peer takes the full
+	// connections when it hears them
+	aGw.AddTestConnection(NewPeer(PeerName(20), "", PeerUID(20), 0, PeerShortID(20)))
+	require.True(t, summaryVersion() < version)
+
+	// and we no longer summarise, so take them too
+	_, newUpdate, err := aGw.ApplyUpdate(full)
+	require.NoError(t, err)
+	require.Contains(t, newUpdate, PeerName(1))
+	require.Len(t, aGw.Fetch(PeerName(1)).connections, 2)
+	require.False(t, aGw.Fetch(PeerName(1)).Summarised)
+	require.Equal(t, version, summaryVersion())
+}
@@ -32,6 +32,13 @@ type DNSServer struct {
 	ttl     uint32
 	address string
 
+	// Networks permitted to transfer the zone; transfers are
+	// disabled when empty.
+	transferACL []*net.IPNet
+	// TSIG secrets, by key name, for authenticating dynamic
+	// updates; updates are disabled when empty.
+	updateKeys map[string]string
+
 	servers   []*dns.Server
 	upstream  *dns.ClientConfig
 	tcpClient *dns.Client
@@ -49,14 +56,16 @@ func filter(ss []string, s string) []string {
 	return ss
 }
 
-func NewDNSServer(ns *Nameserver, domain, address, effectiveAddress string, ttl uint32, clientTimeout time.Duration) (*DNSServer, error) {
+func NewDNSServer(ns *Nameserver, domain, address, effectiveAddress string, ttl uint32, clientTimeout time.Duration, transferACL []*net.IPNet, updateKeys map[string]string) (*DNSServer, error) {
 	s := &DNSServer{
-		ns:        ns,
-		domain:    dns.Fqdn(domain),
-		ttl:       ttl,
-		address:   address,
-		tcpClient: &dns.Client{Net: "tcp", ReadTimeout: clientTimeout},
-		udpClient: &dns.Client{Net: "udp", ReadTimeout: clientTimeout, UDPSize: udpBuffSize},
+		ns:          ns,
+		domain:      dns.Fqdn(domain),
+		ttl:         ttl,
+		address:     address,
+		transferACL: transferACL,
+		updateKeys:  updateKeys,
+		tcpClient:   &dns.Client{Net: "tcp", ReadTimeout: clientTimeout},
+		udpClient:   &dns.Client{Net: "udp", ReadTimeout: clientTimeout, UDPSize: udpBuffSize},
 	}
 	var err error
 	if s.upstream, err = dns.ClientConfigFromFile(etcResolvConf); err != nil {
@@ -75,6 +84,12 @@ func (d *DNSServer) String() string {
 	fmt.Fprintf(&buf, "WeaveDNS (%s)\n", d.ns.ourName)
 	fmt.Fprintf(&buf, "  listening on %s, for domain %s\n", d.address, d.domain)
 	fmt.Fprintf(&buf, "  response ttl %d\n", d.ttl)
+	if len(d.transferACL) > 0 {
+		fmt.Fprintf(&buf, "  zone transfers allowed from %s\n", d.transferACLString())
+	}
+	if len(d.updateKeys) > 0 {
+		fmt.Fprintf(&buf, "  dynamic updates allowed with %d TSIG key(s)\n", len(d.updateKeys))
+	}
 	return buf.String()
 }
 
@@ -83,14 +98,16 @@ func (d *DNSServer) listen(address string) error {
 	if err != nil {
 		return err
 	}
-	udpServer := &dns.Server{PacketConn: udpListener, Handler: d.createMux(d.udpClient, minUDPSize)}
+	udpServer := &dns.Server{PacketConn: udpListener, Handler: d.createMux(d.udpClient, minUDPSize),
+		TsigSecret: d.updateKeys, MsgAcceptFunc: d.acceptMsg}
 
 	tcpListener, err := net.Listen("tcp", address)
 	if err != nil {
 		udpServer.Shutdown()
 		return err
 	}
-	tcpServer := &dns.Server{Listener: tcpListener, Handler: d.createMux(d.tcpClient, -1)}
+	tcpServer := &dns.Server{Listener: tcpListener, Handler: d.createMux(d.tcpClient, -1),
+		TsigSecret: d.updateKeys, MsgAcceptFunc: d.acceptMsg}
 
 	d.servers = []*dns.Server{udpServer, tcpServer}
 	return nil
@@ -134,6 +151,20 @@ func (d *DNSServer) createMux(client *dns.Client, defaultMaxResponseSize int) *d
 
 func (h *handler) handleLocal(w dns.ResponseWriter, req *dns.Msg) {
 	h.ns.debugf("local request: %+v", *req)
+	if req.Opcode == dns.OpcodeUpdate {
+		h.handleUpdate(w, req)
+		return
+	}
+	if len(req.Question) == 1 && h.isZoneApex(req.Question[0].Name) {
+		switch req.Question[0].Qtype {
+		case dns.TypeAXFR, dns.TypeIXFR:
+			h.handleTransfer(w, req)
+			return
+		case dns.TypeSOA:
+			h.handleSOA(w, req)
+			return
+		}
+	}
 	if len(req.Question) != 1 || req.Question[0].Qtype != dns.TypeA {
 		h.nameError(w, req)
 		return
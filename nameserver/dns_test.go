@@ -11,15 +11,17 @@ import (
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/require"
 
+	"github.com/weaveworks/weave/mesh"
 	"github.com/weaveworks/weave/net/address"
-	"github.com/weaveworks/weave/router"
 )
 
-func startServer(t *testing.T, upstream *dns.ClientConfig) (*DNSServer, *Nameserver, int, int) {
-	peername, err := router.PeerNameFromString("00:00:00:02:00:00")
+var testUpdateKeys = map[string]string{"weave-key.": "c2VjcmV0"}
+
+func startServer(t *testing.T, upstream *dns.ClientConfig, transferACL ...*net.IPNet) (*DNSServer, *Nameserver, int, int) {
+	peername, err := mesh.PeerNameFromString("00:00:00:02:00:00")
 	require.Nil(t, err)
 	nameserver := New(peername, nil, "")
-	dnsserver, err := NewDNSServer(nameserver, "weave.local.", "0.0.0.0:0", "", 30, 5*time.Second)
+	dnsserver, err := NewDNSServer(nameserver, "weave.local.", "0.0.0.0:0", "", 30, 5*time.Second, transferACL, testUpdateKeys)
 	require.Nil(t, err)
 	udpPort := dnsserver.servers[0].PacketConn.LocalAddr().(*net.UDPAddr).Port
 	tcpPort := dnsserver.servers[1].Listener.Addr().(*net.TCPAddr).Port
@@ -39,7 +41,7 @@ func TestTruncation(t *testing.T) {
 	addrs := []address.Address{}
 	for i := address.Address(0); i < 100; i++ {
 		addrs = append(addrs, i)
-		nameserver.AddEntry("foo.weave.local.", "", router.UnknownPeerName, i)
+		nameserver.AddEntry("foo.weave.local.", "", mesh.UnknownPeerName, i)
 	}
 
 	doRequest := func(client *dns.Client, request *dns.Msg, port int) *dns.Msg {
@@ -170,3 +172,148 @@ func TestRecursiveCompress(t *testing.T) {
 	require.True(t, len(gotRequest) > 0)
 	require.True(t, res.Len() > maxSize)
 }
+
+func TestZoneTransfer(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	dnsserver, nameserver, udpPort, tcpPort := startServer(t, nil, loopback)
+	defer dnsserver.Stop()
+
+	nameserver.AddEntry("foo.weave.local.", "c1", nameserver.ourName, address.Address(1))
+	nameserver.AddEntry("foo.weave.local.", "c2", nameserver.ourName, address.Address(1))
+	nameserver.AddEntry("bar.weave.local.", "c3", nameserver.ourName, address.Address(2))
+	nameserver.AddEntry("baz.weave.local.", "c4", nameserver.ourName, address.Address(3))
+	nameserver.Delete("baz.weave.local.", "c4", "*", address.Address(0))
+
+	transfer := func(request *dns.Msg) []dns.RR {
+		env, err := new(dns.Transfer).In(request, fmt.Sprintf("127.0.0.1:%d", tcpPort))
+		require.Nil(t, err)
+		records := []dns.RR{}
+		for e := range env {
+			require.Nil(t, e.Error)
+			records = append(records, e.RR...)
+		}
+		return records
+	}
+
+	request := &dns.Msg{}
+	request.SetAxfr("weave.local.")
+	records := transfer(request)
+	require.Len(t, records, 5)
+	soa := records[0].(*dns.SOA)
+	require.Equal(t, soa, records[4])
+	names := map[string]string{}
+	for _, rr := range records[2:4] {
+		names[rr.Header().Name] = rr.(*dns.A).A.String()
+	}
+	require.Equal(t, map[string]string{"foo.weave.local.": "0.0.0.1", "bar.weave.local.": "0.0.0.2"}, names)
+
+	// an up to date IXFR gets just the SOA back
+	request = &dns.Msg{}
+	request.SetIxfr("weave.local.", soa.Serial, soa.Ns, soa.Mbox)
+	records = transfer(request)
+	require.Len(t, records, 1)
+
+	// the serial changes with the zone
+	nameserver.AddEntry("qux.weave.local.", "c5", nameserver.ourName, address.Address(4))
+	request = &dns.Msg{}
+	request.SetQuestion("weave.local.", dns.TypeSOA)
+	response, _, err := new(dns.Client).Exchange(request, fmt.Sprintf("127.0.0.1:%d", udpPort))
+	require.Nil(t, err)
+	require.Len(t, response.Answer, 1)
+	require.True(t, response.Answer[0].(*dns.SOA).Serial > soa.Serial)
+}
+
+func TestZoneTransferRefused(t *testing.T) {
+	_, elsewhere, _ := net.ParseCIDR("10.0.0.0/8")
+	dnsserver, _, _, tcpPort := startServer(t, nil, elsewhere)
+	defer dnsserver.Stop()
+
+	request := &dns.Msg{}
+	request.SetAxfr("weave.local.")
+	env, err := new(dns.Transfer).In(request, fmt.Sprintf("127.0.0.1:%d", tcpPort))
+	require.Nil(t, err)
+	e := <-env
+	require.NotNil(t, e.Error)
+}
+
+func TestDynamicUpdate(t *testing.T) {
+	dnsserver, nameserver, _, tcpPort := startServer(t, nil)
+	defer dnsserver.Stop()
+
+	update := func(key string, f func(*dns.Msg)) int {
+		request := &dns.Msg{}
+		request.SetUpdate("weave.local.")
+		f(request)
+		client := &dns.Client{Net: "tcp", TsigSecret: map[string]string{"weave-key.": "c2VjcmV0", "other-key.": "b3RoZXI="}}
+		if key != "" {
+			request.SetTsig(key, dns.HmacSHA256, 300, time.Now().Unix())
+		}
+		response, _, err := client.Exchange(request, fmt.Sprintf("127.0.0.1:%d", tcpPort))
+		require.Nil(t, err)
+		return response.Rcode
+	}
+	rr := func(s string) dns.RR {
+		rr, err := dns.NewRR(s)
+		require.Nil(t, err)
+		return rr
+	}
+
+	require.Equal(t, dns.RcodeSuccess, update("weave-key.", func(m *dns.Msg) {
+		m.Insert([]dns.RR{rr("foo.weave.local. 30 IN A 10.0.0.1"), rr("foo.weave.local. 30 IN A 10.0.0.2")})
+	}))
+	require.Len(t, nameserver.Lookup("foo.weave.local."), 2)
+
+	require.Equal(t, dns.RcodeSuccess, update("weave-key.", func(m *dns.Msg) {
+		m.Remove([]dns.RR{rr("foo.weave.local. 30 IN A 10.0.0.1")})
+	}))
+	require.Len(t, nameserver.Lookup("foo.weave.local."), 1)
+
+	require.Equal(t, dns.RcodeSuccess, update("weave-key.", func(m *dns.Msg) {
+		m.RemoveName([]dns.RR{rr("foo.weave.local. 30 IN A 0.0.0.0")})
+	}))
+	require.Len(t, nameserver.Lookup("foo.weave.local."), 0)
+
+	// names are matched case-insensitively on deletion
+	require.Equal(t, dns.RcodeSuccess, update("weave-key.", func(m *dns.Msg) {
+		m.Insert([]dns.RR{rr("Foo.weave.local. 30 IN A 10.0.0.1")})
+	}))
+	require.Equal(t, dns.RcodeSuccess, update("weave-key.", func(m *dns.Msg) {
+		m.Remove([]dns.RR{rr("fOO.weave.local. 30 IN A 10.0.0.1")})
+	}))
+	require.Len(t, nameserver.Lookup("foo.weave.local."), 0)
+
+	// an update with any record we can't carry out is not applied at all
+	require.Equal(t, dns.RcodeNotImplemented, update("weave-key.", func(m *dns.Msg) {
+		m.Insert([]dns.RR{rr("foo.weave.local. 30 IN A 10.0.0.1"), rr("foo.weave.local. 30 IN AAAA ::1")})
+	}))
+	require.Len(t, nameserver.Lookup("foo.weave.local."), 0)
+
+	// names registered by other peers can't be deleted, nor can
+	// records other than A records
+	otherPeer, err := mesh.PeerNameFromString("00:00:00:03:00:00")
+	require.Nil(t, err)
+	require.Nil(t, nameserver.AddEntry("other.weave.local.", "container", otherPeer, address.Address(4)))
+	require.Equal(t, dns.RcodeRefused, update("weave-key.", func(m *dns.Msg) {
+		m.RemoveName([]dns.RR{rr("Other.weave.local. 30 IN A 0.0.0.0")})
+	}))
+	require.Equal(t, dns.RcodeRefused, update("weave-key.", func(m *dns.Msg) {
+		m.Remove([]dns.RR{rr("other.weave.local. 30 IN A 0.0.0.4")})
+	}))
+	require.Len(t, nameserver.Lookup("other.weave.local."), 1)
+	require.Equal(t, dns.RcodeNotImplemented, update("weave-key.", func(m *dns.Msg) {
+		m.RemoveRRset([]dns.RR{rr("foo.weave.local. 30 IN TXT \"text\"")})
+	}))
+	require.Equal(t, dns.RcodeNotImplemented, update("weave-key.", func(m *dns.Msg) {
+		m.Remove([]dns.RR{rr("foo.weave.local. 30 IN AAAA ::1")})
+	}))
+
+	// unauthenticated, unknown keys, and names outside our domain
+	// are all rejected
+	insert := func(m *dns.Msg) { m.Insert([]dns.RR{rr("bar.weave.local. 30 IN A 10.0.0.3")}) }
+	require.Equal(t, dns.RcodeNotAuth, update("", insert))
+	require.Equal(t, dns.RcodeNotAuth, update("other-key.", insert))
+	require.Equal(t, dns.RcodeNotZone, update("weave-key.", func(m *dns.Msg) {
+		m.Insert([]dns.RR{rr("bar.example.com. 30 IN A 10.0.0.3")})
+	}))
+	require.Len(t, nameserver.Lookup("bar.weave.local."), 0)
+}
@@ -4,6 +4,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/miekg/dns"
@@ -91,4 +94,130 @@ func (n *Nameserver) HandleHTTP(router *mux.Router, dockerCli *docker.Client) {
 			n.badRequest(w, fmt.Errorf("Error marshalling response: %v", err))
 		}
 	})
+
+	router.Methods("GET").Path("/name/events").Headers("Accept", "text/event-stream").HandlerFunc(n.streamEvents)
+	router.Methods("GET").Path("/name/events").HandlerFunc(n.pollEvents)
+}
+
+// Events as given to watchers, who resume from a cursor rather than
+// a bare serial, as serials from before a restart mean nothing now.
+type watchEvent struct {
+	Cursor string `json:",omitempty"`
+	Type   string
+	Entry  *Entry `json:",omitempty"`
+}
+
+func (n *Nameserver) watchEvents(events []Event) []watchEvent {
+	result := make([]watchEvent, len(events))
+	for i, event := range events {
+		result[i] = watchEvent{Type: event.Type, Entry: event.Entry}
+		if event.Serial != 0 {
+			result[i].Cursor = fmt.Sprintf("%d-%d", n.instance, event.Serial)
+		}
+	}
+	return result
+}
+
+// The cursor to resume from is given either as the 'since' parameter
+// or, by an EventSource which has reconnected, as Last-Event-ID.  A
+// cursor from an earlier run cannot be resumed from.
+func (n *Nameserver) parseSince(r *http.Request) (uint32, bool, error) {
+	sinceStr := r.Header.Get("Last-Event-ID")
+	if sinceStr == "" {
+		sinceStr = r.FormValue("since")
+	}
+	if sinceStr == "" {
+		return 0, false, nil
+	}
+	parts := strings.Split(sinceStr, "-")
+	if len(parts) != 2 {
+		return 0, false, fmt.Errorf("Invalid cursor '%s'", sinceStr)
+	}
+	instance, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("Invalid cursor '%s'", sinceStr)
+	}
+	since, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return 0, false, fmt.Errorf("Invalid cursor '%s'", sinceStr)
+	}
+	return uint32(since), instance == n.instance, nil
+}
+
+// Long-poll: respond with the events since the given cursor, waiting
+// for some to happen if there are none yet.
+func (n *Nameserver) pollEvents(w http.ResponseWriter, r *http.Request) {
+	since, resume, err := n.parseSince(r)
+	if err != nil {
+		n.badRequest(w, err)
+		return
+	}
+	timeout := defaultPollTimeout
+	if timeoutStr := r.FormValue("timeout"); timeoutStr != "" {
+		if timeout, err = time.ParseDuration(timeoutStr); err != nil {
+			n.badRequest(w, err)
+			return
+		}
+	}
+
+	events, changed := n.EventsSince(since, resume)
+	if len(events) == 0 {
+		select {
+		case <-changed:
+			events, _ = n.EventsSince(since, resume)
+		case <-time.After(timeout):
+		case <-w.(http.CloseNotifier).CloseNotify():
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(n.watchEvents(events)); err != nil {
+		n.badRequest(w, fmt.Errorf("Error marshalling response: %v", err))
+	}
+}
+
+// Server-sent events: stream events until the client goes away.
+func (n *Nameserver) streamEvents(w http.ResponseWriter, r *http.Request) {
+	since, resume, err := n.parseSince(r)
+	if err != nil {
+		n.badRequest(w, err)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	closed := w.(http.CloseNotifier).CloseNotify()
+
+	for {
+		events, changed := n.EventsSince(since, resume)
+		for i, event := range n.watchEvents(events) {
+			data, err := json.Marshal(event)
+			if err != nil {
+				n.errorf("Error marshalling event: %v", err)
+				return
+			}
+			// Without an id, an EventSource keeps the last one
+			// it had
+			if event.Cursor != "" {
+				if _, err := fmt.Fprintf(w, "id: %s\n", event.Cursor); err != nil {
+					return
+				}
+				since, resume = events[i].Serial, true
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+
+		select {
+		case <-changed:
+		case <-closed:
+			return
+		}
+	}
 }
@@ -0,0 +1,169 @@
+package nameserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/weave/mesh"
+	"github.com/weaveworks/weave/net/address"
+)
+
+func startEventsServer(t *testing.T) (*Nameserver, *httptest.Server) {
+	peername, err := mesh.PeerNameFromString("00:00:00:02:00:00")
+	require.Nil(t, err)
+	nameserver := New(peername, nil, "")
+	router := mux.NewRouter()
+	nameserver.HandleHTTP(router, nil)
+	return nameserver, httptest.NewServer(router)
+}
+
+// As watchEvent, as far as the tests need to decode it
+type testWatchEvent struct {
+	Cursor string
+	Type   string
+	Entry  *struct{ Hostname string }
+}
+
+func pollEvents(t *testing.T, server *httptest.Server, params url.Values) []testWatchEvent {
+	resp, err := http.Get(server.URL + "/name/events?" + params.Encode())
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var events []testWatchEvent
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&events))
+	return events
+}
+
+func watchEventTypes(events []testWatchEvent) []string {
+	types := []string{}
+	for _, event := range events {
+		types = append(types, event.Type)
+	}
+	return types
+}
+
+func TestPollEvents(t *testing.T) {
+	nameserver, server := startEventsServer(t)
+	defer server.Close()
+	require.Nil(t, nameserver.AddEntry("host1", "container1", nameserver.ourName, address.Address(1)))
+	require.Nil(t, nameserver.AddEntry("host2", "container2", nameserver.ourName, address.Address(2)))
+
+	// Without a cursor we get the current state, with a cursor
+	// only on the last event
+	events := pollEvents(t, server, url.Values{})
+	require.Equal(t, []string{EventReset, EventAdd, EventAdd}, watchEventTypes(events))
+	require.Empty(t, events[0].Cursor)
+	require.Empty(t, events[1].Cursor)
+	cursor := events[2].Cursor
+	require.NotEmpty(t, cursor)
+
+	// Nothing happens before the timeout
+	events = pollEvents(t, server, url.Values{"since": {cursor}, "timeout": {"10ms"}})
+	require.Empty(t, events)
+
+	// Each change has a cursor of its own
+	done := make(chan []testWatchEvent)
+	go func() { done <- pollEvents(t, server, url.Values{"since": {cursor}}) }()
+	nameserver.ContainerDied("container1")
+	events = <-done
+	require.Equal(t, []string{EventTombstone}, watchEventTypes(events))
+	require.Equal(t, "host1", events[0].Entry.Hostname)
+	tombstoned := events[0].Cursor
+	require.NotEqual(t, cursor, tombstoned)
+
+	require.Nil(t, nameserver.AddEntry("host3", "container3", nameserver.ourName, address.Address(3)))
+	events = pollEvents(t, server, url.Values{"since": {cursor}})
+	require.Equal(t, []string{EventTombstone, EventAdd}, watchEventTypes(events))
+	require.Equal(t, tombstoned, events[0].Cursor)
+	events = pollEvents(t, server, url.Values{"since": {tombstoned}})
+	require.Equal(t, []string{EventAdd}, watchEventTypes(events))
+	require.Equal(t, "host3", events[0].Entry.Hostname)
+
+	// A cursor from before a restart gets a reset
+	serial := strings.SplitN(cursor, "-", 2)[1]
+	events = pollEvents(t, server, url.Values{"since": {"1-" + serial}})
+	require.Equal(t, []string{EventReset, EventAdd, EventAdd}, watchEventTypes(events))
+
+	resp, err := http.Get(server.URL + "/name/events?since=" + serial)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+type sseEvent struct {
+	id, event string
+	data      testWatchEvent
+}
+
+func readSSEEvent(t *testing.T, reader *bufio.Reader) sseEvent {
+	var event sseEvent
+	for {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimRight(line, "\n")
+		switch {
+		case line == "":
+			return event
+		case strings.HasPrefix(line, "id: "):
+			event.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			event.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event.data))
+		}
+	}
+}
+
+func streamEvents(t *testing.T, server *httptest.Server, lastEventID string) (*http.Response, *bufio.Reader) {
+	req, err := http.NewRequest("GET", server.URL+"/name/events", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "text/event-stream")
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	return resp, bufio.NewReader(resp.Body)
+}
+
+func TestStreamEvents(t *testing.T) {
+	nameserver, server := startEventsServer(t)
+	defer server.Close()
+	require.Nil(t, nameserver.AddEntry("host1", "container1", nameserver.ourName, address.Address(1)))
+
+	resp, reader := streamEvents(t, server, "")
+	defer resp.Body.Close()
+	reset := readSSEEvent(t, reader)
+	require.Equal(t, EventReset, reset.event)
+	require.Empty(t, reset.id)
+	add := readSSEEvent(t, reader)
+	require.Equal(t, EventAdd, add.event)
+	require.Equal(t, "host1", add.data.Entry.Hostname)
+	require.NotEmpty(t, add.id)
+	require.Equal(t, add.id, add.data.Cursor)
+
+	// Changes are streamed as they happen
+	require.Nil(t, nameserver.AddEntry("host2", "container2", nameserver.ourName, address.Address(2)))
+	event := readSSEEvent(t, reader)
+	require.Equal(t, EventAdd, event.event)
+	require.Equal(t, "host2", event.data.Entry.Hostname)
+	require.NotEqual(t, add.id, event.id)
+	resp.Body.Close()
+
+	// An EventSource reconnecting resumes after the last id it had
+	nameserver.ContainerDied("container1")
+	resp, reader = streamEvents(t, server, event.id)
+	defer resp.Body.Close()
+	event = readSSEEvent(t, reader)
+	require.Equal(t, EventTombstone, event.event)
+	require.Equal(t, "host1", event.data.Entry.Hostname)
+}
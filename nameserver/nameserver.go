@@ -11,8 +11,8 @@ import (
 	"github.com/miekg/dns"
 
 	. "github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/mesh"
 	"github.com/weaveworks/weave/net/address"
-	"github.com/weaveworks/weave/router"
 )
 
 const (
@@ -37,20 +37,39 @@ const (
 // - Update is O(n) for now
 type Nameserver struct {
 	sync.RWMutex
-	ourName router.PeerName
+	ourName mesh.PeerName
 	domain  string
-	gossip  router.Gossip
+	gossip  mesh.Gossip
 	entries Entries
-	peers   *router.Peers
+	serial  uint32
+	peers   *mesh.Peers
 	quit    chan struct{}
+
+	// Where to record serials ahead of use, and how far; see
+	// serial.go
+	serialFile  string
+	serialLimit uint32
+
+	// Recent changes, for watchers; see watch.go
+	events     []Event
+	eventsFrom uint32
+	notify     chan struct{}
+	// Tells watchers' cursors from this run apart from those of
+	// earlier ones, whose serials may come round again
+	instance int64
 }
 
-func New(ourName router.PeerName, peers *router.Peers, domain string) *Nameserver {
+func New(ourName mesh.PeerName, peers *mesh.Peers, domain string) *Nameserver {
+	serial := uint32(now())
 	ns := &Nameserver{
-		ourName: ourName,
-		domain:  dns.Fqdn(domain),
-		peers:   peers,
-		quit:    make(chan struct{}),
+		ourName:    ourName,
+		domain:     dns.Fqdn(domain),
+		serial:     serial,
+		peers:      peers,
+		quit:       make(chan struct{}),
+		eventsFrom: serial,
+		notify:     make(chan struct{}),
+		instance:   time.Now().UnixNano(),
 	}
 	if peers != nil {
 		peers.OnGC(ns.PeerGone)
@@ -58,7 +77,7 @@ func New(ourName router.PeerName, peers *router.Peers, domain string) *Nameserve
 	return ns
 }
 
-func (n *Nameserver) SetGossip(gossip router.Gossip) {
+func (n *Nameserver) SetGossip(gossip mesh.Gossip) {
 	n.gossip = gossip
 }
 
@@ -90,10 +109,11 @@ func (n *Nameserver) broadcastEntries(es ...Entry) error {
 	return nil
 }
 
-func (n *Nameserver) AddEntry(hostname, containerid string, origin router.PeerName, addr address.Address) error {
+func (n *Nameserver) AddEntry(hostname, containerid string, origin mesh.PeerName, addr address.Address) error {
 	n.infof("adding entry %s -> %s", hostname, addr.String())
 	n.Lock()
 	entry := n.entries.add(hostname, containerid, origin, addr)
+	n.changed(EventAdd, entry)
 	n.Unlock()
 	return n.broadcastEntries(entry)
 }
@@ -128,6 +148,21 @@ func (n *Nameserver) ReverseLookup(ip address.Address) (string, error) {
 	return match.Hostname, nil
 }
 
+// Snapshot returns a copy of the live (ie, not tombstoned) entries,
+// along with a serial number which increases whenever they change.
+func (n *Nameserver) Snapshot() (uint32, Entries) {
+	n.RLock()
+	defer n.RUnlock()
+
+	entries := Entries{}
+	for _, e := range n.entries {
+		if e.Tombstone == 0 {
+			entries = append(entries, e)
+		}
+	}
+	return n.serial, entries
+}
+
 func (n *Nameserver) ContainerStarted(ident string) {}
 
 func (n *Nameserver) ContainerDied(ident string) {
@@ -139,6 +174,7 @@ func (n *Nameserver) ContainerDied(ident string) {
 		}
 		return false
 	})
+	n.changed(EventTombstone, entries...)
 	n.Unlock()
 	if len(entries) > 0 {
 		if err := n.broadcastEntries(entries...); err != nil {
@@ -147,13 +183,19 @@ func (n *Nameserver) ContainerDied(ident string) {
 	}
 }
 
-func (n *Nameserver) PeerGone(peer *router.Peer) {
+func (n *Nameserver) PeerGone(peer *mesh.Peer) {
 	n.infof("peer %s gone", peer.String())
 	n.Lock()
 	defer n.Unlock()
+	removed := Entries{}
 	n.entries.filter(func(e *Entry) bool {
-		return e.Origin != peer.Name
+		if e.Origin == peer.Name {
+			removed = append(removed, *e)
+			return false
+		}
+		return true
 	})
+	n.changed(EventDelete, removed...)
 }
 
 func (n *Nameserver) Delete(hostname, containerid, ipStr string, ip address.Address) error {
@@ -175,6 +217,7 @@ func (n *Nameserver) Delete(hostname, containerid, ipStr string, ip address.Addr
 		n.infof("tombstoning entry %v", e)
 		return true
 	})
+	n.changed(EventTombstone, entries...)
 	n.Unlock()
 	return n.broadcastEntries(entries...)
 }
@@ -183,14 +226,24 @@ func (n *Nameserver) deleteTombstones() {
 	n.Lock()
 	defer n.Unlock()
 	now := time.Now().Unix()
+	removed := Entries{}
 	n.entries.filter(func(e *Entry) bool {
-		return e.Tombstone == 0 || now-e.Tombstone <= int64(tombstoneTimeout/time.Second)
+		if e.Tombstone == 0 || now-e.Tombstone <= int64(tombstoneTimeout/time.Second) {
+			return true
+		}
+		removed = append(removed, *e)
+		return false
 	})
+	n.changed(EventDelete, removed...)
 }
 
-func (n *Nameserver) Gossip() router.GossipData {
+func (n *Nameserver) Gossip() mesh.GossipData {
 	n.RLock()
 	defer n.RUnlock()
+	return n.gossipAll()
+}
+
+func (n *Nameserver) gossipAll() *GossipData {
 	gossip := &GossipData{
 		Entries:   make(Entries, len(n.entries)),
 		Timestamp: now(),
@@ -200,11 +253,49 @@ func (n *Nameserver) Gossip() router.GossipData {
 	return gossip
 }
 
-func (n *Nameserver) OnGossipUnicast(sender router.PeerName, msg []byte) error {
+// GossipSince returns the entries changed after serial since, or all
+// of them if we no longer hold the events to tell, along with our
+// current serial.
+func (n *Nameserver) GossipSince(since uint64) (mesh.GossipData, uint64) {
+	n.RLock()
+	defer n.RUnlock()
+	serial := uint64(n.serial)
+	switch {
+	case since == serial:
+		return nil, serial
+	case since < uint64(n.eventsFrom) || since > serial:
+		return n.gossipAll(), serial
+	}
+	changed := make(map[Entry]struct{})
+	for _, event := range n.events {
+		if event.Serial > uint32(since) && event.Type != EventDelete {
+			changed[entryKey(event.Entry)] = struct{}{}
+		}
+	}
+	gossip := &GossipData{Timestamp: now()}
+	for _, e := range n.entries {
+		if _, found := changed[entryKey(&e)]; found {
+			gossip.Entries = append(gossip.Entries, e)
+		}
+	}
+	if len(gossip.Entries) == 0 {
+		// only deletions, which aren't gossiped
+		return nil, serial
+	}
+	sort.Sort(CaseSensitive(gossip.Entries))
+	return gossip, serial
+}
+
+// Identifies an entry regardless of version
+func entryKey(e *Entry) Entry {
+	return Entry{ContainerID: e.ContainerID, Origin: e.Origin, Addr: e.Addr, Hostname: e.Hostname}
+}
+
+func (n *Nameserver) OnGossipUnicast(sender mesh.PeerName, msg []byte) error {
 	return nil
 }
 
-func (n *Nameserver) receiveGossip(msg []byte) (router.GossipData, router.GossipData, error) {
+func (n *Nameserver) receiveGossip(msg []byte) (mesh.GossipData, mesh.GossipData, error) {
 	var gossip GossipData
 	if err := gob.NewDecoder(bytes.NewReader(msg)).Decode(&gossip); err != nil {
 		return nil, nil, err
@@ -226,6 +317,7 @@ func (n *Nameserver) receiveGossip(msg []byte) (router.GossipData, router.Gossip
 	}
 
 	newEntries := n.entries.merge(gossip.Entries)
+	n.changedByGossip(newEntries)
 	if len(newEntries) > 0 {
 		return &GossipData{Entries: newEntries, Timestamp: now()}, &gossip, nil
 	}
@@ -234,14 +326,14 @@ func (n *Nameserver) receiveGossip(msg []byte) (router.GossipData, router.Gossip
 
 // merge received data into state and return "everything new I've
 // just learnt", or nil if nothing in the received data was new
-func (n *Nameserver) OnGossip(msg []byte) (router.GossipData, error) {
+func (n *Nameserver) OnGossip(msg []byte) (mesh.GossipData, error) {
 	newEntries, _, err := n.receiveGossip(msg)
 	return newEntries, err
 }
 
 // merge received data into state and return a representation of
 // the received data, for further propagation
-func (n *Nameserver) OnGossipBroadcast(_ router.PeerName, msg []byte) (router.GossipData, error) {
+func (n *Nameserver) OnGossipBroadcast(_ mesh.PeerName, msg []byte) (mesh.GossipData, error) {
 	_, entries, err := n.receiveGossip(msg)
 	return entries, err
 }
@@ -2,7 +2,10 @@ package nameserver
 
 import (
 	"fmt"
+	"io/ioutil"
 	"math/rand"
+	"os"
+	"path/filepath"
 	"reflect"
 	"sort"
 	"strings"
@@ -11,8 +14,8 @@ import (
 
 	"github.com/stretchr/testify/require"
 
+	"github.com/weaveworks/weave/mesh"
 	"github.com/weaveworks/weave/net/address"
-	"github.com/weaveworks/weave/router"
 	wt "github.com/weaveworks/weave/testing"
 	"github.com/weaveworks/weave/testing/gossip"
 )
@@ -22,7 +25,7 @@ func makeNetwork(size int) ([]*Nameserver, *gossip.TestRouter) {
 	nameservers := make([]*Nameserver, size)
 
 	for i := 0; i < size; i++ {
-		name, _ := router.PeerNameFromString(fmt.Sprintf("%02d:00:00:02:00:00", i))
+		name, _ := mesh.PeerNameFromString(fmt.Sprintf("%02d:00:00:02:00:00", i))
 		nameserver := New(name, nil, "")
 		nameserver.SetGossip(gossipRouter.Connect(nameserver.ourName, nameserver))
 		nameserver.Start()
@@ -40,7 +43,7 @@ func stopNetwork(nameservers []*Nameserver, grouter *gossip.TestRouter) {
 }
 
 type pair struct {
-	origin router.PeerName
+	origin mesh.PeerName
 	addr   address.Address
 }
 
@@ -83,7 +86,7 @@ func testNameservers(t *testing.T) {
 	lookupTimeout := 10 // ms
 	nameservers, grouter := makeNetwork(50)
 	defer stopNetwork(nameservers, grouter)
-	nameserversByName := map[router.PeerName]*Nameserver{}
+	nameserversByName := map[mesh.PeerName]*Nameserver{}
 	for _, n := range nameservers {
 		nameserversByName[n.ourName] = n
 	}
@@ -203,7 +206,7 @@ func testNameservers(t *testing.T) {
 }
 
 func TestContainerAndPeerDeath(t *testing.T) {
-	peername, err := router.PeerNameFromString("00:00:00:02:00:00")
+	peername, err := mesh.PeerNameFromString("00:00:00:02:00:00")
 	require.Nil(t, err)
 	nameserver := New(peername, nil, "")
 
@@ -218,7 +221,7 @@ func TestContainerAndPeerDeath(t *testing.T) {
 	require.Nil(t, err)
 	require.Equal(t, []address.Address{0}, nameserver.Lookup("hostname"))
 
-	nameserver.PeerGone(&router.Peer{Name: peername})
+	nameserver.PeerGone(&mesh.Peer{Name: peername})
 	require.Equal(t, []address.Address{}, nameserver.Lookup("hostname"))
 }
 
@@ -227,7 +230,7 @@ func TestTombstoneDeletion(t *testing.T) {
 	defer func() { now = oldNow }()
 	now = func() int64 { return 1234 }
 
-	peername, err := router.PeerNameFromString("00:00:00:02:00:00")
+	peername, err := mesh.PeerNameFromString("00:00:00:02:00:00")
 	require.Nil(t, err)
 	nameserver := New(peername, nil, "")
 
@@ -254,3 +257,117 @@ func TestTombstoneDeletion(t *testing.T) {
 	nameserver.deleteTombstones()
 	require.Equal(t, Entries{}, nameserver.entries)
 }
+
+func TestEvents(t *testing.T) {
+	peername, err := mesh.PeerNameFromString("00:00:00:02:00:00")
+	require.Nil(t, err)
+	nameserver := New(peername, nil, "")
+
+	eventTypes := func(events []Event) []string {
+		types := []string{}
+		for _, event := range events {
+			types = append(types, event.Type)
+		}
+		return types
+	}
+
+	// Without a serial to resume from, we get the current state
+	require.Nil(t, nameserver.AddEntry("hostname", "containerid", peername, address.Address(0)))
+	events, changed := nameserver.EventsSince(0, false)
+	require.Equal(t, []string{EventReset, EventAdd}, eventTypes(events))
+	since := events[len(events)-1].Serial
+
+	select {
+	case <-changed:
+		require.FailNow(t, "unexpected change notification")
+	default:
+	}
+
+	nameserver.ContainerDied("containerid")
+	<-changed
+	require.Nil(t, nameserver.AddEntry("hostname2", "containerid2", peername, address.Address(1)))
+	nameserver.PeerGone(&mesh.Peer{Name: peername})
+
+	events, _ = nameserver.EventsSince(since, true)
+	require.Equal(t, []string{EventTombstone, EventAdd, EventDelete, EventDelete}, eventTypes(events))
+	require.Equal(t, "hostname2", events[1].Entry.Hostname)
+	events, _ = nameserver.EventsSince(events[1].Serial, true)
+	require.Equal(t, []string{EventDelete, EventDelete}, eventTypes(events))
+
+	// A serial we know nothing about gets a reset
+	events, _ = nameserver.EventsSince(since-2, true)
+	require.Equal(t, []string{EventReset}, eventTypes(events))
+}
+
+func TestGossipSince(t *testing.T) {
+	nameservers, grouter := makeNetwork(1)
+	defer stopNetwork(nameservers, grouter)
+	ns := nameservers[0]
+
+	require.NoError(t, ns.AddEntry("a.weave.local.", "c1", ns.ourName, 1))
+	require.NoError(t, ns.AddEntry("b.weave.local.", "c2", ns.ourName, 2))
+	_, serial := ns.GossipSince(0)
+
+	// Nothing changed
+	gossip, same := ns.GossipSince(serial)
+	require.Nil(t, gossip)
+	require.Equal(t, serial, same)
+
+	// Just what changed since
+	require.NoError(t, ns.AddEntry("c.weave.local.", "c3", ns.ourName, 3))
+	require.NoError(t, ns.Delete("a.weave.local.", "c1", "*", 0))
+	gossip, latest := ns.GossipSince(serial)
+	require.True(t, latest > serial)
+	entries := gossip.(*GossipData).Entries
+	require.Len(t, entries, 2)
+	require.Equal(t, "a.weave.local.", entries[0].Hostname)
+	require.True(t, entries[0].Tombstone > 0)
+	require.Equal(t, "c.weave.local.", entries[1].Hostname)
+
+	// Everything, for versions we can't account for
+	gossip, _ = ns.GossipSince(0)
+	require.Len(t, gossip.(*GossipData).Entries, 3)
+}
+
+func TestSerial(t *testing.T) {
+	oldNow := now
+	defer func() { now = oldNow }()
+	now = func() int64 { return 1234 }
+
+	dir, err := ioutil.TempDir("", "weave-dns-serial")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "serial")
+
+	peername, err := mesh.PeerNameFromString("00:00:00:02:00:00")
+	require.Nil(t, err)
+	nameserver := New(peername, nil, "")
+	require.NoError(t, nameserver.UseSerialFile(path))
+
+	// A burst of changes takes the serial ahead of the clock
+	for i := 0; i < 2*serialReservation; i++ {
+		require.Nil(t, nameserver.AddEntry(fmt.Sprintf("host%d", i), "containerid", peername, address.Address(i)))
+	}
+	serial, _ := nameserver.Snapshot()
+	require.Equal(t, uint32(1234+2*serialReservation), serial)
+
+	// After a restart, with the clock stepped back, the serial
+	// still goes forward
+	now = func() int64 { return 1000 }
+	nameserver = New(peername, nil, "")
+	require.NoError(t, nameserver.UseSerialFile(path))
+	require.Nil(t, nameserver.AddEntry("host", "containerid", peername, address.Address(0)))
+	restarted, _ := nameserver.Snapshot()
+	require.True(t, serialAfter(restarted, serial))
+
+	// Without a file, it follows the clock, but never goes back
+	nameserver = New(peername, nil, "")
+	now = func() int64 { return 2000 }
+	require.Nil(t, nameserver.AddEntry("host", "containerid", peername, address.Address(0)))
+	serial, _ = nameserver.Snapshot()
+	require.Equal(t, uint32(2000), serial)
+	now = func() int64 { return 1000 }
+	nameserver.ContainerDied("containerid")
+	next, _ := nameserver.Snapshot()
+	require.Equal(t, serial+1, next)
+}
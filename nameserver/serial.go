@@ -0,0 +1,82 @@
+package nameserver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Secondaries only transfer the zone when its SOA serial has gone
+// forward (RFC 1982 serial arithmetic), so it must never go back.  We
+// keep it at or ahead of the clock, so that it carries on from about
+// the right place after a restart.  A clock stepping back, or a burst
+// of changes just before a restart, could still take it back, so
+// given a file, we record a high-water mark there ahead of time, and
+// start from it next time.
+
+// Number of serials recorded ahead in the file
+const serialReservation = 1000
+
+// Is serial a after serial b, in RFC 1982 terms?
+func serialAfter(a, b uint32) bool {
+	return int32(a-b) > 0
+}
+
+// Advance the serial for a change, and return it.  Call with the
+// lock held.
+func (n *Nameserver) nextSerial() uint32 {
+	next := n.serial + 1
+	if t := uint32(now()); serialAfter(t, next) {
+		next = t
+	}
+	n.serial = next
+	if n.serialFile != "" && !serialAfter(n.serialLimit, next) {
+		if err := n.reserveSerials(); err != nil {
+			n.errorf("%v", err)
+		}
+	}
+	return next
+}
+
+// UseSerialFile starts the serial from the high-water mark recorded
+// in path by a previous run, if any, and records one there in turn.
+func (n *Nameserver) UseSerialFile(path string) error {
+	n.Lock()
+	defer n.Unlock()
+
+	data, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return err
+	default:
+		limit, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid serial in %s: %v", path, err)
+		}
+		if serialAfter(uint32(limit), n.serial) {
+			n.serial = uint32(limit)
+			n.eventsFrom = n.serial
+		}
+	}
+
+	n.serialFile = path
+	return n.reserveSerials()
+}
+
+// Record the serials up to serialReservation ahead of the current
+// one as used.  Call with the lock held.
+func (n *Nameserver) reserveSerials() error {
+	limit := n.serial + serialReservation
+	tmp := n.serialFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strconv.FormatUint(uint64(limit), 10)+"\n"), 0644); err != nil {
+		return fmt.Errorf("unable to record DNS serial: %v", err)
+	}
+	if err := os.Rename(tmp, n.serialFile); err != nil {
+		return fmt.Errorf("unable to record DNS serial: %v", err)
+	}
+	n.serialLimit = limit
+	return nil
+}
@@ -0,0 +1,173 @@
+package nameserver
+
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// SOA timers handed to secondaries; they poll for the serial
+	// every soaRefresh seconds, since we do not send NOTIFYs.
+	soaRefresh = 60
+	soaRetry   = 30
+	soaExpire  = 3600
+
+	// Number of records per transfer message, keeping each well
+	// within the 64k limit of a DNS message over TCP.
+	transferChunkSize = 500
+)
+
+// Zone transfers (AXFR, and IXFR which we always answer with the
+// whole zone) let a conventional DNS server act as a secondary for
+// our domain, so that names can be resolved from outside the weave
+// network.
+
+func (d *DNSServer) transferAllowed(addr net.Addr) bool {
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	default:
+		return false
+	}
+	for _, cidr := range d.transferACL {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *DNSServer) transferACLString() string {
+	cidrs := make([]string, len(d.transferACL))
+	for i, cidr := range d.transferACL {
+		cidrs[i] = cidr.String()
+	}
+	return strings.Join(cidrs, ", ")
+}
+
+func (d *DNSServer) isZoneApex(name string) bool {
+	return strings.ToLower(dns.Fqdn(name)) == strings.ToLower(d.domain)
+}
+
+func (d *DNSServer) nameServer() string {
+	return "ns." + d.domain
+}
+
+func (d *DNSServer) soa(serial uint32) *dns.SOA {
+	return &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   d.domain,
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    d.ttl,
+		},
+		Ns:      d.nameServer(),
+		Mbox:    "hostmaster." + d.domain,
+		Serial:  serial,
+		Refresh: soaRefresh,
+		Retry:   soaRetry,
+		Expire:  soaExpire,
+		Minttl:  d.ttl,
+	}
+}
+
+// zone returns all the records in our domain, bracketed by the SOA
+// record as required for a transfer.
+func (d *DNSServer) zone() []dns.RR {
+	serial, entries := d.ns.Snapshot()
+	soa := d.soa(serial)
+	records := []dns.RR{soa, &dns.NS{
+		Hdr: dns.RR_Header{
+			Name:   d.domain,
+			Rrtype: dns.TypeNS,
+			Class:  dns.ClassINET,
+			Ttl:    d.ttl,
+		},
+		Ns: d.nameServer(),
+	}}
+
+	// The same hostname and address may be registered by several
+	// containers or peers; only list each pair once.
+	seen := make(map[string]struct{})
+	for _, entry := range entries {
+		hostname := dns.Fqdn(entry.Hostname)
+		if !dns.IsSubDomain(d.domain, strings.ToLower(hostname)) {
+			continue
+		}
+		key := strings.ToLower(hostname) + " " + entry.Addr.String()
+		if _, found := seen[key]; found {
+			continue
+		}
+		seen[key] = struct{}{}
+		records = append(records, &dns.A{
+			Hdr: dns.RR_Header{
+				Name:   hostname,
+				Rrtype: dns.TypeA,
+				Class:  dns.ClassINET,
+				Ttl:    d.ttl,
+			},
+			A: entry.Addr.IP4(),
+		})
+	}
+	return append(records, soa)
+}
+
+func (h *handler) handleSOA(w dns.ResponseWriter, req *dns.Msg) {
+	if len(h.transferACL) == 0 {
+		h.nameError(w, req)
+		return
+	}
+	serial, _ := h.ns.Snapshot()
+	h.respond(w, h.makeResponse(req, []dns.RR{h.soa(serial)}))
+}
+
+func (h *handler) handleTransfer(w dns.ResponseWriter, req *dns.Msg) {
+	if !h.transferAllowed(w.RemoteAddr()) {
+		h.ns.infof("refusing zone transfer to %s", w.RemoteAddr())
+		h.respond(w, h.makeErrorResponse(req, dns.RcodeRefused))
+		return
+	}
+
+	// Tell IXFR clients which are up to date, or which asked over
+	// UDP, about our current serial only (RFC 1995 section 4); the
+	// latter will retry over TCP.
+	if req.Question[0].Qtype == dns.TypeIXFR {
+		serial, _ := h.ns.Snapshot()
+		if _, isUDP := w.RemoteAddr().(*net.UDPAddr); isUDP || ixfrUpToDate(req, serial) {
+			h.respond(w, h.makeResponse(req, []dns.RR{h.soa(serial)}))
+			return
+		}
+	} else if _, isTCP := w.RemoteAddr().(*net.TCPAddr); !isTCP {
+		h.respond(w, h.makeErrorResponse(req, dns.RcodeRefused))
+		return
+	}
+
+	h.ns.infof("zone transfer of %s to %s", h.domain, w.RemoteAddr())
+	records := h.zone()
+	ch := make(chan *dns.Envelope, len(records)/transferChunkSize+1)
+	for len(records) > transferChunkSize {
+		ch <- &dns.Envelope{RR: records[:transferChunkSize]}
+		records = records[transferChunkSize:]
+	}
+	ch <- &dns.Envelope{RR: records}
+	close(ch)
+	if err := new(dns.Transfer).Out(w, req, ch); err != nil {
+		h.ns.infof("error during zone transfer to %s: %v", w.RemoteAddr(), err)
+	}
+}
+
+// ixfrUpToDate returns true if the serial of the SOA in the
+// authority section of an IXFR request is not older than ours.
+func ixfrUpToDate(req *dns.Msg, serial uint32) bool {
+	for _, rr := range req.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return int32(serial-soa.Serial) <= 0
+		}
+	}
+	return false
+}
@@ -0,0 +1,180 @@
+package nameserver
+
+import (
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/weaveworks/weave/net/address"
+)
+
+const (
+	// Container identifier for names registered by DNS UPDATE, the
+	// same one `weave dns-add` uses for names without a container.
+	updateContainerID = "weave:extern"
+
+	tsigFudge = 300
+)
+
+// Dynamic updates (RFC 2136), authenticated by TSIG (RFC 2845), allow
+// standard tools such as nsupdate to add and remove names in our
+// domain.  Only A records can be added or deleted, and only names
+// registered by this peer can be deleted; prerequisites are not
+// supported.  Names are matched case-insensitively, as in DNS.
+
+// The default check on incoming messages rejects all updates, since
+// they may carry any number of records; let them through if we have
+// keys to authenticate them with.
+func (d *DNSServer) acceptMsg(dh dns.Header) dns.MsgAcceptAction {
+	const qr = 1 << 15
+	if opcode := int(dh.Bits>>11) & 0xF; opcode == dns.OpcodeUpdate && dh.Bits&qr == 0 && len(d.updateKeys) > 0 {
+		return dns.MsgAccept
+	}
+	return dns.DefaultMsgAcceptFunc(dh)
+}
+
+func (h *handler) handleUpdate(w dns.ResponseWriter, req *dns.Msg) {
+	h.ns.debugf("update request: %+v", *req)
+	tsig := req.IsTsig()
+	switch {
+	case len(h.updateKeys) == 0:
+		h.respond(w, h.makeErrorResponse(req, dns.RcodeRefused))
+		return
+	case tsig == nil || w.TsigStatus() != nil:
+		h.ns.infof("refusing unauthenticated update from %s", w.RemoteAddr())
+		h.respond(w, h.makeErrorResponse(req, dns.RcodeNotAuth))
+		return
+	}
+
+	rcode := h.checkUpdate(req)
+	if rcode == dns.RcodeSuccess {
+		h.ns.infof("update from %s with key %s", w.RemoteAddr(), tsig.Hdr.Name)
+		rcode = h.applyUpdate(req.Ns)
+	}
+
+	response := h.makeErrorResponse(req, rcode)
+	response.SetTsig(tsig.Hdr.Name, tsig.Algorithm, tsigFudge, time.Now().Unix())
+	h.respond(w, response)
+}
+
+// Check that an update is for our zone, and that every record in it
+// is one we can carry out, before applying any of it.
+func (h *handler) checkUpdate(req *dns.Msg) int {
+	if len(req.Question) != 1 || req.Question[0].Qtype != dns.TypeSOA {
+		return dns.RcodeFormatError
+	}
+	if !h.isZoneApex(req.Question[0].Name) {
+		return dns.RcodeNotAuth
+	}
+	if len(req.Answer) > 0 {
+		return dns.RcodeNotImplemented
+	}
+	for _, rr := range req.Ns {
+		header := rr.Header()
+		if !dns.IsSubDomain(h.domain, strings.ToLower(dns.Fqdn(header.Name))) {
+			return dns.RcodeNotZone
+		}
+		switch header.Class {
+		case dns.ClassINET:
+			a, ok := rr.(*dns.A)
+			if !ok {
+				return dns.RcodeNotImplemented
+			}
+			if a.A.To4() == nil {
+				return dns.RcodeFormatError
+			}
+		case dns.ClassANY:
+			// RFC 2136 section 2.5.2: no TTL and no data
+			if header.Ttl != 0 || header.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+			if header.Rrtype != dns.TypeA && header.Rrtype != dns.TypeANY {
+				return dns.RcodeNotImplemented
+			}
+			if h.ns.heldElsewhere(header.Name, nil) {
+				return dns.RcodeRefused
+			}
+		case dns.ClassNONE:
+			if header.Ttl != 0 {
+				return dns.RcodeFormatError
+			}
+			a, ok := rr.(*dns.A)
+			if !ok {
+				return dns.RcodeNotImplemented
+			}
+			if a.A.To4() == nil {
+				return dns.RcodeFormatError
+			}
+			addr := address.FromIP4(a.A)
+			if h.ns.heldElsewhere(header.Name, &addr) {
+				return dns.RcodeRefused
+			}
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// Apply a checked update.  Every record in it is applied locally even
+// if broadcasting one of them fails, since those entries will still be
+// gossiped in due course, rather than leave the update half done.
+func (h *handler) applyUpdate(updates []dns.RR) int {
+	for _, rr := range updates {
+		header := rr.Header()
+		hostname := dns.Fqdn(header.Name)
+		var err error
+		switch header.Class {
+		case dns.ClassINET:
+			// Add to an RRset
+			addr := address.FromIP4(rr.(*dns.A).A)
+			err = h.ns.AddEntry(hostname, updateContainerID, h.ns.ourName, addr)
+		case dns.ClassANY:
+			// Delete the A RRset, or all RRsets, for the name
+			err = h.ns.deleteByName(hostname, nil)
+		case dns.ClassNONE:
+			// Delete an RR from an RRset
+			addr := address.FromIP4(rr.(*dns.A).A)
+			err = h.ns.deleteByName(hostname, &addr)
+		}
+		if err != nil {
+			h.ns.errorf("failed to broadcast update %v: %v", rr, err)
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// Are any of the live entries for a name, and address if given,
+// registered by other peers, so that we cannot delete them?
+func (n *Nameserver) heldElsewhere(hostname string, addr *address.Address) bool {
+	n.RLock()
+	defer n.RUnlock()
+	for _, e := range n.entries.lookup(dns.Fqdn(hostname)) {
+		if e.Tombstone == 0 && e.Origin != n.ourName && (addr == nil || e.Addr == *addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// As Delete, for all containers, but matching the name
+// case-insensitively.
+func (n *Nameserver) deleteByName(hostname string, addr *address.Address) error {
+	addrStr := "*"
+	if addr != nil {
+		addrStr = addr.String()
+	}
+	n.Lock()
+	n.infof("tombstoning hostname=%s, ip=%s", hostname, addrStr)
+	entries := n.entries.tombstone(n.ourName, func(e *Entry) bool {
+		if !strings.EqualFold(e.Hostname, hostname) || (addr != nil && e.Addr != *addr) {
+			return false
+		}
+		n.infof("tombstoning entry %v", e)
+		return true
+	})
+	n.changed(EventTombstone, entries...)
+	n.Unlock()
+	return n.broadcastEntries(entries...)
+}
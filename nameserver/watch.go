@@ -0,0 +1,94 @@
+package nameserver
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	EventAdd       = "add"
+	EventTombstone = "tombstone"
+	EventDelete    = "delete"
+	// Sent when a watcher cannot resume from the serial it gave, and
+	// followed by an EventAdd for every live entry.
+	EventReset = "reset"
+
+	// Number of recent events held for watchers to resume from.
+	maxEvents = 4096
+
+	// How long a long-poll for events waits before returning none.
+	defaultPollTimeout = 30 * time.Second
+)
+
+// Event describes a change to an entry.  Serial is the nameserver's
+// serial number after the change, which every event gets one of its
+// own; a watcher that has seen an event can ask for everything after
+// its serial.  Of a reset and the adds following it, only the last
+// has a serial, so that a watcher which misses the rest of them
+// starts over.
+type Event struct {
+	Serial uint32
+	Type   string
+	Entry  *Entry `json:",omitempty"`
+}
+
+// Record a change to entries, and wake up anyone watching.  Must be
+// called with the lock held.
+func (n *Nameserver) changed(eventType string, entries ...Entry) {
+	n.record(entries, func(Entry) string { return eventType })
+}
+
+// As changed(), for entries received by gossip, which may be
+// additions or tombstones.
+func (n *Nameserver) changedByGossip(entries Entries) {
+	n.record(entries, func(e Entry) string {
+		if e.Tombstone > 0 {
+			return EventTombstone
+		}
+		return EventAdd
+	})
+}
+
+func (n *Nameserver) record(entries Entries, eventType func(Entry) string) {
+	if len(entries) == 0 {
+		return
+	}
+	for _, e := range entries {
+		entry := e
+		n.events = append(n.events, Event{Serial: n.nextSerial(), Type: eventType(e), Entry: &entry})
+	}
+	if excess := len(n.events) - maxEvents; excess > 0 {
+		// Watchers can only resume from a serial whose events
+		// we still hold in their entirety
+		n.eventsFrom = n.events[excess-1].Serial
+		n.events = append([]Event{}, n.events[excess:]...)
+	}
+	close(n.notify)
+	n.notify = make(chan struct{})
+}
+
+// EventsSince returns the events after serial since, or if those are
+// no longer available (or resume is false), a reset followed by the
+// current entries.  It also returns a channel which will be closed
+// at the next change.
+func (n *Nameserver) EventsSince(since uint32, resume bool) ([]Event, <-chan struct{}) {
+	n.RLock()
+	defer n.RUnlock()
+
+	if resume && since >= n.eventsFrom && since <= n.serial {
+		i := sort.Search(len(n.events), func(i int) bool {
+			return n.events[i].Serial > since
+		})
+		return append([]Event{}, n.events[i:]...), n.notify
+	}
+
+	events := []Event{{Type: EventReset}}
+	for _, e := range n.entries {
+		if e.Tombstone == 0 {
+			entry := e
+			events = append(events, Event{Type: EventAdd, Entry: &entry})
+		}
+	}
+	events[len(events)-1].Serial = n.serial
+	return events, n.notify
+}
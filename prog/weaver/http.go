@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"github.com/gorilla/mux"
 	. "github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/dhcp"
 	"github.com/weaveworks/weave/ipam"
+	"github.com/weaveworks/weave/mesh"
 	"github.com/weaveworks/weave/nameserver"
 	"github.com/weaveworks/weave/net/address"
 	weave "github.com/weaveworks/weave/router"
@@ -15,6 +17,7 @@ import (
 )
 
 var rootTemplate = template.New("root").Funcs(map[string]interface{}{
+	"join": strings.Join,
 	"countDNSEntries": func(entries []nameserver.EntryStatus) int {
 		count := 0
 		for _, entry := range entries {
@@ -24,14 +27,14 @@ var rootTemplate = template.New("root").Funcs(map[string]interface{}{
 		}
 		return count
 	},
-	"printConnectionCounts": func(conns []weave.LocalConnectionStatus) string {
+	"printConnectionCounts": func(conns []mesh.LocalConnectionStatus) string {
 		counts := make(map[string]int)
 		for _, conn := range conns {
 			counts[conn.State]++
 		}
 		return printCounts(counts, []string{"established", "pending", "retrying", "failed", "connecting"})
 	},
-	"printPeerConnectionCounts": func(peers []weave.PeerStatus) string {
+	"printPeerConnectionCounts": func(peers []mesh.PeerStatus) string {
 		counts := make(map[string]int)
 		for _, peer := range peers {
 			for _, conn := range peer.Connections {
@@ -51,6 +54,10 @@ var rootTemplate = template.New("root").Funcs(map[string]interface{}{
 		return "disabled"
 	},
 	"trimSuffix": strings.TrimSuffix,
+	"printTraffic": func(stats weave.TrafficStats) string {
+		return fmt.Sprintf("%10.1f packets/s %12.1f bytes/s (total %d packets, %d bytes)",
+			stats.PacketRate, stats.ByteRate, stats.Packets, stats.Bytes)
+	},
 })
 
 // Print counts in a specified order
@@ -85,23 +92,58 @@ var statusTemplate = defTemplate("status", `\
 {{.Router.ProtocolMinVersion}}..{{.Router.ProtocolMaxVersion}}\
 {{end}}
           Name: {{.Router.Name}}({{.Router.NickName}})
+{{with .Router.Zone}}\
+          Zone: {{.}}{{if $.Router.ZoneGateway}} (gateway){{end}}
+{{end}}\
     Encryption: {{printState .Router.Encryption}}
  PeerDiscovery: {{printState .Router.PeerDiscovery}}
        Targets: {{len .Router.Targets}}
    Connections: {{len .Router.Connections}}{{with printConnectionCounts .Router.Connections}} ({{.}}){{end}}
          Peers: {{len .Router.Peers}}{{with printPeerConnectionCounts .Router.Peers}} (with {{.}} connections){{end}}
-{{if .IPAM}}\
+{{with .Router.TopTalkers}}         Flows: {{.Flows}} ({{printf "%.1f" .Total.PacketRate}} packets/s, {{printf "%.1f" .Total.ByteRate}} bytes/s)
+{{end}}{{if .IPAM}}\
 
        Service: ipam
 {{if .IPAM.Entries}}\
      Consensus: achieved
 {{else if .IPAM.Paxos}}\
      Consensus: waiting (quorum: {{.IPAM.Paxos.Quorum}}, known: {{.IPAM.Paxos.KnownNodes}})
+{{else if .IPAM.Observer}}\
+     Consensus: waiting to hear from {{with .IPAM.Seed}}seed {{join . ", "}}{{else}}other peers{{end}}
+{{else if .IPAM.Seed}}\
+     Consensus: deferred (seed: {{join .IPAM.Seed ", "}})
 {{else}}\
      Consensus: deferred
 {{end}}\
          Range: {{.IPAM.Range}}
+{{with .IPAM.PendingRanges}}\
+ PendingRanges: {{join . ", "}}
+{{end}}\
  DefaultSubnet: {{.IPAM.DefaultSubnet}}
+{{with .IPAM.Reservations}}\
+  Reservations: {{len .}}
+{{end}}\
+{{with .IPAM.Rebalance}}{{if .Requests}}\
+     Rebalance: {{.Requests}} requests for space, last to {{.LastDonor}}
+{{end}}{{end}}\
+{{with .IPAM.Takeover}}\
+{{if .TakenOver}}\
+      Takeover: this peer's ranges were taken over by another peer
+{{else}}\
+{{with .Absent}}\
+        Absent: {{join . ", "}}
+{{end}}\
+{{with .TakingOver}}\
+      Takeover: agreeing to take over {{.}}
+{{end}}\
+{{end}}\
+{{end}}\
+{{if or .IPAM.Leaked .IPAM.Reclaimed}}\
+        Leaked: {{.IPAM.Leaked}} (reclaimed {{.IPAM.Reclaimed}})
+{{end}}\
+{{range .IPAM.Pools}}\
+          Pool: {{.Name}} {{.Subnet}}{{if .Tenant}} (tenant {{.Tenant}}){{end}} used {{.Used}}{{if .Quota}} of {{.Quota}}{{end}}
+{{end}}\
 {{end}}\
 {{if .DNS}}\
 
@@ -110,6 +152,13 @@ var statusTemplate = defTemplate("status", `\
            TTL: {{.DNS.TTL}}
        Entries: {{countDNSEntries .DNS.Entries}}
 {{end}}\
+{{if .DHCP}}\
+
+       Service: dhcp
+     Interface: {{.DHCP.Interface}}
+        Subnet: {{.DHCP.Subnet}}
+        Leases: {{.DHCP.Leases}}
+{{end}}\
 `)
 
 var targetsTemplate = defTemplate("targetsTemplate", `\
@@ -125,7 +174,7 @@ var connectionsTemplate = defTemplate("connectionsTemplate", `\
 
 var peersTemplate = defTemplate("peers", `\
 {{range .Router.Peers}}\
-{{.Name}}({{.NickName}})
+{{.Name}}({{.NickName}}){{with .Zone}} zone {{.}}{{end}}{{if .ZoneGateway}} gateway{{end}}
 {{range .Connections}}\
    {{if .Outbound}}->{{else}}<-{{end}} {{printf "%-21v" .Address}} \
 {{$nameNickName := printf "%v(%v)" .Name .NickName}}{{printf "%-32v" $nameNickName}} \
@@ -134,6 +183,19 @@ var peersTemplate = defTemplate("peers", `\
 {{end}}\
 `)
 
+var talkersTemplate = defTemplate("talkers", `\
+{{with .Router.TopTalkers}}\
+{{range .MACPairs}}\
+{{printf "%-17v" .SrcMAC}} -> {{printf "%-17v" .DstMAC}} {{printTraffic .TrafficStats}}
+{{end}}\
+{{if .Peers}}
+{{end}}\
+{{range .Peers}}\
+{{printf "%-38v" .Peer}} {{printTraffic .TrafficStats}}
+{{end}}\
+{{end}}\
+`)
+
 var dnsEntriesTemplate = defTemplate("dnsEntries", `\
 {{$domain := printf ".%v" .DNS.Domain}}\
 {{range .DNS.Entries}}\
@@ -146,18 +208,20 @@ var dnsEntriesTemplate = defTemplate("dnsEntries", `\
 
 type WeaveStatus struct {
 	Version string
-	Router  *weave.Status      `json:"Router,omitempty"`
-	IPAM    *ipam.Status       `json:"IPAM,omitempty"`
-	DNS     *nameserver.Status `json:"DNS,omitempty"`
+	Router  *weave.NetworkRouterStatus `json:"Router,omitempty"`
+	IPAM    *ipam.Status               `json:"IPAM,omitempty"`
+	DNS     *nameserver.Status         `json:"DNS,omitempty"`
+	DHCP    *dhcp.Status               `json:"DHCP,omitempty"`
 }
 
-func HandleHTTP(muxRouter *mux.Router, version string, router *weave.Router, allocator *ipam.Allocator, defaultSubnet address.CIDR, ns *nameserver.Nameserver, dnsserver *nameserver.DNSServer) {
+func HandleHTTP(muxRouter *mux.Router, version string, router *weave.NetworkRouter, allocator *ipam.Allocator, defaultSubnet address.CIDR, ns *nameserver.Nameserver, dnsserver *nameserver.DNSServer, dhcpServer *dhcp.Server) {
 	status := func() WeaveStatus {
 		return WeaveStatus{
 			version,
-			weave.NewStatus(router),
+			weave.NewNetworkRouterStatus(router),
 			ipam.NewStatus(allocator, defaultSubnet),
-			nameserver.NewStatus(ns, dnsserver)}
+			nameserver.NewStatus(ns, dnsserver),
+			dhcp.NewStatus(dhcpServer)}
 	}
 	muxRouter.Methods("GET").Path("/report").Headers("Accept", "application/json").HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
@@ -199,5 +263,6 @@ func HandleHTTP(muxRouter *mux.Router, version string, router *weave.Router, all
 	defHandler("/status/connections", connectionsTemplate)
 	defHandler("/status/peers", peersTemplate)
 	defHandler("/status/dns", dnsEntriesTemplate)
+	defHandler("/status/talkers", talkersTemplate)
 
 }
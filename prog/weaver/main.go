@@ -1,23 +1,29 @@
 package main
 
 import (
+	"encoding/base64"
 	"fmt"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/davecheney/profile"
 	"github.com/docker/docker/pkg/mflag"
 	"github.com/gorilla/mux"
+	"github.com/miekg/dns"
 	"github.com/weaveworks/go-odp/odp"
 
 	. "github.com/weaveworks/weave/common"
 	"github.com/weaveworks/weave/common/docker"
+	"github.com/weaveworks/weave/common/mflagext"
+	"github.com/weaveworks/weave/dhcp"
 	"github.com/weaveworks/weave/ipam"
+	"github.com/weaveworks/weave/mesh"
 	"github.com/weaveworks/weave/nameserver"
 	weavenet "github.com/weaveworks/weave/net"
 	"github.com/weaveworks/weave/net/address"
@@ -42,7 +48,8 @@ func main() {
 		deleteDatapath       bool
 		addDatapathInterface string
 
-		config                    weave.Config
+		config                    mesh.Config
+		networkConfig             weave.NetworkConfig
 		protocolMinVersion        int
 		ifaceName                 string
 		routerName                string
@@ -52,10 +59,21 @@ func main() {
 		logLevel                  string
 		prof                      string
 		bufSzMB                   int
+		capture                   string
+		captureFanout             int
 		noDiscovery               bool
 		httpAddr                  string
-		iprangeCIDR               string
+		gossipSocket              string
+		iprangeCIDRs              []string
 		ipsubnetCIDR              string
+		ipallocPools              []string
+		ipallocGCInterval         time.Duration
+		ipallocGCGrace            time.Duration
+		ipallocLivenessURL        string
+		ipallocTakeoverAfter      time.Duration
+		ipallocRebalance          ipam.RebalanceConfig
+		ipallocInit               string
+		ipallocAuditLog           string
 		peerCount                 int
 		dockerAPI                 string
 		peers                     []string
@@ -65,8 +83,16 @@ func main() {
 		dnsTTL                    int
 		dnsClientTimeout          time.Duration
 		dnsEffectiveListenAddress string
+		dnsTransferAllow          []string
+		dnsUpdateKeys             []string
+		dnsSerialFile             string
+		dhcpIfaceName             string
+		dhcpLeaseTime             time.Duration
+		dhcpDNS                   bool
 		iface                     *net.Interface
 		datapathName              string
+		datapathMACExpiry         time.Duration
+		datapathFlowExpiry        time.Duration
 	)
 
 	mflag.BoolVar(&justVersion, []string{"#version", "-version"}, false, "print version and exit")
@@ -74,8 +100,8 @@ func main() {
 	mflag.BoolVar(&deleteDatapath, []string{"-delete-datapath"}, false, "delete ODP datapath and exit")
 	mflag.StringVar(&addDatapathInterface, []string{"-add-datapath-iface"}, "", "add a network interface to the ODP datapath and exit")
 
-	mflag.IntVar(&config.Port, []string{"#port", "-port"}, weave.Port, "router port")
-	mflag.IntVar(&protocolMinVersion, []string{"-min-protocol-version"}, weave.ProtocolMinVersion, "minimum weave protocol version")
+	mflag.IntVar(&config.Port, []string{"#port", "-port"}, mesh.Port, "router port")
+	mflag.IntVar(&protocolMinVersion, []string{"-min-protocol-version"}, mesh.ProtocolMinVersion, "minimum weave protocol version")
 	mflag.StringVar(&ifaceName, []string{"#iface", "-iface"}, "", "name of interface to capture/inject from (disabled if blank)")
 	mflag.StringVar(&routerName, []string{"#name", "-name"}, "", "name of router (defaults to MAC of interface)")
 	mflag.StringVar(&nickName, []string{"#nickname", "-nickname"}, "", "nickname of peer (defaults to hostname)")
@@ -84,11 +110,26 @@ func main() {
 	mflag.BoolVar(&pktdebug, []string{"#pktdebug", "#-pktdebug", "-pkt-debug"}, false, "enable per-packet debug logging")
 	mflag.StringVar(&prof, []string{"#profile", "-profile"}, "", "enable profiling and write profiles to given path")
 	mflag.IntVar(&config.ConnLimit, []string{"#connlimit", "#-connlimit", "-conn-limit"}, 30, "connection limit (0 for unlimited)")
+	mflag.BoolVar(&config.GossipCompression, []string{"-gossip-compression"}, false, "compress gossip to peers which also have this enabled")
 	mflag.BoolVar(&noDiscovery, []string{"#nodiscovery", "#-nodiscovery", "-no-discovery"}, false, "disable peer discovery")
+	mflag.StringVar(&config.Zone, []string{"-zone"}, "", "zone of peer; peer discovery only connects to peers in the same zone, and gateways of other zones connect to each other (no zones if blank)")
+	mflag.BoolVar(&config.ZoneGateway, []string{"-zone-gateway"}, false, "make this peer a gateway between its zone and other zones")
 	mflag.IntVar(&bufSzMB, []string{"#bufsz", "-bufsz"}, 8, "capture buffer size in MB")
+	mflag.StringVar(&capture, []string{"-capture"}, "pcap", "how to capture/inject packets on --iface: pcap, or afpacket for memory-mapped AF_PACKET rings (falls back to pcap if unavailable)")
+	mflag.IntVar(&captureFanout, []string{"-capture-fanout"}, runtime.NumCPU(), "number of sockets and goroutines to spread captured packets across, with --capture afpacket")
 	mflag.StringVar(&httpAddr, []string{"#httpaddr", "#-httpaddr", "-http-addr"}, fmt.Sprintf(":%d", weave.HTTPPort), "address to bind HTTP interface to (disabled if blank, absolute path indicates unix domain socket)")
-	mflag.StringVar(&iprangeCIDR, []string{"#iprange", "#-iprange", "-ipalloc-range"}, "", "IP address range reserved for automatic allocation, in CIDR notation")
+	mflag.StringVar(&gossipSocket, []string{"-gossip-socket"}, "", "unix socket on which to serve the API for other processes to gossip over the weave network (disabled if blank)")
+	mflagext.ListVar(&iprangeCIDRs, []string{"#iprange", "#-iprange", "-ipalloc-range"}, nil, "IP address range reserved for automatic allocation, in CIDR notation (may be repeated)")
 	mflag.StringVar(&ipsubnetCIDR, []string{"#ipsubnet", "#-ipsubnet", "-ipalloc-default-subnet"}, "", "subnet to allocate within by default, in CIDR notation")
+	mflagext.ListVar(&ipallocPools, []string{"-ipalloc-pool"}, nil, "named subnet to allocate within, as name=cidr[,tenant=label][,quota=n]; may be repeated")
+	mflag.DurationVar(&ipallocGCInterval, []string{"-ipalloc-gc-interval"}, 0, "how often to check for addresses leaked by containers which have gone away, and free them (0 to disable)")
+	mflag.DurationVar(&ipallocGCGrace, []string{"-ipalloc-gc-grace"}, 10*time.Minute, "how long a container must have gone away before its addresses are freed")
+	mflag.StringVar(&ipallocLivenessURL, []string{"-ipalloc-liveness-url"}, "", "URL to ask whether a container exists, as URL/<id>, when not using Docker")
+	mflag.DurationVar(&ipallocTakeoverAfter, []string{"-ipalloc-takeover-after"}, 0, "take over the address ranges of peers which have been gone for this long (0 to never)")
+	mflag.DurationVar(&ipallocRebalance.Interval, []string{"-ipalloc-rebalance-interval"}, 0, "how often to ask other peers for address space ahead of need (0 to never)")
+	mflag.IntVar(&ipallocRebalance.Horizon, []string{"-ipalloc-rebalance-horizon"}, 10, "how many rebalance intervals' worth of allocations to keep free")
+	mflag.StringVar(&ipallocInit, []string{"-ipalloc-init"}, "", "how to create the IP allocation ring: consensus[=<count>], seed=<peer>,... or observer")
+	mflag.StringVar(&ipallocAuditLog, []string{"-ipalloc-audit-log"}, "", "file to append a record of every IP allocation and range transfer to, as JSON lines")
 	mflag.IntVar(&peerCount, []string{"#initpeercount", "#-initpeercount", "-init-peer-count"}, 0, "number of peers in network (for IP address allocation)")
 	mflag.StringVar(&dockerAPI, []string{"#api", "#-api", "-docker-api"}, "", "Docker API endpoint, e.g. unix:///var/run/docker.sock")
 	mflag.BoolVar(&noDNS, []string{"-no-dns"}, false, "disable DNS server")
@@ -97,7 +138,15 @@ func main() {
 	mflag.IntVar(&dnsTTL, []string{"-dns-ttl"}, nameserver.DefaultTTL, "TTL for DNS request from our domain")
 	mflag.DurationVar(&dnsClientTimeout, []string{"-dns-fallback-timeout"}, nameserver.DefaultClientTimeout, "timeout for fallback DNS requests")
 	mflag.StringVar(&dnsEffectiveListenAddress, []string{"-dns-effective-listen-address"}, "", "address DNS will actually be listening, after Docker port mapping")
+	mflagext.ListVar(&dnsTransferAllow, []string{"-dns-transfer-allow"}, nil, "network, in CIDR notation, allowed to transfer the DNS zone (AXFR/IXFR); may be repeated")
+	mflagext.ListVar(&dnsUpdateKeys, []string{"-dns-update-key"}, nil, "TSIG key, as name:base64-secret, allowed to make dynamic DNS updates; may be repeated")
+	mflag.StringVar(&dnsSerialFile, []string{"-dns-serial-file"}, "", "file to keep the DNS zone serial number in across restarts")
+	mflag.StringVar(&dhcpIfaceName, []string{"-dhcp-iface"}, "", "serve DHCP on this interface, e.g. the weave bridge, leasing addresses from the default subnet (disabled if blank)")
+	mflag.DurationVar(&dhcpLeaseTime, []string{"-dhcp-lease-time"}, dhcp.DefaultLeaseTime, "how long DHCP leases last before they must be renewed")
+	mflag.BoolVar(&dhcpDNS, []string{"-dhcp-dns"}, false, "register the host names of DHCP clients in weaveDNS")
 	mflag.StringVar(&datapathName, []string{"-datapath"}, "", "ODP datapath name")
+	mflag.DurationVar(&datapathMACExpiry, []string{"-datapath-mac-expiry"}, weave.DefaultExpireMACsInterval, "how often the ODP datapath forgets MACs which have not been seen since the last time")
+	mflag.DurationVar(&datapathFlowExpiry, []string{"-datapath-flow-expiry"}, weave.DefaultExpireFlowsInterval, "how often the ODP datapath deletes flows which have not been used since the last time")
 
 	// crude way of detecting that we probably have been started in a
 	// container, with `weave launch` --> suppress misleading paths in
@@ -142,12 +191,12 @@ func main() {
 	Log.Println("Command line options:", options())
 	Log.Println("Command line peers:", peers)
 
-	if protocolMinVersion < weave.ProtocolMinVersion || protocolMinVersion > weave.ProtocolMaxVersion {
-		Log.Fatalf("--min-protocol-version must be in range [%d,%d]", weave.ProtocolMinVersion, weave.ProtocolMaxVersion)
+	if protocolMinVersion < mesh.ProtocolMinVersion || protocolMinVersion > mesh.ProtocolMaxVersion {
+		Log.Fatalf("--min-protocol-version must be in range [%d,%d]", mesh.ProtocolMinVersion, mesh.ProtocolMaxVersion)
 	}
 	config.ProtocolMinVersion = byte(protocolMinVersion)
 
-	var fastDPOverlay weave.Overlay
+	var fastDPOverlay weave.NetworkOverlay
 	if datapathName != "" {
 		// A datapath name implies that "Bridge" and "Overlay"
 		// packet handling use fast datapath, although other
@@ -155,12 +204,14 @@ func main() {
 		// things are overridden, we might need bridging on
 		// the datapath.
 		fastdp, err := weave.NewFastDatapath(weave.FastDatapathConfig{
-			DatapathName: datapathName,
-			Port:         config.Port,
+			DatapathName:        datapathName,
+			Port:                config.Port,
+			ExpireMACsInterval:  datapathMACExpiry,
+			ExpireFlowsInterval: datapathFlowExpiry,
 		})
 
 		checkFatal(err)
-		config.Bridge = fastdp.Bridge()
+		networkConfig.Bridge = fastdp.Bridge()
 		fastDPOverlay = fastdp.Overlay()
 	}
 
@@ -175,8 +226,21 @@ func main() {
 		checkFatal(err)
 
 		// bufsz flag is in MB
-		config.Bridge, err = weave.NewPcap(iface, bufSzMB*1024*1024)
-		checkFatal(err)
+		var bridge weave.Bridge
+		switch capture {
+		case "afpacket":
+			if bridge, err = weave.NewAFPacket(iface, bufSzMB*1024*1024, captureFanout); err != nil {
+				Log.Warningln("Falling back to pcap:", err)
+			}
+		case "pcap":
+		default:
+			Log.Fatalf("Invalid --capture '%s': expected pcap or afpacket", capture)
+		}
+		if bridge == nil {
+			bridge, err = weave.NewPcap(iface, bufSzMB*1024*1024)
+			checkFatal(err)
+		}
+		networkConfig.Bridge = bridge
 	}
 
 	if password == "" {
@@ -200,7 +264,6 @@ func main() {
 	sleeve := weave.NewSleeveOverlay(config.Port)
 	overlays.Add("sleeve", sleeve)
 	overlays.SetCompatOverlay(sleeve)
-	config.Overlay = overlays
 
 	if routerName == "" {
 		if iface == nil {
@@ -209,7 +272,7 @@ func main() {
 		routerName = iface.HardwareAddr.String()
 	}
 
-	name, err := weave.PeerNameFromUserInput(routerName)
+	name, err := mesh.PeerNameFromUserInput(routerName)
 	checkFatal(err)
 
 	if nickName == "" {
@@ -227,12 +290,12 @@ func main() {
 	config.PeerDiscovery = !noDiscovery
 
 	if pktdebug {
-		config.PacketLogging = packetLogging{}
+		networkConfig.PacketLogging = packetLogging{}
 	} else {
-		config.PacketLogging = nopPacketLogging{}
+		networkConfig.PacketLogging = nopPacketLogging{}
 	}
 
-	router := weave.NewRouter(config, name, nickName)
+	router := weave.NewNetworkRouter(config, networkConfig, name, nickName, overlays)
 	Log.Println("Our name is", router.Ourself)
 
 	var dockerCli *docker.Client
@@ -252,11 +315,42 @@ func main() {
 	}
 	var allocator *ipam.Allocator
 	var defaultSubnet address.CIDR
-	if iprangeCIDR != "" {
-		allocator, defaultSubnet = createAllocator(router, iprangeCIDR, ipsubnetCIDR, determineQuorum(peerCount, peers))
+	// An empty range disables IP allocation
+	for i := 0; i < len(iprangeCIDRs); {
+		if iprangeCIDRs[i] == "" {
+			iprangeCIDRs = append(iprangeCIDRs[:i], iprangeCIDRs[i+1:]...)
+		} else {
+			i++
+		}
+	}
+	if len(iprangeCIDRs) > 0 {
+		quorum, seed, observer := parseIPAllocInit(ipallocInit, peerCount, peers)
+		allocator, defaultSubnet = createAllocator(router.Router, iprangeCIDRs, ipsubnetCIDR, ipallocPools, quorum, seed, observer, ipallocAuditLog)
 		observeContainers(allocator)
+		var livenessCheckers []ipam.LivenessChecker
+		if dockerCli != nil {
+			livenessCheckers = append(livenessCheckers, dockerCli)
+		}
+		if ipallocLivenessURL != "" {
+			livenessCheckers = append(livenessCheckers, ipam.HTTPLivenessChecker{URL: ipallocLivenessURL})
+		}
+		if ipallocGCInterval > 0 && len(livenessCheckers) > 0 {
+			allocator.StartLeaseGC(ipallocGCInterval, ipallocGCGrace, livenessCheckers...)
+		}
+		if ipallocRebalance.Interval > 0 {
+			allocator.StartRebalancing(ipallocRebalance)
+		}
+		if ipallocTakeoverAfter > 0 {
+			allocator.StartDeadPeerTakeover(ipallocTakeoverAfter, router.Peers)
+		}
 	} else if peerCount > 0 {
 		Log.Fatal("--init-peer-count flag specified without --ipalloc-range")
+	} else if ipallocAuditLog != "" {
+		Log.Fatal("--ipalloc-audit-log flag specified without --ipalloc-range")
+	} else if ipallocInit != "" {
+		Log.Fatal("--ipalloc-init flag specified without --ipalloc-range")
+	} else if len(ipallocPools) > 0 {
+		Log.Fatal("--ipalloc-pool flag specified without --ipalloc-range")
 	}
 
 	var (
@@ -265,12 +359,17 @@ func main() {
 	)
 	if !noDNS {
 		ns = nameserver.New(router.Ourself.Peer.Name, router.Peers, dnsDomain)
+		if dnsSerialFile != "" {
+			if err := ns.UseSerialFile(dnsSerialFile); err != nil {
+				Log.Fatal("Unable to use DNS serial file: ", err)
+			}
+		}
 		ns.SetGossip(router.NewGossip("nameserver", ns))
 		observeContainers(ns)
 		ns.Start()
 		defer ns.Stop()
 		dnsserver, err = nameserver.NewDNSServer(ns, dnsDomain, dnsListenAddress,
-			dnsEffectiveListenAddress, uint32(dnsTTL), dnsClientTimeout)
+			dnsEffectiveListenAddress, uint32(dnsTTL), dnsClientTimeout, parseCIDRs(dnsTransferAllow), parseTSIGKeys(dnsUpdateKeys))
 		if err != nil {
 			Log.Fatal("Unable to start dns server: ", err)
 		}
@@ -283,6 +382,26 @@ func main() {
 		defer dnsserver.Stop()
 	}
 
+	var dhcpServer *dhcp.Server
+	if dhcpIfaceName != "" {
+		if allocator == nil {
+			Log.Fatal("--dhcp-iface flag specified without --ipalloc-range")
+		}
+		dhcpIface, err := net.InterfaceByName(dhcpIfaceName)
+		if err != nil {
+			Log.Fatal("Unable to find DHCP interface: ", err)
+		}
+		var registrar dhcp.Registrar
+		if dhcpDNS && ns != nil {
+			registrar = ns
+		}
+		dhcpServer = dhcp.NewServer(dhcpIface, defaultSubnet, dhcpLeaseTime, allocator, registrar, dnsDomain, router.Ourself.Peer.Name)
+		if err := dhcpServer.Start(); err != nil {
+			Log.Fatal("Unable to start DHCP server: ", err)
+		}
+		defer dhcpServer.Stop()
+	}
+
 	router.Start()
 	if errors := router.ConnectionMaker.InitiateConnections(peers, false); len(errors) > 0 {
 		Log.Fatal(ErrorMessages(errors))
@@ -300,10 +419,18 @@ func main() {
 			ns.HandleHTTP(muxRouter, dockerCli)
 		}
 		router.HandleHTTP(muxRouter)
-		HandleHTTP(muxRouter, version, router, allocator, defaultSubnet, ns, dnsserver)
+		HandleHTTP(muxRouter, version, router, allocator, defaultSubnet, ns, dnsserver, dhcpServer)
 		http.Handle("/", muxRouter)
 		Log.Println("Listening for HTTP control messages on", httpAddr)
-		go listenAndServeHTTP(httpAddr, muxRouter)
+		// The default mux also serves /debug/pprof
+		go listenAndServeHTTP(httpAddr, nil)
+	}
+
+	if gossipSocket != "" {
+		muxRouter := mux.NewRouter()
+		mesh.NewGossipAPI(router.Router).HandleHTTP(muxRouter)
+		Log.Println("Listening for gossip API requests on", gossipSocket)
+		go listenAndServeHTTP(gossipSocket, muxRouter)
 	}
 
 	SignalHandlerLoop(router)
@@ -359,16 +486,72 @@ func parseAndCheckCIDR(cidrStr string) address.CIDR {
 	return cidr
 }
 
-func createAllocator(router *weave.Router, ipRangeStr string, defaultSubnetStr string, quorum uint) (*ipam.Allocator, address.CIDR) {
-	ipRange := parseAndCheckCIDR(ipRangeStr)
-	defaultSubnet := ipRange
+func parseCIDRs(cidrStrs []string) []*net.IPNet {
+	var cidrs []*net.IPNet
+	for _, cidrStr := range cidrStrs {
+		_, cidr, err := net.ParseCIDR(cidrStr)
+		checkFatal(err)
+		cidrs = append(cidrs, cidr)
+	}
+	return cidrs
+}
+
+func parseTSIGKeys(keyStrs []string) map[string]string {
+	keys := make(map[string]string)
+	for _, keyStr := range keyStrs {
+		parts := strings.SplitN(keyStr, ":", 2)
+		if len(parts) != 2 {
+			Log.Fatalf("Invalid TSIG key '%s': expected name:secret", keyStr)
+		}
+		if _, err := base64.StdEncoding.DecodeString(parts[1]); err != nil {
+			Log.Fatalf("Invalid TSIG secret for key '%s': %v", parts[0], err)
+		}
+		keys[dns.Fqdn(strings.ToLower(parts[0]))] = parts[1]
+	}
+	return keys
+}
+
+func createAllocator(router *mesh.Router, ipRangeStrs []string, defaultSubnetStr string, poolStrs []string, quorum uint, seed []mesh.PeerName, observer bool, auditLog string) (*ipam.Allocator, address.CIDR) {
+	var universe []address.Range
+	for _, ipRangeStr := range ipRangeStrs {
+		ipRange := parseAndCheckCIDR(ipRangeStr).Range()
+		for _, r := range universe {
+			if r.Overlaps(ipRange) {
+				Log.Fatalf("IP address allocation ranges %s and %s overlap", r.AsCIDRString(), ipRangeStr)
+			}
+		}
+		universe = append(universe, ipRange)
+	}
+	defaultSubnet := parseAndCheckCIDR(ipRangeStrs[0])
 	if defaultSubnetStr != "" {
 		defaultSubnet = parseAndCheckCIDR(defaultSubnetStr)
-		if !ipRange.Range().Overlaps(defaultSubnet.Range()) {
-			Log.Fatalf("IP address allocation default subnet %s does not overlap with allocation range %s", defaultSubnet, ipRange)
+		overlaps := false
+		for _, r := range universe {
+			overlaps = overlaps || r.Overlaps(defaultSubnet.Range())
 		}
+		if !overlaps {
+			Log.Fatalf("IP address allocation default subnet %s does not overlap with allocation range %s", defaultSubnet, strings.Join(ipRangeStrs, ", "))
+		}
+	}
+	allocator := ipam.NewAllocator(router.Ourself.Peer.Name, router.Ourself.Peer.UID, router.Ourself.Peer.NickName, universe, quorum)
+	for _, poolStr := range poolStrs {
+		pool, err := ipam.ParsePool(poolStr)
+		checkFatal(err)
+		checkFatal(allocator.AddPool(pool))
+	}
+	switch {
+	case len(seed) > 0:
+		allocator.SeedWith(seed)
+	case observer:
+		allocator.Observe()
+	}
+	if auditLog != "" {
+		auditFile, err := os.OpenFile(auditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			Log.Fatal("Unable to open IP allocation audit log: ", err)
+		}
+		allocator.SetAuditWriter(auditFile)
 	}
-	allocator := ipam.NewAllocator(router.Ourself.Peer.Name, router.Ourself.Peer.UID, router.Ourself.Peer.NickName, ipRange.Range(), quorum)
 
 	allocator.SetInterfaces(router.NewGossip("IPallocation", allocator))
 	allocator.Start()
@@ -376,6 +559,46 @@ func createAllocator(router *weave.Router, ipRangeStr string, defaultSubnetStr s
 	return allocator, defaultSubnet
 }
 
+// Parse --ipalloc-init, returning the quorum for consensus, and the
+// seed peers or whether we are an observer.  Seeds and observers
+// still need a quorum to agree later changes, such as adding ranges.
+func parseIPAllocInit(init string, initPeerCountFlag int, peers []string) (uint, []mesh.PeerName, bool) {
+	mode, arg := init, ""
+	if i := strings.Index(init, "="); i >= 0 {
+		mode, arg = init[:i], init[i+1:]
+	}
+	switch {
+	case mode == "" || mode == "consensus":
+		if arg != "" {
+			count, err := strconv.Atoi(arg)
+			if err != nil || count <= 0 {
+				Log.Fatalf("Invalid peer count '%s' in --ipalloc-init", arg)
+			}
+			if initPeerCountFlag > 0 && initPeerCountFlag != count {
+				Log.Fatal("--ipalloc-init consensus=<count> and --init-peer-count disagree")
+			}
+			initPeerCountFlag = count
+		}
+		return determineQuorum(initPeerCountFlag, peers), nil, false
+	case initPeerCountFlag > 0:
+		Log.Fatalf("--init-peer-count cannot be used with --ipalloc-init %s", mode)
+	case mode == "seed" && arg != "":
+		var seed []mesh.PeerName
+		for _, peerStr := range strings.Split(arg, ",") {
+			peer, err := mesh.PeerNameFromUserInput(peerStr)
+			if err != nil {
+				Log.Fatalf("Invalid seed peer name '%s': %s", peerStr, err)
+			}
+			seed = append(seed, peer)
+		}
+		return uint(len(seed)/2 + 1), seed, false
+	case mode == "observer" && arg == "":
+		return determineQuorum(0, peers), nil, true
+	}
+	Log.Fatalf("Invalid --ipalloc-init '%s': expected consensus[=<count>], seed=<peer>,... or observer", init)
+	return 0, nil, false
+}
+
 // Pick a quorum size heuristically based on the number of peer
 // addresses passed.
 func determineQuorum(initPeerCountFlag int, peers []string) uint {
@@ -396,7 +619,7 @@ func determineQuorum(initPeerCountFlag int, peers []string) uint {
 	return quorum
 }
 
-func listenAndServeHTTP(httpAddr string, muxRouter *mux.Router) {
+func listenAndServeHTTP(httpAddr string, handler http.Handler) {
 	protocol := "tcp"
 	if strings.HasPrefix(httpAddr, "/") {
 		os.Remove(httpAddr) // in case it's there from last time
@@ -406,7 +629,7 @@ func listenAndServeHTTP(httpAddr string, muxRouter *mux.Router) {
 	if err != nil {
 		Log.Fatal("Unable to create http listener socket: ", err)
 	}
-	err = http.Serve(l, nil)
+	err = http.Serve(l, handler)
 	if err != nil {
 		Log.Fatal("Unable to create http server", err)
 	}
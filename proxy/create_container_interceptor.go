@@ -49,6 +49,12 @@ func (i *createContainerInterceptor) InterceptRequest(r *http.Request) error {
 		return err
 	}
 
+	if i.proxy.Config.PoolFromLabel != "" {
+		if env, err = i.setPoolFromLabel(container, env); err != nil {
+			return err
+		}
+	}
+
 	if cidrs, err := i.proxy.weaveCIDRs(networkMode, env); err != nil {
 		Log.Infof("Leaving container alone because %s", err)
 	} else {
@@ -172,3 +178,24 @@ func (i *createContainerInterceptor) hostnameFromLabel(hostname string, containe
 
 	return label, nil
 }
+
+// Allocate from the pool named by the label, unless the container
+// asks for specific addresses
+func (i *createContainerInterceptor) setPoolFromLabel(container jsonObject, env []string) ([]string, error) {
+	labels, err := container.Object("Labels")
+	if err != nil {
+		return nil, err
+	}
+	pool, err := labels.String(i.proxy.Config.PoolFromLabel)
+	if err != nil || pool == "" {
+		return env, err
+	}
+	for _, e := range env {
+		if strings.HasPrefix(e, "WEAVE_CIDR=") {
+			return env, nil
+		}
+	}
+	env = append(env, "WEAVE_CIDR=pool:"+pool)
+	container["Env"] = env
+	return env, nil
+}
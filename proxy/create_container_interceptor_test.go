@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetPoolFromLabel(t *testing.T) {
+	i := &createContainerInterceptor{proxy: &Proxy{Config: Config{PoolFromLabel: "works.weave.pool"}}}
+	labelled := func(pool string) jsonObject {
+		return jsonObject{"Labels": map[string]interface{}{"works.weave.pool": pool}}
+	}
+
+	container := labelled("acme")
+	env, err := i.setPoolFromLabel(container, []string{"FOO=bar"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"FOO=bar", "WEAVE_CIDR=pool:acme"}, env)
+	require.Equal(t, env, container["Env"])
+
+	// Containers asking for specific addresses keep them
+	container = labelled("acme")
+	env, err = i.setPoolFromLabel(container, []string{"WEAVE_CIDR=10.2.1.1/24"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"WEAVE_CIDR=10.2.1.1/24"}, env)
+	require.Nil(t, container["Env"])
+
+	// Unlabelled containers are left alone
+	for _, container := range []jsonObject{labelled(""), {"Labels": map[string]interface{}{}}, {}} {
+		env, err = i.setPoolFromLabel(container, nil)
+		require.NoError(t, err)
+		require.Nil(t, env)
+		require.Nil(t, container["Env"])
+	}
+
+	_, err = i.setPoolFromLabel(jsonObject{"Labels": map[string]interface{}{"works.weave.pool": 1}}, nil)
+	require.Error(t, err)
+}
@@ -51,6 +51,7 @@ type Config struct {
 	RewriteInspect      bool
 	NoDefaultIPAM       bool
 	NoRewriteHosts      bool
+	PoolFromLabel       string
 	TLSConfig           TLSConfig
 	Version             string
 	WithDNS             bool
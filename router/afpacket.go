@@ -0,0 +1,502 @@
+package router
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// Linux AF_PACKET definitions not provided by the syscall package
+// (see linux/if_packet.h)
+const (
+	packetAddMembership = 1
+	packetMrPromisc     = 1
+	packetRxRing        = 5
+	packetStatistics    = 6
+	packetVersion       = 10
+	packetTxRing        = 13
+	packetLoss          = 14
+	packetFanout        = 18
+
+	packetFanoutHash       = 0
+	packetFanoutFlagDefrag = 0x8000
+
+	tpacketV2 = 1
+	tpacketV3 = 2
+
+	tpStatusKernel        = 0
+	tpStatusUser          = 1
+	tpStatusSendRequest   = 1
+	tpStatusSending       = 2
+	tpStatusVLANValid     = 0x10
+	tpStatusVLANTPIDValid = 0x40
+
+	// Offsets into struct tpacket_block_desc
+	blockStatusOffset   = 8
+	blockNumPktsOffset  = 12
+	blockFirstPktOffset = 16
+
+	// Offsets into struct tpacket3_hdr, and its size after
+	// TPACKET_ALIGN, at which the struct sockaddr_ll follows
+	tp3NextOffset = 0
+	tp3Snaplen    = 12
+	tp3Status     = 20
+	tp3Mac        = 24
+	tp3VLANTCI    = 32
+	tp3VLANTPID   = 36
+	tp3HdrLen     = 48
+	sllPkttype    = 10
+
+	// Offsets into struct tpacket2_hdr, and where frame data goes
+	// in a TX ring slot
+	tp2Status     = 0
+	tp2Len        = 4
+	tp2DataOffset = 32
+)
+
+const (
+	afpacketBlockSize  = 1 << 18 // [1]
+	afpacketFrameSize  = 1 << 11 // [2]
+	afpacketMinBlocks  = 2
+	afpacketRetireTOV  = 1 // [3]
+	afpacketTxFrames   = 256
+	afpacketMaxVLANHdr = 4
+)
+
+// [1] size of each block in the TPACKET_V3 receive rings.  Must be a
+// power-of-two multiple of the page size, and bigger than the largest
+// frame.
+
+// [2] nominal frame size; TPACKET_V3 packs frames of any size into
+// blocks, but the kernel insists on tp_frame_nr being consistent
+// with it.
+
+// [3] milliseconds before the kernel hands us a block that isn't
+// full.  This bounds the latency added to captured packets when
+// traffic is light.
+
+// AFPacket is a Bridge which captures and injects packets using
+// memory-mapped AF_PACKET rings.  Captured packets are received in
+// batches through TPACKET_V3 rings, on several sockets which the
+// kernel fans packets out to by flow hash, each with its own
+// goroutine.  Injected packets are queued on a TX ring, and handed to
+// the kernel in batches.
+type AFPacket struct {
+	NonDiscardingFlowOp
+
+	iface *net.Interface
+
+	// The TX ring.  Slots are filled under txLock; the kernel is
+	// told about them by txFlusher, so that frames queued while it
+	// is busy get sent with a single syscall.
+	txLock    sync.Mutex
+	txFd      int
+	txRing    []byte
+	txSlotSz  int
+	txIdx     int
+	txPending chan struct{}
+	txDropped int
+
+	// Receive sockets, one per member of the fanout group
+	rxLock    sync.Mutex
+	rx        []*afpacketReceiver
+	consuming bool
+	received  int
+	dropped   int
+	rxFreezes int
+}
+
+type afpacketReceiver struct {
+	fd      int
+	epfd    int
+	ring    []byte
+	current int
+	blockNr int
+}
+
+func NewAFPacket(iface *net.Interface, bufSz int, fanout int) (Bridge, error) {
+	if fanout < 1 {
+		fanout = 1
+	}
+
+	afp := &AFPacket{iface: iface, txPending: make(chan struct{}, 1)}
+	if err := afp.openTx(); err != nil {
+		return nil, fmt.Errorf("unable to set up AF_PACKET injection on %s: %s", iface.Name, err)
+	}
+
+	// Set up the receive rings now, rather than when we start
+	// consuming packets, so that the caller can fall back to
+	// something else if they are not supported.  Split the buffer
+	// between the sockets in the fanout group.
+	blockNr := bufSz / fanout / afpacketBlockSize
+	if blockNr < afpacketMinBlocks {
+		blockNr = afpacketMinBlocks
+	}
+
+	group := os.Getpid() & 0xffff
+	for i := 0; i < fanout; i++ {
+		rx, err := newAFPacketReceiver(iface, blockNr, group)
+		if err != nil {
+			afp.close()
+			return nil, fmt.Errorf("unable to set up AF_PACKET capture on %s: %s", iface.Name, err)
+		}
+		afp.rx = append(afp.rx, rx)
+	}
+
+	go afp.txFlusher()
+	return afp, nil
+}
+
+func (afp *AFPacket) close() {
+	for _, rx := range afp.rx {
+		rx.close()
+	}
+	syscall.Munmap(afp.txRing)
+	syscall.Close(afp.txFd)
+}
+
+func (afp *AFPacket) openTx() error {
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, 0)
+	if err != nil {
+		return err
+	}
+
+	// Each frame gets a whole number of pages, so that frames can
+	// be any size up to the interface MTU plus headers.
+	pageSz := os.Getpagesize()
+	slotSz := tp2DataOffset + afpacketMaxVLANHdr + EthernetOverhead + afp.iface.MTU
+	slotSz = (slotSz + pageSz - 1) / pageSz * pageSz
+	req := tpacketReq{
+		blockSize: uint32(slotSz),
+		blockNr:   afpacketTxFrames,
+		frameSize: uint32(slotSz),
+		frameNr:   afpacketTxFrames,
+	}
+
+	// Binding with a zero protocol means this socket never
+	// receives packets.  The PACKET_LOSS option means malformed
+	// frames get discarded, rather than blocking the ring.
+	if err = syscall.SetsockoptInt(fd, syscall.SOL_PACKET, packetVersion, tpacketV2); err == nil {
+		if err = syscall.SetsockoptInt(fd, syscall.SOL_PACKET, packetLoss, 1); err == nil {
+			if err = setsockopt(fd, packetTxRing, unsafe.Pointer(&req), unsafe.Sizeof(req)); err == nil {
+				err = syscall.Bind(fd, &syscall.SockaddrLinklayer{Ifindex: afp.iface.Index})
+			}
+		}
+	}
+	if err != nil {
+		syscall.Close(fd)
+		return err
+	}
+
+	ring, err := syscall.Mmap(fd, 0, slotSz*afpacketTxFrames, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		syscall.Close(fd)
+		return err
+	}
+
+	afp.txFd, afp.txRing, afp.txSlotSz = fd, ring, slotSz
+	return nil
+}
+
+func (afp *AFPacket) StartConsumingPackets(consumer BridgeConsumer) error {
+	afp.rxLock.Lock()
+	defer afp.rxLock.Unlock()
+	if afp.consuming {
+		panic("already consuming")
+	}
+
+	afp.consuming = true
+	for _, rx := range afp.rx {
+		go rx.sniff(consumer)
+	}
+	return nil
+}
+
+func newAFPacketReceiver(iface *net.Interface, blockNr int, group int) (*afpacketReceiver, error) {
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	rx := &afpacketReceiver{fd: fd, epfd: -1, blockNr: blockNr}
+	if err := rx.setup(iface, group); err != nil {
+		rx.close()
+		return nil, err
+	}
+
+	return rx, nil
+}
+
+func (rx *afpacketReceiver) setup(iface *net.Interface, group int) error {
+	req := tpacketReq3{
+		tpacketReq: tpacketReq{
+			blockSize: afpacketBlockSize,
+			blockNr:   uint32(rx.blockNr),
+			frameSize: afpacketFrameSize,
+			frameNr:   uint32(afpacketBlockSize / afpacketFrameSize * rx.blockNr),
+		},
+		retireBlkTOV: afpacketRetireTOV,
+	}
+	if err := syscall.SetsockoptInt(rx.fd, syscall.SOL_PACKET, packetVersion, tpacketV3); err != nil {
+		return err
+	}
+	if err := setsockopt(rx.fd, packetRxRing, unsafe.Pointer(&req), unsafe.Sizeof(req)); err != nil {
+		return err
+	}
+
+	ring, err := syscall.Mmap(rx.fd, 0, afpacketBlockSize*rx.blockNr, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	rx.ring = ring
+
+	if err := syscall.Bind(rx.fd, &syscall.SockaddrLinklayer{Protocol: htons(syscall.ETH_P_ALL), Ifindex: iface.Index}); err != nil {
+		return err
+	}
+
+	mreq := packetMreq{ifindex: int32(iface.Index), typ: packetMrPromisc}
+	if err := setsockopt(rx.fd, packetAddMembership, unsafe.Pointer(&mreq), unsafe.Sizeof(mreq)); err != nil {
+		return err
+	}
+
+	// Keep packets of the same flow on the same socket, so they
+	// stay in order.
+	fanoutArg := group | (packetFanoutHash|packetFanoutFlagDefrag)<<16
+	if err := syscall.SetsockoptInt(rx.fd, syscall.SOL_PACKET, packetFanout, fanoutArg); err != nil {
+		return err
+	}
+
+	rx.epfd, err = syscall.EpollCreate1(0)
+	if err != nil {
+		return err
+	}
+	return syscall.EpollCtl(rx.epfd, syscall.EPOLL_CTL_ADD, rx.fd,
+		&syscall.EpollEvent{Events: syscall.EPOLLIN | syscall.EPOLLERR, Fd: int32(rx.fd)})
+}
+
+func (rx *afpacketReceiver) close() {
+	if rx.ring != nil {
+		syscall.Munmap(rx.ring)
+	}
+	if rx.epfd >= 0 {
+		syscall.Close(rx.epfd)
+	}
+	syscall.Close(rx.fd)
+}
+
+func (rx *afpacketReceiver) sniff(consumer BridgeConsumer) {
+	dec := NewEthernetDecoder()
+	events := make([]syscall.EpollEvent, 1)
+
+	for {
+		block := rx.ring[rx.current*afpacketBlockSize:][:afpacketBlockSize]
+		status := (*uint32)(unsafe.Pointer(&block[blockStatusOffset]))
+		if atomic.LoadUint32(status)&tpStatusUser == 0 {
+			_, err := syscall.EpollWait(rx.epfd, events, -1)
+			if err != nil && err != syscall.EINTR {
+				checkFatal(err)
+			}
+			continue
+		}
+
+		rx.consumeBlock(block, dec, consumer)
+		atomic.StoreUint32(status, tpStatusKernel)
+		rx.current = (rx.current + 1) % rx.blockNr
+	}
+}
+
+func (rx *afpacketReceiver) consumeBlock(block []byte, dec *EthernetDecoder, consumer BridgeConsumer) {
+	numPkts := hostUint32(block[blockNumPktsOffset:])
+	offset := hostUint32(block[blockFirstPktOffset:])
+
+	for i := uint32(0); i < numPkts; i++ {
+		hdr := block[offset:]
+		offset += hostUint32(hdr[tp3NextOffset:])
+
+		// Don't capture packets we injected, or that the
+		// kernel is sending out of the interface.
+		if hdr[tp3HdrLen+sllPkttype] == syscall.PACKET_OUTGOING {
+			continue
+		}
+
+		mac := uint32(hostUint16(hdr[tp3Mac:]))
+		pkt := hdr[mac : mac+hostUint32(hdr[tp3Snaplen:])]
+		if pktStatus := hostUint32(hdr[tp3Status:]); pktStatus&tpStatusVLANValid != 0 {
+			tpid := uint16(0x8100)
+			if pktStatus&tpStatusVLANTPIDValid != 0 {
+				tpid = hostUint16(hdr[tp3VLANTPID:])
+			}
+			pkt = insertVLANTag(pkt, tpid, uint16(hostUint32(hdr[tp3VLANTCI:])))
+		}
+
+		dec.DecodeLayers(pkt)
+		if len(dec.decoded) == 0 {
+			continue
+		}
+
+		if fop := consumer(dec.PacketKey()); !fop.Discards() {
+			// We are handing over the frame to
+			// forwarders, so we need to make a copy of it
+			// before the ring block is given back to the
+			// kernel
+			pktCopy := make([]byte, len(pkt))
+			copy(pktCopy, pkt)
+			fop.Process(pktCopy, dec, false)
+		}
+	}
+}
+
+// The kernel strips VLAN tags from received frames, so put them
+// back, as pcap does.
+func insertVLANTag(pkt []byte, tpid uint16, tci uint16) []byte {
+	if len(pkt) < 12 {
+		return pkt
+	}
+
+	tagged := make([]byte, len(pkt)+4)
+	copy(tagged, pkt[:12])
+	binary.BigEndian.PutUint16(tagged[12:], tpid)
+	binary.BigEndian.PutUint16(tagged[14:], tci)
+	copy(tagged[16:], pkt[12:])
+	return tagged
+}
+
+func (afp *AFPacket) String() string {
+	return fmt.Sprint(afp.iface.Name, " (via AF_PACKET)")
+}
+
+func (afp *AFPacket) InjectPacket(PacketKey) FlowOp {
+	return afp
+}
+
+func (afp *AFPacket) Process(frame []byte, dec *EthernetDecoder, broadcast bool) {
+	afp.txLock.Lock()
+	defer afp.txLock.Unlock()
+
+	if len(frame) > afp.txSlotSz-tp2DataOffset {
+		log.Warnln("AF_PACKET: dropping oversized frame of length", len(frame), "for", afp.iface.Name)
+		return
+	}
+
+	slot := afp.txRing[afp.txIdx*afp.txSlotSz:][:afp.txSlotSz]
+	status := (*uint32)(unsafe.Pointer(&slot[tp2Status]))
+	if atomic.LoadUint32(status)&(tpStatusSendRequest|tpStatusSending) != 0 {
+		// The ring is full
+		afp.txDropped++
+		afp.kickTx()
+		return
+	}
+
+	copy(slot[tp2DataOffset:], frame)
+	*(*uint32)(unsafe.Pointer(&slot[tp2Len])) = uint32(len(frame))
+	atomic.StoreUint32(status, tpStatusSendRequest)
+	afp.txIdx = (afp.txIdx + 1) % afpacketTxFrames
+	afp.kickTx()
+}
+
+func (afp *AFPacket) kickTx() {
+	select {
+	case afp.txPending <- struct{}{}:
+	default:
+	}
+}
+
+func (afp *AFPacket) txFlusher() {
+	for range afp.txPending {
+		// With a TX ring, send transmits every frame queued on
+		// the ring, and waits for them to go.
+		checkWarn(syscall.Sendto(afp.txFd, nil, 0, nil))
+	}
+}
+
+func (afp *AFPacket) Stats() map[string]int {
+	afp.rxLock.Lock()
+	defer afp.rxLock.Unlock()
+
+	// The kernel resets the statistics each time they are read,
+	// so we keep totals.
+	for _, rx := range afp.rx {
+		var stats tpacketStatsV3
+		if err := getsockopt(rx.fd, packetStatistics, unsafe.Pointer(&stats), unsafe.Sizeof(stats)); err != nil {
+			continue
+		}
+		afp.received += int(stats.packets)
+		afp.dropped += int(stats.drops)
+		afp.rxFreezes += int(stats.freezeQCount)
+	}
+
+	afp.txLock.Lock()
+	txDropped := afp.txDropped
+	afp.txLock.Unlock()
+
+	return map[string]int{
+		"PacketsReceived":        afp.received,
+		"PacketsDropped":         afp.dropped,
+		"QueueFreezes":           afp.rxFreezes,
+		"InjectedPacketsDropped": txDropped,
+	}
+}
+
+type tpacketReq struct {
+	blockSize uint32
+	blockNr   uint32
+	frameSize uint32
+	frameNr   uint32
+}
+
+type tpacketReq3 struct {
+	tpacketReq
+	retireBlkTOV   uint32
+	sizeofPriv     uint32
+	featureReqWord uint32
+}
+
+type tpacketStatsV3 struct {
+	packets      uint32
+	drops        uint32
+	freezeQCount uint32
+}
+
+type packetMreq struct {
+	ifindex int32
+	typ     uint16
+	alen    uint16
+	address [8]byte
+}
+
+func setsockopt(fd int, opt int, val unsafe.Pointer, size uintptr) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_SETSOCKOPT, uintptr(fd), syscall.SOL_PACKET, uintptr(opt), uintptr(val), size, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func getsockopt(fd int, opt int, val unsafe.Pointer, size uintptr) error {
+	l := uint32(size)
+	_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(fd), syscall.SOL_PACKET, uintptr(opt), uintptr(val), uintptr(unsafe.Pointer(&l)), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Ring headers are in host byte order
+func hostUint32(b []byte) uint32 {
+	return *(*uint32)(unsafe.Pointer(&b[0]))
+}
+
+func hostUint16(b []byte) uint16 {
+	return *(*uint16)(unsafe.Pointer(&b[0]))
+}
+
+func htons(v uint16) uint16 {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	return hostUint16(b[:])
+}
@@ -0,0 +1,133 @@
+package router
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testRxPacket struct {
+	frame    []byte
+	outgoing bool
+	vlan     bool
+	tpid     uint16 // 0 for the kernel not to say
+	tci      uint16
+}
+
+// Lay out packets in a block as the kernel does for TPACKET_V3
+func makeTestBlock(pkts []testRxPacket) []byte {
+	block := make([]byte, afpacketBlockSize)
+	putHostUint32(block[blockNumPktsOffset:], uint32(len(pkts)))
+	offset := uint32(64)
+	putHostUint32(block[blockFirstPktOffset:], offset)
+
+	for _, pkt := range pkts {
+		hdr := block[offset:]
+		mac := uint32(tp3HdrLen + 32)
+		next := (mac + uint32(len(pkt.frame)) + 15) &^ 15
+		putHostUint32(hdr[tp3NextOffset:], next)
+		putHostUint32(hdr[tp3Snaplen:], uint32(len(pkt.frame)))
+		putHostUint16(hdr[tp3Mac:], uint16(mac))
+		var status uint32 = tpStatusUser
+		if pkt.vlan {
+			status |= tpStatusVLANValid
+			putHostUint32(hdr[tp3VLANTCI:], uint32(pkt.tci))
+			if pkt.tpid != 0 {
+				status |= tpStatusVLANTPIDValid
+				putHostUint16(hdr[tp3VLANTPID:], pkt.tpid)
+			}
+		}
+		putHostUint32(hdr[tp3Status:], status)
+		if pkt.outgoing {
+			hdr[tp3HdrLen+sllPkttype] = syscall.PACKET_OUTGOING
+		} else {
+			hdr[tp3HdrLen+sllPkttype] = syscall.PACKET_HOST
+		}
+		copy(hdr[mac:], pkt.frame)
+		offset += next
+	}
+
+	return block
+}
+
+func putHostUint32(b []byte, v uint32) {
+	*(*uint32)(unsafe.Pointer(&b[0])) = v
+}
+
+func putHostUint16(b []byte, v uint16) {
+	*(*uint16)(unsafe.Pointer(&b[0])) = v
+}
+
+type recordingFlowOp struct {
+	NonDiscardingFlowOp
+	frames [][]byte
+}
+
+func (fop *recordingFlowOp) Process(frame []byte, dec *EthernetDecoder, broadcast bool) {
+	fop.frames = append(fop.frames, frame)
+}
+
+func testFrame(src, dst string, payload string) []byte {
+	srcMAC, _ := net.ParseMAC(src)
+	dstMAC, _ := net.ParseMAC(dst)
+	frame := make([]byte, 14, 64)
+	copy(frame[0:], dstMAC)
+	copy(frame[6:], srcMAC)
+	binary.BigEndian.PutUint16(frame[12:], 0x88b5) // local experimental
+	return append(frame, payload...)
+}
+
+func TestAFPacketConsumeBlock(t *testing.T) {
+	plain := testFrame("00:00:00:00:00:01", "00:00:00:00:00:02", "plain")
+	injected := testFrame("00:00:00:00:00:02", "00:00:00:00:00:01", "injected")
+	tagged := testFrame("00:00:00:00:00:03", "00:00:00:00:00:02", "tagged")
+	qinq := testFrame("00:00:00:00:00:04", "00:00:00:00:00:02", "qinq")
+	block := makeTestBlock([]testRxPacket{
+		{frame: plain},
+		{frame: injected, outgoing: true},
+		{frame: tagged, vlan: true, tci: 42},
+		{frame: qinq, vlan: true, tpid: 0x88a8, tci: 7},
+	})
+
+	fop := &recordingFlowOp{}
+	var keys []PacketKey
+	rx := &afpacketReceiver{}
+	rx.consumeBlock(block, NewEthernetDecoder(), func(key PacketKey) FlowOp {
+		keys = append(keys, key)
+		return fop
+	})
+
+	// The outgoing packet is skipped, and the kernel's VLAN tags
+	// are put back
+	require.Len(t, keys, 3)
+	require.Equal(t, []byte{0, 0, 0, 0, 0, 1}, keys[0].SrcMAC[:])
+	require.Equal(t, []byte{0, 0, 0, 0, 0, 3}, keys[1].SrcMAC[:])
+	require.Equal(t, []byte{0, 0, 0, 0, 0, 4}, keys[2].SrcMAC[:])
+	require.Equal(t, [][]byte{plain, insertVLANTag(tagged, 0x8100, 42), insertVLANTag(qinq, 0x88a8, 7)}, fop.frames)
+
+	// The frames handed on are copies, so the block can go back
+	// to the kernel
+	for i := range block {
+		block[i] = 0
+	}
+	require.Equal(t, plain, fop.frames[0])
+}
+
+func TestInsertVLANTag(t *testing.T) {
+	frame := testFrame("00:00:00:00:00:01", "00:00:00:00:00:02", "payload")
+	tagged := insertVLANTag(frame, 0x8100, 0x2005)
+	require.Len(t, tagged, len(frame)+4)
+	require.Equal(t, frame[:12], tagged[:12])
+	require.Equal(t, []byte{0x81, 0x00, 0x20, 0x05}, tagged[12:16])
+	require.Equal(t, frame[12:], tagged[16:])
+	require.True(t, bytes.HasSuffix(tagged, []byte("payload")))
+
+	// Runt frames are left alone
+	runt := frame[:10]
+	require.Equal(t, runt, insertVLANTag(runt, 0x8100, 1))
+}
@@ -1,7 +1,9 @@
 package router
 
 import (
+	"bytes"
 	"encoding/binary"
+	"encoding/gob"
 	"encoding/json"
 	"fmt"
 	"net"
@@ -9,6 +11,8 @@ import (
 	"time"
 
 	"github.com/weaveworks/go-odp/odp"
+
+	"github.com/weaveworks/weave/mesh"
 )
 
 // The virtual bridge accepts packets from ODP vports and the router
@@ -28,6 +32,11 @@ type missHandler func(fks odp.FlowKeys, lock *fastDatapathLock) FlowOp
 type FastDatapath struct {
 	dpname string
 
+	// How often to expire MACs which have not been seen, and
+	// flows which have not been used
+	expireMACsInterval  time.Duration
+	expireFlowsInterval time.Duration
+
 	// The mtu from the datapath netdev (which should match the
 	// mtus on all the veths hooked up to the datapath).  We
 	// validate that we are able to support that mtu.
@@ -40,15 +49,15 @@ type FastDatapath struct {
 	dp               odp.DatapathHandle
 	deleteFlowsCount uint64
 	missHandlers     map[odp.VportID]missHandler
-	localPeer        *Peer
-	peers            *Peers
+	localPeer        *mesh.Peer
+	peers            *mesh.Peers
 	overlayConsumer  OverlayConsumer
 
 	// Bridge state: How to send to the given bridge port
 	sendToPort map[bridgePortID]bridgeSender
 
-	// How to send to a given destination MAC
-	sendToMAC map[MAC]bridgeSender
+	// Which bridge port a given MAC is on
+	macPorts map[MAC]bridgePortID
 
 	// MACs seen on the bridge recently
 	seenMACs map[MAC]struct{}
@@ -62,9 +71,23 @@ type FastDatapath struct {
 	dec *EthernetDecoder
 
 	// forwarders by remote peer
-	forwarders map[PeerName]*fastDatapathForwarder
+	forwarders map[mesh.PeerName]*fastDatapathForwarder
+
+	// The peer IDs we have given out (see below), and the remote
+	// IPs of the forwarders which use them
+	peerIDs       map[mesh.PeerName]mesh.PeerShortID
+	peerIDNames   []mesh.PeerName
+	peerIDSenders map[*fastDatapathForwarder][4]byte
+
+	// packet and byte counts of flows
+	flowStats *flowStats
 }
 
+const (
+	DefaultExpireMACsInterval  = 10 * time.Minute
+	DefaultExpireFlowsInterval = 5 * time.Minute
+)
+
 type FastDatapathConfig struct {
 	DatapathName        string
 	Port                int
@@ -73,6 +96,13 @@ type FastDatapathConfig struct {
 }
 
 func NewFastDatapath(config FastDatapathConfig) (*FastDatapath, error) {
+	if config.ExpireMACsInterval <= 0 {
+		config.ExpireMACsInterval = DefaultExpireMACsInterval
+	}
+	if config.ExpireFlowsInterval <= 0 {
+		config.ExpireFlowsInterval = DefaultExpireFlowsInterval
+	}
+
 	dpif, err := odp.NewDpif()
 	if err != nil {
 		return nil, err
@@ -96,16 +126,21 @@ func NewFastDatapath(config FastDatapathConfig) (*FastDatapath, error) {
 	}
 
 	fastdp := &FastDatapath{
-		dpname:        config.DatapathName,
-		mtu:           iface.MTU,
-		dpif:          dpif,
-		dp:            dp,
-		missHandlers:  make(map[odp.VportID]missHandler),
-		sendToPort:    nil,
-		sendToMAC:     make(map[MAC]bridgeSender),
-		seenMACs:      make(map[MAC]struct{}),
-		vxlanVportIDs: make(map[int]odp.VportID),
-		forwarders:    make(map[PeerName]*fastDatapathForwarder),
+		dpname:              config.DatapathName,
+		expireMACsInterval:  config.ExpireMACsInterval,
+		expireFlowsInterval: config.ExpireFlowsInterval,
+		mtu:                 iface.MTU,
+		dpif:                dpif,
+		dp:                  dp,
+		missHandlers:        make(map[odp.VportID]missHandler),
+		sendToPort:          nil,
+		macPorts:            make(map[MAC]bridgePortID),
+		seenMACs:            make(map[MAC]struct{}),
+		vxlanVportIDs:       make(map[int]odp.VportID),
+		forwarders:          make(map[mesh.PeerName]*fastDatapathForwarder),
+		peerIDs:             make(map[mesh.PeerName]mesh.PeerShortID),
+		peerIDSenders:       make(map[*fastDatapathForwarder][4]byte),
+		flowStats:           newFlowStats(),
 	}
 
 	if err := fastdp.deleteVxlanVports(); err != nil {
@@ -251,17 +286,27 @@ func (fastdp fastDatapathBridge) InjectPacket(key PacketKey) FlowOp {
 func (fastdp *FastDatapath) bridge(ingress bridgePortID,
 	key PacketKey, lock *fastDatapathLock) FlowOp {
 	lock.relock()
-	if fastdp.sendToMAC[key.SrcMAC] == nil {
+	if port, found := fastdp.macPorts[key.SrcMAC]; !found || port != ingress {
+		if found {
+			// The MAC has moved to another port (e.g. a
+			// container was re-attached), so flows
+			// delivering to the old port are stale.
+			log.Debug("MAC ", key.SrcMAC, " moved to port ", ingress)
+			checkWarn(fastdp.deleteFlowsMatching(flowToMAC(key.SrcMAC)))
+		}
+
 		// Learn the source MAC
-		fastdp.sendToMAC[key.SrcMAC] = fastdp.sendToPort[ingress]
+		fastdp.macPorts[key.SrcMAC] = ingress
 		fastdp.seenMACs[key.SrcMAC] = struct{}{}
 	}
 
 	// If we know about the destination MAC, deliver it to the
 	// associated port.
-	if sender := fastdp.sendToMAC[key.DstMAC]; sender != nil {
-		return NewMultiFlowOp(false, odpEthernetFlowKey(key),
-			sender(key, lock))
+	if port, found := fastdp.macPorts[key.DstMAC]; found {
+		if sender := fastdp.sendToPort[port]; sender != nil {
+			return NewMultiFlowOp(false, odpEthernetFlowKey(key),
+				sender(key, lock))
+		}
 	}
 
 	// Otherwise, it might be a real broadcast, or it might
@@ -299,15 +344,24 @@ type fastDatapathOverlay struct {
 	*FastDatapath
 }
 
-func (fastdp *FastDatapath) Overlay() Overlay {
+func (fastdp *FastDatapath) Overlay() NetworkOverlay {
 	return fastDatapathOverlay{fastdp}
 }
 
+// Only flows which go through the router depend on routes; those
+// between local vports are left in place.
 func (fastdp fastDatapathOverlay) InvalidateRoutes() {
 	log.Debug("InvalidateRoutes")
 	fastdp.lock.Lock()
 	defer fastdp.lock.Unlock()
-	checkWarn(fastdp.deleteFlows())
+	checkWarn(fastdp.deleteFlowsMatching(flowUsesRouter))
+}
+
+func (fastdp fastDatapathOverlay) InvalidateMAC(mac MAC) {
+	log.Debug("InvalidateMAC ", mac)
+	fastdp.lock.Lock()
+	defer fastdp.lock.Unlock()
+	checkWarn(fastdp.deleteFlowsMatching(flowToMAC(mac)))
 }
 
 func (fastdp fastDatapathOverlay) InvalidateShortIDs() {
@@ -318,8 +372,9 @@ func (fastdp fastDatapathOverlay) InvalidateShortIDs() {
 }
 
 func (fastDatapathOverlay) AddFeaturesTo(features map[string]string) {
-	// Nothing needed.  Fast datapath support is indicated through
+	// Fast datapath support itself is indicated through
 	// OverlaySwitch.
+	features["FastDatapathPeerIDs"] = "1"
 }
 
 type FlowStatus odp.FlowInfo
@@ -393,8 +448,8 @@ func (fastdp fastDatapathOverlay) Diagnostics() interface{} {
 	}
 }
 
-func (fastdp fastDatapathOverlay) StartConsumingPackets(localPeer *Peer,
-	peers *Peers, consumer OverlayConsumer) error {
+func (fastdp fastDatapathOverlay) StartConsumingPackets(localPeer *mesh.Peer,
+	peers *mesh.Peers, consumer OverlayConsumer) error {
 	fastdp.lock.Lock()
 	defer fastdp.lock.Unlock()
 
@@ -405,9 +460,19 @@ func (fastdp fastDatapathOverlay) StartConsumingPackets(localPeer *Peer,
 	fastdp.localPeer = localPeer
 	fastdp.peers = peers
 	fastdp.overlayConsumer = consumer
+
+	// When a peer leaves, delete the flows that refer to it
+	peers.OnGC(func(peer *mesh.Peer) {
+		fastdp.lock.Lock()
+		defer fastdp.lock.Unlock()
+		checkWarn(fastdp.deleteFlowsMatching(flowUsesPeer(peer)))
+	})
 	return nil
 }
 
+// fastdp only encapsulates with vxlan.  go-odp can't create Geneve
+// vports or set tunnel options, so peers can't be identified by
+// anything wider than the short IDs packed into the VNI.
 func (fastdp *FastDatapath) getVxlanVportID(udpPort int) (odp.VportID, error) {
 	fastdp.lock.Lock()
 	defer fastdp.lock.Unlock()
@@ -434,18 +499,15 @@ func (fastdp *FastDatapath) getVxlanVportID(udpPort int) (odp.VportID, error) {
 			return vetoFlowCreationFlowOp{}
 		}
 
-		srcPeer, dstPeer := fastdp.extractPeers(tunKey.TunnelId)
-		if srcPeer == nil || dstPeer == nil {
-			return vetoFlowCreationFlowOp{}
-		}
-
-		lock.unlock()
+		// Heartbeats identify their connection themselves,
+		// so we can learn the remote address of a forwarder
+		// before knowing which IDs it uses
 		pk := flowKeysToPacketKey(fks)
 		var zeroMAC MAC
 		if pk.SrcMAC == zeroMAC && pk.DstMAC == zeroMAC {
+			lock.unlock()
 			return vxlanSpecialPacketFlowOp{
-				fastdp:  fastdp,
-				srcPeer: srcPeer,
+				fastdp: fastdp,
 				sender: &net.UDPAddr{
 					IP:   net.IP(tunKey.Ipv4Src[:]),
 					Port: udpPort,
@@ -453,6 +515,13 @@ func (fastdp *FastDatapath) getVxlanVportID(udpPort int) (odp.VportID, error) {
 			}
 		}
 
+		srcPeer, dstPeer := fastdp.tunnelPeers(tunKey)
+		if srcPeer == nil || dstPeer == nil {
+			return vetoFlowCreationFlowOp{}
+		}
+
+		lock.unlock()
+
 		key := ForwardPacketKey{
 			SrcPeer:   srcPeer,
 			DstPeer:   dstPeer,
@@ -471,39 +540,161 @@ func (fastdp *FastDatapath) getVxlanVportID(udpPort int) (odp.VportID, error) {
 	return vxlanVportID, nil
 }
 
-func (fastdp *FastDatapath) extractPeers(tunnelID [8]byte) (*Peer, *Peer) {
+// The source and destination peers of a tunnelled packet, by the IDs
+// we gave out if it came from a neighbour using them, otherwise by
+// their short IDs.  Call with the lock held.
+func (fastdp *FastDatapath) tunnelPeers(tunnel odp.TunnelAttrs) (*mesh.Peer, *mesh.Peer) {
+	if !fastdp.sendsPeerIDs(tunnel.Ipv4Src) {
+		return fastdp.extractPeers(tunnel.TunnelId)
+	}
+
+	src, dst := tunnelIDShortIDs(tunnel.TunnelId)
+	return fastdp.peerByID(src), fastdp.peerByID(dst)
+}
+
+// The peer a tunnelled packet is sent to
+func (fastdp *FastDatapath) tunnelDstPeer(tunnel odp.TunnelAttrs) *mesh.Peer {
+	for fwd, remoteIP := range fastdp.peerIDSenders {
+		if remoteIP == tunnel.Ipv4Dst {
+			_, dst := tunnelIDShortIDs(tunnel.TunnelId)
+			return fwd.peerByRemoteID(dst)
+		}
+	}
+
+	_, dstPeer := fastdp.extractPeers(tunnel.TunnelId)
+	return dstPeer
+}
+
+func (fastdp *FastDatapath) extractPeers(tunnelID [8]byte) (*mesh.Peer, *mesh.Peer) {
+	src, dst := tunnelIDShortIDs(tunnelID)
+	return fastdp.peers.FetchByShortID(src), fastdp.peers.FetchByShortID(dst)
+}
+
+func tunnelIDShortIDs(tunnelID [8]byte) (mesh.PeerShortID, mesh.PeerShortID) {
 	vni := binary.BigEndian.Uint64(tunnelID[:])
-	srcPeer := fastdp.peers.FetchByShortID(PeerShortID(vni & 0xfff))
-	dstPeer := fastdp.peers.FetchByShortID(PeerShortID((vni >> 12) & 0xfff))
-	return srcPeer, dstPeer
+	return mesh.PeerShortID(vni & 0xfff), mesh.PeerShortID((vni >> 12) & 0xfff)
 }
 
 type vxlanSpecialPacketFlowOp struct {
 	NonDiscardingFlowOp
-	fastdp  *FastDatapath
-	srcPeer *Peer
-	sender  *net.UDPAddr
+	fastdp *FastDatapath
+	sender *net.UDPAddr
 }
 
 func (op vxlanSpecialPacketFlowOp) Process(frame []byte, dec *EthernetDecoder,
 	broadcast bool) {
+	if !dec.IsSpecial() || len(frame) < EthernetOverhead+8 {
+		return
+	}
+
+	// The heartbeat starts with the connection uid
+	connUID := binary.BigEndian.Uint64(frame[EthernetOverhead:])
+	var fwd *fastDatapathForwarder
 	op.fastdp.lock.Lock()
-	fwd := op.fastdp.forwarders[op.srcPeer.Name]
+	for _, candidate := range op.fastdp.forwarders {
+		if candidate.connUID == connUID {
+			fwd = candidate
+			break
+		}
+	}
 	op.fastdp.lock.Unlock()
 
-	if fwd != nil && dec.IsSpecial() {
+	if fwd != nil {
 		fwd.handleVxlanSpecialPacket(frame, op.sender)
 	}
 }
 
+// Peer IDs
+//
+// vxlan tunnel IDs only have room for two 12-bit short IDs, which are
+// unique across the mesh, so a mesh of more than 4096 peers runs out
+// of them.  Peers which support it (the FastDatapathPeerIDs feature)
+// instead give out IDs of their own, for the neighbours they receive
+// packets from to use in the tunnel IDs.  Those neighbours ask for
+// the IDs they need over the connection.  So the limit is on the
+// number of peers a peer hears about over fast datapath, rather than
+// on the size of the mesh, though in a mesh where every peer talks
+// to every other that comes to the same thing.
+//
+// Packets carrying these IDs arrive on the same vxlan port as others,
+// so we tell them apart by which forwarder they came from, i.e. by
+// the remote IP.  A neighbour only uses them once we have acked its
+// heartbeat, and so know its IP.  Beware that an older peer sharing
+// an IP with a newer one would have its packets misread.
+
+// Give out IDs for the named peers, as long as there are any left.
+// They are never reused, as neighbours hold on to them.
+func (fastdp *FastDatapath) givePeerIDs(names []mesh.PeerName) map[mesh.PeerName]mesh.PeerShortID {
+	fastdp.lock.Lock()
+	defer fastdp.lock.Unlock()
+
+	ids := make(map[mesh.PeerName]mesh.PeerShortID)
+	for _, name := range names {
+		id, found := fastdp.peerIDs[name]
+		if !found {
+			if len(fastdp.peerIDNames) >= 1<<mesh.PeerShortIDBits {
+				continue
+			}
+			id = mesh.PeerShortID(len(fastdp.peerIDNames))
+			fastdp.peerIDs[name] = id
+			fastdp.peerIDNames = append(fastdp.peerIDNames, name)
+		}
+		ids[name] = id
+	}
+	return ids
+}
+
+func (fastdp *FastDatapath) peerByID(id mesh.PeerShortID) *mesh.Peer {
+	if int(id) >= len(fastdp.peerIDNames) {
+		return nil
+	}
+	return fastdp.peers.Fetch(fastdp.peerIDNames[id])
+}
+
+// Call with the lock held
+func (fastdp *FastDatapath) sendsPeerIDs(remoteIP [4]byte) bool {
+	for _, ip := range fastdp.peerIDSenders {
+		if ip == remoteIP {
+			return true
+		}
+	}
+	return false
+}
+
+// Note the remote IP of a forwarder using peer IDs.  Call with the
+// forwarder's lock held.
+func (fastdp *FastDatapath) setPeerIDSender(fwd *fastDatapathForwarder) {
+	if !fwd.peerIDs || !fwd.confirmed || fwd.remoteAddr == nil {
+		return
+	}
+
+	remoteIP, err := ipv4Bytes(fwd.remoteAddr.IP)
+	if err != nil {
+		return
+	}
+
+	fastdp.lock.Lock()
+	defer fastdp.lock.Unlock()
+	if fastdp.forwarders[fwd.remotePeer.Name] == fwd {
+		fastdp.peerIDSenders[fwd] = remoteIP
+	}
+}
+
 type fastDatapathForwarder struct {
 	fastdp         *FastDatapath
-	remotePeer     *Peer
+	remotePeer     *mesh.Peer
 	localIP        [4]byte
 	sendControlMsg func(byte, []byte) error
 	connUID        uint64
 	vxlanVportID   odp.VportID
 
+	// Whether the remote peer gives out peer IDs, the ones it has
+	// given us, and the ones we have asked for
+	peerIDs      bool
+	idLock       sync.Mutex
+	remoteIDs    map[mesh.PeerName]mesh.PeerShortID
+	requestedIDs map[mesh.PeerName]struct{}
+
 	lock              sync.RWMutex
 	confirmed         bool
 	remoteAddr        *net.UDPAddr
@@ -511,6 +702,7 @@ type fastDatapathForwarder struct {
 	heartbeatTimer    *time.Timer
 	heartbeatTimeout  *time.Timer
 	ackedHeartbeat    bool
+	established       bool
 	stopChan          chan struct{}
 	stopped           bool
 
@@ -518,9 +710,9 @@ type fastDatapathForwarder struct {
 	errorChan       chan error
 }
 
-func (fastdp fastDatapathOverlay) MakeForwarder(
-	params ForwarderParams) (OverlayForwarder, error) {
-	if params.Crypto != nil {
+func (fastdp fastDatapathOverlay) PrepareConnection(
+	params mesh.OverlayConnectionParams) (mesh.OverlayConnection, error) {
+	if params.SessionKey != nil {
 		// No encryption suport in fastdp.  The weaver main.go
 		// is responsible for ensuring this doesn't happen.
 		log.Fatal("Attempt to use FastDatapath with encryption")
@@ -556,6 +748,10 @@ func (fastdp fastDatapathOverlay) MakeForwarder(
 		connUID:        params.ConnUID,
 		vxlanVportID:   vxlanVportID,
 
+		peerIDs:      params.Features["FastDatapathPeerIDs"] == "1",
+		remoteIDs:    make(map[mesh.PeerName]mesh.PeerShortID),
+		requestedIDs: make(map[mesh.PeerName]struct{}),
+
 		remoteAddr:        remoteAddr,
 		heartbeatInterval: FastHeartbeat,
 		stopChan:          make(chan struct{}),
@@ -592,13 +788,14 @@ func (fwd *fastDatapathForwarder) Confirm() {
 	log.Debug(fwd.logPrefix(), "confirmed")
 	fwd.fastdp.addForwarder(fwd.remotePeer.Name, fwd)
 	fwd.confirmed = true
+	fwd.fastdp.setPeerIDSender(fwd)
 
 	if fwd.remoteAddr != nil {
 		// have the goroutine send a heartbeat straight away
 		fwd.heartbeatTimer = time.NewTimer(0)
 	} else {
 		// we'll reset the timer when we learn the remote ip
-		fwd.heartbeatTimer = time.NewTimer(MaxDuration)
+		fwd.heartbeatTimer = time.NewTimer(mesh.MaxDuration)
 	}
 
 	fwd.heartbeatTimeout = time.NewTimer(HeartbeatTimeout)
@@ -674,11 +871,18 @@ func (fwd *fastDatapathForwarder) sendHeartbeat() {
 		DstPeer:   fwd.remotePeer,
 	}
 	fwd.lock.RUnlock()
-	fwd.Forward(pk).Process(buf, dec, false)
+
+	// Without IDs for the peers, we can't send over vxlan, so
+	// the heartbeats time out and we fall back to another overlay
+	if fop := fwd.forward(pk, true); fop != nil {
+		fop.Process(buf, dec, false)
+	}
 }
 
 const (
 	FastDatapathHeartbeatAck = iota
+	FastDatapathPeerIDRequest
+	FastDatapathPeerIDs
 )
 
 func (fwd *fastDatapathForwarder) handleVxlanSpecialPacket(frame []byte,
@@ -701,6 +905,7 @@ func (fwd *fastDatapathForwarder) handleVxlanSpecialPacket(frame []byte,
 
 	if fwd.remoteAddr == nil {
 		fwd.remoteAddr = sender
+		fwd.fastdp.setPeerIDSender(fwd)
 
 		if fwd.confirmed {
 			fwd.heartbeatTimer.Reset(0)
@@ -709,6 +914,7 @@ func (fwd *fastDatapathForwarder) handleVxlanSpecialPacket(frame []byte,
 		log.Info(fwd.logPrefix(),
 			"Peer IP address changed to ", sender)
 		fwd.remoteAddr = sender
+		fwd.fastdp.setPeerIDSender(fwd)
 	}
 
 	if !fwd.ackedHeartbeat {
@@ -731,6 +937,12 @@ func (fwd *fastDatapathForwarder) ControlMessage(tag byte, msg []byte) {
 	case FastDatapathHeartbeatAck:
 		fwd.handleHeartbeatAck()
 
+	case FastDatapathPeerIDRequest:
+		fwd.handlePeerIDRequest(msg)
+
+	case FastDatapathPeerIDs:
+		fwd.handlePeerIDs(msg)
+
 	default:
 		log.Info(fwd.logPrefix(),
 			"Ignoring unknown control message: ", tag)
@@ -744,7 +956,8 @@ func (fwd *fastDatapathForwarder) DisplayName() string {
 func (fwd *fastDatapathForwarder) handleHeartbeatAck() {
 	log.Debug(fwd.logPrefix(), "handleHeartbeatAck")
 
-	if fwd.heartbeatInterval != SlowHeartbeat {
+	if !fwd.established {
+		fwd.established = true
 		close(fwd.establishedChan)
 		fwd.heartbeatInterval = SlowHeartbeat
 		if fwd.heartbeatTimer != nil {
@@ -753,14 +966,109 @@ func (fwd *fastDatapathForwarder) handleHeartbeatAck() {
 	}
 }
 
-func (fwd *fastDatapathForwarder) Forward(key ForwardPacketKey) FlowOp {
-	if !key.SrcPeer.HasShortID || !key.DstPeer.HasShortID {
-		return nil
+func (fwd *fastDatapathForwarder) handlePeerIDRequest(msg []byte) {
+	var names []mesh.PeerName
+	if err := gob.NewDecoder(bytes.NewReader(msg)).Decode(&names); err != nil {
+		log.Warning(fwd.logPrefix(), "bad peer ID request: ", err)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(fwd.fastdp.givePeerIDs(names)); err != nil {
+		log.Error(fwd.logPrefix(), err)
+		return
+	}
+	fwd.handleError(fwd.sendControlMsg(FastDatapathPeerIDs, buf.Bytes()))
+}
+
+// Peers we asked for IDs for which are missing from the answer stay
+// without, and so go over another overlay
+func (fwd *fastDatapathForwarder) handlePeerIDs(msg []byte) {
+	var ids map[mesh.PeerName]mesh.PeerShortID
+	if err := gob.NewDecoder(bytes.NewReader(msg)).Decode(&ids); err != nil {
+		log.Warning(fwd.logPrefix(), "bad peer IDs: ", err)
+		return
+	}
+
+	fwd.idLock.Lock()
+	defer fwd.idLock.Unlock()
+	for name, id := range ids {
+		fwd.remoteIDs[name] = id
+	}
+}
+
+// The ID the remote peer gave us for a peer, asking for it if we
+// haven't already.  Call with the lock held.
+func (fwd *fastDatapathForwarder) remoteID(name mesh.PeerName) (mesh.PeerShortID, bool) {
+	fwd.idLock.Lock()
+	defer fwd.idLock.Unlock()
+
+	if id, found := fwd.remoteIDs[name]; found {
+		return id, true
+	}
+	if _, found := fwd.requestedIDs[name]; found {
+		return 0, false
+	}
+
+	fwd.requestedIDs[name] = struct{}{}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode([]mesh.PeerName{name}); err != nil {
+		log.Error(fwd.logPrefix(), err)
+		return 0, false
+	}
+	fwd.handleError(fwd.sendControlMsg(FastDatapathPeerIDRequest, buf.Bytes()))
+	return 0, false
+}
+
+func (fwd *fastDatapathForwarder) peerByRemoteID(id mesh.PeerShortID) *mesh.Peer {
+	fwd.idLock.Lock()
+	defer fwd.idLock.Unlock()
+
+	for name, remoteID := range fwd.remoteIDs {
+		if remoteID == id {
+			return fwd.fastdp.peers.Fetch(name)
+		}
+	}
+	return nil
+}
+
+// The tunnel ID for a packet, from the IDs the remote peer gave us if
+// it gives them out, otherwise from short IDs.  Call with the lock
+// held.
+func (fwd *fastDatapathForwarder) tunnelID(key ForwardPacketKey, heartbeat bool) ([8]byte, bool) {
+	if !fwd.peerIDs {
+		// A peer whose short id collides with another's
+		// would be mistaken for it.
+		if !fwd.fastdp.ownsShortID(key.SrcPeer) || !fwd.fastdp.ownsShortID(key.DstPeer) {
+			return [8]byte{}, false
+		}
+		return tunnelIDFor(key.SrcPeer.ShortID, key.DstPeer.ShortID), true
+	}
+
+	// Until the remote peer has our heartbeat, it doesn't know
+	// our IP, so would take the IDs for short IDs
+	if !fwd.established && !heartbeat {
+		return [8]byte{}, false
 	}
 
+	src, srcOK := fwd.remoteID(key.SrcPeer.Name)
+	dst, dstOK := fwd.remoteID(key.DstPeer.Name)
+	return tunnelIDFor(src, dst), srcOK && dstOK
+}
+
+func (fwd *fastDatapathForwarder) Forward(key ForwardPacketKey) FlowOp {
+	return fwd.forward(key, false)
+}
+
+func (fwd *fastDatapathForwarder) forward(key ForwardPacketKey, heartbeat bool) FlowOp {
 	fwd.lock.RLock()
 	defer fwd.lock.RUnlock()
 
+	tunnelID, ok := fwd.tunnelID(key, heartbeat)
+	if !ok {
+		return nil
+	}
+
 	if fwd.remoteAddr == nil {
 		// Returning nil would discard the packet, but also
 		// result in a flow rule, which we would have to
@@ -776,7 +1084,7 @@ func (fwd *fastDatapathForwarder) Forward(key ForwardPacketKey) FlowOp {
 	}
 
 	var sta odp.SetTunnelAction
-	sta.SetTunnelId(tunnelIDFor(key))
+	sta.SetTunnelId(tunnelID)
 	sta.SetIpv4Src(fwd.localIP)
 	sta.SetIpv4Dst(remoteIP)
 	sta.SetTos(0)
@@ -786,20 +1094,19 @@ func (fwd *fastDatapathForwarder) Forward(key ForwardPacketKey) FlowOp {
 	return fwd.fastdp.odpActions(sta, odp.NewOutputAction(fwd.vxlanVportID))
 }
 
-func tunnelIDFor(key ForwardPacketKey) (tunnelID [8]byte) {
-	src := uint64(key.SrcPeer.ShortID)
-	dst := uint64(key.DstPeer.ShortID)
-	binary.BigEndian.PutUint64(tunnelID[:], src|dst<<12)
+func (fastdp *FastDatapath) ownsShortID(peer *mesh.Peer) bool {
+	return peer.HasShortID && fastdp.peers.FetchByShortID(peer.ShortID) == peer
+}
+
+func tunnelIDFor(src, dst mesh.PeerShortID) (tunnelID [8]byte) {
+	binary.BigEndian.PutUint64(tunnelID[:], uint64(src)|uint64(dst)<<12)
 	return
 }
 
 func (fwd *fastDatapathForwarder) Stop() {
-	// Might be nice to delete all the relevant flows here, but we
-	// can just let them expire.
 	fwd.fastdp.removeForwarder(fwd.remotePeer.Name, fwd)
 
 	fwd.lock.Lock()
-	defer fwd.lock.Unlock()
 	fwd.sendControlMsg = func(byte, []byte) error { return nil }
 
 	// stop the heartbeat goroutine
@@ -807,9 +1114,22 @@ func (fwd *fastDatapathForwarder) Stop() {
 		fwd.stopped = true
 		close(fwd.stopChan)
 	}
+	remoteAddr := fwd.remoteAddr
+	fwd.lock.Unlock()
+
+	// Delete the flows that tunnel to the remote peer over this
+	// connection
+	if remoteAddr == nil {
+		return
+	}
+	if remoteIP, err := ipv4Bytes(remoteAddr.IP); err == nil {
+		fwd.fastdp.lock.Lock()
+		defer fwd.fastdp.lock.Unlock()
+		checkWarn(fwd.fastdp.deleteFlowsMatching(flowTunnelsTo(remoteIP)))
+	}
 }
 
-func (fastdp *FastDatapath) addForwarder(peer PeerName,
+func (fastdp *FastDatapath) addForwarder(peer mesh.PeerName,
 	fwd *fastDatapathForwarder) {
 	fastdp.lock.Lock()
 	defer fastdp.lock.Unlock()
@@ -819,13 +1139,14 @@ func (fastdp *FastDatapath) addForwarder(peer PeerName,
 	fastdp.forwarders[peer] = fwd
 }
 
-func (fastdp *FastDatapath) removeForwarder(peer PeerName,
+func (fastdp *FastDatapath) removeForwarder(peer mesh.PeerName,
 	fwd *fastDatapathForwarder) {
 	fastdp.lock.Lock()
 	defer fastdp.lock.Unlock()
 	if fastdp.forwarders[peer] == fwd {
 		delete(fastdp.forwarders, peer)
 	}
+	delete(fastdp.peerIDSenders, fwd)
 }
 
 func (fastdp *FastDatapath) deleteFlows() error {
@@ -846,6 +1167,122 @@ func (fastdp *FastDatapath) deleteFlows() error {
 	return nil
 }
 
+// Delete the flows for which the predicate holds.  Call with the
+// lock held.
+func (fastdp *FastDatapath) deleteFlowsMatching(pred func(odp.FlowInfo) bool) error {
+	fastdp.deleteFlowsCount++
+
+	flows, err := fastdp.dp.EnumerateFlows()
+	if err != nil {
+		return err
+	}
+
+	for _, flow := range flows {
+		if !pred(flow) {
+			continue
+		}
+		err = fastdp.dp.DeleteFlow(flow.FlowKeys)
+		if err != nil && !odp.IsNoSuchFlowError(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Predicates on flows, for deleteFlowsMatching
+
+func flowToMAC(mac MAC) func(odp.FlowInfo) bool {
+	return func(flow odp.FlowInfo) bool {
+		ethKey, ok := flow.FlowKeys[odp.OVS_KEY_ATTR_ETHERNET].(odp.EthernetFlowKey)
+		return ok && MAC(ethKey.Key().EthDst) == mac
+	}
+}
+
+// Flows through the router are those from or to other peers, and
+// broadcasts, which go to them too.  The router also decides to drop
+// packets, whereas the bridge always outputs somewhere.
+func flowUsesRouter(flow odp.FlowInfo) bool {
+	if _, ok := flow.FlowKeys[odp.OVS_KEY_ATTR_IN_PORT]; !ok {
+		// not one of ours
+		return false
+	}
+	if _, ok := flow.FlowKeys[odp.OVS_KEY_ATTR_TUNNEL]; ok {
+		return true
+	}
+	if ethKey, ok := flow.FlowKeys[odp.OVS_KEY_ATTR_ETHERNET].(odp.EthernetFlowKey); ok && ethKey.Key().EthDst[0]&1 != 0 {
+		return true
+	}
+	if len(flow.Actions) == 0 {
+		return true
+	}
+	for _, action := range flow.Actions {
+		if _, ok := setTunnelAttrs(action); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func flowUsesVport(vport odp.VportID) func(odp.FlowInfo) bool {
+	return func(flow odp.FlowInfo) bool {
+		if inPort, ok := flow.FlowKeys[odp.OVS_KEY_ATTR_IN_PORT].(odp.InPortFlowKey); ok && inPort.VportID() == vport {
+			return true
+		}
+		for _, action := range flow.Actions {
+			if output, ok := action.(odp.OutputAction); ok && output.VportID() == vport {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func flowTunnelsTo(remoteIP [4]byte) func(odp.FlowInfo) bool {
+	return func(flow odp.FlowInfo) bool {
+		for _, action := range flow.Actions {
+			if tunnel, ok := setTunnelAttrs(action); ok && tunnel.Ipv4Dst == remoteIP {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Does the flow carry traffic from or to the given peer, identified
+// by its short ID?  Flows over connections using peer IDs go when the
+// routes change, as the peer does.
+func flowUsesPeer(peer *mesh.Peer) func(odp.FlowInfo) bool {
+	uses := func(tunnelID [8]byte) bool {
+		if !peer.HasShortID {
+			return false
+		}
+		src, dst := tunnelIDShortIDs(tunnelID)
+		return src == peer.ShortID || dst == peer.ShortID
+	}
+	return func(flow odp.FlowInfo) bool {
+		if tunKey, ok := flow.FlowKeys[odp.OVS_KEY_ATTR_TUNNEL].(odp.TunnelFlowKey); ok && uses(tunKey.Key().TunnelId) {
+			return true
+		}
+		for _, action := range flow.Actions {
+			if tunnel, ok := setTunnelAttrs(action); ok && uses(tunnel.TunnelId) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func setTunnelAttrs(action odp.Action) (odp.TunnelAttrs, bool) {
+	switch sta := action.(type) {
+	case odp.SetTunnelAction:
+		return sta.TunnelAttrs, true
+	case *odp.SetTunnelAction:
+		return sta.TunnelAttrs, true
+	}
+	return odp.TunnelAttrs{}, false
+}
+
 func (fastdp *FastDatapath) deleteVxlanVports() error {
 	vports, err := fastdp.dp.EnumerateVports()
 	if err != nil {
@@ -867,8 +1304,9 @@ func (fastdp *FastDatapath) deleteVxlanVports() error {
 }
 
 func (fastdp *FastDatapath) run() {
-	expireMACsCh := time.Tick(10 * time.Minute)
-	expireFlowsCh := time.Tick(5 * time.Minute)
+	expireMACsCh := time.Tick(fastdp.expireMACsInterval)
+	expireFlowsCh := time.Tick(fastdp.expireFlowsInterval)
+	flowStatsCh := time.Tick(flowStatsInterval)
 
 	for {
 		select {
@@ -877,6 +1315,9 @@ func (fastdp *FastDatapath) run() {
 
 		case <-expireFlowsCh:
 			fastdp.expireFlows()
+
+		case <-flowStatsCh:
+			fastdp.updateFlowStats()
 		}
 	}
 }
@@ -885,9 +1326,9 @@ func (fastdp *FastDatapath) expireMACs() {
 	lock := fastdp.startLock()
 	defer lock.unlock()
 
-	for mac := range fastdp.sendToMAC {
+	for mac := range fastdp.macPorts {
 		if _, present := fastdp.seenMACs[mac]; !present {
-			delete(fastdp.sendToMAC, mac)
+			delete(fastdp.macPorts, mac)
 		}
 	}
 
@@ -903,6 +1344,10 @@ func (fastdp *FastDatapath) expireFlows() {
 		log.Warn(err)
 	}
 
+	// Clearing the flows resets their counters, so account for
+	// them first
+	fastdp.flowStats.update(flows, fastdp.flowTalkers)
+
 	for _, flow := range flows {
 		if flow.Used == 0 {
 			log.Debug("Expiring flow ", flow.FlowSpec)
@@ -910,6 +1355,7 @@ func (fastdp *FastDatapath) expireFlows() {
 		} else {
 			fastdp.touchFlow(flow.FlowKeys, &lock)
 			err = fastdp.dp.ClearFlow(flow.FlowSpec)
+			fastdp.flowStats.cleared(flow.FlowKeys)
 		}
 
 		if err != nil && !odp.IsNoSuchFlowError(err) {
@@ -918,6 +1364,51 @@ func (fastdp *FastDatapath) expireFlows() {
 	}
 }
 
+func (fastdp *FastDatapath) updateFlowStats() {
+	lock := fastdp.startLock()
+	defer lock.unlock()
+	flows, err := fastdp.dp.EnumerateFlows()
+	if err != nil {
+		log.Warn(err)
+		return
+	}
+
+	fastdp.flowStats.update(flows, fastdp.flowTalkers)
+}
+
+// Attribute a flow to its MAC pair, and to the remote peers it
+// carries traffic from or to.
+func (fastdp *FastDatapath) flowTalkers(flow odp.FlowInfo) (*macPair, []*mesh.Peer) {
+	var macs *macPair
+	if ethKey, ok := flow.FlowKeys[odp.OVS_KEY_ATTR_ETHERNET].(odp.EthernetFlowKey); ok {
+		eth := ethKey.Key()
+		macs = &macPair{eth.EthSrc, eth.EthDst}
+	}
+
+	if fastdp.peers == nil {
+		return macs, nil
+	}
+
+	var peers []*mesh.Peer
+	if tunKey, ok := flow.FlowKeys[odp.OVS_KEY_ATTR_TUNNEL].(odp.TunnelFlowKey); ok {
+		if srcPeer, _ := fastdp.tunnelPeers(tunKey.Key()); srcPeer != nil {
+			peers = append(peers, srcPeer)
+		}
+	}
+	for _, action := range flow.Actions {
+		if tunnel, ok := setTunnelAttrs(action); ok {
+			if dstPeer := fastdp.tunnelDstPeer(tunnel); dstPeer != nil {
+				peers = append(peers, dstPeer)
+			}
+		}
+	}
+	return macs, peers
+}
+
+func (fastdp *FastDatapath) TopTalkers() *TopTalkers {
+	return fastdp.flowStats.topTalkers(topTalkersCount)
+}
+
 // The router needs to know which flows are active in order to
 // maintain its MAC->peer table.  We do this by querying the router
 // without an actual packet being involved.  Maybe it's
@@ -999,12 +1490,19 @@ func (fastdp *FastDatapath) VportDeleted(dpid odp.DatapathID, vport odp.Vport) e
 	fastdp.lock.Lock()
 	defer fastdp.lock.Unlock()
 
-	// there might be flow rules that still refer to the id of
-	// this vport.  But we just allow them to expire.  Unless we
-	// want prompt migration of MAC addresses, that should be
-	// fine.
+	// Delete the flows that refer to the id of this vport, and
+	// forget the MACs on it, so that if they turn up elsewhere
+	// (e.g. on another host), we broadcast frames for them until
+	// we learn where.
 	delete(fastdp.missHandlers, vport.ID)
-	fastdp.deleteSendToPort(bridgePortID{vport: vport.ID})
+	portID := bridgePortID{vport: vport.ID}
+	fastdp.deleteSendToPort(portID)
+	for mac, port := range fastdp.macPorts {
+		if port == portID {
+			delete(fastdp.macPorts, mac)
+		}
+	}
+	checkWarn(fastdp.deleteFlowsMatching(flowUsesVport(vport.ID)))
 	return nil
 }
 
@@ -0,0 +1,217 @@
+package router
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/go-odp/odp"
+
+	"github.com/weaveworks/weave/mesh"
+)
+
+const (
+	testVport       = odp.VportID(1)
+	testOtherVport  = odp.VportID(2)
+	testTunnelVport = odp.VportID(3)
+)
+
+var (
+	testMAC1      = MAC{0, 0, 0, 0, 0, 1}
+	testMAC2      = MAC{0, 0, 0, 0, 0, 2}
+	testBroadcast = MAC{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	testRemoteIP  = [4]byte{10, 0, 0, 2}
+	testOtherIP   = [4]byte{10, 0, 0, 3}
+)
+
+func testFlow(keys []odp.FlowKey, actions ...odp.Action) odp.FlowInfo {
+	spec := odp.NewFlowSpec()
+	for _, key := range keys {
+		spec.AddKey(key)
+	}
+	spec.AddActions(actions)
+	return odp.FlowInfo{FlowSpec: spec}
+}
+
+func testEthernetKey(src, dst MAC) odp.FlowKey {
+	fk := odp.NewEthernetFlowKey()
+	fk.SetEthSrc(src)
+	fk.SetEthDst(dst)
+	return fk
+}
+
+func testTunnelKey(src, dst *mesh.Peer) odp.FlowKey {
+	var fk odp.TunnelFlowKey
+	fk.SetTunnelId(tunnelIDFor(src.ShortID, dst.ShortID))
+	fk.SetIpv4Src(testRemoteIP)
+	return fk
+}
+
+func testTunnelAction(src, dst *mesh.Peer, remoteIP [4]byte) odp.Action {
+	var sta odp.SetTunnelAction
+	sta.SetTunnelId(tunnelIDFor(src.ShortID, dst.ShortID))
+	sta.SetIpv4Dst(remoteIP)
+	return sta
+}
+
+func testPeers() (*mesh.Peer, *mesh.Peer, *mesh.Peer) {
+	name1, _ := mesh.PeerNameFromString("01:00:00:01:00:00")
+	name2, _ := mesh.PeerNameFromString("02:00:00:02:00:00")
+	name3, _ := mesh.PeerNameFromString("03:00:00:03:00:00")
+	return mesh.NewPeer(name1, "one", 0, 0, 1),
+		mesh.NewPeer(name2, "two", 0, 0, 2),
+		mesh.NewPeer(name3, "three", 0, 0, 3)
+}
+
+func TestFlowPredicates(t *testing.T) {
+	peer1, peer2, peer3 := testPeers()
+
+	// Between two local vports
+	local := testFlow([]odp.FlowKey{odp.NewInPortFlowKey(testVport), testEthernetKey(testMAC1, testMAC2)},
+		odp.NewOutputAction(testOtherVport))
+	// From a local vport to peer2
+	outbound := testFlow([]odp.FlowKey{odp.NewInPortFlowKey(testVport), testEthernetKey(testMAC1, testMAC2)},
+		testTunnelAction(peer1, peer2, testRemoteIP), odp.NewOutputAction(testTunnelVport))
+	// From peer2 to a local vport
+	inbound := testFlow([]odp.FlowKey{odp.NewInPortFlowKey(testTunnelVport), testTunnelKey(peer2, peer1), testEthernetKey(testMAC2, testMAC1)},
+		odp.NewOutputAction(testVport))
+	// A broadcast from a local vport, with no other peers
+	broadcast := testFlow([]odp.FlowKey{odp.NewInPortFlowKey(testVport), testEthernetKey(testMAC1, testBroadcast)},
+		odp.NewOutputAction(testOtherVport))
+	// Dropped by the router
+	dropped := testFlow([]odp.FlowKey{odp.NewInPortFlowKey(testVport), testEthernetKey(testMAC1, testMAC2)})
+	// Not one of ours
+	foreign := testFlow([]odp.FlowKey{testEthernetKey(testMAC1, testMAC2)})
+
+	require.True(t, flowToMAC(testMAC2)(local))
+	require.True(t, flowToMAC(testMAC1)(inbound))
+	require.False(t, flowToMAC(testMAC1)(local))
+	require.False(t, flowToMAC(testMAC2)(broadcast))
+
+	require.True(t, flowUsesVport(testVport)(local))
+	require.True(t, flowUsesVport(testOtherVport)(local))
+	require.True(t, flowUsesVport(testVport)(inbound))
+	require.True(t, flowUsesVport(testTunnelVport)(outbound))
+	require.False(t, flowUsesVport(testTunnelVport)(local))
+	require.False(t, flowUsesVport(testOtherVport)(outbound))
+
+	require.True(t, flowTunnelsTo(testRemoteIP)(outbound))
+	require.False(t, flowTunnelsTo(testOtherIP)(outbound))
+	require.False(t, flowTunnelsTo(testRemoteIP)(inbound))
+	require.False(t, flowTunnelsTo(testRemoteIP)(local))
+
+	require.True(t, flowUsesPeer(peer2)(outbound))
+	require.True(t, flowUsesPeer(peer2)(inbound))
+	require.True(t, flowUsesPeer(peer1)(inbound))
+	require.False(t, flowUsesPeer(peer3)(outbound))
+	require.False(t, flowUsesPeer(peer3)(inbound))
+	require.False(t, flowUsesPeer(peer2)(local))
+
+	require.True(t, flowUsesRouter(outbound))
+	require.True(t, flowUsesRouter(inbound))
+	require.True(t, flowUsesRouter(broadcast))
+	require.True(t, flowUsesRouter(dropped))
+	require.False(t, flowUsesRouter(local))
+	require.False(t, flowUsesRouter(foreign))
+}
+
+type testControlMsg struct {
+	tag byte
+	msg []byte
+}
+
+func TestFastDatapathPeerIDs(t *testing.T) {
+	name1, _ := mesh.PeerNameFromString("01:00:00:01:00:00")
+	_, peer2, peer3 := testPeers()
+	ourself := mesh.NewLocalPeer(name1, "one", nil)
+	ourself.ShortID = 1
+	peers := mesh.NewPeers(ourself)
+	peer1 := peers.Fetch(name1)
+	peer2 = peers.FetchWithDefault(peer2)
+	peer3 = peers.FetchWithDefault(peer3)
+	fastdp := &FastDatapath{
+		peers:         peers,
+		forwarders:    make(map[mesh.PeerName]*fastDatapathForwarder),
+		peerIDs:       make(map[mesh.PeerName]mesh.PeerShortID),
+		peerIDSenders: make(map[*fastDatapathForwarder][4]byte),
+	}
+
+	// IDs are handed out in turn, and kept
+	require.Equal(t, map[mesh.PeerName]mesh.PeerShortID{peer3.Name: 0, peer1.Name: 1},
+		fastdp.givePeerIDs([]mesh.PeerName{peer3.Name, peer1.Name}))
+	require.Equal(t, map[mesh.PeerName]mesh.PeerShortID{peer1.Name: 1},
+		fastdp.givePeerIDs([]mesh.PeerName{peer1.Name}))
+
+	// The forwarder to peer2, which gives out the IDs above (we
+	// answer our own requests)
+	var sent []testControlMsg
+	fwd := &fastDatapathForwarder{
+		fastdp:     fastdp,
+		remotePeer: peer2,
+		sendControlMsg: func(tag byte, msg []byte) error {
+			sent = append(sent, testControlMsg{tag, msg})
+			return nil
+		},
+		peerIDs:      true,
+		remoteIDs:    make(map[mesh.PeerName]mesh.PeerShortID),
+		requestedIDs: make(map[mesh.PeerName]struct{}),
+		confirmed:    true,
+		remoteAddr:   &net.UDPAddr{IP: net.IP(testRemoteIP[:])},
+	}
+	fastdp.forwarders[peer2.Name] = fwd
+	key := ForwardPacketKey{SrcPeer: peer1, DstPeer: peer3}
+
+	// Data waits for the heartbeat to be acked; heartbeats wait
+	// for the IDs
+	_, ok := fwd.tunnelID(key, false)
+	require.False(t, ok)
+	require.Empty(t, sent)
+	_, ok = fwd.tunnelID(key, true)
+	require.False(t, ok)
+	require.Len(t, sent, 2)
+	_, ok = fwd.tunnelID(key, true)
+	require.False(t, ok)
+	require.Len(t, sent, 2, "IDs are only asked for once")
+
+	for _, req := range sent {
+		require.Equal(t, byte(FastDatapathPeerIDRequest), req.tag)
+		fwd.handlePeerIDRequest(req.msg)
+	}
+	for _, reply := range sent[2:] {
+		require.Equal(t, byte(FastDatapathPeerIDs), reply.tag)
+		fwd.handlePeerIDs(reply.msg)
+	}
+
+	fwd.established = true
+	tunnelID, ok := fwd.tunnelID(key, false)
+	require.True(t, ok)
+	require.Equal(t, tunnelIDFor(1, 0), tunnelID)
+
+	// Packets from the forwarder's IP are read with our IDs once
+	// it is known to use them; others by short IDs
+	tunnel := odp.TunnelAttrs{TunnelId: tunnelID, Ipv4Src: testRemoteIP, Ipv4Dst: testRemoteIP}
+	_, dstPeer := fastdp.tunnelPeers(tunnel)
+	require.Nil(t, dstPeer)
+	fastdp.setPeerIDSender(fwd)
+	srcPeer, dstPeer := fastdp.tunnelPeers(tunnel)
+	require.Equal(t, peer1, srcPeer)
+	require.Equal(t, peer3, dstPeer)
+	require.Equal(t, peer3, fastdp.tunnelDstPeer(tunnel))
+
+	other := odp.TunnelAttrs{TunnelId: tunnelIDFor(2, 3), Ipv4Src: testOtherIP}
+	srcPeer, dstPeer = fastdp.tunnelPeers(other)
+	require.Equal(t, peer2, srcPeer)
+	require.Equal(t, peer3, dstPeer)
+
+	// A forwarder to an older peer sticks to short IDs
+	older := &fastDatapathForwarder{fastdp: fastdp, remotePeer: peer2}
+	tunnelID, ok = older.tunnelID(ForwardPacketKey{SrcPeer: peer2, DstPeer: peer3}, false)
+	require.True(t, ok)
+	require.Equal(t, tunnelIDFor(2, 3), tunnelID)
+
+	// Once the IDs run out, peers go without
+	for i := len(fastdp.peerIDNames); i < 1<<mesh.PeerShortIDBits; i++ {
+		fastdp.givePeerIDs([]mesh.PeerName{mesh.PeerName(1000 + i)})
+	}
+	require.Empty(t, fastdp.givePeerIDs([]mesh.PeerName{peer2.Name}))
+}
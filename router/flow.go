@@ -1,11 +1,20 @@
 package router
 
-import "net"
+import (
+	"net"
+
+	"github.com/weaveworks/weave/mesh"
+)
 
 // Just enough flow machinery for the weave router
 
 type MAC [6]byte
 
+func macOf(mac net.HardwareAddr) (key MAC) {
+	copy(key[:], mac)
+	return
+}
+
 func (mac MAC) String() string {
 	return net.HardwareAddr(mac[:]).String()
 }
@@ -16,8 +25,8 @@ type PacketKey struct {
 }
 
 type ForwardPacketKey struct {
-	SrcPeer *Peer
-	DstPeer *Peer
+	SrcPeer *mesh.Peer
+	DstPeer *mesh.Peer
 	PacketKey
 }
 
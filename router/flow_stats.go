@@ -0,0 +1,229 @@
+package router
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/weaveworks/go-odp/odp"
+
+	"github.com/weaveworks/weave/mesh"
+)
+
+// ODP keeps packet and byte counters for each flow.  We read them
+// each time we enumerate the flows, and aggregate the change since
+// the previous enumeration by MAC pair and by peer, to find the top
+// talkers.  Counts for a flow between its last enumeration and its
+// deletion are lost, so the figures are a lower bound.
+
+const (
+	flowStatsInterval = 30 * time.Second
+	topTalkersCount   = 10
+)
+
+// Packet and byte counts, with rates over the last interval
+type TrafficStats struct {
+	Packets    uint64
+	Bytes      uint64
+	PacketRate float64 // per second
+	ByteRate   float64 // per second
+}
+
+type MACPairStats struct {
+	SrcMAC string
+	DstMAC string
+	TrafficStats
+}
+
+type PeerTrafficStats struct {
+	Peer string
+	TrafficStats
+}
+
+type TopTalkers struct {
+	Flows    int
+	Interval time.Duration // over which the rates were computed
+	Total    TrafficStats
+	MACPairs []MACPairStats
+	Peers    []PeerTrafficStats
+}
+
+type flowCounts struct {
+	packets uint64
+	bytes   uint64
+}
+
+type trafficCounter struct {
+	total flowCounts
+	last  flowCounts // in the last interval
+}
+
+func (tc *trafficCounter) add(delta flowCounts) {
+	tc.total.packets += delta.packets
+	tc.total.bytes += delta.bytes
+	tc.last.packets += delta.packets
+	tc.last.bytes += delta.bytes
+}
+
+func (tc *trafficCounter) stats(interval time.Duration) TrafficStats {
+	stats := TrafficStats{Packets: tc.total.packets, Bytes: tc.total.bytes}
+	if secs := interval.Seconds(); secs > 0 {
+		stats.PacketRate = float64(tc.last.packets) / secs
+		stats.ByteRate = float64(tc.last.bytes) / secs
+	}
+	return stats
+}
+
+type macPair [2]MAC
+
+// Which MAC pair and peers a flow's traffic should be attributed to
+type flowTalkers func(odp.FlowInfo) (*macPair, []*mesh.Peer)
+
+type flowStats struct {
+	sync.Mutex
+	lastUpdate time.Time
+	interval   time.Duration
+	flows      map[string]flowCounts // at the last enumeration
+	total      trafficCounter
+	byMACs     map[macPair]*trafficCounter
+	byPeer     map[*mesh.Peer]*trafficCounter
+}
+
+func newFlowStats() *flowStats {
+	return &flowStats{
+		flows:  make(map[string]flowCounts),
+		byMACs: make(map[macPair]*trafficCounter),
+		byPeer: make(map[*mesh.Peer]*trafficCounter)}
+}
+
+// Account for the counters of the enumerated flows.  MAC pairs and
+// peers with no flows are dropped.
+func (fs *flowStats) update(flows []odp.FlowInfo, talkers flowTalkers) {
+	fs.Lock()
+	defer fs.Unlock()
+
+	now := time.Now()
+	if !fs.lastUpdate.IsZero() {
+		fs.interval = now.Sub(fs.lastUpdate)
+	}
+	fs.lastUpdate = now
+
+	byMACs := make(map[macPair]*trafficCounter)
+	byPeer := make(map[*mesh.Peer]*trafficCounter)
+	counter := func(tc *trafficCounter) *trafficCounter {
+		if tc == nil {
+			return &trafficCounter{}
+		}
+		tc.last = flowCounts{}
+		return tc
+	}
+	fs.total.last = flowCounts{}
+
+	counts := make(map[string]flowCounts, len(flows))
+	for _, flow := range flows {
+		id := flowID(flow.FlowKeys)
+		cur := flowCounts{flow.Packets, flow.Bytes}
+		counts[id] = cur
+
+		// If the counters went down, the flow was cleared or
+		// recreated since we last saw it
+		delta := cur
+		if prev, found := fs.flows[id]; found && cur.packets >= prev.packets && cur.bytes >= prev.bytes {
+			delta = flowCounts{cur.packets - prev.packets, cur.bytes - prev.bytes}
+		}
+		fs.total.add(delta)
+
+		macs, peers := talkers(flow)
+		if macs != nil {
+			tc, found := byMACs[*macs]
+			if !found {
+				tc = counter(fs.byMACs[*macs])
+				byMACs[*macs] = tc
+			}
+			tc.add(delta)
+		}
+		for _, peer := range peers {
+			tc, found := byPeer[peer]
+			if !found {
+				tc = counter(fs.byPeer[peer])
+				byPeer[peer] = tc
+			}
+			tc.add(delta)
+		}
+	}
+
+	fs.flows, fs.byMACs, fs.byPeer = counts, byMACs, byPeer
+}
+
+// The counters of a flow were cleared after it was enumerated
+func (fs *flowStats) cleared(fks odp.FlowKeys) {
+	fs.Lock()
+	defer fs.Unlock()
+	id := flowID(fks)
+	if _, found := fs.flows[id]; found {
+		fs.flows[id] = flowCounts{}
+	}
+}
+
+func (fs *flowStats) topTalkers(n int) *TopTalkers {
+	fs.Lock()
+	defer fs.Unlock()
+
+	tt := &TopTalkers{
+		Flows:    len(fs.flows),
+		Interval: fs.interval,
+		Total:    fs.total.stats(fs.interval)}
+
+	for macs, tc := range fs.byMACs {
+		tt.MACPairs = append(tt.MACPairs, MACPairStats{macs[0].String(), macs[1].String(), tc.stats(fs.interval)})
+	}
+	sort.Sort(macPairsByRate(tt.MACPairs))
+	if len(tt.MACPairs) > n {
+		tt.MACPairs = tt.MACPairs[:n]
+	}
+
+	for peer, tc := range fs.byPeer {
+		tt.Peers = append(tt.Peers, PeerTrafficStats{peer.String(), tc.stats(fs.interval)})
+	}
+	sort.Sort(peersByRate(tt.Peers))
+	if len(tt.Peers) > n {
+		tt.Peers = tt.Peers[:n]
+	}
+
+	return tt
+}
+
+func (a TrafficStats) busier(b TrafficStats) bool {
+	if a.ByteRate != b.ByteRate {
+		return a.ByteRate > b.ByteRate
+	}
+	return a.Bytes > b.Bytes
+}
+
+type macPairsByRate []MACPairStats
+
+func (s macPairsByRate) Len() int           { return len(s) }
+func (s macPairsByRate) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s macPairsByRate) Less(i, j int) bool { return s[i].busier(s[j].TrafficStats) }
+
+type peersByRate []PeerTrafficStats
+
+func (s peersByRate) Len() int           { return len(s) }
+func (s peersByRate) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s peersByRate) Less(i, j int) bool { return s[i].busier(s[j].TrafficStats) }
+
+// Identifies a flow by its keys, in a consistent order
+func flowID(fks odp.FlowKeys) string {
+	types := make([]int, 0, len(fks))
+	for typ := range fks {
+		types = append(types, int(typ))
+	}
+	sort.Ints(types)
+
+	var id string
+	for _, typ := range types {
+		id += fmt.Sprintf("%d:%v;", typ, fks[odp.FlowKeyType(typ)])
+	}
+	return id
+}
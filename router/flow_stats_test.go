@@ -0,0 +1,51 @@
+package router
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/go-odp/odp"
+
+	"github.com/weaveworks/weave/mesh"
+)
+
+func TestFlowStats(t *testing.T) {
+	name, _ := mesh.PeerNameFromString("01:00:00:01:00:00")
+	peer := mesh.NewPeer(name, "one", 0, 0, 0)
+	flow := func(vport odp.VportID, packets, bytes uint64) odp.FlowInfo {
+		spec := odp.NewFlowSpec()
+		spec.FlowKeys = odp.FlowKeys{odp.OVS_KEY_ATTR_IN_PORT: odp.NewInPortFlowKey(vport)}
+		return odp.FlowInfo{FlowSpec: spec, Packets: packets, Bytes: bytes}
+	}
+	// Flows are from a MAC numbered by their ingress vport, all
+	// to the same peer
+	talkers := func(flow odp.FlowInfo) (*macPair, []*mesh.Peer) {
+		vport := flow.FlowKeys[odp.OVS_KEY_ATTR_IN_PORT].(odp.InPortFlowKey).VportID()
+		return &macPair{MAC{0, 0, 0, 0, 0, byte(vport)}, MAC{}}, []*mesh.Peer{peer}
+	}
+	fs := newFlowStats()
+
+	fs.update([]odp.FlowInfo{flow(1, 10, 1000), flow(2, 1, 100)}, talkers)
+	tt := fs.topTalkers(10)
+	require.Equal(t, 2, tt.Flows)
+	require.Equal(t, uint64(11), tt.Total.Packets)
+	require.Len(t, tt.MACPairs, 2)
+	require.Equal(t, "00:00:00:00:00:01", tt.MACPairs[0].SrcMAC)
+	require.Equal(t, uint64(1100), tt.Peers[0].Bytes)
+
+	// Only the change in a flow's counters is accounted for.  A
+	// MAC pair without flows is dropped, but its peer lives on.
+	fs.update([]odp.FlowInfo{flow(1, 30, 3000)}, talkers)
+	tt = fs.topTalkers(1)
+	require.Equal(t, 1, tt.Flows)
+	require.Equal(t, uint64(31), tt.Total.Packets)
+	require.Equal(t, []MACPairStats{{"00:00:00:00:00:01", "00:00:00:00:00:00", TrafficStats{
+		Packets: 30, Bytes: 3000,
+		PacketRate: 20 / tt.Interval.Seconds(), ByteRate: 2000 / tt.Interval.Seconds()}}}, tt.MACPairs)
+	require.Equal(t, uint64(3100), tt.Peers[0].Bytes)
+
+	// Clearing a flow resets its counters
+	fs.cleared(flow(1, 0, 0).FlowKeys)
+	fs.update([]odp.FlowInfo{flow(1, 5, 500)}, talkers)
+	require.Equal(t, uint64(36), fs.topTalkers(10).Total.Packets)
+}
@@ -1,28 +1,212 @@
 package router
 
 import (
+	"encoding/json"
 	"fmt"
-	"github.com/gorilla/mux"
-	"github.com/weaveworks/weave/common"
+	"io"
+	"net"
 	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/weaveworks/weave/mesh"
 )
 
-func (router *Router) HandleHTTP(muxRouter *mux.Router) {
+func (router *NetworkRouter) HandleHTTP(muxRouter *mux.Router) {
+	router.Router.HandleHTTP(muxRouter)
 
-	muxRouter.Methods("POST").Path("/connect").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if err := r.ParseForm(); err != nil {
-			http.Error(w, fmt.Sprint("unable to parse form: ", err), http.StatusBadRequest)
+	// Stream a pcapng capture of the packets going through the
+	// router, e.g. with
+	//   curl -sN "http://$WEAVE_IP:6784/capture?ip=10.32.0.1" | wireshark -k -i -
+	muxRouter.Methods("GET").Path("/capture").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filter, err := parseCaptureFilter(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+			return
 		}
-		if errors := router.ConnectionMaker.InitiateConnections(r.Form["peer"], r.FormValue("replace") == "true"); len(errors) > 0 {
-			http.Error(w, common.ErrorMessages(errors), http.StatusBadRequest)
+		capture, err := router.Captures.Start(filter)
+		if err != nil {
+			http.Error(w, fmt.Sprint("invalid capture filter: ", err), http.StatusBadRequest)
+			return
+		}
+		defer router.Captures.Stop(capture)
+		defer func() {
+			if dropped := capture.Dropped(); dropped > 0 {
+				log.Warnln("Packet capture dropped", dropped, "packets because the client did not keep up")
+			}
+		}()
+
+		w.Header().Set("Content-Type", "application/x-pcapng")
+		w.Header().Set("Cache-Control", "no-cache")
+		pw, err := NewPcapngWriter(w, router.Bridge.String())
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+
+		closed := w.(http.CloseNotifier).CloseNotify()
+		for {
+			select {
+			case pkt := <-capture.Packets():
+				if err := pw.WritePacket(pkt.Time, pkt.Frame, pkt.Annotation()); err != nil {
+					return
+				}
+				// Batch up packets which are already waiting
+				for n := len(capture.Packets()); n > 0; n-- {
+					pkt := <-capture.Packets()
+					if err := pw.WritePacket(pkt.Time, pkt.Frame, pkt.Annotation()); err != nil {
+						return
+					}
+				}
+				flusher.Flush()
+			case <-closed:
+				return
+			}
 		}
 	})
 
-	muxRouter.Methods("POST").Path("/forget").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if err := r.ParseForm(); err != nil {
-			http.Error(w, fmt.Sprint("unable to parse form: ", err), http.StatusBadRequest)
+	muxRouter.Methods("POST").Path("/trace").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srcMAC, err := net.ParseMAC(r.FormValue("srcmac"))
+		if err != nil {
+			http.Error(w, fmt.Sprint("invalid source MAC: ", err), http.StatusBadRequest)
+			return
+		}
+		dstMAC, err := net.ParseMAC(r.FormValue("dstmac"))
+		if err != nil {
+			http.Error(w, fmt.Sprint("invalid destination MAC: ", err), http.StatusBadRequest)
+			return
+		}
+		srcIP, dstIP := net.ParseIP(r.FormValue("srcip")), net.ParseIP(r.FormValue("dstip"))
+		timeout := defaultTraceTimeout
+		if t := r.FormValue("timeout"); t != "" {
+			if timeout, err = time.ParseDuration(t); err != nil {
+				http.Error(w, fmt.Sprint("invalid timeout: ", err), http.StatusBadRequest)
+				return
+			}
+		}
+
+		hops, err := router.Tracer.Trace(srcMAC, dstMAC, srcIP, dstIP, timeout)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if r.Header.Get("Accept") == "application/json" {
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(hops); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+		for i, hop := range hops {
+			fmt.Fprintf(w, "%2d %s %s, destination MAC at %s: %s", i+1, hop.Peer, hop.Received, hop.DstMAC, hop.Decision)
+			if hop.Overlay != "" {
+				encryption := "unencrypted"
+				if hop.Encrypted {
+					encryption = "encrypted"
+				}
+				fmt.Fprintf(w, " (%s, %s)", hop.Overlay, encryption)
+			}
+			fmt.Fprintln(w)
 		}
-		router.ConnectionMaker.ForgetConnections(r.Form["peer"])
 	})
 
+	// Fast datapath flow statistics, in the Prometheus text format
+	muxRouter.Methods("GET").Path("/metrics").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if tt := topTalkers(router); tt != nil {
+			writeFlowMetrics(w, tt)
+		}
+	})
+
+	// Pin a MAC to a peer (by default this one), e.g. with
+	//   curl -X PUT "http://$WEAVE_IP:6784/macs/0a:58:0a:20:00:01?peer=$PEER"
+	muxRouter.Methods("PUT").Path("/macs/{mac}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mac, err := net.ParseMAC(mux.Vars(r)["mac"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		peer := router.Ourself.Peer
+		if name := r.FormValue("peer"); name != "" {
+			peerName, err := mesh.PeerNameFromUserInput(name)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if peer = router.Peers.Fetch(peerName); peer == nil {
+				http.Error(w, fmt.Sprint("unknown peer ", peerName), http.StatusNotFound)
+				return
+			}
+		}
+		router.Macs.AddStatic(mac, peer)
+		router.Overlay.InvalidateMAC(macOf(mac))
+		log.Println("Pinned MAC", mac, "to", peer)
+		w.WriteHeader(204)
+	})
+
+	muxRouter.Methods("DELETE").Path("/macs/{mac}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mac, err := net.ParseMAC(mux.Vars(r)["mac"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !router.Macs.DeleteStatic(mac) {
+			http.NotFound(w, r)
+			return
+		}
+		router.Overlay.InvalidateMAC(macOf(mac))
+		log.Println("Unpinned MAC", mac)
+		w.WriteHeader(204)
+	})
+}
+
+func writeFlowMetrics(w io.Writer, tt *TopTalkers) {
+	metric := func(name, typ, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+
+	metric("weave_flows", "gauge", "Number of fast datapath flows.")
+	fmt.Fprintf(w, "weave_flows %d\n", tt.Flows)
+	metric("weave_flow_packets_total", "counter", "Packets through fast datapath flows.")
+	fmt.Fprintf(w, "weave_flow_packets_total %d\n", tt.Total.Packets)
+	metric("weave_flow_bytes_total", "counter", "Bytes through fast datapath flows.")
+	fmt.Fprintf(w, "weave_flow_bytes_total %d\n", tt.Total.Bytes)
+
+	metric("weave_peer_flow_packets_total", "counter", "Packets through fast datapath flows, by remote peer.")
+	for _, p := range tt.Peers {
+		fmt.Fprintf(w, "weave_peer_flow_packets_total{peer=%q} %d\n", p.Peer, p.Packets)
+	}
+	metric("weave_peer_flow_bytes_total", "counter", "Bytes through fast datapath flows, by remote peer.")
+	for _, p := range tt.Peers {
+		fmt.Fprintf(w, "weave_peer_flow_bytes_total{peer=%q} %d\n", p.Peer, p.Bytes)
+	}
+
+	metric("weave_top_talker_bytes_per_second", "gauge", "Byte rate of the busiest MAC pairs.")
+	for _, p := range tt.MACPairs {
+		fmt.Fprintf(w, "weave_top_talker_bytes_per_second{src_mac=%q,dst_mac=%q} %g\n", p.SrcMAC, p.DstMAC, p.ByteRate)
+	}
+}
+
+func parseCaptureFilter(r *http.Request) (filter CaptureFilter, err error) {
+	if mac := r.FormValue("mac"); mac != "" {
+		if filter.MAC, err = net.ParseMAC(mac); err != nil {
+			return
+		}
+	}
+	if ip := r.FormValue("ip"); ip != "" {
+		if filter.IP = net.ParseIP(ip); filter.IP == nil {
+			err = fmt.Errorf("invalid IP address '%s'", ip)
+			return
+		}
+	}
+	filter.Peer = r.FormValue("peer")
+	filter.BPF = r.FormValue("bpf")
+	return
 }
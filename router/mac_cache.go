@@ -4,11 +4,14 @@ import (
 	"net"
 	"sync"
 	"time"
+
+	"github.com/weaveworks/weave/mesh"
 )
 
 type MacCacheEntry struct {
 	lastSeen time.Time
-	peer     *Peer
+	peer     *mesh.Peer
+	static   bool // pinned to the peer, rather than learned
 }
 
 type MacCache struct {
@@ -16,10 +19,10 @@ type MacCache struct {
 	table       map[uint64]*MacCacheEntry
 	maxAge      time.Duration
 	expiryTimer *time.Timer
-	onExpiry    func(net.HardwareAddr, *Peer)
+	onExpiry    func(net.HardwareAddr, *mesh.Peer)
 }
 
-func NewMacCache(maxAge time.Duration, onExpiry func(net.HardwareAddr, *Peer)) *MacCache {
+func NewMacCache(maxAge time.Duration, onExpiry func(net.HardwareAddr, *mesh.Peer)) *MacCache {
 	cache := &MacCache{
 		table:    make(map[uint64]*MacCacheEntry),
 		maxAge:   maxAge,
@@ -28,7 +31,7 @@ func NewMacCache(maxAge time.Duration, onExpiry func(net.HardwareAddr, *Peer)) *
 	return cache
 }
 
-func (cache *MacCache) add(mac net.HardwareAddr, peer *Peer, force bool) (bool, *Peer) {
+func (cache *MacCache) add(mac net.HardwareAddr, peer *mesh.Peer, force bool) (bool, *mesh.Peer) {
 	key := macint(mac)
 	now := time.Now()
 
@@ -50,6 +53,14 @@ func (cache *MacCache) add(mac net.HardwareAddr, peer *Peer, force bool) (bool,
 	}
 
 	if entry.peer != peer {
+		if entry.static {
+			// Static entries are only changed explicitly
+			if force {
+				return false, nil
+			}
+			return false, entry.peer
+		}
+
 		if !force {
 			return false, entry.peer
 		}
@@ -64,15 +75,80 @@ func (cache *MacCache) add(mac net.HardwareAddr, peer *Peer, force bool) (bool,
 	return false, nil
 }
 
-func (cache *MacCache) Add(mac net.HardwareAddr, peer *Peer) (bool, *Peer) {
+func (cache *MacCache) Add(mac net.HardwareAddr, peer *mesh.Peer) (bool, *mesh.Peer) {
 	return cache.add(mac, peer, false)
 }
 
-func (cache *MacCache) AddForced(mac net.HardwareAddr, peer *Peer) (bool, *Peer) {
+func (cache *MacCache) AddForced(mac net.HardwareAddr, peer *mesh.Peer) (bool, *mesh.Peer) {
 	return cache.add(mac, peer, true)
 }
 
-func (cache *MacCache) Lookup(mac net.HardwareAddr) *Peer {
+// Move a MAC to the given peer, in response to an announcement that
+// it moved there.  Returns whether the cache changed, and the peer
+// the MAC was previously at, if any.  Static entries are not moved.
+func (cache *MacCache) Move(mac net.HardwareAddr, peer *mesh.Peer) (bool, *mesh.Peer) {
+	key := macint(mac)
+	cache.Lock()
+	defer cache.Unlock()
+	entry, found := cache.table[key]
+	switch {
+	case !found:
+		cache.table[key] = &MacCacheEntry{lastSeen: time.Now(), peer: peer}
+		return true, nil
+	case entry.peer == peer || entry.static:
+		return false, entry.peer
+	}
+	oldPeer := entry.peer
+	entry.peer = peer
+	entry.lastSeen = time.Now()
+	return true, oldPeer
+}
+
+// Pin a MAC to a peer.  The entry does not expire, and is not
+// changed by traffic or move announcements, but is deleted if the
+// peer leaves the network.
+func (cache *MacCache) AddStatic(mac net.HardwareAddr, peer *mesh.Peer) {
+	cache.Lock()
+	defer cache.Unlock()
+	cache.table[macint(mac)] = &MacCacheEntry{lastSeen: time.Now(), peer: peer, static: true}
+}
+
+// Unpin a MAC, returning whether it was pinned.  The MAC is forgotten,
+// to be learned again from traffic.
+func (cache *MacCache) DeleteStatic(mac net.HardwareAddr) bool {
+	key := macint(mac)
+	cache.Lock()
+	defer cache.Unlock()
+	entry, found := cache.table[key]
+	if !found || !entry.static {
+		return false
+	}
+	delete(cache.table, key)
+	return true
+}
+
+// Delete a MAC if it is at the given peer, unless it is pinned there.
+// Returns whether it was deleted.
+func (cache *MacCache) DeleteAt(mac net.HardwareAddr, peer *mesh.Peer) bool {
+	key := macint(mac)
+	cache.Lock()
+	defer cache.Unlock()
+	entry, found := cache.table[key]
+	if !found || entry.peer != peer || entry.static {
+		return false
+	}
+	delete(cache.table, key)
+	return true
+}
+
+func (cache *MacCache) IsStatic(mac net.HardwareAddr) bool {
+	cache.RLock()
+	defer cache.RUnlock()
+	entry, found := cache.table[macint(mac)]
+	return found && entry.static
+}
+
+func (cache *MacCache) Lookup(mac net.HardwareAddr) *mesh.Peer {
 	key := macint(mac)
 	cache.RLock()
 	defer cache.RUnlock()
@@ -83,7 +159,7 @@ func (cache *MacCache) Lookup(mac net.HardwareAddr) *Peer {
 	return entry.peer
 }
 
-func (cache *MacCache) Delete(peer *Peer) bool {
+func (cache *MacCache) Delete(peer *mesh.Peer) bool {
 	found := false
 	cache.Lock()
 	defer cache.Unlock()
@@ -105,7 +181,7 @@ func (cache *MacCache) expire() {
 	cache.Lock()
 	defer cache.Unlock()
 	for key, entry := range cache.table {
-		if now.After(entry.lastSeen.Add(cache.maxAge)) {
+		if !entry.static && now.After(entry.lastSeen.Add(cache.maxAge)) {
 			delete(cache.table, key)
 			cache.onExpiry(intmac(key), entry.peer)
 		}
@@ -0,0 +1,69 @@
+package router
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/weave/mesh"
+)
+
+func TestMacCacheStaticAndMove(t *testing.T) {
+	name1, _ := mesh.PeerNameFromString("01:00:00:01:00:00")
+	name2, _ := mesh.PeerNameFromString("02:00:00:02:00:00")
+	peer1 := mesh.NewPeer(name1, "one", 0, 0, 0)
+	peer2 := mesh.NewPeer(name2, "two", 0, 0, 0)
+	mac, _ := net.ParseMAC("0a:00:00:00:00:01")
+	cache := NewMacCache(time.Minute, func(net.HardwareAddr, *mesh.Peer) {})
+
+	// A move announcement for an unknown MAC adds it
+	moved, oldPeer := cache.Move(mac, peer1)
+	require.True(t, moved)
+	require.Nil(t, oldPeer)
+	moved, _ = cache.Move(mac, peer1)
+	require.False(t, moved)
+	moved, oldPeer = cache.Move(mac, peer2)
+	require.True(t, moved)
+	require.Equal(t, peer1, oldPeer)
+
+	// A pinned MAC stays put
+	cache.AddStatic(mac, peer1)
+	require.True(t, cache.IsStatic(mac))
+	moved, oldPeer = cache.Move(mac, peer2)
+	require.False(t, moved)
+	require.Equal(t, peer1, oldPeer)
+	_, conflictPeer := cache.AddForced(mac, peer2)
+	require.Nil(t, conflictPeer)
+	_, conflictPeer = cache.Add(mac, peer2)
+	require.Equal(t, peer1, conflictPeer)
+	require.Equal(t, peer1, cache.Lookup(mac))
+
+	require.True(t, cache.DeleteStatic(mac))
+	require.False(t, cache.DeleteStatic(mac))
+	require.Nil(t, cache.Lookup(mac))
+}
+
+func TestGratuitousARP(t *testing.T) {
+	var srcMAC MAC
+	copy(srcMAC[:], []byte{0x0a, 0, 0, 0, 0, 1})
+	frame := make([]byte, 14+28)
+	copy(frame[0:], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	copy(frame[6:], srcMAC[:])
+	copy(frame[12:], []byte{0x08, 0x06})
+	arp := frame[14:]
+	copy(arp[0:], []byte{0, 1, 0x08, 0x00, 6, 4, 0, 1})
+	copy(arp[8:], srcMAC[:])
+	copy(arp[14:], []byte{10, 32, 0, 1})
+	copy(arp[24:], []byte{10, 32, 0, 1})
+	require.True(t, isGratuitousARP(frame, srcMAC))
+
+	// An ordinary ARP request
+	copy(arp[24:], []byte{10, 32, 0, 2})
+	require.False(t, isGratuitousARP(frame, srcMAC))
+
+	var otherMAC MAC
+	copy(arp[24:], []byte{10, 32, 0, 1})
+	require.False(t, isGratuitousARP(frame, otherMAC))
+}
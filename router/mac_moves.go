@@ -0,0 +1,146 @@
+package router
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"net"
+
+	"github.com/weaveworks/weave/mesh"
+)
+
+// When a container is re-attached on another host, the MAC caches of
+// all peers associate its MAC with the old host until the entries
+// expire, and until then the new host discards the container's
+// frames.  But re-attaching a container sends a gratuitous ARP, so
+// when we capture one from a MAC at another peer, we take the MAC
+// over and announce the move to all peers, which update their caches
+// straight away.
+
+type macMove struct {
+	MAC  MAC
+	Peer mesh.PeerName
+}
+
+type MacMoves struct {
+	router *NetworkRouter
+	gossip mesh.Gossip
+}
+
+func NewMacMoves(router *NetworkRouter) *MacMoves {
+	moves := &MacMoves{router: router}
+	moves.gossip = router.NewGossip("macmove", moves)
+	return moves
+}
+
+// Take over a MAC from another peer, announcing the move.  Returns
+// false if the MAC is pinned elsewhere.
+func (moves *MacMoves) moveHere(mac MAC) bool {
+	router := moves.router
+	moved, oldPeer := router.Macs.Move(net.HardwareAddr(mac[:]), router.Ourself.Peer)
+	if !moved {
+		return oldPeer == router.Ourself.Peer
+	}
+
+	log.Println("MAC", mac, "moved here from", oldPeer)
+	router.MacTable.addLocal(mac)
+	router.Overlay.InvalidateMAC(mac)
+	if err := moves.gossip.GossipBroadcast(&macMovesGossipData{[]macMove{{mac, router.Ourself.Name}}}); err != nil {
+		log.Warnln("Unable to announce move of MAC", mac, ":", err)
+	}
+	return true
+}
+
+// Gossiper methods
+
+func (moves *MacMoves) OnGossipUnicast(sender mesh.PeerName, msg []byte) error {
+	return nil
+}
+
+func (moves *MacMoves) OnGossipBroadcast(_ mesh.PeerName, update []byte) (mesh.GossipData, error) {
+	var announced []macMove
+	if err := gob.NewDecoder(bytes.NewReader(update)).Decode(&announced); err != nil {
+		return nil, err
+	}
+
+	// Only relay the moves which are news to us, so that
+	// announcements die out once every peer has seen them
+	var relay []macMove
+	for _, move := range announced {
+		peer := moves.router.Peers.Fetch(move.Peer)
+		if peer == nil {
+			continue
+		}
+		mac := net.HardwareAddr(move.MAC[:])
+		if moved, oldPeer := moves.router.Macs.Move(mac, peer); moved {
+			log.Println("MAC", mac, "moved to", peer, "from", oldPeer)
+			if oldPeer == moves.router.Ourself.Peer {
+				moves.router.MacTable.deleteLocal(move.MAC)
+			}
+			moves.router.Overlay.InvalidateMAC(move.MAC)
+			relay = append(relay, move)
+		}
+	}
+
+	if len(relay) == 0 {
+		return nil, nil
+	}
+	return &macMovesGossipData{relay}, nil
+}
+
+// Moves are announced as they happen, so there is no state to gossip
+func (moves *MacMoves) Gossip() mesh.GossipData {
+	return nil
+}
+
+func (moves *MacMoves) OnGossip(update []byte) (mesh.GossipData, error) {
+	return nil, nil
+}
+
+type macMovesGossipData struct {
+	moves []macMove
+}
+
+func (d *macMovesGossipData) Merge(other mesh.GossipData) {
+	d.moves = append(d.moves, other.(*macMovesGossipData).moves...)
+}
+
+func (d *macMovesGossipData) Encode() [][]byte {
+	return [][]byte{mesh.GobEncode(d.moves)}
+}
+
+// Handles frames captured from a local MAC which the cache associates
+// with another peer.  A gratuitous ARP means the MAC has moved here,
+// so we take it over and route the frame.  Other frames are
+// discarded.
+type macMoveFlowOp struct {
+	NonDiscardingFlowOp
+	router *NetworkRouter
+	key    PacketKey
+}
+
+func (fop *macMoveFlowOp) Process(frame []byte, dec *EthernetDecoder, broadcast bool) {
+	if !isGratuitousARP(frame, fop.key.SrcMAC) || !fop.router.MacMoves.moveHere(fop.key.SrcMAC) {
+		return
+	}
+	if routeFop, _ := fop.router.routeCapturedPacket(fop.key); routeFop != nil {
+		routeFop.Process(frame, dec, broadcast)
+	}
+}
+
+// Is the frame a gratuitous ARP, i.e. an ARP request or reply from
+// the given MAC about its own IP address?
+func isGratuitousARP(frame []byte, srcMAC MAC) bool {
+	const ethHdrLen, arpLen = 14, 28
+	if len(frame) < ethHdrLen+arpLen || frame[12] != 0x08 || frame[13] != 0x06 {
+		return false
+	}
+	arp := frame[ethHdrLen:]
+	if binary.BigEndian.Uint16(arp[0:]) != 1 || // Ethernet
+		binary.BigEndian.Uint16(arp[2:]) != 0x0800 || // IPv4
+		arp[4] != 6 || arp[5] != 4 {
+		return false
+	}
+	senderMAC, senderIP, targetIP := arp[8:14], arp[14:18], arp[24:28]
+	return bytes.Equal(senderMAC, srcMAC[:]) && bytes.Equal(senderIP, targetIP)
+}
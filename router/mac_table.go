@@ -0,0 +1,257 @@
+package router
+
+import (
+	"bytes"
+	"encoding/gob"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/weaveworks/weave/mesh"
+)
+
+// Each peer gossips the MACs it has learned locally, so that other
+// peers can forward unicast frames to them directly, rather than
+// broadcasting them until they see return traffic.  A peer's entries
+// are versioned by the peer, and are tombstoned when the MAC expires
+// from its cache.
+
+const (
+	// Tombstones only need to last long enough to reach all
+	// peers; a peer which misses one still expires the MAC from
+	// its cache eventually.
+	macTombstoneTimeout = 30 * time.Minute
+)
+
+type MacEntry struct {
+	MAC       MAC
+	Origin    mesh.PeerName
+	Version   int
+	Tombstone int64 // timestamp of when it was deleted
+}
+
+type macEntryKey struct {
+	MAC    MAC
+	Origin mesh.PeerName
+}
+
+func (e *MacEntry) key() macEntryKey {
+	return macEntryKey{e.MAC, e.Origin}
+}
+
+type MacTable struct {
+	sync.RWMutex
+	router  *NetworkRouter
+	gossip  mesh.Gossip
+	entries map[macEntryKey]MacEntry
+}
+
+func NewMacTable(router *NetworkRouter) *MacTable {
+	table := &MacTable{
+		router:  router,
+		entries: make(map[macEntryKey]MacEntry)}
+	table.gossip = router.NewGossip("macs", table)
+	time.AfterFunc(macTombstoneTimeout/10, table.deleteTombstones)
+	return table
+}
+
+// Record a MAC learned locally
+func (table *MacTable) addLocal(mac MAC) {
+	table.updateLocal(mac, false)
+}
+
+// Record that a local MAC expired or moved away
+func (table *MacTable) deleteLocal(mac MAC) {
+	table.updateLocal(mac, true)
+}
+
+func (table *MacTable) updateLocal(mac MAC, tombstone bool) {
+	table.Lock()
+	key := macEntryKey{mac, table.router.Ourself.Name}
+	entry, found := table.entries[key]
+	if (found && (entry.Tombstone != 0) == tombstone) || (!found && tombstone) {
+		table.Unlock()
+		return
+	}
+	entry = table.newLocalVersion(key, entry, tombstone)
+	table.Unlock()
+	table.broadcast(entry)
+}
+
+// Call with the lock held
+func (table *MacTable) newLocalVersion(key macEntryKey, entry MacEntry, tombstone bool) MacEntry {
+	entry.MAC, entry.Origin = key.MAC, key.Origin
+	entry.Version++
+	entry.Tombstone = 0
+	if tombstone {
+		entry.Tombstone = time.Now().Unix()
+	}
+	table.entries[key] = entry
+	return entry
+}
+
+func (table *MacTable) broadcast(entries ...MacEntry) {
+	if err := table.gossip.GossipBroadcast(&macTableGossipData{entries}); err != nil {
+		log.Warnln("Unable to gossip MACs:", err)
+	}
+}
+
+// Forget the MACs of a peer which has left the network
+func (table *MacTable) PeerGone(peer *mesh.Peer) {
+	table.Lock()
+	defer table.Unlock()
+	for key := range table.entries {
+		if key.Origin == peer.Name {
+			delete(table.entries, key)
+		}
+	}
+}
+
+func (table *MacTable) deleteTombstones() {
+	now := time.Now().Unix()
+	table.Lock()
+	for key, entry := range table.entries {
+		if entry.Tombstone != 0 && now-entry.Tombstone > int64(macTombstoneTimeout/time.Second) {
+			delete(table.entries, key)
+		}
+	}
+	table.Unlock()
+	time.AfterFunc(macTombstoneTimeout/10, table.deleteTombstones)
+}
+
+// Merge received entries, returning those which were new to us.  The
+// MAC cache is updated with all the received entries we hold, so that
+// periodic gossip keeps remote MACs from expiring.
+func (table *MacTable) receive(msg []byte) ([]MacEntry, []MacEntry, error) {
+	var gossip macTableGossipData
+	if err := gob.NewDecoder(bytes.NewReader(msg)).Decode(&gossip.Entries); err != nil {
+		return nil, nil, err
+	}
+
+	router := table.router
+	var received, newEntries, reasserted, current []MacEntry
+	table.Lock()
+	for _, entry := range gossip.Entries {
+		if router.Peers.Fetch(entry.Origin) == nil {
+			continue
+		}
+		received = append(received, entry)
+		key := entry.key()
+		ours, found := table.entries[key]
+		if found && ours.Version >= entry.Version {
+			if ours == entry && entry.Origin != router.Ourself.Name {
+				current = append(current, entry)
+			}
+			continue
+		}
+
+		if ourTombstone := !found || ours.Tombstone != 0; entry.Origin == router.Ourself.Name && ourTombstone != (entry.Tombstone != 0) {
+			// A stale entry of ours, e.g. from before we
+			// restarted, so supersede it with what we
+			// know
+			ours.Version = entry.Version
+			ours = table.newLocalVersion(key, ours, ourTombstone)
+			reasserted = append(reasserted, ours)
+			continue
+		}
+
+		table.entries[key] = entry
+		newEntries = append(newEntries, entry)
+		if entry.Origin != router.Ourself.Name {
+			current = append(current, entry)
+		}
+	}
+	table.Unlock()
+
+	if len(reasserted) > 0 {
+		table.broadcast(reasserted...)
+	}
+	table.updateCache(current)
+	return newEntries, received, nil
+}
+
+func (table *MacTable) updateCache(entries []MacEntry) {
+	router := table.router
+	var invalidate []MAC
+	for _, entry := range entries {
+		peer := router.Peers.Fetch(entry.Origin)
+		if peer == nil {
+			continue
+		}
+		mac := net.HardwareAddr(entry.MAC[:])
+		if entry.Tombstone != 0 {
+			if router.Macs.DeleteAt(mac, peer) {
+				log.Println("Forgot remote MAC", mac, "at", peer)
+				invalidate = append(invalidate, entry.MAC)
+			}
+		} else if newMac, _ := router.Macs.Add(mac, peer); newMac {
+			log.Println("Discovered remote MAC", mac, "at", peer, "from gossip")
+		}
+	}
+
+	// Clear out any flows forwarding to peers the MACs are no
+	// longer at
+	for _, mac := range invalidate {
+		router.Overlay.InvalidateMAC(mac)
+	}
+}
+
+// Gossiper methods
+
+func (table *MacTable) OnGossipUnicast(sender mesh.PeerName, msg []byte) error {
+	return nil
+}
+
+// merge received data into state and return "everything new I've
+// just learnt", or nil if nothing in the received data was new
+func (table *MacTable) OnGossip(msg []byte) (mesh.GossipData, error) {
+	newEntries, _, err := table.receive(msg)
+	if err != nil || len(newEntries) == 0 {
+		return nil, err
+	}
+	return &macTableGossipData{newEntries}, nil
+}
+
+// merge received data into state and return a representation of
+// the received data, for further propagation
+func (table *MacTable) OnGossipBroadcast(_ mesh.PeerName, msg []byte) (mesh.GossipData, error) {
+	_, received, err := table.receive(msg)
+	if err != nil || len(received) == 0 {
+		return nil, err
+	}
+	return &macTableGossipData{received}, nil
+}
+
+func (table *MacTable) Gossip() mesh.GossipData {
+	table.RLock()
+	defer table.RUnlock()
+	gossip := &macTableGossipData{make([]MacEntry, 0, len(table.entries))}
+	for _, entry := range table.entries {
+		gossip.Entries = append(gossip.Entries, entry)
+	}
+	return gossip
+}
+
+type macTableGossipData struct {
+	Entries []MacEntry
+}
+
+// Keep the latest version of each entry
+func (d *macTableGossipData) Merge(other mesh.GossipData) {
+	index := make(map[macEntryKey]int, len(d.Entries))
+	for i, entry := range d.Entries {
+		index[entry.key()] = i
+	}
+	for _, entry := range other.(*macTableGossipData).Entries {
+		if i, found := index[entry.key()]; !found {
+			index[entry.key()] = len(d.Entries)
+			d.Entries = append(d.Entries, entry)
+		} else if entry.Version > d.Entries[i].Version {
+			d.Entries[i] = entry
+		}
+	}
+}
+
+func (d *macTableGossipData) Encode() [][]byte {
+	return [][]byte{mesh.GobEncode(d.Entries)}
+}
@@ -0,0 +1,59 @@
+package router
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/weave/mesh"
+)
+
+func TestMacTableGossip(t *testing.T) {
+	name1, _ := mesh.PeerNameFromString("01:00:00:01:00:00")
+	name2, _ := mesh.PeerNameFromString("02:00:00:02:00:00")
+	router := NewNetworkRouter(mesh.Config{}, NetworkConfig{PacketLogging: nopPacketLogging{}}, name1, "one", nil)
+	peer2 := router.Peers.FetchWithDefault(mesh.NewPeer(name2, "two", 0, 0, 0))
+	var mac MAC
+	copy(mac[:], []byte{0x0a, 0, 0, 0, 0, 1})
+	hwMac := net.HardwareAddr(mac[:])
+
+	receive := func(entries ...MacEntry) mesh.GossipData {
+		update, err := router.MacTable.OnGossip(mesh.GobEncode(entries))
+		require.NoError(t, err)
+		return update
+	}
+
+	// A remote MAC is learned from gossip, and forgotten when
+	// tombstoned
+	require.NotNil(t, receive(MacEntry{MAC: mac, Origin: name2, Version: 1}))
+	require.Equal(t, peer2, router.Macs.Lookup(hwMac))
+	require.Nil(t, receive(MacEntry{MAC: mac, Origin: name2, Version: 1}))
+	require.NotNil(t, receive(MacEntry{MAC: mac, Origin: name2, Version: 2, Tombstone: 1}))
+	require.Nil(t, router.Macs.Lookup(hwMac))
+	require.Nil(t, receive(MacEntry{MAC: mac, Origin: name2, Version: 1}))
+	require.Nil(t, router.Macs.Lookup(hwMac))
+
+	// Entries from unknown peers are ignored
+	name3, _ := mesh.PeerNameFromString("03:00:00:03:00:00")
+	require.Nil(t, receive(MacEntry{MAC: mac, Origin: name3, Version: 1}))
+
+	// A stale entry of our own is superseded
+	receive(MacEntry{MAC: mac, Origin: name1, Version: 3})
+	entry := router.MacTable.entries[macEntryKey{mac, name1}]
+	require.Equal(t, 4, entry.Version)
+	require.NotZero(t, entry.Tombstone)
+
+	router.MacTable.addLocal(mac)
+	entry = router.MacTable.entries[macEntryKey{mac, name1}]
+	require.Equal(t, 5, entry.Version)
+	require.Zero(t, entry.Tombstone)
+}
+
+func TestMacTableGossipDataMerge(t *testing.T) {
+	name1, _ := mesh.PeerNameFromString("01:00:00:01:00:00")
+	name2, _ := mesh.PeerNameFromString("02:00:00:02:00:00")
+	d := &macTableGossipData{[]MacEntry{{Origin: name1, Version: 2}, {Origin: name2, Version: 1}}}
+	d.Merge(&macTableGossipData{[]MacEntry{{Origin: name1, Version: 1}, {Origin: name2, Version: 3, Tombstone: 1}}})
+	require.Equal(t, []MacEntry{{Origin: name1, Version: 2}, {Origin: name2, Version: 3, Tombstone: 1}}, d.Entries)
+}
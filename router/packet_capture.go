@@ -0,0 +1,216 @@
+package router
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+
+	"github.com/weaveworks/weave/mesh"
+)
+
+const captureQueueSize = 1024
+
+// What the router decided to do with a packet
+type Decision struct {
+	Local     bool       // injected on the local bridge
+	Forward   *mesh.Peer // unicast to this peer...
+	Via       mesh.PeerName
+	Broadcast bool   // broadcast to other peers
+	Discard   string // why the packet was discarded, if it was
+}
+
+func (d Decision) String() string {
+	var actions []string
+	if d.Local {
+		actions = append(actions, "local")
+	}
+	if d.Forward != nil {
+		actions = append(actions, fmt.Sprint("forward to ", d.Forward, " via ", d.Via))
+	}
+	if d.Broadcast {
+		actions = append(actions, "broadcast")
+	}
+	if len(actions) == 0 {
+		return fmt.Sprint("discard (", d.Discard, ")")
+	}
+	return strings.Join(actions, ", ")
+}
+
+// Which packets a capture should include.  Zero-valued fields match
+// everything.
+type CaptureFilter struct {
+	MAC  net.HardwareAddr
+	IP   net.IP
+	Peer string // name or nickname of the source, destination or next-hop peer
+	BPF  string
+}
+
+// A live capture of packets going through the router, with the
+// routing decision for each.
+type PacketCapture struct {
+	filter  CaptureFilter
+	bpfLock sync.Mutex // pcap.BPF is not safe for concurrent use
+	bpf     *pcap.BPF
+	packets chan CapturedPacket
+	dropped uint32
+}
+
+type CapturedPacket struct {
+	Time     time.Time
+	Frame    []byte
+	What     string // "captured" from the bridge, or "forwarded" from a peer
+	Decision Decision
+}
+
+func (pkt CapturedPacket) Annotation() string {
+	return pkt.What + ": " + pkt.Decision.String()
+}
+
+// The set of live captures on a router.
+type PacketCaptures struct {
+	sync.Mutex
+	active   int32
+	captures map[*PacketCapture]struct{}
+	onStart  func()
+}
+
+// onStart is called whenever a capture starts, to discard any cached
+// flows which would stop packets being seen by the router.
+func NewPacketCaptures(onStart func()) *PacketCaptures {
+	return &PacketCaptures{captures: make(map[*PacketCapture]struct{}), onStart: onStart}
+}
+
+func (pcs *PacketCaptures) Start(filter CaptureFilter) (*PacketCapture, error) {
+	pc := &PacketCapture{filter: filter, packets: make(chan CapturedPacket, captureQueueSize)}
+	if filter.BPF != "" {
+		bpf, err := pcap.NewBPF(layers.LinkTypeEthernet, 65535, filter.BPF)
+		if err != nil {
+			return nil, err
+		}
+		pc.bpf = bpf
+	}
+
+	pcs.Lock()
+	pcs.captures[pc] = struct{}{}
+	atomic.StoreInt32(&pcs.active, int32(len(pcs.captures)))
+	pcs.Unlock()
+
+	pcs.onStart()
+	return pc, nil
+}
+
+func (pcs *PacketCaptures) Stop(pc *PacketCapture) {
+	pcs.Lock()
+	defer pcs.Unlock()
+	delete(pcs.captures, pc)
+	atomic.StoreInt32(&pcs.active, int32(len(pcs.captures)))
+}
+
+// Add captures of the packet to the FlowOp the router decided on.
+// This is cheap when there are no captures, so that it can be done
+// for every packet.
+func (pcs *PacketCaptures) flowOp(what string, srcPeer, dstPeer *mesh.Peer, key PacketKey, fop FlowOp, decision Decision) FlowOp {
+	if atomic.LoadInt32(&pcs.active) == 0 {
+		return fop
+	}
+
+	var matching []*PacketCapture
+	pcs.Lock()
+	for pc := range pcs.captures {
+		if pc.filter.matchesKey(srcPeer, dstPeer, key, decision) {
+			matching = append(matching, pc)
+		}
+	}
+	pcs.Unlock()
+
+	if len(matching) == 0 {
+		return fop
+	}
+
+	// The captures are done through the FlowOp so that we see the
+	// frame.  This also prevents the fast datapath from creating a
+	// flow, so that we continue to see similar frames.
+	cfop := &captureFlowOp{captures: matching, what: what, decision: decision}
+	if fop == nil {
+		return cfop
+	}
+	return NewMultiFlowOp(false, cfop, fop)
+}
+
+func (filter *CaptureFilter) matchesKey(srcPeer, dstPeer *mesh.Peer, key PacketKey, decision Decision) bool {
+	if filter.MAC != nil && !bytes.Equal(filter.MAC, key.SrcMAC[:]) && !bytes.Equal(filter.MAC, key.DstMAC[:]) {
+		return false
+	}
+
+	if filter.Peer != "" {
+		isPeer := func(peer *mesh.Peer) bool {
+			return peer != nil && (peer.Name.String() == filter.Peer || peer.NickName == filter.Peer)
+		}
+		if !isPeer(srcPeer) && !isPeer(dstPeer) && !isPeer(decision.Forward) && decision.Via.String() != filter.Peer {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (pc *PacketCapture) matchesFrame(frame []byte, dec *EthernetDecoder) bool {
+	if pc.filter.IP != nil {
+		// Only IPv4 gets decoded
+		if len(dec.decoded) != 2 || !(pc.filter.IP.Equal(dec.IP.SrcIP) || pc.filter.IP.Equal(dec.IP.DstIP)) {
+			return false
+		}
+	}
+
+	if pc.bpf != nil {
+		pc.bpfLock.Lock()
+		defer pc.bpfLock.Unlock()
+		return pc.bpf.Matches(gopacket.CaptureInfo{CaptureLength: len(frame), Length: len(frame)}, frame)
+	}
+
+	return true
+}
+
+// Packets captured, until the capture is stopped
+func (pc *PacketCapture) Packets() <-chan CapturedPacket {
+	return pc.packets
+}
+
+// How many packets were dropped because the reader of Packets() did
+// not keep up
+func (pc *PacketCapture) Dropped() int {
+	return int(atomic.LoadUint32(&pc.dropped))
+}
+
+type captureFlowOp struct {
+	NonDiscardingFlowOp
+	captures []*PacketCapture
+	what     string
+	decision Decision
+}
+
+func (cfop *captureFlowOp) Process(frame []byte, dec *EthernetDecoder, broadcast bool) {
+	now := time.Now()
+	for _, pc := range cfop.captures {
+		if !pc.matchesFrame(frame, dec) {
+			continue
+		}
+
+		// The frame may get reused after we return
+		frameCopy := make([]byte, len(frame))
+		copy(frameCopy, frame)
+		select {
+		case pc.packets <- CapturedPacket{now, frameCopy, cfop.what, cfop.decision}:
+		default:
+			atomic.AddUint32(&pc.dropped, 1)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package router
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/weave/mesh"
+)
+
+func TestPacketCaptureFilters(t *testing.T) {
+	var flowsInvalidated int
+	captures := NewPacketCaptures(func() { flowsInvalidated++ })
+
+	name1, _ := mesh.PeerNameFromString("01:00:00:01:00:00")
+	name2, _ := mesh.PeerNameFromString("02:00:00:02:00:00")
+	peer1 := mesh.NewPeer(name1, "one", 0, 0, 0)
+	peer2 := mesh.NewPeer(name2, "two", 0, 0, 0)
+	mac1, _ := net.ParseMAC("00:00:00:00:00:01")
+	mac2, _ := net.ParseMAC("00:00:00:00:00:02")
+	var key PacketKey
+	copy(key.SrcMAC[:], mac1)
+	copy(key.DstMAC[:], mac2)
+	frame := make([]byte, 64)
+	copy(frame[0:], mac2)
+	copy(frame[6:], mac1)
+	dec := NewEthernetDecoder()
+	dec.DecodeLayers(frame)
+
+	// Without any captures, the FlowOp is untouched
+	fop := captures.flowOp("captured", peer1, nil, key, DiscardingFlowOp{}, Decision{Discard: "STP"})
+	require.Equal(t, DiscardingFlowOp{}, fop)
+
+	byMAC, err := captures.Start(CaptureFilter{MAC: mac2})
+	require.NoError(t, err)
+	byPeer, err := captures.Start(CaptureFilter{Peer: "two"})
+	require.NoError(t, err)
+	require.Equal(t, 2, flowsInvalidated)
+
+	// Discarded packets are still captured, so the FlowOp no
+	// longer discards
+	fop = captures.flowOp("captured", peer1, nil, key, DiscardingFlowOp{}, Decision{Discard: "STP"})
+	require.False(t, fop.Discards())
+	fop.Process(frame, dec, false)
+	pkt := <-byMAC.Packets()
+	require.Equal(t, frame, pkt.Frame)
+	require.Equal(t, "captured: discard (STP)", pkt.Annotation())
+	require.Len(t, byPeer.Packets(), 0)
+
+	// A packet forwarded via the peer matches the peer filter
+	fop = captures.flowOp("captured", peer1, nil, PacketKey{}, nil, Decision{Forward: peer2, Via: name2})
+	fop.Process(frame, dec, false)
+	pkt = <-byPeer.Packets()
+	require.Equal(t, "captured: forward to "+peer2.String()+" via "+name2.String(), pkt.Annotation())
+	require.Len(t, byMAC.Packets(), 0)
+
+	captures.Stop(byMAC)
+	captures.Stop(byPeer)
+	fop = captures.flowOp("forwarded", peer2, peer1, key, DiscardingFlowOp{}, Decision{Local: true, Broadcast: true})
+	require.Equal(t, DiscardingFlowOp{}, fop)
+}
+
+func TestPcapngWriter(t *testing.T) {
+	var buf bytes.Buffer
+	pw, err := NewPcapngWriter(&buf, "weave")
+	require.NoError(t, err)
+	require.NoError(t, pw.WritePacket(time.Unix(1, 0), make([]byte, 61), "captured: broadcast"))
+
+	// Walk the blocks, checking their lengths
+	var types []uint32
+	data := buf.Bytes()
+	for len(data) > 0 {
+		typ := binary.LittleEndian.Uint32(data[0:])
+		length := binary.LittleEndian.Uint32(data[4:])
+		require.Equal(t, uint32(0), length%4)
+		require.Equal(t, length, binary.LittleEndian.Uint32(data[length-4:]))
+		types = append(types, typ)
+		data = data[length:]
+	}
+	require.Equal(t, []uint32{pcapngSectionHeaderBlock, pcapngInterfaceDescBlock, pcapngEnhancedPacketBlock}, types)
+}
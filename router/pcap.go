@@ -6,6 +6,8 @@ import (
 	"sync"
 
 	"github.com/google/gopacket/pcap"
+
+	"github.com/weaveworks/weave/mesh"
 )
 
 type Pcap struct {
@@ -77,7 +79,7 @@ func newPcapHandle(ifName string, promisc bool, snaplen int, bufSz int) (handle
 	if err = inactive.SetSnapLen(snaplen); err != nil {
 		return
 	}
-	if err = inactive.SetTimeout(MaxDuration); err != nil {
+	if err = inactive.SetTimeout(mesh.MaxDuration); err != nil {
 		return
 	}
 	if err = inactive.SetImmediateMode(true); err != nil {
@@ -0,0 +1,110 @@
+package router
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// Just enough of the pcapng file format
+// (https://github.com/pcapng/pcapng) to stream captured Ethernet
+// frames with a comment on each, which Wireshark shows.
+
+const (
+	pcapngSectionHeaderBlock    = 0x0A0D0D0A
+	pcapngInterfaceDescBlock    = 0x00000001
+	pcapngEnhancedPacketBlock   = 0x00000006
+	pcapngByteOrderMagic        = 0x1A2B3C4D
+	pcapngLinkTypeEthernet      = 1
+	pcapngOptEndOfOpt           = 0
+	pcapngOptComment            = 1
+	pcapngOptShbUserAppl        = 4
+	pcapngOptIfName             = 2
+	pcapngOptIfTsresol          = 9
+	pcapngTsresolMicroseconds   = 6
+	pcapngSectionLengthUnknown  = 0xFFFFFFFFFFFFFFFF
+	pcapngBlockOverhead         = 12 // type, and length at both ends
+	pcapngEnhancedPacketHdrSize = 20
+)
+
+type PcapngWriter struct {
+	w io.Writer
+}
+
+// Writes the section header, and describes a single Ethernet
+// interface, to which all packets belong.
+func NewPcapngWriter(w io.Writer, ifName string) (*PcapngWriter, error) {
+	pw := &PcapngWriter{w: w}
+
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[4:], 1) // major version
+	binary.LittleEndian.PutUint16(shb[6:], 0) // minor version
+	binary.LittleEndian.PutUint64(shb[8:], pcapngSectionLengthUnknown)
+	shb = appendPcapngOption(shb, pcapngOptShbUserAppl, []byte("weave"))
+	shb = appendPcapngOption(shb, pcapngOptEndOfOpt, nil)
+	if err := pw.writeBlock(pcapngSectionHeaderBlock, shb); err != nil {
+		return nil, err
+	}
+
+	idb := make([]byte, 8)
+	binary.LittleEndian.PutUint16(idb[0:], pcapngLinkTypeEthernet)
+	binary.LittleEndian.PutUint32(idb[4:], 0) // no snap length
+	idb = appendPcapngOption(idb, pcapngOptIfName, []byte(ifName))
+	idb = appendPcapngOption(idb, pcapngOptIfTsresol, []byte{pcapngTsresolMicroseconds})
+	idb = appendPcapngOption(idb, pcapngOptEndOfOpt, nil)
+	if err := pw.writeBlock(pcapngInterfaceDescBlock, idb); err != nil {
+		return nil, err
+	}
+
+	return pw, nil
+}
+
+func (pw *PcapngWriter) WritePacket(t time.Time, frame []byte, comment string) error {
+	ts := uint64(t.UnixNano() / int64(time.Microsecond))
+	epb := make([]byte, pcapngEnhancedPacketHdrSize, pcapngEnhancedPacketHdrSize+len(frame)+len(comment)+16)
+	binary.LittleEndian.PutUint32(epb[0:], 0) // interface ID
+	binary.LittleEndian.PutUint32(epb[4:], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(epb[8:], uint32(ts))
+	binary.LittleEndian.PutUint32(epb[12:], uint32(len(frame)))
+	binary.LittleEndian.PutUint32(epb[16:], uint32(len(frame)))
+	epb = appendPcapngPadded(epb, frame)
+	if comment != "" {
+		epb = appendPcapngOption(epb, pcapngOptComment, []byte(comment))
+		epb = appendPcapngOption(epb, pcapngOptEndOfOpt, nil)
+	}
+	return pw.writeBlock(pcapngEnhancedPacketBlock, epb)
+}
+
+func (pw *PcapngWriter) writeBlock(typ uint32, body []byte) error {
+	length := uint32(pcapngBlockOverhead + len(body))
+	block := make([]byte, 0, length)
+	block = appendUint32(block, typ)
+	block = appendUint32(block, length)
+	block = append(block, body...)
+	block = appendUint32(block, length)
+	_, err := pw.w.Write(block)
+	return err
+}
+
+func appendPcapngOption(buf []byte, code uint16, value []byte) []byte {
+	var hdr [4]byte
+	binary.LittleEndian.PutUint16(hdr[0:], code)
+	binary.LittleEndian.PutUint16(hdr[2:], uint16(len(value)))
+	return appendPcapngPadded(append(buf, hdr[:]...), value)
+}
+
+// Fields in pcapng are padded to 32 bits
+func appendPcapngPadded(buf []byte, value []byte) []byte {
+	buf = append(buf, value...)
+	for len(buf)%4 != 0 {
+		buf = append(buf, 0)
+	}
+	return buf
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	return append(buf, b[:]...)
+}
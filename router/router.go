@@ -1,35 +1,21 @@
 package router
 
 import (
-	"fmt"
 	"net"
-	"sync"
 	"time"
-)
 
-const (
-	macMaxAge        = 10 * time.Minute       // [1]
-	acceptMaxTokens  = 100                    // [2]
-	acceptTokenDelay = 100 * time.Millisecond // [3]
+	"github.com/weaveworks/weave/mesh"
 )
 
+const macMaxAge = 10 * time.Minute // [1]
+
 // [1] should be greater than typical ARP cache expiries, i.e. > 3/2 *
 // /proc/sys/net/ipv4_neigh/*/base_reachable_time_ms on Linux
 
-// [2] capacity of token bucket for rate limiting accepts
-
-// [3] control rate at which new tokens are added to the bucket
-
-type Config struct {
-	Port               int
-	ProtocolMinVersion byte
-	Password           []byte
-	ConnLimit          int
-	PeerDiscovery      bool
-	BufSz              int
-	PacketLogging      PacketLogging
-	Bridge             Bridge
-	Overlay            Overlay
+type NetworkConfig struct {
+	BufSz         int
+	PacketLogging PacketLogging
+	Bridge        Bridge
 }
 
 type PacketLogging interface {
@@ -37,89 +23,88 @@ type PacketLogging interface {
 	LogForwardPacket(string, ForwardPacketKey)
 }
 
-type Router struct {
-	Config
-	Ourself         *LocalPeer
-	Macs            *MacCache
-	Peers           *Peers
-	Routes          *Routes
-	ConnectionMaker *ConnectionMaker
-	gossipLock      sync.RWMutex
-	gossipChannels  GossipChannels
-	TopologyGossip  Gossip
-	UDPListener     *net.UDPConn
-	acceptLimiter   *TokenBucket
+// A NetworkRouter forwards packets between the peers of a mesh,
+// alongside the gossip the mesh carries.
+type NetworkRouter struct {
+	*mesh.Router
+	NetworkConfig
+	Overlay  NetworkOverlay
+	Macs     *MacCache
+	MacMoves *MacMoves
+	MacTable *MacTable
+	Captures *PacketCaptures
+	Tracer   *Tracer
 }
 
-func NewRouter(config Config, name PeerName, nickName string) *Router {
-	router := &Router{Config: config, gossipChannels: make(GossipChannels)}
-
-	if router.Bridge == nil {
-		router.Bridge = NullBridge{}
+func NewNetworkRouter(config mesh.Config, networkConfig NetworkConfig, name mesh.PeerName, nickName string, overlay NetworkOverlay) *NetworkRouter {
+	if overlay == nil {
+		overlay = NullNetworkOverlay{}
 	}
-
-	if router.Overlay == nil {
-		router.Overlay = NullOverlay{}
+	if networkConfig.Bridge == nil {
+		networkConfig.Bridge = NullBridge{}
 	}
 
-	router.Ourself = NewLocalPeer(name, nickName, router)
+	router := &NetworkRouter{NetworkConfig: networkConfig, Overlay: overlay}
+	router.Router = mesh.NewRouter(config, name, nickName, overlay)
 	router.Macs = NewMacCache(macMaxAge,
-		func(mac net.HardwareAddr, peer *Peer) {
+		func(mac net.HardwareAddr, peer *mesh.Peer) {
 			log.Println("Expired MAC", mac, "at", peer)
+			if peer == router.Ourself.Peer {
+				router.MacTable.deleteLocal(macOf(mac))
+			}
 		})
-	router.Peers = NewPeers(router.Ourself)
-	router.Peers.OnGC(func(peer *Peer) {
+	router.MacMoves = NewMacMoves(router)
+	router.MacTable = NewMacTable(router)
+	router.Peers.OnGC(func(peer *mesh.Peer) {
 		router.Macs.Delete(peer)
-		log.Println("Removed unreachable peer", peer)
+		router.MacTable.PeerGone(peer)
 	})
-	router.Peers.OnInvalidateShortIDs(router.Overlay.InvalidateShortIDs)
-
-	router.Routes = NewRoutes(router.Ourself, router.Peers, router.Overlay.InvalidateRoutes)
-	router.ConnectionMaker = NewConnectionMaker(router.Ourself, router.Peers, router.Port, router.PeerDiscovery)
-	router.TopologyGossip = router.NewGossip("topology", router)
-	router.acceptLimiter = NewTokenBucket(acceptMaxTokens, acceptTokenDelay)
+	router.Peers.OnInvalidateShortIDs(overlay.InvalidateShortIDs)
+	router.Routes.OnChange(overlay.InvalidateRoutes)
+	router.Captures = NewPacketCaptures(overlay.InvalidateRoutes)
+	router.Tracer = NewTracer(router)
 	return router
 }
 
 // Start listening for TCP connections, locally captured packets, and
-// forwarded packets.  This is separate from NewRouter so
-// that gossipers can register before we start forming connections.
-func (router *Router) Start() {
+// forwarded packets.
+func (router *NetworkRouter) Start() {
 	log.Println("Sniffing traffic on", router.Bridge)
 	checkFatal(router.Bridge.StartConsumingPackets(router.handleCapturedPacket))
 	checkFatal(router.Overlay.StartConsumingPackets(router.Ourself.Peer, router.Peers, router.handleForwardedPacket))
-	router.listenTCP(router.Port)
-}
-
-func (router *Router) Stop() error {
-	// TODO: perform graceful shutdown...
-	return nil
+	router.Router.Start()
 }
 
-func (router *Router) UsingPassword() bool {
-	return router.Password != nil
+func (router *NetworkRouter) handleCapturedPacket(key PacketKey) FlowOp {
+	router.PacketLogging.LogPacket("Captured", key)
+	fop, decision := router.routeCapturedPacket(key)
+	return router.Captures.flowOp("captured", router.Ourself.Peer, nil, key, fop, decision)
 }
 
-func (router *Router) handleCapturedPacket(key PacketKey) FlowOp {
-	router.PacketLogging.LogPacket("Captured", key)
+func (router *NetworkRouter) routeCapturedPacket(key PacketKey) (FlowOp, Decision) {
 	srcMac := net.HardwareAddr(key.SrcMAC[:])
 
 	switch newSrcMac, conflictPeer := router.Macs.Add(srcMac, router.Ourself.Peer); {
 	case newSrcMac:
 		log.Println("Discovered local MAC", srcMac)
+		router.MacTable.addLocal(key.SrcMAC)
 
 	case conflictPeer != nil:
 		// The MAC cache has an entry for the source MAC
-		// associated with another peer.  This probably means
+		// associated with another peer.  Either the MAC has
+		// moved here, which a gratuitous ARP will tell us, or
 		// we are seeing a frame we injected ourself.  That
 		// shouldn't happen, but discard it just in case.
 		log.Error("Captured frame from MAC (", srcMac, ") associated with another peer ", conflictPeer)
-		return DiscardingFlowOp{}
+		if router.Macs.IsStatic(srcMac) {
+			return DiscardingFlowOp{}, Decision{Discard: "source MAC is pinned to another peer"}
+		}
+		return &macMoveFlowOp{router: router, key: key}, Decision{Discard: "source MAC is at another peer"}
 	}
 
 	// Discard STP broadcasts
 	if key.DstMAC == [...]byte{0x01, 0x80, 0xC2, 0x00, 0x00, 0x00} {
-		return DiscardingFlowOp{}
+		return DiscardingFlowOp{}, Decision{Discard: "STP"}
 	}
 
 	dstMac := net.HardwareAddr(key.DstMAC[:])
@@ -130,12 +115,12 @@ func (router *Router) handleCapturedPacket(key PacketKey) FlowOp {
 		// it's likely to be broadcasting the packet to all
 		// ports.  So if it happens, just drop the packet to
 		// avoid warnings if we try to forward it.
-		return DiscardingFlowOp{}
+		return DiscardingFlowOp{}, Decision{Discard: "destination MAC is local"}
 	case nil:
 		// If we don't know which peer corresponds to the dest
 		// MAC, broadcast it.
 		router.PacketLogging.LogPacket("Broadcasting", key)
-		return router.relayBroadcast(router.Ourself.Peer, key)
+		return router.relayBroadcast(router.Ourself.Peer, key), Decision{Broadcast: true}
 	default:
 		router.PacketLogging.LogPacket("Forwarding", key)
 		return router.relay(ForwardPacketKey{
@@ -145,36 +130,12 @@ func (router *Router) handleCapturedPacket(key PacketKey) FlowOp {
 	}
 }
 
-func (router *Router) listenTCP(localPort int) {
-	localAddr, err := net.ResolveTCPAddr("tcp4", fmt.Sprint(":", localPort))
-	checkFatal(err)
-	ln, err := net.ListenTCP("tcp4", localAddr)
-	checkFatal(err)
-	go func() {
-		defer ln.Close()
-		for {
-			tcpConn, err := ln.AcceptTCP()
-			if err != nil {
-				log.Errorln(err)
-				continue
-			}
-			router.acceptTCP(tcpConn)
-			router.acceptLimiter.Wait()
-		}
-	}()
-}
-
-func (router *Router) acceptTCP(tcpConn *net.TCPConn) {
-	// someone else is dialing us, so our udp sender is the conn
-	// on router.Port and we wait for them to send us something on UDP to
-	// start.
-	remoteAddrStr := tcpConn.RemoteAddr().String()
-	log.Printf("->[%s] connection accepted", remoteAddrStr)
-	connRemote := NewRemoteConnection(router.Ourself.Peer, nil, remoteAddrStr, false, false)
-	StartLocalConnection(connRemote, tcpConn, nil, router, true)
+func (router *NetworkRouter) handleForwardedPacket(key ForwardPacketKey) FlowOp {
+	fop, decision := router.routeForwardedPacket(key)
+	return router.Captures.flowOp("forwarded", key.SrcPeer, key.DstPeer, key.PacketKey, fop, decision)
 }
 
-func (router *Router) handleForwardedPacket(key ForwardPacketKey) FlowOp {
+func (router *NetworkRouter) routeForwardedPacket(key ForwardPacketKey) (FlowOp, Decision) {
 	if key.DstPeer != router.Ourself.Peer {
 		// it's not for us, we're just relaying it
 		router.PacketLogging.LogForwardPacket("Relaying", key)
@@ -194,58 +155,62 @@ func (router *Router) handleForwardedPacket(key ForwardPacketKey) FlowOp {
 
 	case conflictPeer != nil:
 		log.Print("Discovered remote MAC ", srcMac, " at ", key.SrcPeer, " (was at ", conflictPeer, ")")
+		if conflictPeer == router.Ourself.Peer {
+			router.MacTable.deleteLocal(key.SrcMAC)
+		}
 
 		// We need to clear out any flows destined to the MAC
 		// that forward to the old peer.
-		router.Overlay.InvalidateRoutes()
+		router.Overlay.InvalidateMAC(key.SrcMAC)
 	}
 
 	router.PacketLogging.LogForwardPacket("Injecting", key)
 	injectFop := router.Bridge.InjectPacket(key.PacketKey)
 	dstPeer := router.Macs.Lookup(dstMac)
 	if dstPeer == router.Ourself.Peer {
-		return injectFop
+		return injectFop, Decision{Local: true}
 	}
 
 	router.PacketLogging.LogForwardPacket("Relaying broadcast", key)
 	relayFop := router.relayBroadcast(key.SrcPeer, key.PacketKey)
+	decision := Decision{Local: true, Broadcast: true}
 	switch {
 	case injectFop == nil:
-		return relayFop
+		return relayFop, decision
 
 	case relayFop == nil:
-		return injectFop
+		return injectFop, decision
 
 	default:
 		mfop := NewMultiFlowOp(false)
 		mfop.Add(injectFop)
 		mfop.Add(relayFop)
-		return mfop
+		return mfop, decision
 	}
 }
 
 // Routing
 
-func (router *Router) relay(key ForwardPacketKey) FlowOp {
+func (router *NetworkRouter) relay(key ForwardPacketKey) (FlowOp, Decision) {
 	relayPeerName, found := router.Routes.Unicast(key.DstPeer.Name)
 	if !found {
 		// Not necessarily an error as there could be a race with the
 		// dst disappearing whilst the frame is in flight
 		log.Println("Received packet for unknown destination:", key.DstPeer)
-		return DiscardingFlowOp{}
+		return DiscardingFlowOp{}, Decision{Discard: "no route to destination peer"}
 	}
 
 	conn, found := router.Ourself.ConnectionTo(relayPeerName)
 	if !found {
 		// Again, could just be a race, not necessarily an error
 		log.Println("Unable to find connection to relay peer", relayPeerName)
-		return DiscardingFlowOp{}
+		return DiscardingFlowOp{}, Decision{Discard: "no connection to relay peer"}
 	}
 
-	return conn.(*LocalConnection).Forward(key)
+	return forward(conn, key), Decision{Forward: key.DstPeer, Via: relayPeerName}
 }
 
-func (router *Router) relayBroadcast(srcPeer *Peer, key PacketKey) FlowOp {
+func (router *NetworkRouter) relayBroadcast(srcPeer *mesh.Peer, key PacketKey) FlowOp {
 	nextHops := router.Routes.Broadcast(srcPeer.Name)
 	if len(nextHops) == 0 {
 		return DiscardingFlowOp{}
@@ -254,7 +219,7 @@ func (router *Router) relayBroadcast(srcPeer *Peer, key PacketKey) FlowOp {
 	op := NewMultiFlowOp(true)
 
 	for _, conn := range router.Ourself.ConnectionsTo(nextHops) {
-		op.Add(conn.(*LocalConnection).Forward(ForwardPacketKey{
+		op.Add(forward(conn, ForwardPacketKey{
 			PacketKey: key,
 			SrcPeer:   srcPeer,
 			DstPeer:   conn.Remote()}))
@@ -263,75 +228,6 @@ func (router *Router) relayBroadcast(srcPeer *Peer, key PacketKey) FlowOp {
 	return op
 }
 
-// Gossiper methods - the Router is the topology Gossiper
-
-type TopologyGossipData struct {
-	peers  *Peers
-	update PeerNameSet
-}
-
-func (router *Router) BroadcastTopologyUpdate(update []*Peer) {
-	names := make(PeerNameSet)
-	for _, p := range update {
-		names[p.Name] = void
-	}
-
-	router.TopologyGossip.GossipBroadcast(&TopologyGossipData{
-		peers:  router.Peers,
-		update: names,
-	})
-}
-
-func (d *TopologyGossipData) Merge(other GossipData) {
-	for name := range other.(*TopologyGossipData).update {
-		d.update[name] = void
-	}
-}
-
-func (d *TopologyGossipData) Encode() [][]byte {
-	return [][]byte{d.peers.EncodePeers(d.update)}
-}
-
-func (router *Router) OnGossipUnicast(sender PeerName, msg []byte) error {
-	return fmt.Errorf("unexpected topology gossip unicast: %v", msg)
-}
-
-func (router *Router) OnGossipBroadcast(_ PeerName, update []byte) (GossipData, error) {
-	origUpdate, _, err := router.applyTopologyUpdate(update)
-	if err != nil || len(origUpdate) == 0 {
-		return nil, err
-	}
-	return &TopologyGossipData{peers: router.Peers, update: origUpdate}, nil
-}
-
-func (router *Router) Gossip() GossipData {
-	return &TopologyGossipData{peers: router.Peers, update: router.Peers.Names()}
-}
-
-func (router *Router) OnGossip(update []byte) (GossipData, error) {
-	_, newUpdate, err := router.applyTopologyUpdate(update)
-	if err != nil || len(newUpdate) == 0 {
-		return nil, err
-	}
-	return &TopologyGossipData{peers: router.Peers, update: newUpdate}, nil
-}
-
-func (router *Router) applyTopologyUpdate(update []byte) (PeerNameSet, PeerNameSet, error) {
-	origUpdate, newUpdate, err := router.Peers.ApplyUpdate(update)
-	if _, ok := err.(UnknownPeerError); err != nil && ok {
-		// That update contained a reference to a peer which wasn't
-		// itself included in the update, and we didn't know about
-		// already. We ignore this; eventually we should receive an
-		// update containing a complete topology.
-		log.Println("Topology gossip:", err)
-		return nil, nil, nil
-	}
-	if err != nil {
-		return nil, nil, err
-	}
-	if len(newUpdate) > 0 {
-		router.ConnectionMaker.Refresh()
-		router.Routes.Recalculate()
-	}
-	return origUpdate, newUpdate, nil
+func forward(conn mesh.Connection, key ForwardPacketKey) FlowOp {
+	return conn.(*mesh.LocalConnection).OverlayConn.(OverlayForwarder).Forward(key)
 }
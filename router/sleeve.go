@@ -17,6 +17,8 @@ import (
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
+
+	"github.com/weaveworks/weave/mesh"
 )
 
 // This diagram explains the various arithmetic and variables related
@@ -60,21 +62,21 @@ type SleeveOverlay struct {
 
 	// These fields are set in StartConsumingPackets, and not
 	// subsequently modified
-	localPeer    *Peer
+	localPeer    *mesh.Peer
 	localPeerBin []byte
 	consumer     OverlayConsumer
-	peers        *Peers
+	peers        *mesh.Peers
 	conn         *net.UDPConn
 
 	lock       sync.Mutex
-	forwarders map[PeerName]*sleeveForwarder
+	forwarders map[mesh.PeerName]*sleeveForwarder
 }
 
-func NewSleeveOverlay(localPort int) Overlay {
+func NewSleeveOverlay(localPort int) NetworkOverlay {
 	return &SleeveOverlay{localPort: localPort}
 }
 
-func (sleeve *SleeveOverlay) StartConsumingPackets(localPeer *Peer, peers *Peers,
+func (sleeve *SleeveOverlay) StartConsumingPackets(localPeer *mesh.Peer, peers *mesh.Peers,
 	consumer OverlayConsumer) error {
 	localAddr, err := net.ResolveUDPAddr("udp4",
 		fmt.Sprint(":", sleeve.localPort))
@@ -116,7 +118,7 @@ func (sleeve *SleeveOverlay) StartConsumingPackets(localPeer *Peer, peers *Peers
 	sleeve.consumer = consumer
 	sleeve.peers = peers
 	sleeve.conn = conn
-	sleeve.forwarders = make(map[PeerName]*sleeveForwarder)
+	sleeve.forwarders = make(map[mesh.PeerName]*sleeveForwarder)
 	go sleeve.readUDP()
 	return nil
 }
@@ -125,6 +127,10 @@ func (*SleeveOverlay) InvalidateRoutes() {
 	// no cached information, so nothing to do
 }
 
+func (*SleeveOverlay) InvalidateMAC(MAC) {
+	// no cached information, so nothing to do
+}
+
 func (*SleeveOverlay) InvalidateShortIDs() {
 	// no cached information, so nothing to do
 }
@@ -137,19 +143,19 @@ func (*SleeveOverlay) Diagnostics() interface{} {
 	return nil
 }
 
-func (sleeve *SleeveOverlay) lookupForwarder(peer PeerName) *sleeveForwarder {
+func (sleeve *SleeveOverlay) lookupForwarder(peer mesh.PeerName) *sleeveForwarder {
 	sleeve.lock.Lock()
 	defer sleeve.lock.Unlock()
 	return sleeve.forwarders[peer]
 }
 
-func (sleeve *SleeveOverlay) addForwarder(peer PeerName, fwd *sleeveForwarder) {
+func (sleeve *SleeveOverlay) addForwarder(peer mesh.PeerName, fwd *sleeveForwarder) {
 	sleeve.lock.Lock()
 	defer sleeve.lock.Unlock()
 	sleeve.forwarders[peer] = fwd
 }
 
-func (sleeve *SleeveOverlay) removeForwarder(peer PeerName,
+func (sleeve *SleeveOverlay) removeForwarder(peer mesh.PeerName,
 	fwd *sleeveForwarder) {
 	sleeve.lock.Lock()
 	defer sleeve.lock.Unlock()
@@ -170,19 +176,19 @@ func (sleeve *SleeveOverlay) readUDP() {
 		} else if err != nil {
 			log.Print("ignoring UDP read error ", err)
 			continue
-		} else if n < NameSize {
+		} else if n < mesh.NameSize {
 			log.Print("ignoring too short UDP packet from ", sender)
 			continue
 		}
 
-		fwdName := PeerNameFromBin(buf[:NameSize])
+		fwdName := mesh.PeerNameFromBin(buf[:mesh.NameSize])
 		fwd := sleeve.lookupForwarder(fwdName)
 		if fwd == nil {
 			continue
 		}
 
-		packet := make([]byte, n-NameSize)
-		copy(packet, buf[NameSize:n])
+		packet := make([]byte, n-mesh.NameSize)
+		copy(packet, buf[mesh.NameSize:n])
 
 		err = fwd.crypto.Dec.IterateFrames(packet,
 			func(src []byte, dst []byte, frame []byte) {
@@ -218,8 +224,8 @@ func (sleeve *SleeveOverlay) handleFrame(sender *net.UDPAddr,
 		return
 	}
 
-	srcPeer := sleeve.peers.Fetch(PeerNameFromBin(src))
-	dstPeer := sleeve.peers.Fetch(PeerNameFromBin(dst))
+	srcPeer := sleeve.peers.Fetch(mesh.PeerNameFromBin(src))
+	dstPeer := sleeve.peers.Fetch(mesh.PeerNameFromBin(dst))
 	if srcPeer == nil || dstPeer == nil {
 		return
 	}
@@ -246,7 +252,7 @@ func (sleeve *SleeveOverlay) handleFrame(sender *net.UDPAddr,
 	sleeve.sendToConsumer(srcPeer, dstPeer, frame, dec)
 }
 
-func (sleeve *SleeveOverlay) sendToConsumer(srcPeer, dstPeer *Peer,
+func (sleeve *SleeveOverlay) sendToConsumer(srcPeer, dstPeer *mesh.Peer,
 	frame []byte, dec *EthernetDecoder) {
 	if sleeve.consumer == nil {
 		return
@@ -283,7 +289,7 @@ func (sleeve *SleeveOverlay) send(msg []byte, raddr *net.UDPAddr) error {
 type sleeveForwarder struct {
 	// Immutable
 	sleeve         *SleeveOverlay
-	remotePeer     *Peer
+	remotePeer     *mesh.Peer
 	remotePeerBin  []byte
 	sendControlMsg func(byte, []byte) error
 	connUID        uint64
@@ -350,21 +356,11 @@ type controlMessage struct {
 	msg []byte
 }
 
-func (sleeve *SleeveOverlay) MakeForwarder(params ForwarderParams) (OverlayForwarder, error) {
-	var crypto OverlayCrypto
-	if params.Crypto != nil {
-		crypto = *params.Crypto
-	} else {
-		name := sleeve.localPeer.NameByte
-		crypto = OverlayCrypto{
-			Dec:   NewNonDecryptor(),
-			Enc:   NewNonEncryptor(name),
-			EncDF: NewNonEncryptor(name),
-		}
-	}
+func (sleeve *SleeveOverlay) PrepareConnection(params mesh.OverlayConnectionParams) (mesh.OverlayConnection, error) {
+	crypto := NewOverlayCrypto(sleeve.localPeer, params)
 
-	aggChan := make(chan aggregatorFrame, ChannelSize)
-	aggDFChan := make(chan aggregatorFrame, ChannelSize)
+	aggChan := make(chan aggregatorFrame, mesh.ChannelSize)
+	aggDFChan := make(chan aggregatorFrame, mesh.ChannelSize)
 	specialChan := make(chan specialFrame, 1)
 	controlMsgChan := make(chan controlMessage, 1)
 	confirmedChan := make(chan struct{})
@@ -766,13 +762,13 @@ func (fwd *sleeveForwarder) handleSpecialFrame(special specialFrame) error {
 
 func (fwd *sleeveForwarder) handleControlMessage(cm controlMessage) error {
 	switch cm.tag {
-	case ProtocolConnectionEstablished:
+	case mesh.ProtocolConnectionEstablished:
 		return fwd.handleHeartbeatAck()
 
-	case ProtocolFragmentationReceived:
+	case mesh.ProtocolFragmentationReceived:
 		return fwd.handleFragTestAck()
 
-	case ProtocolPMTUVerified:
+	case mesh.ProtocolPMTUVerified:
 		return fwd.handleMTUTestAck(cm.msg)
 
 	default:
@@ -843,7 +839,7 @@ func (fwd *sleeveForwarder) handleHeartbeat(special specialFrame) error {
 
 	if !fwd.ackedHeartbeat {
 		fwd.ackedHeartbeat = true
-		if err := fwd.sendControlMsg(ProtocolConnectionEstablished, nil); err != nil {
+		if err := fwd.sendControlMsg(mesh.ProtocolConnectionEstablished, nil); err != nil {
 			return err
 		}
 	}
@@ -904,7 +900,7 @@ func (fwd *sleeveForwarder) handleFragTest(frame []byte) error {
 		return nil
 	}
 
-	return fwd.sendControlMsg(ProtocolFragmentationReceived, nil)
+	return fwd.sendControlMsg(mesh.ProtocolFragmentationReceived, nil)
 }
 
 func (fwd *sleeveForwarder) handleFragTestAck() error {
@@ -950,7 +946,7 @@ func (fwd *sleeveForwarder) sendMTUTest() error {
 func (fwd *sleeveForwarder) handleMTUTest(frame []byte) error {
 	buf := make([]byte, 2)
 	binary.BigEndian.PutUint16(buf, uint16(len(frame)-EthernetOverhead))
-	return fwd.sendControlMsg(ProtocolPMTUVerified, buf)
+	return fwd.sendControlMsg(mesh.ProtocolPMTUVerified, buf)
 }
 
 func (fwd *sleeveForwarder) handleMTUTestAck(msg []byte) error {
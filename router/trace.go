@@ -0,0 +1,359 @@
+package router
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/weaveworks/weave/mesh"
+)
+
+const (
+	traceProbePort  = 6782                   // UDP destination port of probe frames
+	traceStartDelay = 200 * time.Millisecond // [1]
+	traceWatchTime  = 30 * time.Second       // [2]
+
+	defaultTraceTimeout = 2 * time.Second
+)
+
+// [1] time for the start of a trace to be gossiped to other peers,
+// before we inject the probe
+
+// [2] how long peers watch for the probe of a trace
+
+var traceProbeMagic = []byte("weave-trace-probe")
+
+// A TraceHop reports how one peer handled the probe frame of a trace.
+type TraceHop struct {
+	Peer      string
+	Received  string // "captured" from the bridge, or "forwarded" from a peer
+	DstMAC    string // which peer the destination MAC is at, as far as this peer knows
+	Decision  string
+	Relay     string // next hop, when forwarding to a single peer
+	Overlay   string // overlay used to reach the next hop
+	Encrypted bool   // whether the connection to the next hop is encrypted
+}
+
+// A Tracer traces the path that frames take through the network, by
+// injecting a probe frame on one peer, and having every peer which
+// sees the probe report back how it handled it.
+type Tracer struct {
+	sync.Mutex
+	router  *NetworkRouter
+	gossip  mesh.Gossip
+	watches map[uint64]struct{}      // traces we are watching for
+	traces  map[uint64]chan TraceHop // traces we started
+}
+
+type traceStart struct {
+	ID     uint64
+	Origin mesh.PeerName
+	SrcMAC MAC
+	DstMAC MAC
+}
+
+type traceReport struct {
+	ID  uint64
+	Hop TraceHop
+}
+
+func NewTracer(router *NetworkRouter) *Tracer {
+	tracer := &Tracer{
+		router:  router,
+		watches: make(map[uint64]struct{}),
+		traces:  make(map[uint64]chan TraceHop)}
+	tracer.gossip = router.NewGossip("trace", tracer)
+	return tracer
+}
+
+// Trace the path of a frame from srcMAC, which should be the MAC of a
+// container attached to this peer, to dstMAC.  The IP addresses go
+// in the IP header of the probe, and may be nil.  Hops are returned in
+// the order the probe took, as far as they are known, followed by any
+// others.
+func (tracer *Tracer) Trace(srcMAC, dstMAC net.HardwareAddr, srcIP, dstIP net.IP, timeout time.Duration) ([]TraceHop, error) {
+	start := traceStart{Origin: tracer.router.Ourself.Name}
+	if err := binary.Read(rand.Reader, binary.LittleEndian, &start.ID); err != nil {
+		return nil, err
+	}
+	copy(start.SrcMAC[:], srcMAC)
+	copy(start.DstMAC[:], dstMAC)
+	frame, err := makeTraceProbe(start, srcIP, dstIP)
+	if err != nil {
+		return nil, err
+	}
+
+	hops := make(chan TraceHop, 64)
+	tracer.Lock()
+	tracer.traces[start.ID] = hops
+	tracer.Unlock()
+	defer func() {
+		tracer.Lock()
+		delete(tracer.traces, start.ID)
+		tracer.Unlock()
+	}()
+
+	if err := tracer.watch(start); err != nil {
+		return nil, err
+	}
+	if err := tracer.gossip.GossipBroadcast(&traceGossipData{[]traceStart{start}}); err != nil {
+		return nil, err
+	}
+	time.Sleep(traceStartDelay)
+
+	// Inject the probe as if it had been captured from the bridge
+	dec := NewEthernetDecoder()
+	dec.DecodeLayers(frame)
+	if fop := tracer.router.handleCapturedPacket(start.key()); fop != nil && !fop.Discards() {
+		fop.Process(frame, dec, false)
+	}
+
+	var received []TraceHop
+	deadline := time.After(timeout)
+	for {
+		select {
+		case hop := <-hops:
+			received = append(received, hop)
+		case <-deadline:
+			return orderTraceHops(tracer.router.Ourself.Name.String(), received), nil
+		}
+	}
+}
+
+// Follow the relays from the origin, so that hops are in path order
+func orderTraceHops(origin string, hops []TraceHop) []TraceHop {
+	var ordered []TraceHop
+	used := make([]bool, len(hops))
+	next, received := origin, "captured"
+	for {
+		found := false
+		for i, hop := range hops {
+			if !used[i] && hop.Peer == next && hop.Received == received {
+				ordered = append(ordered, hop)
+				used[i], found = true, true
+				next, received = hop.Relay, "forwarded"
+				break
+			}
+		}
+		if !found {
+			break
+		}
+	}
+	for i, hop := range hops {
+		if !used[i] {
+			ordered = append(ordered, hop)
+		}
+	}
+	return ordered
+}
+
+func (start traceStart) key() PacketKey {
+	return PacketKey{SrcMAC: start.SrcMAC, DstMAC: start.DstMAC}
+}
+
+func makeTraceProbe(start traceStart, srcIP, dstIP net.IP) ([]byte, error) {
+	if srcIP == nil {
+		srcIP = net.IPv4zero
+	}
+	if dstIP == nil {
+		dstIP = net.IPv4zero
+	}
+
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    srcIP.To4(),
+		DstIP:    dstIP.To4()}
+	if ip.SrcIP == nil || ip.DstIP == nil {
+		return nil, fmt.Errorf("trace probe addresses must be IPv4")
+	}
+	udp := &layers.UDP{SrcPort: traceProbePort, DstPort: traceProbePort}
+	udp.SetNetworkLayerForChecksum(ip)
+
+	payload := make([]byte, len(traceProbeMagic)+8)
+	copy(payload, traceProbeMagic)
+	binary.BigEndian.PutUint64(payload[len(traceProbeMagic):], start.ID)
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	err := gopacket.SerializeLayers(buf, opts,
+		&layers.Ethernet{
+			SrcMAC:       net.HardwareAddr(start.SrcMAC[:]),
+			DstMAC:       net.HardwareAddr(start.DstMAC[:]),
+			EthernetType: layers.EthernetTypeIPv4},
+		ip, udp, gopacket.Payload(payload))
+	return buf.Bytes(), err
+}
+
+// Is the frame the probe for the given trace?
+func isTraceProbe(frame []byte, id uint64) bool {
+	if len(frame) < 14+20 || frame[12] != 0x08 || frame[13] != 0x00 {
+		return false
+	}
+	ipHdr := frame[14:]
+	ihl := int(ipHdr[0]&0x0f) * 4
+	if ipHdr[9] != byte(layers.IPProtocolUDP) || len(ipHdr) < ihl+8+len(traceProbeMagic)+8 {
+		return false
+	}
+	udp := ipHdr[ihl:]
+	if binary.BigEndian.Uint16(udp[2:]) != traceProbePort {
+		return false
+	}
+	payload := udp[8:]
+	return bytes.HasPrefix(payload, traceProbeMagic) &&
+		binary.BigEndian.Uint64(payload[len(traceProbeMagic):]) == id
+}
+
+// Watch for the probe of a trace, reporting how we handle it to the
+// origin of the trace.
+func (tracer *Tracer) watch(start traceStart) error {
+	tracer.Lock()
+	if _, found := tracer.watches[start.ID]; found {
+		tracer.Unlock()
+		return nil
+	}
+	tracer.watches[start.ID] = struct{}{}
+	tracer.Unlock()
+
+	capture, err := tracer.router.Captures.Start(CaptureFilter{MAC: net.HardwareAddr(start.SrcMAC[:])})
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		defer func() {
+			tracer.router.Captures.Stop(capture)
+			tracer.Lock()
+			delete(tracer.watches, start.ID)
+			tracer.Unlock()
+		}()
+
+		deadline := time.After(traceWatchTime)
+		for {
+			select {
+			case pkt := <-capture.Packets():
+				if isTraceProbe(pkt.Frame, start.ID) {
+					tracer.report(start, tracer.hop(start, pkt))
+				}
+			case <-deadline:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (tracer *Tracer) hop(start traceStart, pkt CapturedPacket) TraceHop {
+	router := tracer.router
+	hop := TraceHop{
+		Peer:     router.Ourself.Name.String(),
+		Received: pkt.What,
+		DstMAC:   "unknown",
+		Decision: pkt.Decision.String()}
+	if peer := router.Macs.Lookup(net.HardwareAddr(start.DstMAC[:])); peer != nil {
+		hop.DstMAC = peer.String()
+	}
+
+	if pkt.Decision.Forward != nil {
+		hop.Relay = pkt.Decision.Via.String()
+		if conn, found := router.Ourself.ConnectionTo(pkt.Decision.Via); found {
+			if lc, ok := conn.(*mesh.LocalConnection); ok {
+				hop.Overlay = lc.OverlayConn.DisplayName()
+				hop.Encrypted = lc.SessionKey != nil
+			}
+		}
+	}
+	return hop
+}
+
+func (tracer *Tracer) report(start traceStart, hop TraceHop) {
+	if start.Origin == tracer.router.Ourself.Name {
+		tracer.deliver(traceReport{start.ID, hop})
+		return
+	}
+
+	if err := tracer.gossip.GossipUnicast(start.Origin, mesh.GobEncode(traceReport{start.ID, hop})); err != nil {
+		log.Warnln("Trace: unable to report to", start.Origin, ":", err)
+	}
+}
+
+func (tracer *Tracer) deliver(report traceReport) {
+	tracer.Lock()
+	hops, found := tracer.traces[report.ID]
+	tracer.Unlock()
+	if found {
+		select {
+		case hops <- report.Hop:
+		default:
+		}
+	}
+}
+
+// Gossiper methods
+
+// Reports from peers on traces we started
+func (tracer *Tracer) OnGossipUnicast(sender mesh.PeerName, msg []byte) error {
+	var report traceReport
+	if err := gob.NewDecoder(bytes.NewReader(msg)).Decode(&report); err != nil {
+		return err
+	}
+	tracer.deliver(report)
+	return nil
+}
+
+// Traces started by other peers
+func (tracer *Tracer) OnGossipBroadcast(_ mesh.PeerName, update []byte) (mesh.GossipData, error) {
+	var starts []traceStart
+	if err := gob.NewDecoder(bytes.NewReader(update)).Decode(&starts); err != nil {
+		return nil, err
+	}
+
+	var relay []traceStart
+	for _, start := range starts {
+		tracer.Lock()
+		_, found := tracer.watches[start.ID]
+		tracer.Unlock()
+		if found {
+			continue
+		}
+		if err := tracer.watch(start); err != nil {
+			return nil, err
+		}
+		relay = append(relay, start)
+	}
+
+	if len(relay) == 0 {
+		return nil, nil
+	}
+	return &traceGossipData{relay}, nil
+}
+
+// Traces are short-lived, so there is no state to gossip
+func (tracer *Tracer) Gossip() mesh.GossipData {
+	return nil
+}
+
+func (tracer *Tracer) OnGossip(update []byte) (mesh.GossipData, error) {
+	return nil, nil
+}
+
+type traceGossipData struct {
+	starts []traceStart
+}
+
+func (d *traceGossipData) Merge(other mesh.GossipData) {
+	d.starts = append(d.starts, other.(*traceGossipData).starts...)
+}
+
+func (d *traceGossipData) Encode() [][]byte {
+	return [][]byte{mesh.GobEncode(d.starts)}
+}
@@ -0,0 +1,62 @@
+package router
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/weave/mesh"
+)
+
+func TestTraceProbe(t *testing.T) {
+	start := traceStart{ID: 0x0123456789abcdef}
+	frame, err := makeTraceProbe(start, net.ParseIP("10.32.0.1"), net.ParseIP("10.32.0.2"))
+	require.NoError(t, err)
+	require.True(t, isTraceProbe(frame, start.ID))
+	require.False(t, isTraceProbe(frame, start.ID+1))
+	require.False(t, isTraceProbe(frame[:len(frame)-1], start.ID))
+
+	_, err = makeTraceProbe(start, net.ParseIP("fe80::1"), nil)
+	require.Error(t, err)
+}
+
+func TestOrderTraceHops(t *testing.T) {
+	hops := []TraceHop{
+		{Peer: "c", Received: "forwarded", Decision: "local"},
+		{Peer: "b", Received: "forwarded", Decision: "forward to c via c", Relay: "c"},
+		{Peer: "a", Received: "captured", Decision: "forward to c via b", Relay: "b"},
+		{Peer: "d", Received: "forwarded", Decision: "local"},
+	}
+	var order []string
+	for _, hop := range orderTraceHops("a", hops) {
+		order = append(order, hop.Peer)
+	}
+	require.Equal(t, []string{"a", "b", "c", "d"}, order)
+}
+
+func TestTraceOnLonePeer(t *testing.T) {
+	name, _ := mesh.PeerNameFromString("01:00:00:01:00:00")
+	router := NewNetworkRouter(mesh.Config{}, NetworkConfig{PacketLogging: nopPacketLogging{}}, name, "lone", nil)
+	srcMAC, _ := net.ParseMAC("0a:00:00:00:00:01")
+	dstMAC, _ := net.ParseMAC("0a:00:00:00:00:02")
+
+	// With no other peers, a frame to an unknown MAC is broadcast
+	// to nobody
+	hops, err := router.Tracer.Trace(srcMAC, dstMAC, nil, nil, 100*time.Millisecond)
+	require.NoError(t, err)
+	require.Equal(t, []TraceHop{{
+		Peer:     name.String(),
+		Received: "captured",
+		DstMAC:   "unknown",
+		Decision: "broadcast"}}, hops)
+}
+
+type nopPacketLogging struct{}
+
+func (nopPacketLogging) LogPacket(string, PacketKey) {
+}
+
+func (nopPacketLogging) LogForwardPacket(string, ForwardPacketKey) {
+}
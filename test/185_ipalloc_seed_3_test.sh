@@ -0,0 +1,25 @@
+#! /bin/bash
+
+. ./config.sh
+
+NAME1=aa:00:00:00:00:01
+NAME2=aa:00:00:00:00:02
+NAME3=aa:00:00:00:00:03
+
+start_suite "IPAM ring seeded without a peer count"
+
+weave_on $HOST1 launch-router --name $NAME1 --ipalloc-init seed=$NAME1,$NAME2
+weave_on $HOST2 launch-router --name $NAME2 --ipalloc-init seed=$NAME1,$NAME2 $HOST1
+weave_on $HOST3 launch-router --name $NAME3 --ipalloc-init observer $HOST1
+
+# The observer can allocate once the seeds have created the ring
+start_container $HOST3
+assert "weave_on $HOST3 status | grep -oP '(?<=Consensus: ).*'" "achieved"
+
+# A peer launched with a different seed refuses the ring and says why
+weave_on $HOST3 stop
+weave_on $HOST3 launch-router --name $NAME3 --ipalloc-init seed=$NAME3 $HOST1
+sleep 5
+assert_raises "docker_on $HOST3 logs weave 2>&1 | grep 'launched with seed'"
+
+end_suite